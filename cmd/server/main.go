@@ -3,9 +3,12 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	_ "net/http/pprof"
+	"os"
 	"os/signal"
+	"path"
 	"syscall"
 	"yametrics/internal/crypto"
 	"yametrics/internal/server"
@@ -13,9 +16,19 @@ import (
 	"go.uber.org/zap"
 
 	"yametrics/internal/metainfo"
+	"yametrics/internal/metricscrypto"
+	"yametrics/internal/server/alerting"
+	"yametrics/internal/server/anomaly"
 	"yametrics/internal/server/config"
+	"yametrics/internal/server/graphite"
 	"yametrics/internal/server/grpc"
+	"yametrics/internal/server/idempotency"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/otlp"
+	"yametrics/internal/server/pubsub"
+	"yametrics/internal/server/statsd"
 	"yametrics/internal/server/storage"
+	"yametrics/internal/server/webhook"
 )
 
 var (
@@ -40,10 +53,34 @@ func main() {
 
 	cfg := config.NewServerConfig()
 
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(ctx, cfg, logger, flag.Args()[1:]); err != nil {
+			logger.Fatalf("error on migrate: %v", err)
+		}
+		return
+	}
+
+	if err := cfg.Retention.Validate(); err != nil {
+		logger.Fatalf("error in retention config: %v", err)
+	}
+	if err := cfg.Webhooks.Validate(); err != nil {
+		logger.Fatalf("error in webhooks config: %v", err)
+	}
+	if err := cfg.Anomaly.Validate(); err != nil {
+		logger.Fatalf("error in anomaly config: %v", err)
+	}
+	for _, pattern := range cfg.InfluxCounters {
+		if _, err := path.Match(pattern, ""); err != nil {
+			logger.Fatalf("bad influx counter pattern %q: %v", pattern, err)
+		}
+	}
+
 	var metricstorage storage.MetricsStorage
 
 	if len(cfg.DBURL) != 0 {
-		metricstorage, err = storage.NewDBMetricStorage(cfg.DBURL, ctx, logger)
+		metricstorage, err = storage.NewDBMetricStorage(cfg.DBURL, &cfg.Retention, ctx, logger)
+	} else if len(cfg.SQLitePath) != 0 {
+		metricstorage, err = storage.NewSQLiteMetricStorage(cfg.SQLitePath, &cfg.Retention, ctx, logger)
 	} else {
 		metricstorage, err = storage.NewFileMetricsStorage(cfg, logger, ctx)
 	}
@@ -51,13 +88,155 @@ func main() {
 	if err != nil {
 		logger.Fatalf("error on create metric storage %v", err)
 	}
+	if cfg.WriteBufferSize > 0 {
+		metricstorage = storage.NewBufferedMetricsStorage(metricstorage, cfg.WriteBufferSize, cfg.WriteBufferInterval.Duration, ctx, logger)
+	}
 
 	privateKey, err := crypto.ReadPrivateKey(cfg.CryptoKeyPath)
 	if err != nil {
 		logger.Errorf("error on read private key, %v", err)
 	}
 
-	go grpc.RunMetricsServer(logger, ctx, metricstorage)
-	server.Run(logger, cfg, metricstorage, ctx, privateKey)
+	// служебное состояние хранится вместе с метриками, если хранилище это поддерживает
+	stateStore, _ := metricstorage.(storage.StateStore)
+
+	var window *idempotency.Window
+	if cfg.IdempotencyWindow > 0 {
+		// окно ключей хранится вместе с метриками, чтобы повторы после перезапуска сервера тоже отсеивались
+		var store idempotency.Store
+		if stateStore != nil {
+			store = stateStore
+		}
+		window, err = idempotency.NewWindow(store, cfg.IdempotencyWindow, cfg.IdempotencyLimit, cfg.IdempotencyTTL.Duration, logger)
+		if err != nil {
+			logger.Fatalf("error on load idempotency window: %v", err)
+		}
+		go window.Run(ctx, idempotency.DefaultSaveInterval)
+	}
+
+	// все источники обновлений пишут через хранилище, поэтому подписчики получают обновления любого протокола
+	hub := pubsub.NewHub(pubsub.DefaultBufferSize)
+	metricstorage = pubsub.NewPublishingStorage(metricstorage, hub)
+
+	var webhooks *webhook.Dispatcher
+	if cfg.Webhooks.Enabled() {
+		webhooks, err = webhook.NewDispatcher(&cfg.Webhooks, logger)
+		if err != nil {
+			logger.Fatalf("error on start webhooks: %v", err)
+		}
+		for _, h := range webhooks.Hooks() {
+			name := h.Name
+			forward(hub, pubsub.Filter{Names: h.Names, Types: h.Types, Selector: h.Labels}, "webhook "+name, logger, func(e pubsub.Event) {
+				webhooks.Notify(name, e.Seq, e.Time, e.Metric)
+			})
+		}
+	}
+
+	var detector *anomaly.Detector
+	if cfg.Anomaly.Enabled() {
+		// базовые линии хранятся вместе с метриками и не набираются заново после перезапуска
+		var store anomaly.Store
+		if stateStore != nil {
+			store = stateStore
+		}
+		detector, err = anomaly.NewDetector(&cfg.Anomaly, store, logger)
+		if err != nil {
+			logger.Fatalf("error on load anomaly baselines: %v", err)
+		}
+		go detector.Run(ctx)
+		forward(hub, pubsub.Filter{Names: detector.Patterns(), Types: []string{models.GAUGE}}, "anomaly detector", logger, func(e pubsub.Event) {
+			detector.Observe(e.Metric, e.Time)
+		})
+	}
+
+	// statsd и graphite не несут подписи, при заданном ключе их прием нужно разрешить явно
+	if !cfg.UnsignedAllowed() && (cfg.StatsDAddress != "" || cfg.GraphiteAddress != "" || cfg.GraphitePickleAddress != "") {
+		logger.Fatal("statsd and graphite metrics are unsigned and rejected while sign key is set, use allow-unsigned to accept them")
+	}
+
+	var statsdServer *statsd.Server
+	if cfg.StatsDAddress != "" {
+		statsdServer, err = statsd.NewServer(cfg.StatsDNetwork, cfg.StatsDAddress, cfg.StatsDFlushInterval.Duration, cfg.HistogramBuckets, metricstorage, logger)
+		if err != nil {
+			logger.Fatalf("error on start statsd listener: %v", err)
+		}
+	}
+
+	var graphiteServer *graphite.Server
+	if cfg.GraphiteAddress != "" || cfg.GraphitePickleAddress != "" {
+		templates, err := graphite.ParseTemplates(cfg.GraphiteTemplates)
+		if err != nil {
+			logger.Fatalf("error on parse graphite templates: %v", err)
+		}
+		graphiteServer, err = graphite.NewServer(cfg.GraphiteNetwork, cfg.GraphiteAddress, cfg.GraphitePickleAddress, graphite.DefaultFlushInterval, templates, metricstorage, logger)
+		if err != nil {
+			logger.Fatalf("error on start graphite listener: %v", err)
+		}
+	}
+
+	alerts, err := alerting.NewEngine(cfg.ReadAlerting, metricstorage, logger)
+	if err != nil {
+		logger.Fatalf("error in alerting config: %v", err)
+	}
+	go alerts.Run(ctx)
+	go reloadOnHangup(ctx, alerts, logger)
+
+	receiver := otlp.NewReceiver(metricstorage, logger)
+
+	// подписи проверяются одним Verifier, чтобы nonce, принятый по http, нельзя было повторить по grpc
+	verifier := metricscrypto.NewVerifier(cfg.SignKey, cfg.SignSkew.Duration, cfg.LegacySign)
+	go grpc.RunMetricsServer(logger, ctx, metricstorage, verifier, window, receiver, cfg.UnsignedAllowed())
+	server.Run(logger, cfg, metricstorage, ctx, privateKey, window, verifier, receiver, hub, webhooks, alerts, detector)
+	if webhooks != nil {
+		// подписки закрыты вместе с хабом при остановке http-сервера, поэтому новых уведомлений уже нет
+		webhooks.Close()
+	}
+	if statsdServer != nil {
+		// накопленные за неполный интервал значения сохраняются до закрытия хранилища
+		statsdServer.Close()
+	}
+	if graphiteServer != nil {
+		graphiteServer.Close()
+	}
+	if window != nil {
+		if err := window.Save(); err != nil {
+			logger.Errorf("error on save idempotency window: %v", err)
+		}
+	}
+	if detector != nil {
+		if err := detector.Save(); err != nil {
+			logger.Errorf("error on save anomaly baselines: %v", err)
+		}
+	}
 	metricstorage.Close()
 }
+
+// forward - передача обновлений, подходящих под filter, в handle. name - получатель в журнале
+func forward(hub *pubsub.Hub, filter pubsub.Filter, name string, logger *zap.SugaredLogger, handle func(e pubsub.Event)) {
+	sub := hub.Subscribe(filter)
+	go func() {
+		for e := range sub.Events() {
+			if dropped := sub.TakeDropped(); dropped > 0 {
+				logger.Warnf("%s: %d updates dropped", name, dropped)
+			}
+			handle(e)
+		}
+	}()
+}
+
+// reloadOnHangup - перечитывание правил оповещений по сигналу SIGHUP
+func reloadOnHangup(ctx context.Context, alerts *alerting.Engine, logger *zap.SugaredLogger) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := alerts.Reload(); err != nil {
+				logger.Errorf("error on reload alerting rules: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"yametrics/internal/server/config"
+	"yametrics/internal/server/storage/migrations"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+const migrateUsage = `usage: server [flags] migrate <command>
+
+commands:
+  status     list migrations and their state
+  up         apply all pending migrations
+  down [n]   roll back n last applied migrations, 1 by default`
+
+// runMigrate - управление миграциями бд из командной строки,
+// бд задается тем же флагом -d или переменной DATABASE_DSN, что и для сервера
+func runMigrate(ctx context.Context, cfg *config.ServerConfig, logger *zap.SugaredLogger, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	if cfg.DBURL == "" {
+		return errors.New("db connection url is not defined")
+	}
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", cfg.DBURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := migrations.NewMigrator(db, logger)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.Applied() {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return w.Flush()
+
+	case "up":
+		count, err := migrator.Up(ctx)
+		fmt.Printf("%d migrations applied\n", count)
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations to roll back: %s", args[1])
+			}
+		}
+		count, err := migrator.Down(ctx, steps)
+		fmt.Printf("%d migrations rolled back\n", count)
+		return err
+
+	default:
+		return fmt.Errorf("unknown migrate command %s\n%s", args[0], migrateUsage)
+	}
+}
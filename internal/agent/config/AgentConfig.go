@@ -3,9 +3,12 @@ package config
 import (
 	"flag"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 	"yametrics/internal/configfile"
 	"yametrics/internal/durationextension"
+	"yametrics/internal/metricscrypto"
 )
 
 type AgentConfig struct {
@@ -13,8 +16,14 @@ type AgentConfig struct {
 	ReportInterval durationextension.Duration `env:"REPORT_INTERVAL" envDefault:"10s" json:"report_interval"`
 	PollInterval   durationextension.Duration `env:"POLL_INTERVAL" envDefault:"2s" json:"poll_interval"`
 	SignKey        string                     `env:"KEY"`
-	CryptoKeyPath  string                     `env:"CRYPTO_KEY" json:"crypto_key"`
+	// SignVersion - схема подписи: 2 (по умолчанию) или 1 для серверов, не знающих v2
+	SignVersion   int               `env:"SIGN_VERSION" json:"sign_version"`
+	CryptoKeyPath string            `env:"CRYPTO_KEY" json:"crypto_key"`
+	Labels        map[string]string `env:"LABELS" json:"labels"`
+	// GCPauseBuckets - границы бакетов гистограммы пауз GC в наносекундах
+	GCPauseBuckets []float64 `json:"gc_pause_buckets"`
 	configPath     string
+	labels         string
 }
 
 func NewAgentConfig() *AgentConfig {
@@ -24,6 +33,7 @@ func NewAgentConfig() *AgentConfig {
 	cfg.readConfigFile()
 	flag.Parse()
 	cfg.loadFromEnv()
+	cfg.parseLabels()
 	return cfg
 }
 
@@ -32,8 +42,10 @@ func (cfg *AgentConfig) defineFlags() {
 	flag.DurationVar(&cfg.ReportInterval.Duration, "r", time.Second*10, "report interval")
 	flag.DurationVar(&cfg.PollInterval.Duration, "p", time.Second*2, "poll interval")
 	flag.StringVar(&cfg.SignKey, "k", "", "sign key")
+	flag.IntVar(&cfg.SignVersion, "sign-version", metricscrypto.SignV2, "signature scheme version: 1 or 2")
 	flag.StringVar(&cfg.CryptoKeyPath, "crypto-key", "public_key.pem", "path to public key")
 	flag.StringVar(&cfg.configPath, "c", "", "path to config file")
+	flag.StringVar(&cfg.labels, "l", "", "metric labels, exmpl: host=web-1,env=prod")
 }
 
 func (cfg *AgentConfig) loadFromEnv() {
@@ -46,7 +58,24 @@ func (cfg *AgentConfig) loadFromEnv() {
 	setIfDefined("REPORT_INTERVAL", func(v string) { cfg.ReportInterval.Duration, _ = time.ParseDuration(v) })
 	setIfDefined("POLL_INTERVAL", func(v string) { cfg.PollInterval.Duration, _ = time.ParseDuration(v) })
 	setIfDefined("KEY", func(v string) { cfg.SignKey = v })
+	setIfDefined("SIGN_VERSION", func(v string) { cfg.SignVersion, _ = strconv.Atoi(v) })
 	setIfDefined("CRYPTO_KEY", func(v string) { cfg.CryptoKeyPath = v })
+	setIfDefined("LABELS", func(v string) { cfg.labels = v })
+}
+
+// parseLabels - метки из флага или переменной окружения дополняют метки из файла конфигурации
+func (cfg *AgentConfig) parseLabels() {
+	if cfg.labels == "" {
+		return
+	}
+	if cfg.Labels == nil {
+		cfg.Labels = make(map[string]string)
+	}
+	for _, pair := range strings.Split(cfg.labels, ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok && k != "" {
+			cfg.Labels[k] = v
+		}
+	}
 }
 
 func (cfg *AgentConfig) readConfigFile() {
@@ -4,20 +4,39 @@ import (
 	"context"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"time"
 	"yametrics/internal/agent/models/storage"
+	"yametrics/internal/metricscrypto"
+	"yametrics/internal/protocol"
 	pb "yametrics/internal/protocol/proto"
+	"yametrics/internal/server/idempotency"
 )
 
 type GRPCTransportManager struct {
 	logger *zap.SugaredLogger
+	// signKey - ключ подписи пакета, пустой - пакет не подписывается
+	signKey string
+	// signVersion - схема подписи пакета
+	signVersion int
+	// pending - поток, который сервер еще не подтвердил, повторяется с тем же ключом
+	pending *pendingStream
 }
 
-func NewGRPCTransportManager(logger *zap.SugaredLogger) *GRPCTransportManager {
-	return &GRPCTransportManager{logger: logger}
+// pendingStream - метрики потока SaveMetrics и ключ идемпотентности
+type pendingStream struct {
+	metrics []*pb.Metric
+	key     string
 }
 
-func (t *GRPCTransportManager) Send(ctx context.Context, metrics *storage.Metrics) error {
+func NewGRPCTransportManager(logger *zap.SugaredLogger, signKey string, signVersion int) *GRPCTransportManager {
+	return &GRPCTransportManager{logger: logger, signKey: signKey, signVersion: signVersion}
+}
+
+func (t *GRPCTransportManager) Send(ctx context.Context, metrics *storage.Metrics, labels map[string]string) error {
 	creds, err := credentials.NewClientTLSFromFile("cert/service.pem", "")
 	if err != nil {
 		t.logger.Errorf("could not process the credentials: %v", err)
@@ -31,34 +50,79 @@ func (t *GRPCTransportManager) Send(ctx context.Context, metrics *storage.Metric
 	}
 	defer conn.Close()
 	c := pb.NewMetricsClient(conn)
-	stream, err := c.SaveMetrics(ctx)
-	if err != nil {
-		t.logger.Error(err)
-		return err
-	}
-
 	metricsForSend := make([]*pb.Metric, 0)
 
 	metrics.OperateOverMetricMaps(
 		func(s string, f float64) {
 			metricsForSend = append(metricsForSend,
 				&pb.Metric{
-					Id:    s,
-					Type:  pb.MetricTypes_GAUGE,
-					Value: &f,
+					Id:     s,
+					Type:   pb.MetricTypes_GAUGE,
+					Value:  &f,
+					Labels: labels,
 				})
 		},
 		func(s string, i int64) {
 			metricsForSend = append(metricsForSend,
 				&pb.Metric{
-					Id:    s,
-					Type:  pb.MetricTypes_COUNTER,
-					Delta: &i,
+					Id:          s,
+					Type:        pb.MetricTypes_COUNTER,
+					Delta:       &i,
+					Labels:      labels,
+					Temporality: pb.Temporality_CUMULATIVE,
 				})
 		})
 
-	for i := 0; i < len(metricsForSend); i++ {
-		err := stream.Send(metricsForSend[i])
+	for s, h := range metrics.Histograms() {
+		metricsForSend = append(metricsForSend,
+			&pb.Metric{
+				Id:        s,
+				Type:      pb.MetricTypes_HISTOGRAM,
+				Histogram: pb.HistogramToProto(h),
+				Labels:    labels,
+			})
+	}
+
+	// неподтвержденный поток повторяется первым, новые метрики отправляются отдельным потоком после него
+	if t.pending != nil {
+		if err := t.sendStream(ctx, c, t.pending); err != nil && !rejected(err) {
+			return err
+		}
+		t.pending = nil
+	}
+	t.pending = &pendingStream{metrics: metricsForSend, key: newIdempotencyKey()}
+	err = t.sendStream(ctx, c, t.pending)
+	if err == nil || rejected(err) {
+		t.pending = nil
+	}
+	return err
+}
+
+// rejected - сервер отклонил поток как некорректный, повтор получит тот же ответ
+func rejected(err error) bool {
+	code := status.Code(err)
+	return code == codes.InvalidArgument || code == codes.PermissionDenied
+}
+
+// sendStream - отправка потока SaveMetrics. ключ пакета защищает от повторного применения,
+// а подпись обновляется при каждой отправке, чтобы повтор не отклонялся по времени
+func (t *GRPCTransportManager) sendStream(ctx context.Context, c pb.MetricsClient, batch *pendingStream) error {
+	ctx = metadata.AppendToOutgoingContext(ctx, idempotency.MetadataKey, batch.key)
+	if t.signKey != "" {
+		signed := make([]protocol.Metrics, len(batch.metrics))
+		for i := range batch.metrics {
+			signed[i] = pb.MetricToProtocol(batch.metrics[i])
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, metricscrypto.BatchSignMetadataKey, metricscrypto.SignBatch(signed, t.signKey, t.signVersion, time.Now()))
+	}
+	stream, err := c.SaveMetrics(ctx)
+	if err != nil {
+		t.logger.Error(err)
+		return err
+	}
+
+	for i := 0; i < len(batch.metrics); i++ {
+		err := stream.Send(batch.metrics[i])
 		if err != nil {
 			return err
 		}
@@ -8,6 +8,7 @@ import (
 	"yametrics/internal/agent/config"
 	"yametrics/internal/agent/models/storage"
 	"yametrics/internal/agent/utils"
+	"yametrics/internal/histogram"
 
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/mem"
@@ -39,9 +40,13 @@ func NewMetricManager(
 	logger *zap.SugaredLogger,
 	config *config.AgentConfig) *MetricManager {
 
+	metrics := storage.NewMetrics()
+	if len(config.GCPauseBuckets) > 0 {
+		metrics.GCPauseNs = histogram.New(config.GCPauseBuckets)
+	}
 	return &MetricManager{
 		logger:   logger,
-		metrics:  storage.NewMetrics(),
+		metrics:  metrics,
 		config:   config,
 		syncCh:   make(chan MetricWorker),
 		NotifyCh: make(chan storage.Metrics),
@@ -72,7 +77,7 @@ func (m *MetricManager) syncUpdates(ctx context.Context, wg *sync.WaitGroup) {
 			if len(unicJob) == 2 {
 				unicJob = make(map[MetricWorker]struct{})
 				m.logger.Debug("sending updated metrics to channel")
-				m.NotifyCh <- *m.metrics
+				m.NotifyCh <- m.snapshot()
 			}
 
 		case <-ctx.Done():
@@ -84,6 +89,15 @@ func (m *MetricManager) syncUpdates(ctx context.Context, wg *sync.WaitGroup) {
 	}
 }
 
+// snapshot - копия собранных метрик. гистограмма пауз GC в снимке - приращение с прошлого снимка
+func (m *MetricManager) snapshot() storage.Metrics {
+	m.syncWorkersMu.Lock()
+	defer m.syncWorkersMu.Unlock()
+	snapshot := *m.metrics
+	snapshot.GCPauseNs = m.metrics.TakeGCPauses()
+	return snapshot
+}
+
 func (m *MetricManager) updateAdditionalMetricsWithInterval(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 	utils.Schedule(
@@ -115,6 +129,7 @@ func (m *MetricManager) updateMetricsWithInterval(ctx context.Context, wg *sync.
 			m.syncWorkersMu.Lock()
 
 			runtime.ReadMemStats(m.metrics.MemStats)
+			m.metrics.ObserveGCPauses()
 			m.metrics.PollCount++
 			m.metrics.RandomValue = rand.Float64()
 
@@ -3,10 +3,13 @@ package managers
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/rsa"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"sync"
 	"time"
 	"yametrics/internal/agent/config"
@@ -14,7 +17,9 @@ import (
 	"yametrics/internal/agent/utils"
 	"yametrics/internal/crypto"
 	"yametrics/internal/iputils"
+	"yametrics/internal/metricscrypto"
 	"yametrics/internal/protocol"
+	"yametrics/internal/server/idempotency"
 
 	"go.uber.org/zap"
 )
@@ -45,6 +50,16 @@ type TransportManager struct {
 	once          sync.Once
 	publicKey     *rsa.PublicKey
 	grpcTransport *GRPCTransportManager
+	// pending - пакет /updates, который сервер еще не подтвердил
+	pending *pendingBatch
+}
+
+// pendingBatch - пакет /updates с ключом идемпотентности. до ответа 200 пакет повторяется
+// с тем же телом и ключом: если сервер применил пакет, но ответ не дошел, повтор не применится второй раз
+type pendingBatch struct {
+	metrics []protocol.Metrics
+	body    []byte
+	key     string
 }
 
 // NewTransportManager - создание менеджера отправки метрик.
@@ -57,7 +72,7 @@ func NewTransportManager(l *zap.SugaredLogger, config *config.AgentConfig, pubKe
 		metrics:       storage.NewMetrics(),
 		config:        config,
 		publicKey:     pubKey,
-		grpcTransport: NewGRPCTransportManager(l),
+		grpcTransport: NewGRPCTransportManager(l, config.SignKey, config.SignVersion),
 	}
 }
 
@@ -76,9 +91,7 @@ func (m *TransportManager) subscribeOnUpdates(notifyCh <-chan storage.Metrics, c
 		select {
 		case updated := <-notifyCh:
 			m.logger.Info("update metrics from notifyCh")
-			m.rwMutex.Lock()
-			m.metrics = &updated
-			m.rwMutex.Unlock()
+			m.update(updated)
 
 		case <-ctx.Done():
 			m.logger.Info("transportManager shutdown")
@@ -88,29 +101,49 @@ func (m *TransportManager) subscribeOnUpdates(notifyCh <-chan storage.Metrics, c
 	}
 }
 
-func (m *TransportManager) sendMetricsWithInterval(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
-	utils.Schedule(func() {
-		m.rwMutex.RLock()
-		defer m.rwMutex.RUnlock()
+// update - новый снимок метрик. приращения гистограмм копятся, пока не попадут в пакет /updates
+func (m *TransportManager) update(updated storage.Metrics) {
+	m.rwMutex.Lock()
+	defer m.rwMutex.Unlock()
+	if updated.GCPauseNs != nil && m.metrics.GCPauseNs != nil && m.metrics.GCPauseNs.Count > 0 {
+		if err := updated.GCPauseNs.Merge(m.metrics.GCPauseNs); err != nil {
+			m.logger.Errorf("unsent GC pauses dropped: %v", err)
+		}
+	}
+	m.metrics = &updated
+}
 
-		m.sendMetricsV1()
-		m.sendMetricsV2()
-		m.sendMultipleMetricsV2()
-		m.sendMetricsGRPC(ctx)
+// report - отправка метрик всеми транспортами. gauge и накопленные counter отправляются каждым,
+// а приращение гистограмм - только пакетом /updates, иначе сервер учтет его несколько раз.
+// с ключом подписи метрики не отправляются через /update/{type}/{name}/{value}: там нет подписи, и сервер их отклоняет
+func (m *TransportManager) report(ctx context.Context) {
+	m.rwMutex.Lock()
+	defer m.rwMutex.Unlock()
 
-		if m.publicKey != nil {
-			m.sendMultipleMetricsV2Encrypted()
-		}
-	},
+	scalars := m.metrics.WithoutHistograms()
+	if m.config.SignKey == "" {
+		m.sendMetricsV1(scalars)
+	}
+	m.sendMetricsV2(scalars)
+	m.sendMultipleMetricsV2()
+	m.sendMetricsGRPC(ctx, scalars)
+
+	if m.publicKey != nil {
+		m.sendMultipleMetricsV2Encrypted(scalars)
+	}
+}
+
+func (m *TransportManager) sendMetricsWithInterval(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	utils.Schedule(func() { m.report(ctx) },
 		ctx,
 		m.config.ReportInterval.Duration,
 		"sending metrics",
 		m.logger)
 }
 
-func (m *TransportManager) sendMetricsGRPC(ctx context.Context) {
-	err := m.grpcTransport.Send(ctx, m.metrics)
+func (m *TransportManager) sendMetricsGRPC(ctx context.Context, metrics *storage.Metrics) {
+	err := m.grpcTransport.Send(ctx, metrics, m.config.Labels)
 	if err != nil {
 		m.logger.Errorf("GRPC: error in send metric: %v", err)
 	} else {
@@ -118,27 +151,89 @@ func (m *TransportManager) sendMetricsGRPC(ctx context.Context) {
 	}
 }
 
+// newIdempotencyKey - случайный ключ пакета: повторная отправка пакета с тем же ключом не применяется сервером второй раз
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(key)
+}
+
+// sendMultipleMetricsV2 - отправка пакетов /updates. сначала повторяется неподтвержденный пакет,
+// новые данные отправляются отдельным пакетом только после него
 func (m *TransportManager) sendMultipleMetricsV2() {
-	apiMetrics := m.metrics.ToAPI()
-	if marshal, err := json.Marshal(apiMetrics); err != nil {
-		m.logger.Errorf("error on  Marshal metric: %v", err)
-	} else {
-		if r, err := m.client.Post(fmt.Sprintf("%s/updates", m.url), "application/json", bytes.NewBuffer(marshal)); err != nil {
-			m.logger.Errorf("error in send metric: %v", err)
-		} else {
-			if err := r.Body.Close(); err != nil {
-				m.logger.Errorf("error in close body %v", err)
-			}
+	if m.pending != nil {
+		if !m.sendBatch(m.pending) {
+			return
 		}
+		m.pending = nil
+	}
+	batch, err := m.newBatch()
+	if err != nil {
+		m.logger.Errorf("error on  Marshal metric: %v", err)
+		return
+	}
+	m.pending = batch
+	if m.sendBatch(batch) {
+		m.pending = nil
+	}
+}
+
+// newBatch - пакет из текущих метрик, приращение гистограмм переходит в пакет
+func (m *TransportManager) newBatch() (*pendingBatch, error) {
+	snapshot := *m.metrics
+	if m.metrics.GCPauseNs != nil {
+		snapshot.GCPauseNs = m.metrics.TakeGCPauses()
+	}
+	apiMetrics := snapshot.ToAPI(m.config.Labels)
+	body, err := json.Marshal(apiMetrics)
+	if err != nil {
+		return nil, err
+	}
+	return &pendingBatch{metrics: apiMetrics, body: body, key: newIdempotencyKey()}, nil
+}
+
+// sendBatch - отправка пакета, true - с пакетом покончено: сервер его принял или отклонил как некорректный.
+// подпись пакета обновляется при каждой отправке, чтобы повтор после долгого сбоя не отклонялся по времени
+func (m *TransportManager) sendBatch(batch *pendingBatch) bool {
+	request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/updates", m.url), bytes.NewReader(batch.body))
+	if err != nil {
+		m.logger.Errorf("error on create request: %v", err)
+		return false
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(idempotency.Header, batch.key)
+	if m.config.SignKey != "" {
+		request.Header.Set(metricscrypto.BatchSignHeader, metricscrypto.SignBatch(batch.metrics, m.config.SignKey, m.config.SignVersion, time.Now()))
+	}
+	r, err := m.client.Do(request)
+	if err != nil {
+		m.logger.Errorf("error in send metric: %v", err)
+		return false
+	}
+	if err := r.Body.Close(); err != nil {
+		m.logger.Errorf("error in close body %v", err)
+	}
+	switch {
+	case r.StatusCode == http.StatusOK:
+		return true
+	case r.StatusCode < http.StatusInternalServerError:
+		// повтор тех же данных получит тот же ответ
+		m.logger.Errorf("metrics batch rejected and dropped: %s", r.Status)
+		return true
+	default:
+		m.logger.Errorf("metrics batch not saved, will retry: %s", r.Status)
+		return false
 	}
 }
 
-func (m *TransportManager) sendMetricsV2() {
+func (m *TransportManager) sendMetricsV2(metrics *storage.Metrics) {
 	var apiMetrics []protocol.Metrics
 	if m.config.SignKey != "" {
-		apiMetrics = m.metrics.ToAPIWithSign(m.config.SignKey)
+		apiMetrics = metrics.ToAPIWithSign(m.config.SignKey, m.config.SignVersion, m.config.Labels)
 	} else {
-		apiMetrics = m.metrics.ToAPI()
+		apiMetrics = metrics.ToAPI(m.config.Labels)
 	}
 
 	for i := 0; i < len(apiMetrics); i++ {
@@ -154,12 +249,12 @@ func (m *TransportManager) sendMetricsV2() {
 	}
 }
 
-func (m *TransportManager) sendMultipleMetricsV2Encrypted() {
+func (m *TransportManager) sendMultipleMetricsV2Encrypted(metrics *storage.Metrics) {
 	var apiMetrics []protocol.Metrics
 	if m.config.SignKey != "" {
-		apiMetrics = m.metrics.ToAPIWithSign(m.config.SignKey)
+		apiMetrics = metrics.ToAPIWithSign(m.config.SignKey, m.config.SignVersion, m.config.Labels)
 	} else {
-		apiMetrics = m.metrics.ToAPI()
+		apiMetrics = metrics.ToAPI(m.config.Labels)
 	}
 
 	for i := 0; i < len(apiMetrics); i++ {
@@ -177,7 +272,7 @@ func (m *TransportManager) sendMultipleMetricsV2Encrypted() {
 	}
 }
 
-func (m *TransportManager) sendMetricsV1() {
+func (m *TransportManager) sendMetricsV1(metrics *storage.Metrics) {
 	send := func(url string) {
 		if r, err := m.client.Post(url, "text/plain", nil); err != nil {
 			m.logger.Errorf("error in send metric: %v", err)
@@ -188,12 +283,23 @@ func (m *TransportManager) sendMetricsV1() {
 		}
 	}
 
-	m.metrics.OperateOverMetricMaps(
+	query, counterQuery := "", "?temporality="+protocol.CUMULATIVE
+	if len(m.config.Labels) > 0 {
+		params := url.Values{}
+		for k, v := range m.config.Labels {
+			params.Add("label", k+":"+v)
+		}
+		query = "?" + params.Encode()
+		params.Set("temporality", protocol.CUMULATIVE)
+		counterQuery = "?" + params.Encode()
+	}
+
+	metrics.OperateOverMetricMaps(
 		func(key string, v float64) {
-			send(fmt.Sprintf("%s/update/gauge/%s/%v", m.url, key, v))
+			send(fmt.Sprintf("%s/update/gauge/%s/%v%s", m.url, key, v, query))
 		},
 		func(key string, v int64) {
-			send(fmt.Sprintf("%s/update/counter/%s/%v", m.url, key, v))
+			send(fmt.Sprintf("%s/update/counter/%s/%v%s", m.url, key, v, counterQuery))
 		},
 	)
 }
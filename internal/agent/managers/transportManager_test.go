@@ -0,0 +1,180 @@
+package managers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"yametrics/internal/agent/config"
+	"yametrics/internal/protocol"
+	"yametrics/internal/server/idempotency"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// receiver - сервер, запоминающий присланные гистограммы по путям запросов
+type receiver struct {
+	mutex sync.Mutex
+	// observations - число значений в гистограммах, присланных пакетом /updates
+	observations []uint64
+	// singleHistograms - гистограммы, присланные другими путями
+	singleHistograms int
+	// unsigned - запросы /update/{type}/{name}/{value}, которые не несут подписи
+	unsigned int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	switch r.URL.Path {
+	case "/updates":
+		var metrics []protocol.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var count uint64
+		for _, m := range metrics {
+			if m.Histogram != nil {
+				count += m.Histogram.Count
+			}
+		}
+		rc.observations = append(rc.observations, count)
+	case "/update":
+		var m protocol.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&m); err == nil && m.Histogram != nil {
+			rc.singleHistograms++
+		}
+	default:
+		if strings.HasPrefix(r.URL.Path, "/update/") {
+			rc.unsigned++
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestReportGCPauses(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	cfg := &config.AgentConfig{Address: strings.TrimPrefix(srv.URL, "http://")}
+	logger := zap.NewNop().Sugar()
+	metrics := NewMetricManager(logger, cfg)
+	transport := NewTransportManager(logger, cfg, nil)
+
+	metrics.metrics.GCPauseNs.Observe(2e4)
+	metrics.metrics.GCPauseNs.Observe(3e5)
+	// снимки между отправками копятся, каждое значение отправляется один раз
+	transport.update(metrics.snapshot())
+	metrics.metrics.GCPauseNs.Observe(7e6)
+	transport.update(metrics.snapshot())
+	transport.report(context.Background())
+
+	// без новых пауз GC отчеты не содержат новых значений
+	transport.update(metrics.snapshot())
+	transport.report(context.Background())
+	transport.report(context.Background())
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	require.Len(t, rc.observations, 3)
+	assert.Equal(t, []uint64{3, 0, 0}, rc.observations)
+	assert.Zero(t, rc.singleHistograms, "histogram increments go only through /updates")
+}
+
+func TestReportRetriesPendingBatch(t *testing.T) {
+	type request struct {
+		key          string
+		body         string
+		observations uint64
+	}
+	var requests []request
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/updates" {
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var metrics []protocol.Metrics
+		require.NoError(t, json.Unmarshal(body, &metrics))
+		var count uint64
+		for _, m := range metrics {
+			if m.Histogram != nil {
+				count += m.Histogram.Count
+			}
+		}
+		requests = append(requests, request{key: r.Header.Get(idempotency.Header), body: string(body), observations: count})
+		// пакет мог быть применен, но ответ не дошел до агента
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	cfg := &config.AgentConfig{Address: strings.TrimPrefix(srv.URL, "http://")}
+	logger := zap.NewNop().Sugar()
+	metrics := NewMetricManager(logger, cfg)
+	transport := NewTransportManager(logger, cfg, nil)
+
+	metrics.metrics.GCPauseNs.Observe(2e4)
+	transport.update(metrics.snapshot())
+	transport.report(context.Background())
+	require.NotNil(t, transport.pending)
+
+	// новое значение не попадает в неподтвержденный пакет, а уходит отдельным пакетом после него
+	metrics.metrics.GCPauseNs.Observe(3e5)
+	transport.update(metrics.snapshot())
+	fail = false
+	transport.report(context.Background())
+	assert.Nil(t, transport.pending)
+
+	require.Len(t, requests, 3)
+	assert.NotEmpty(t, requests[0].key)
+	assert.Equal(t, requests[0], requests[1], "pending batch is retried with the same body and key")
+	assert.NotEqual(t, requests[0].key, requests[2].key)
+	assert.Equal(t, uint64(1), requests[2].observations)
+}
+
+func TestReportDropsRejectedBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/updates" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	cfg := &config.AgentConfig{Address: strings.TrimPrefix(srv.URL, "http://")}
+	logger := zap.NewNop().Sugar()
+	metrics := NewMetricManager(logger, cfg)
+	transport := NewTransportManager(logger, cfg, nil)
+
+	transport.update(metrics.snapshot())
+	transport.report(context.Background())
+	assert.Nil(t, transport.pending, "rejected batch is not retried")
+}
+
+func TestReportSignedSkipsUnsigned(t *testing.T) {
+	rc := &receiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	logger := zap.NewNop().Sugar()
+
+	for _, signKey := range []string{"", "key"} {
+		rc.unsigned = 0
+		cfg := &config.AgentConfig{Address: strings.TrimPrefix(srv.URL, "http://"), SignKey: signKey, SignVersion: 2}
+		metrics := NewMetricManager(logger, cfg)
+		metrics.metrics.Alloc = 1
+		transport := NewTransportManager(logger, cfg, nil)
+		transport.update(metrics.snapshot())
+		transport.report(context.Background())
+		if signKey == "" {
+			assert.NotZero(t, rc.unsigned)
+		} else {
+			assert.Zero(t, rc.unsigned, "signed agent does not send metrics without signature")
+		}
+	}
+}
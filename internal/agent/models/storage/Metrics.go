@@ -2,10 +2,15 @@ package storage
 
 import (
 	"runtime"
+	"time"
+	"yametrics/internal/histogram"
 	"yametrics/internal/metricscrypto"
 	"yametrics/internal/protocol"
 )
 
+// DefaultGCPauseBuckets - границы бакетов гистограммы пауз GC в наносекундах: от 10мкс до 100мс
+var DefaultGCPauseBuckets = []float64{1e4, 5e4, 1e5, 5e5, 1e6, 5e6, 1e7, 5e7, 1e8}
+
 type Metrics struct {
 	*runtime.MemStats
 	PollCount       int64
@@ -13,31 +18,83 @@ type Metrics struct {
 	TotalMemory     float64
 	FreeMemory      float64
 	CPUutilization1 float64
-	m2gauge         map[string]float64
-	m2counter       map[string]int64
+	// GCPauseNs - распределение пауз GC с прошлого снимка или отправки: сервер складывает
+	// присланные гистограммы, поэтому передается только приращение. nil - гистограмма не отправляется
+	GCPauseNs *histogram.Histogram
+	lastNumGC uint32
+	m2gauge   map[string]float64
+	m2counter map[string]int64
 }
 
 func NewMetrics() *Metrics {
-	return &Metrics{MemStats: &runtime.MemStats{}, PollCount: 0, RandomValue: 0.0, m2gauge: map[string]float64{}, m2counter: map[string]int64{}}
+	return &Metrics{
+		MemStats:    &runtime.MemStats{},
+		PollCount:   0,
+		RandomValue: 0.0,
+		GCPauseNs:   histogram.New(DefaultGCPauseBuckets),
+		m2gauge:     map[string]float64{},
+		m2counter:   map[string]int64{}}
 }
 
-func (m *Metrics) ToAPI() []protocol.Metrics {
+// ObserveGCPauses - добавление в гистограмму пауз GC, произошедших с прошлого вызова.
+// runtime хранит только последние len(PauseNs) пауз, более старые теряются
+func (m *Metrics) ObserveGCPauses() {
+	size := uint32(len(m.PauseNs))
+	n := m.NumGC - m.lastNumGC
+	if n > size {
+		n = size
+	}
+	for i := uint32(0); i < n; i++ {
+		m.GCPauseNs.Observe(float64(m.PauseNs[(m.NumGC-1-i)%size]))
+	}
+	m.lastNumGC = m.NumGC
+}
+
+// Histograms - метрики типа histogram
+func (m *Metrics) Histograms() map[string]*histogram.Histogram {
+	if m.GCPauseNs == nil {
+		return nil
+	}
+	return map[string]*histogram.Histogram{"GCPauseNs": m.GCPauseNs.Copy()}
+}
+
+// TakeGCPauses - приращение гистограммы пауз GC, сама гистограмма начинается заново
+func (m *Metrics) TakeGCPauses() *histogram.Histogram {
+	taken := m.GCPauseNs
+	m.GCPauseNs = histogram.New(taken.Bounds)
+	return taken
+}
+
+// WithoutHistograms - копия метрик без гистограмм для транспортов, которые не передают приращения гистограмм
+func (m Metrics) WithoutHistograms() *Metrics {
+	m.GCPauseNs = nil
+	return &m
+}
+
+// ToAPI - метрики в формате api, каждой метрике проставляются метки labels
+func (m *Metrics) ToAPI(labels map[string]string) []protocol.Metrics {
 	result := make([]protocol.Metrics, 0)
 	m.OperateOverMetricMaps(
 		func(s string, f float64) {
-			result = append(result, protocol.Metrics{ID: s, MType: protocol.GAUGE, Value: &f})
+			result = append(result, protocol.Metrics{ID: s, MType: protocol.GAUGE, Labels: labels, Value: &f})
 		},
 		func(s string, i int64) {
-			result = append(result, protocol.Metrics{ID: s, MType: protocol.COUNTER, Delta: &i})
+			// счетчики агента не сбрасываются после отправки, поэтому передаются как накопленные значения
+			result = append(result, protocol.Metrics{ID: s, MType: protocol.COUNTER, Labels: labels, Delta: &i, Temporality: protocol.CUMULATIVE})
 		},
 	)
+	for s, h := range m.Histograms() {
+		result = append(result, protocol.Metrics{ID: s, MType: protocol.HISTOGRAM, Labels: labels, Histogram: h})
+	}
 	return result
 }
 
-func (m *Metrics) ToAPIWithSign(key string) []protocol.Metrics {
-	result := m.ToAPI()
+// ToAPIWithSign - метрики для отправки, подписанные ключом key по схеме version
+func (m *Metrics) ToAPIWithSign(key string, version int, labels map[string]string) []protocol.Metrics {
+	result := m.ToAPI(labels)
+	now := time.Now()
 	for i := 0; i < len(result); i++ {
-		result[i].Hash = metricscrypto.GetMetricSign(result[i], key)
+		result[i].Hash = metricscrypto.SignMetric(result[i], key, version, now)
 	}
 	return result
 }
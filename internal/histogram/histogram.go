@@ -0,0 +1,122 @@
+// Package histogram - гистограмма распределения значений с фиксированными границами бакетов
+package histogram
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// ErrIncompatibleBuckets - гистограммы с разными границами бакетов нельзя объединить
+	ErrIncompatibleBuckets = errors.New("histogram buckets are incompatible")
+	// ErrInvalidHistogram - нарушена структура гистограммы
+	ErrInvalidHistogram = errors.New("histogram is invalid")
+)
+
+// DefaultBuckets - границы бакетов по умолчанию (в секундах), как у prometheus
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram - гистограмма.
+// Counts[i] - количество значений v <= Bounds[i], не попавших в предыдущие бакеты,
+// последний элемент Counts - количество значений больше последней границы
+type Histogram struct {
+	Bounds []float64 `json:"bounds"` // верхние границы бакетов по возрастанию
+	Counts []uint64  `json:"counts"` // количество значений в бакетах, len(Counts) == len(Bounds)+1
+	Count  uint64    `json:"count"`  // общее количество значений
+	Sum    float64   `json:"sum"`    // сумма значений
+}
+
+// New - пустая гистограмма с заданными границами бакетов
+func New(bounds []float64) *Histogram {
+	b := make([]float64, len(bounds))
+	copy(b, bounds)
+	sort.Float64s(b)
+	return &Histogram{Bounds: b, Counts: make([]uint64, len(b)+1)}
+}
+
+// Observe - добавление значения в гистограмму
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.Bounds, v)
+	h.Counts[i]++
+	h.Count++
+	h.Sum += v
+}
+
+// Merge - добавление к гистограмме значений из other
+func (h *Histogram) Merge(other *Histogram) error {
+	if err := other.Validate(); err != nil {
+		return err
+	}
+	if len(h.Bounds) != len(other.Bounds) {
+		return ErrIncompatibleBuckets
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return ErrIncompatibleBuckets
+		}
+	}
+	for i := range h.Counts {
+		h.Counts[i] += other.Counts[i]
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+	return nil
+}
+
+// Validate - проверка структуры гистограммы
+func (h *Histogram) Validate() error {
+	if h == nil {
+		return fmt.Errorf("%w: histogram is empty", ErrInvalidHistogram)
+	}
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("%w: expected %d counts, got %d", ErrInvalidHistogram, len(h.Bounds)+1, len(h.Counts))
+	}
+	if !sort.Float64sAreSorted(h.Bounds) {
+		return fmt.Errorf("%w: bounds must be sorted", ErrInvalidHistogram)
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return fmt.Errorf("%w: count %d doesn't match buckets total %d", ErrInvalidHistogram, h.Count, total)
+	}
+	return nil
+}
+
+// Copy - независимая копия гистограммы
+func (h *Histogram) Copy() *Histogram {
+	if h == nil {
+		return nil
+	}
+	c := &Histogram{Bounds: make([]float64, len(h.Bounds)), Counts: make([]uint64, len(h.Counts)), Count: h.Count, Sum: h.Sum}
+	copy(c.Bounds, h.Bounds)
+	copy(c.Counts, h.Counts)
+	return c
+}
+
+// Value - гистограмма хранится в бд в виде json
+func (h *Histogram) Value() (driver.Value, error) {
+	if h == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (h *Histogram) Scan(src any) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), h)
+	case []byte:
+		return json.Unmarshal(v, h)
+	default:
+		return fmt.Errorf("can't scan histogram from %T", src)
+	}
+}
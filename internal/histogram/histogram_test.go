@@ -0,0 +1,42 @@
+package histogram
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObserve(t *testing.T) {
+	h := New([]float64{10, 1, 5})
+	for _, v := range []float64{0.5, 1, 3, 7, 100} {
+		h.Observe(v)
+	}
+	assert.Equal(t, []float64{1, 5, 10}, h.Bounds)
+	assert.Equal(t, []uint64{2, 1, 1, 1}, h.Counts)
+	assert.Equal(t, uint64(5), h.Count)
+	assert.Equal(t, 111.5, h.Sum)
+	assert.NoError(t, h.Validate())
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name   string
+		other  *Histogram
+		err    error
+		counts []uint64
+	}{
+		{"same bounds", &Histogram{Bounds: []float64{1, 5}, Counts: []uint64{1, 2, 3}, Count: 6, Sum: 40}, nil, []uint64{2, 2, 3}},
+		{"other bounds", &Histogram{Bounds: []float64{1, 6}, Counts: []uint64{1, 2, 3}, Count: 6, Sum: 40}, ErrIncompatibleBuckets, []uint64{1, 0, 0}},
+		{"broken counts", &Histogram{Bounds: []float64{1, 5}, Counts: []uint64{1, 2}, Count: 3, Sum: 4}, ErrInvalidHistogram, []uint64{1, 0, 0}},
+		{"wrong count", &Histogram{Bounds: []float64{1, 5}, Counts: []uint64{1, 2, 3}, Count: 1, Sum: 4}, ErrInvalidHistogram, []uint64{1, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New([]float64{1, 5})
+			h.Observe(0.1)
+			err := h.Merge(tt.other)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.counts, h.Counts)
+		})
+	}
+}
@@ -3,21 +3,74 @@ package metricscrypto
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"yametrics/internal/protocol"
 )
 
+const (
+	// BatchSignHeader - заголовок http-запроса с подписью всего пакета /updates
+	BatchSignHeader = "X-Batch-Sign"
+	// BatchSignMetadataKey - ключ метаданных grpc с подписью всего пакета
+	BatchSignMetadataKey = "x-batch-sign"
+	// DeleteSignMetadataKey - ключ метаданных grpc с подписью запроса удаления метрик
+	DeleteSignMetadataKey = "x-delete-sign"
+)
+
+// ErrBadBatchSign - подпись пакета не совпала
+var ErrBadBatchSign = errors.New("bad batch sign")
+
+// GetMetricSign - подпись метрики ключом key по схеме v1.
+// для метрик неизвестного типа или без значения подписываются только имя и тип
 func GetMetricSign(m protocol.Metrics, key string) string {
-	var data string
-	switch m.MType {
-	case protocol.COUNTER:
+	data := fmt.Sprintf("%s:%s", m.ID, m.MType)
+	switch {
+	case m.MType == protocol.COUNTER && m.Delta != nil:
 		data = fmt.Sprintf("%s:%s:%d", m.ID, m.MType, *m.Delta)
-	case protocol.GAUGE:
+	case m.MType == protocol.GAUGE && m.Value != nil:
 		data = fmt.Sprintf("%s:%s:%f", m.ID, m.MType, *m.Value)
-	default:
-		panic("key is not defined")
+	case m.MType == protocol.HISTOGRAM && m.Histogram != nil:
+		data = fmt.Sprintf("%s:%s:%d:%f:%v:%v", m.ID, m.MType, m.Histogram.Count, m.Histogram.Sum, m.Histogram.Bounds, m.Histogram.Counts)
+	}
+	// метки добавляются в подпись только при наличии, чтобы не менять подпись метрик без меток
+	if len(m.Labels) > 0 {
+		data += ":" + labelsToString(m.Labels)
 	}
+	// накопленные значения подписываются с отметкой, чтобы приращение нельзя было выдать за накопленное значение
+	if m.Temporality == protocol.CUMULATIVE {
+		data += ":" + protocol.CUMULATIVE
+	}
+	return GetSign([]byte(data), key)
+}
+
+// GetSign - подпись произвольных данных ключом key: hex HMAC-SHA256
+func GetSign(data []byte, key string) string {
 	h := hmac.New(sha256.New, []byte(key))
-	h.Write([]byte(data))
+	h.Write(data)
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
+
+// GetBatchSign - подпись пакета метрик ключом key по схеме v1: подпись последовательности подписей метрик,
+// поэтому она не зависит от кодирования пакета и одинакова для http и grpc
+func GetBatchSign(metrics []protocol.Metrics, key string) string {
+	signs := make([]string, len(metrics))
+	for i := range metrics {
+		signs[i] = GetMetricSign(metrics[i], key)
+	}
+	return GetSign([]byte(strings.Join(signs, "\n")), key)
+}
+
+func labelsToString(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + labels[k]
+	}
+	return strings.Join(pairs, ",")
+}
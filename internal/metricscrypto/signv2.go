@@ -0,0 +1,373 @@
+package metricscrypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"yametrics/internal/protocol"
+)
+
+// версии схемы подписи
+const (
+	// SignV1 - hex HMAC-SHA256 строки с gauge в формате %f, без времени и nonce
+	SignV1 = 1
+	// SignV2 - каноническое кодирование с полной точностью, время и nonce против повторов:
+	// v2:hmac-sha256:<unix время>:<nonce>:<hex подписи>
+	SignV2 = 2
+)
+
+const (
+	// AlgorithmHMACSHA256 - идентификатор алгоритма подписи v2
+	AlgorithmHMACSHA256 = "hmac-sha256"
+	// DefaultSignSkew - допустимое расхождение времени подписи и часов сервера
+	DefaultSignSkew = 5 * time.Minute
+	signPrefixV2    = "v2"
+	maxNonceLength  = 64
+)
+
+var (
+	// ErrBadSign - подпись метрики не совпала
+	ErrBadSign = errors.New("bad sign")
+	// ErrUnsupportedSign - подпись неизвестной версии или алгоритма
+	ErrUnsupportedSign = errors.New("unsupported sign format")
+	// ErrLegacySign - подпись v1 после отключения старой схемы
+	ErrLegacySign = errors.New("legacy sign is not accepted")
+	// ErrSignExpired - время подписи дальше допустимого расхождения с часами сервера
+	ErrSignExpired = errors.New("sign time is out of allowed skew")
+	// ErrReplayed - подпись с таким nonce уже была принята
+	ErrReplayed = errors.New("sign nonce already used")
+)
+
+// SignMetric - подпись метрики ключом key по схеме version, at - время подписи для v2
+func SignMetric(m protocol.Metrics, key string, version int, at time.Time) string {
+	if version == SignV1 {
+		return GetMetricSign(m, key)
+	}
+	return GetMetricSignV2(m, key, at)
+}
+
+// SignBatch - подпись пакета метрик ключом key по схеме version, at - время подписи для v2
+func SignBatch(metrics []protocol.Metrics, key string, version int, at time.Time) string {
+	if version == SignV1 {
+		return GetBatchSign(metrics, key)
+	}
+	return GetBatchSignV2(metrics, key, at)
+}
+
+// GetMetricSignV2 - подпись метрики ключом key по схеме v2 со случайным nonce
+func GetMetricSignV2(m protocol.Metrics, key string, at time.Time) string {
+	var b strings.Builder
+	writeMetric(&b, m)
+	return signV2(b.String(), key, at.Unix(), newNonce())
+}
+
+// GetBatchSignV2 - подпись пакета метрик ключом key по схеме v2 со случайным nonce.
+// подписывается последовательность канонических кодировок метрик, подписи метрик не нужны
+func GetBatchSignV2(metrics []protocol.Metrics, key string, at time.Time) string {
+	var b strings.Builder
+	writeBatch(&b, metrics)
+	return signV2(b.String(), key, at.Unix(), newNonce())
+}
+
+// GetDeleteSignV2 - подпись запроса удаления метрик id типа mtype с метками labels ключом key по схеме v2,
+// id может быть шаблоном
+func GetDeleteSignV2(id string, mtype string, labels map[string]string, key string, at time.Time) string {
+	var b strings.Builder
+	writeDelete(&b, id, mtype, labels)
+	return signV2(b.String(), key, at.Unix(), newNonce())
+}
+
+func newNonce() string {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		// без случайного nonce подпись все равно проверяется, но не защищена от повтора
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(nonce)
+}
+
+// signV2 - подпись v2: в подписанные данные входят версия, алгоритм, время и nonce
+func signV2(payload string, key string, ts int64, nonce string) string {
+	header := strings.Join([]string{signPrefixV2, AlgorithmHMACSHA256, strconv.FormatInt(ts, 10), nonce}, ":")
+	return header + ":" + GetSign([]byte(header+"\n"+payload), key)
+}
+
+// writeMetric - каноническое кодирование метрики: строки в кавычках Go, чтобы разделители
+// внутри имен и меток не давали одинаковых кодировок, числа с плавающей точкой с полной точностью
+func writeMetric(b *strings.Builder, m protocol.Metrics) {
+	b.WriteString("metric ")
+	b.WriteString(strconv.Quote(m.ID))
+	b.WriteByte(' ')
+	b.WriteString(strconv.Quote(m.MType))
+	b.WriteByte(' ')
+	b.WriteString(strconv.Quote(m.Temporality))
+	b.WriteString("\nlabels")
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteByte(' ')
+		b.WriteString(strconv.Quote(k))
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(m.Labels[k]))
+	}
+	b.WriteString("\ndelta")
+	if m.Delta != nil {
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(*m.Delta, 10))
+	}
+	b.WriteString("\nvalue")
+	if m.Value != nil {
+		b.WriteByte(' ')
+		b.WriteString(formatFloat(*m.Value))
+	}
+	b.WriteString("\nhistogram")
+	if h := m.Histogram; h != nil {
+		b.WriteString(" bounds")
+		for _, v := range h.Bounds {
+			b.WriteByte(' ')
+			b.WriteString(formatFloat(v))
+		}
+		b.WriteString(" counts")
+		for _, v := range h.Counts {
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatUint(v, 10))
+		}
+		b.WriteString(" count ")
+		b.WriteString(strconv.FormatUint(h.Count, 10))
+		b.WriteString(" sum ")
+		b.WriteString(formatFloat(h.Sum))
+	}
+	b.WriteByte('\n')
+}
+
+// writeBatch - каноническое кодирование пакета: число метрик и кодировки метрик по порядку
+func writeBatch(b *strings.Builder, metrics []protocol.Metrics) {
+	b.WriteString("batch ")
+	b.WriteString(strconv.Itoa(len(metrics)))
+	b.WriteByte('\n')
+	for i := range metrics {
+		writeMetric(b, metrics[i])
+	}
+}
+
+// writeDelete - каноническое кодирование запроса удаления, отличается от кодировок метрики и пакета,
+// поэтому подпись записи нельзя выдать за подпись удаления
+func writeDelete(b *strings.Builder, id string, mtype string, labels map[string]string) {
+	b.WriteString("delete\n")
+	writeMetric(b, protocol.Metrics{ID: id, MType: mtype, Labels: labels})
+}
+
+// formatFloat - кратчайшая запись, по которой число восстанавливается без потерь
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// parsedSign - время и nonce подписи v2, сама подпись проверяется пересчетом
+type parsedSign struct {
+	ts    int64
+	nonce string
+}
+
+// parseSignV2 - разбор подписи v2, isV2 = false - подпись другой версии
+func parseSignV2(sign string) (parsed *parsedSign, isV2 bool, err error) {
+	if !strings.HasPrefix(sign, signPrefixV2+":") {
+		return nil, false, nil
+	}
+	parts := strings.Split(sign, ":")
+	if len(parts) != 5 || parts[1] != AlgorithmHMACSHA256 {
+		return nil, true, ErrUnsupportedSign
+	}
+	ts, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || parts[3] == "" || len(parts[3]) > maxNonceLength {
+		return nil, true, ErrUnsupportedSign
+	}
+	return &parsedSign{ts: ts, nonce: parts[3]}, true, nil
+}
+
+// Verifier - проверка подписей метрик и пакетов, общая для всех путей приема, чтобы подпись,
+// принятая по http, нельзя было повторить по grpc. nil Verifier принимает любые метрики
+type Verifier struct {
+	key    string
+	skew   time.Duration
+	legacy bool
+
+	// mutex - защищает nonces и pruned
+	mutex sync.Mutex
+	// nonces - принятые nonce и время, после которого подпись с ними отклоняется по времени
+	nonces map[string]time.Time
+	pruned time.Time
+}
+
+// NewVerifier - проверка подписей ключом key. skew - допустимое расхождение времени подписи v2
+// с часами сервера, 0 - DefaultSignSkew. legacy - принимать ли подписи v1 на время перехода.
+// для пустого ключа возвращает nil: подписи не проверяются
+func NewVerifier(key string, skew time.Duration, legacy bool) *Verifier {
+	if key == "" {
+		return nil
+	}
+	if skew <= 0 {
+		skew = DefaultSignSkew
+	}
+	return &Verifier{key: key, skew: skew, legacy: legacy, nonces: make(map[string]time.Time)}
+}
+
+// SignVersion - схема подписи отдаваемых метрик: v1, пока принимаются подписи v1 и клиенты могут не знать v2,
+// иначе v2
+func (v *Verifier) SignVersion() int {
+	if v != nil && v.legacy {
+		return SignV1
+	}
+	return SignV2
+}
+
+// VerifyMetric - проверка подписи метрики и занятие ее nonce, now - время сервера
+func (v *Verifier) VerifyMetric(m protocol.Metrics, now time.Time) error {
+	if v == nil {
+		return nil
+	}
+	claim := &Claim{verifier: v, nonces: make(map[string]time.Time)}
+	if err := v.verify(m.Hash, now, ErrBadSign, claim,
+		func() string { return GetMetricSign(m, v.key) },
+		func(b *strings.Builder) { writeMetric(b, m) }); err != nil {
+		return err
+	}
+	return claim.Use(now)
+}
+
+// VerifyDelete - проверка подписи запроса удаления и занятие ее nonce. принимается только подпись v2:
+// подписи v1 для удаления не было
+func (v *Verifier) VerifyDelete(id string, mtype string, labels map[string]string, sign string, now time.Time) error {
+	if v == nil {
+		return nil
+	}
+	if sign == "" {
+		return ErrBadSign
+	}
+	if _, isV2, err := parseSignV2(sign); err == nil && !isV2 {
+		return ErrLegacySign
+	}
+	claim := &Claim{verifier: v, nonces: make(map[string]time.Time)}
+	if err := v.verify(sign, now, ErrBadSign, claim,
+		func() string { return "" },
+		func(b *strings.Builder) { writeDelete(b, id, mtype, labels) }); err != nil {
+		return err
+	}
+	return claim.Use(now)
+}
+
+// VerifyBatch - проверка подписей пакета без занятия nonce: их занимает Claim.Use, когда известно,
+// что пакет не повтор уже обработанного с тем же ключом идемпотентности.
+// если задана подпись пакета batchSign, подписи метрик не проверяются, а ошибка подписи пакета
+// возвращается третьей. иначе возвращаются ошибки метрик по их индексам, пустые для пакета без ошибок
+func (v *Verifier) VerifyBatch(metrics []protocol.Metrics, batchSign string, now time.Time) (*Claim, map[int]error, error) {
+	errs := make(map[int]error)
+	if v == nil {
+		return nil, errs, nil
+	}
+	claim := &Claim{verifier: v, nonces: make(map[string]time.Time)}
+	if batchSign != "" {
+		err := v.verify(batchSign, now, ErrBadBatchSign, claim,
+			func() string { return GetBatchSign(metrics, v.key) },
+			func(b *strings.Builder) { writeBatch(b, metrics) })
+		return claim, errs, err
+	}
+	for i := range metrics {
+		m := metrics[i]
+		if err := v.verify(m.Hash, now, ErrBadSign, claim,
+			func() string { return GetMetricSign(m, v.key) },
+			func(b *strings.Builder) { writeMetric(b, m) }); err != nil {
+			errs[i] = err
+		}
+	}
+	return claim, errs, nil
+}
+
+// verify - проверка подписи sign: v1 сравнивается с legacySign, для v2 подписываются данные payload
+// и проверяется время, а nonce добавляется в claim. badSign - ошибка несовпадения подписи
+func (v *Verifier) verify(sign string, now time.Time, badSign error, claim *Claim, legacySign func() string, payload func(*strings.Builder)) error {
+	parsed, isV2, err := parseSignV2(sign)
+	if err != nil {
+		return err
+	}
+	if !isV2 {
+		if !v.legacy {
+			return ErrLegacySign
+		}
+		if !hmac.Equal([]byte(sign), []byte(legacySign())) {
+			return badSign
+		}
+		return nil
+	}
+
+	var b strings.Builder
+	payload(&b)
+	if !hmac.Equal([]byte(sign), []byte(signV2(b.String(), v.key, parsed.ts, parsed.nonce))) {
+		return badSign
+	}
+	at := time.Unix(parsed.ts, 0)
+	if at.Before(now.Add(-v.skew)) || at.After(now.Add(v.skew)) {
+		return ErrSignExpired
+	}
+	if _, ok := claim.nonces[parsed.nonce]; ok {
+		return ErrReplayed
+	}
+	claim.nonces[parsed.nonce] = at.Add(v.skew)
+	return nil
+}
+
+// Claim - nonce подписей проверенного пакета. nil Claim ничего не занимает
+type Claim struct {
+	verifier *Verifier
+	// nonces - nonce и время, после которого подпись с ним отклоняется по времени
+	nonces map[string]time.Time
+}
+
+// Use - занятие nonce пакета: всех или ни одного. ErrReplayed - хотя бы один nonce уже занят
+func (c *Claim) Use(now time.Time) error {
+	if c == nil || len(c.nonces) == 0 {
+		return nil
+	}
+	v := c.verifier
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if now.Sub(v.pruned) > v.skew {
+		for n, t := range v.nonces {
+			if t.Before(now) {
+				delete(v.nonces, n)
+			}
+		}
+		v.pruned = now
+	}
+	for nonce := range c.nonces {
+		if t, ok := v.nonces[nonce]; ok && !t.Before(now) {
+			return ErrReplayed
+		}
+	}
+	for nonce, until := range c.nonces {
+		v.nonces[nonce] = until
+	}
+	return nil
+}
+
+// Release - освобождение nonce пакета, который не был применен, чтобы его повтор мог быть принят
+func (c *Claim) Release() {
+	if c == nil || len(c.nonces) == 0 {
+		return
+	}
+	c.verifier.mutex.Lock()
+	defer c.verifier.mutex.Unlock()
+	for nonce, until := range c.nonces {
+		if t, ok := c.verifier.nonces[nonce]; ok && t.Equal(until) {
+			delete(c.verifier.nonces, nonce)
+		}
+	}
+}
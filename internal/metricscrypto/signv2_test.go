@@ -0,0 +1,156 @@
+package metricscrypto
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"yametrics/internal/histogram"
+	"yametrics/internal/protocol"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(id string, v float64) protocol.Metrics {
+	return protocol.Metrics{ID: id, MType: protocol.GAUGE, Value: &v}
+}
+
+func TestCanonicalEncoding(t *testing.T) {
+	encode := func(m protocol.Metrics) string {
+		var b strings.Builder
+		writeMetric(&b, m)
+		return b.String()
+	}
+	// v1 не различает значения, отличающиеся после шестого знака
+	assert.Equal(t, GetMetricSign(gauge("Alloc", 0.1234567), "key"), GetMetricSign(gauge("Alloc", 0.1234568), "key"))
+	assert.NotEqual(t, encode(gauge("Alloc", 0.1234567)), encode(gauge("Alloc", 0.1234568)))
+	assert.NotEqual(t, encode(gauge("Alloc", 1e-9)), encode(gauge("Alloc", 2e-9)))
+
+	// разделители внутри имен и меток не дают одинаковых кодировок
+	a, b := gauge("a", 1), gauge("a", 1)
+	a.Labels = map[string]string{"k": "v,x=y"}
+	b.Labels = map[string]string{"k": "v", "x": "y"}
+	assert.NotEqual(t, encode(a), encode(b))
+	assert.NotEqual(t, encode(gauge("a b", 1)), encode(protocol.Metrics{ID: "a", MType: "b"}))
+
+	h := histogram.New([]float64{0.1, 1})
+	h.Observe(0.5)
+	assert.Equal(t,
+		"metric \"Latency\" \"histogram\" \"\"\nlabels \"host\"=\"web\"\ndelta\nvalue\nhistogram bounds 0.1 1 counts 0 1 0 count 1 sum 0.5\n",
+		encode(protocol.Metrics{ID: "Latency", MType: protocol.HISTOGRAM, Labels: map[string]string{"host": "web"}, Histogram: h}))
+}
+
+func TestVerifyMetric(t *testing.T) {
+	now := time.Now()
+	v := NewVerifier("key", time.Minute, true)
+	m := gauge("Alloc", 0.1234567)
+
+	m.Hash = GetMetricSignV2(m, "key", now)
+	assert.True(t, strings.HasPrefix(m.Hash, "v2:hmac-sha256:"))
+	require.NoError(t, v.VerifyMetric(m, now))
+	assert.ErrorIs(t, v.VerifyMetric(m, now), ErrReplayed)
+	// после истечения допустимого расхождения подпись отклоняется по времени, а nonce забывается
+	assert.ErrorIs(t, v.VerifyMetric(m, now.Add(2*time.Minute)), ErrSignExpired)
+	later := gauge("Other", 1)
+	later.Hash = GetMetricSignV2(later, "key", now.Add(3*time.Minute))
+	require.NoError(t, v.VerifyMetric(later, now.Add(3*time.Minute)))
+	assert.Len(t, v.nonces, 1)
+
+	tampered := m
+	tampered.Value = new(float64)
+	*tampered.Value = 0.1234568
+	assert.ErrorIs(t, v.VerifyMetric(tampered, now), ErrBadSign)
+
+	m.Hash = GetMetricSignV2(m, "other", now)
+	assert.ErrorIs(t, v.VerifyMetric(m, now), ErrBadSign)
+	m.Hash = GetMetricSignV2(m, "key", now.Add(-2*time.Minute))
+	assert.ErrorIs(t, v.VerifyMetric(m, now), ErrSignExpired)
+	m.Hash = GetMetricSignV2(m, "key", now.Add(2*time.Minute))
+	assert.ErrorIs(t, v.VerifyMetric(m, now), ErrSignExpired)
+	for _, hash := range []string{"v2:hmac-sha512:1:n:00", "v2:hmac-sha256:x:n:00", "v2:hmac-sha256:1::00", "v2:00"} {
+		m.Hash = hash
+		assert.ErrorIs(t, v.VerifyMetric(m, now), ErrUnsupportedSign, hash)
+	}
+
+	// подписи v1 принимаются, пока не отключены
+	m.Hash = GetMetricSign(m, "key")
+	assert.NoError(t, v.VerifyMetric(m, now))
+	assert.ErrorIs(t, NewVerifier("key", 0, false).VerifyMetric(m, now), ErrLegacySign)
+	m.Hash = ""
+	assert.ErrorIs(t, v.VerifyMetric(m, now), ErrBadSign)
+
+	var disabled *Verifier
+	assert.Nil(t, NewVerifier("", 0, true))
+	assert.NoError(t, disabled.VerifyMetric(m, now))
+}
+
+func TestVerifyBatch(t *testing.T) {
+	now := time.Now()
+	v := NewVerifier("key", 0, true)
+	metrics := []protocol.Metrics{gauge("Alloc", 1), gauge("Sys", 2)}
+
+	for _, version := range []int{SignV1, SignV2} {
+		claim, errs, err := v.VerifyBatch(metrics, SignBatch(metrics, "key", version, now), now)
+		assert.NoError(t, err, version)
+		assert.Empty(t, errs)
+		assert.NoError(t, claim.Use(now))
+	}
+	sign := SignBatch(metrics, "key", SignV2, now)
+	_, _, err := v.VerifyBatch(metrics[:1], sign, now)
+	assert.ErrorIs(t, err, ErrBadBatchSign)
+
+	// без подписи пакета проверяются подписи метрик
+	metrics[0].Hash = SignMetric(metrics[0], "key", SignV2, now)
+	_, errs, err := v.VerifyBatch(metrics, "", now)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]error{1: ErrBadSign}, errs)
+}
+
+func TestClaim(t *testing.T) {
+	now := time.Now()
+	v := NewVerifier("key", time.Minute, true)
+	metrics := []protocol.Metrics{gauge("Alloc", 1)}
+	sign := SignBatch(metrics, "key", SignV2, now)
+
+	// проверка подписи не занимает nonce
+	first, _, err := v.VerifyBatch(metrics, sign, now)
+	require.NoError(t, err)
+	second, _, err := v.VerifyBatch(metrics, sign, now)
+	require.NoError(t, err)
+	assert.Empty(t, v.nonces)
+
+	require.NoError(t, first.Use(now))
+	assert.ErrorIs(t, second.Use(now), ErrReplayed)
+
+	// освобожденный nonce можно занять повторно
+	first.Release()
+	assert.Empty(t, v.nonces)
+	require.NoError(t, second.Use(now))
+	_, _, err = v.VerifyBatch(metrics, sign, now)
+	require.NoError(t, err)
+
+	// одна подпись у двух метрик пакета - повтор
+	m := gauge("Sys", 2)
+	m.Hash = SignMetric(m, "key", SignV2, now)
+	_, errs, err := v.VerifyBatch([]protocol.Metrics{m, m}, "", now)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]error{1: ErrReplayed}, errs)
+
+	var disabled *Claim
+	assert.NoError(t, disabled.Use(now))
+	disabled.Release()
+}
+
+func TestVerifyDelete(t *testing.T) {
+	now := time.Now()
+	v := NewVerifier("key", 0, true)
+	labels := map[string]string{"host": "web"}
+
+	sign := GetDeleteSignV2("Alloc*", protocol.GAUGE, labels, "key", now)
+	require.NoError(t, v.VerifyDelete("Alloc*", protocol.GAUGE, labels, sign, now))
+	assert.ErrorIs(t, v.VerifyDelete("Alloc*", protocol.GAUGE, labels, sign, now), ErrReplayed)
+	sign = GetDeleteSignV2("Alloc*", protocol.GAUGE, labels, "key", now)
+	assert.ErrorIs(t, v.VerifyDelete("*", protocol.GAUGE, labels, sign, now), ErrBadSign)
+	assert.ErrorIs(t, v.VerifyDelete("Alloc*", protocol.GAUGE, labels, "", now), ErrBadSign)
+	assert.ErrorIs(t, v.VerifyDelete("Alloc*", protocol.GAUGE, labels, GetSign([]byte("Alloc*"), "key"), now), ErrLegacySign)
+}
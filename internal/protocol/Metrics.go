@@ -1,14 +1,47 @@
 package protocol
 
+import (
+	"time"
+	"yametrics/internal/histogram"
+)
+
+const (
+	GAUGE     = "gauge"
+	COUNTER   = "counter"
+	HISTOGRAM = "histogram"
+)
+
+// временная семантика значения counter
 const (
-	GAUGE   = "gauge"
-	COUNTER = "counter"
+	DELTA      = "delta"      // приращение с прошлой отправки
+	CUMULATIVE = "cumulative" // накопленное значение, сервер сам вычисляет приращение
 )
 
 type Metrics struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики
-	Hash  string   `json:"hash,omitempty"`  // значение хеш-функции
+	ID          string               `json:"id"`                    // имя метрики
+	MType       string               `json:"type"`                  // параметр, принимающий значение gauge, counter или histogram
+	Labels      map[string]string    `json:"labels,omitempty"`      // метки метрики (host, service, env ...)
+	Delta       *int64               `json:"delta,omitempty"`       // значение метрики в случае передачи counter
+	Value       *float64             `json:"value,omitempty"`       // значение метрики
+	Histogram   *histogram.Histogram `json:"histogram,omitempty"`   // значение метрики в случае передачи histogram
+	Temporality string               `json:"temporality,omitempty"` // delta (по умолчанию) или cumulative для counter
+	Hash        string               `json:"hash,omitempty"`        // значение хеш-функции
+}
+
+// MetricPoint - точка истории метрики
+type MetricPoint struct {
+	Timestamp time.Time            `json:"ts"`                  // время получения значения
+	Delta     *int64               `json:"delta,omitempty"`     // значение counter на момент времени
+	Value     *float64             `json:"value,omitempty"`     // значение gauge на момент времени
+	Histogram *histogram.Histogram `json:"histogram,omitempty"` // значение histogram на момент времени
+	Min       *float64             `json:"min,omitempty"`       // минимум gauge за интервал, для точек из агрегатов
+	Max       *float64             `json:"max,omitempty"`       // максимум gauge за интервал, для точек из агрегатов
+	Avg       *float64             `json:"avg,omitempty"`       // среднее gauge за интервал, для точек из агрегатов
+	Sum       *float64             `json:"sum,omitempty"`       // сумма приращений counter за интервал, для точек из агрегатов
+}
+
+// MetricsPage - страница выборки метрик
+type MetricsPage struct {
+	Metrics []Metrics `json:"metrics"`        // метрики страницы
+	Next    string    `json:"next,omitempty"` // курсор следующей страницы, пустой - страница последняя
 }
@@ -0,0 +1,19 @@
+package proto
+
+import "yametrics/internal/histogram"
+
+// HistogramFromProto - преобразование гистограммы из protobuf
+func HistogramFromProto(h *Histogram) *histogram.Histogram {
+	if h == nil {
+		return nil
+	}
+	return &histogram.Histogram{Bounds: h.Bounds, Counts: h.Counts, Count: h.Count, Sum: h.Sum}
+}
+
+// HistogramToProto - преобразование гистограммы в protobuf
+func HistogramToProto(h *histogram.Histogram) *Histogram {
+	if h == nil {
+		return nil
+	}
+	return &Histogram{Bounds: h.Bounds, Counts: h.Counts, Count: h.Count, Sum: h.Sum}
+}
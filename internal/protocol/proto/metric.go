@@ -0,0 +1,27 @@
+package proto
+
+import "yametrics/internal/protocol"
+
+// MetricToProtocol - преобразование метрики из protobuf, в том числе для проверки ее подписи
+func MetricToProtocol(m *Metric) protocol.Metrics {
+	result := protocol.Metrics{
+		ID:        m.Id,
+		Labels:    m.Labels,
+		Delta:     m.Delta,
+		Value:     m.Value,
+		Histogram: HistogramFromProto(m.Histogram),
+		Hash:      m.GetHash(),
+	}
+	switch m.Type {
+	case MetricTypes_COUNTER:
+		result.MType = protocol.COUNTER
+	case MetricTypes_GAUGE:
+		result.MType = protocol.GAUGE
+	case MetricTypes_HISTOGRAM:
+		result.MType = protocol.HISTOGRAM
+	}
+	if m.Temporality == Temporality_CUMULATIVE {
+		result.Temporality = protocol.CUMULATIVE
+	}
+	return result
+}
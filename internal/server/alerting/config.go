@@ -0,0 +1,87 @@
+// Package alerting - правила оповещений по значениям метрик.
+// правило задается выражением вида "FreeMemory < 500MB for 2m" и периодически проверяется по хранилищу.
+// для каждой подходящей метрики (набора меток) заводится оповещение: pending, пока условие выполняется
+// меньше заданного времени, firing - дольше, resolved - условие перестало выполняться.
+// о переходах в firing и resolved сообщают оповещатели: журнал, webhook или файл
+package alerting
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+	"yametrics/internal/durationextension"
+
+	"go.uber.org/zap"
+)
+
+// DefaultInterval - период проверки правил
+const DefaultInterval = 15 * time.Second
+
+// типы оповещателей
+const (
+	NotifierLog     = "log"
+	NotifierWebhook = "webhook"
+	NotifierFile    = "file"
+)
+
+// Rule - правило оповещения
+type Rule struct {
+	// Name - уникальное имя правила
+	Name string `json:"name"`
+	// Expr - условие: "<метрика>[{метка=значение,...}] <оператор> <порог>[единица] [for <длительность>]".
+	// имя метрики может быть шаблоном path.Match, операторы: < <= > >= == !=,
+	// единицы размера B, KB, MB, GB, TB (по 1024) и %
+	Expr string `json:"expr"`
+	// Description - описание, которое передается оповещателям
+	Description string `json:"description"`
+	// Notifiers - имена оповещателей, пустой список - все оповещатели
+	Notifiers []string `json:"notifiers"`
+}
+
+// NotifierConfig - оповещатель
+type NotifierConfig struct {
+	Name string `json:"name"`
+	// Type - log, webhook или file
+	Type string `json:"type"`
+	// URL - адрес webhook
+	URL string `json:"url"`
+	// Secret - ключ подписи тела запроса webhook, пустой - запрос не подписывается
+	Secret string `json:"secret"`
+	// Path - файл, в который оповещения дописываются строками json
+	Path string `json:"path"`
+}
+
+// Config - правила и оповещатели, задаются в файле конфигурации и перечитываются без перезапуска сервера.
+// если оповещатели не заданы, оповещения пишутся в журнал сервера
+type Config struct {
+	Interval  durationextension.Duration `json:"interval"`
+	Rules     []Rule                     `json:"rules"`
+	Notifiers []NotifierConfig           `json:"notifiers"`
+}
+
+// Validate - проверка выражений правил и ссылок на оповещатели
+func (c *Config) Validate() error {
+	_, err := compile(c, zap.NewNop().Sugar())
+	return err
+}
+
+func (n *NotifierConfig) validate() error {
+	switch n.Type {
+	case NotifierLog:
+	case NotifierWebhook:
+		u, err := url.Parse(n.URL)
+		if err != nil {
+			return fmt.Errorf("notifier %s: %w", n.Name, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("notifier %s: url must be absolute http or https url", n.Name)
+		}
+	case NotifierFile:
+		if n.Path == "" {
+			return fmt.Errorf("notifier %s: path must be nonempty", n.Name)
+		}
+	default:
+		return fmt.Errorf("notifier %s: unknown type %q, expected log, webhook or file", n.Name, n.Type)
+	}
+	return nil
+}
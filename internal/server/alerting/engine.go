@@ -0,0 +1,335 @@
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"yametrics/internal/server/models"
+
+	"go.uber.org/zap"
+)
+
+// состояния оповещения
+const (
+	// StatePending - условие выполняется меньше времени, заданного в правиле
+	StatePending = "pending"
+	// StateFiring - условие выполняется дольше времени, заданного в правиле
+	StateFiring = "firing"
+	// StateResolved - условие перестало выполняться после firing
+	StateResolved = "resolved"
+)
+
+// resolvedRetention - сколько решенное оповещение остается в списке
+const resolvedRetention = 15 * time.Minute
+
+// Alert - оповещение правила для одной метрики
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Expr        string            `json:"expr"`
+	Description string            `json:"description,omitempty"`
+	Metric      string            `json:"metric"`
+	MType       string            `json:"type"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Value       float64           `json:"value"`     // значение при последней проверке
+	Threshold   float64           `json:"threshold"` // порог в базовых единицах
+	State       string            `json:"state"`
+	ActiveAt    time.Time         `json:"active_at"` // с какого момента выполняется условие
+	FiredAt     *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolved_at,omitempty"`
+}
+
+// Source - хранилище, по значениям которого проверяются правила
+type Source interface {
+	GetAll() ([]models.Metrics, error)
+}
+
+// Loader - чтение настроек оповещений, вызывается при создании и перезагрузке правил
+type Loader func() (*Config, error)
+
+// rule - правило с разобранным условием и оповещателями
+type rule struct {
+	Rule
+	cond      *condition
+	notifiers []Notifier
+}
+
+// ruleSet - проверенные настройки
+type ruleSet struct {
+	interval time.Duration
+	rules    []*rule
+	byName   map[string]*rule
+}
+
+// compile - разбор правил и создание оповещателей
+func compile(cfg *Config, logger *zap.SugaredLogger) (*ruleSet, error) {
+	set := &ruleSet{interval: cfg.Interval.Duration, byName: make(map[string]*rule, len(cfg.Rules))}
+	if set.interval <= 0 {
+		set.interval = DefaultInterval
+	}
+	notifiers := make(map[string]Notifier, len(cfg.Notifiers))
+	all := make([]Notifier, 0, len(cfg.Notifiers))
+	for _, n := range cfg.Notifiers {
+		if n.Name == "" {
+			return nil, fmt.Errorf("notifier name must be nonempty")
+		}
+		if _, ok := notifiers[n.Name]; ok {
+			return nil, fmt.Errorf("notifier %s: duplicate name", n.Name)
+		}
+		if err := n.validate(); err != nil {
+			return nil, err
+		}
+		notifiers[n.Name] = newNotifier(n, logger)
+		all = append(all, notifiers[n.Name])
+	}
+	if len(all) == 0 {
+		all = append(all, &logNotifier{logger: logger})
+	}
+	for _, r := range cfg.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %q: name must be nonempty", r.Expr)
+		}
+		if _, ok := set.byName[r.Name]; ok {
+			return nil, fmt.Errorf("rule %s: duplicate name", r.Name)
+		}
+		cond, err := parseExpr(r.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		compiled := &rule{Rule: r, cond: cond, notifiers: all}
+		if len(r.Notifiers) > 0 {
+			compiled.notifiers = make([]Notifier, 0, len(r.Notifiers))
+			for _, name := range r.Notifiers {
+				n, ok := notifiers[name]
+				if !ok {
+					return nil, fmt.Errorf("rule %s: unknown notifier %s", r.Name, name)
+				}
+				compiled.notifiers = append(compiled.notifiers, n)
+			}
+		}
+		set.rules = append(set.rules, compiled)
+		set.byName[r.Name] = compiled
+	}
+	return set, nil
+}
+
+// notification - оповещение, о котором нужно сообщить после проверки
+type notification struct {
+	alert     Alert
+	notifiers []Notifier
+}
+
+// Engine - периодическая проверка правил и состояния оповещений
+type Engine struct {
+	load   Loader
+	source Source
+	logger *zap.SugaredLogger
+
+	// mutex - защищает rules и alerts
+	mutex  sync.Mutex
+	rules  *ruleSet
+	alerts map[string]*Alert
+	// reloaded - сигнал Run, что интервал проверки мог измениться
+	reloaded chan struct{}
+}
+
+// NewEngine - загрузка правил через load и создание проверки по source
+func NewEngine(load Loader, source Source, logger *zap.SugaredLogger) (*Engine, error) {
+	e := &Engine{
+		load:     load,
+		source:   source,
+		logger:   logger,
+		alerts:   make(map[string]*Alert),
+		reloaded: make(chan struct{}, 1),
+	}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload - перечитывание правил. при ошибке продолжают действовать прежние правила.
+// оповещения правил, у которых не изменилось выражение, сохраняют состояние
+func (e *Engine) Reload() error {
+	cfg, err := e.load()
+	if err != nil {
+		return fmt.Errorf("error on load alerting config: %w", err)
+	}
+	set, err := compile(cfg, e.logger)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	e.rules = set
+	for key, a := range e.alerts {
+		if r, ok := set.byName[a.Rule]; !ok || r.Expr != a.Expr {
+			delete(e.alerts, key)
+		} else {
+			a.Description = r.Description
+		}
+	}
+	e.mutex.Unlock()
+	select {
+	case e.reloaded <- struct{}{}:
+	default:
+	}
+	e.logger.Infof("alerting rules loaded: %d", len(set.rules))
+	return nil
+}
+
+// Run - проверка правил с заданным в настройках интервалом до отмены ctx
+func (e *Engine) Run(ctx context.Context) {
+	for {
+		timer := time.NewTimer(e.interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-e.reloaded:
+			timer.Stop()
+		case now := <-timer.C:
+			e.Evaluate(ctx, now)
+		}
+	}
+}
+
+func (e *Engine) interval() time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.rules.interval
+}
+
+// Evaluate - проверка правил по текущим значениям метрик на момент now и рассылка оповещений
+// о переходах в firing и resolved
+func (e *Engine) Evaluate(ctx context.Context, now time.Time) {
+	e.mutex.Lock()
+	set := e.rules
+	e.mutex.Unlock()
+	if len(set.rules) == 0 {
+		return
+	}
+	metrics, err := e.source.GetAll()
+	if err != nil {
+		e.logger.Errorf("error on read metrics for alerting rules: %v", err)
+		return
+	}
+
+	notifications := make([]notification, 0)
+	e.mutex.Lock()
+	seen := make(map[string]bool)
+	for _, r := range set.rules {
+		for i := range metrics {
+			m := &metrics[i]
+			v, ok := valueOf(m)
+			if !ok || !r.cond.match(m) {
+				continue
+			}
+			key := r.Name + "\x00" + m.MType + "\x00" + m.Key()
+			seen[key] = true
+			a := e.alerts[key]
+			if !r.cond.test(v) {
+				if a != nil {
+					a.Value = v
+					notifications = e.deactivate(key, a, r, now, notifications)
+				}
+				continue
+			}
+			if a == nil || a.State == StateResolved {
+				a = &Alert{
+					Rule:        r.Name,
+					Expr:        r.Expr,
+					Description: r.Description,
+					Metric:      m.ID,
+					MType:       m.MType,
+					Labels:      m.Labels,
+					Threshold:   r.cond.value,
+					State:       StatePending,
+					ActiveAt:    now,
+				}
+				e.alerts[key] = a
+			}
+			a.Value = v
+			if a.State == StatePending && now.Sub(a.ActiveAt) >= r.cond.hold {
+				fired := now
+				a.State, a.FiredAt = StateFiring, &fired
+				notifications = append(notifications, notification{alert: *a, notifiers: r.notifiers})
+			}
+		}
+	}
+	for key, a := range e.alerts {
+		switch {
+		case a.State == StateResolved:
+			if now.Sub(*a.ResolvedAt) >= resolvedRetention {
+				delete(e.alerts, key)
+			}
+		case !seen[key]:
+			// метрика удалена из хранилища. оповещения правил, загруженных во время проверки, не трогаются
+			if r, ok := set.byName[a.Rule]; ok && r.Expr == a.Expr {
+				notifications = e.deactivate(key, a, r, now, notifications)
+			}
+		}
+	}
+	e.mutex.Unlock()
+
+	for _, n := range notifications {
+		for _, notifier := range n.notifiers {
+			notifyCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+			if err := notifier.Notify(notifyCtx, n.alert); err != nil {
+				e.logger.Errorf("error on notify alert %s: %v", n.alert.Rule, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// deactivate - условие больше не выполняется: firing переходит в resolved, pending удаляется.
+// вызывается под блокировкой
+func (e *Engine) deactivate(key string, a *Alert, r *rule, now time.Time, notifications []notification) []notification {
+	switch a.State {
+	case StatePending:
+		delete(e.alerts, key)
+	case StateFiring:
+		resolved := now
+		a.State, a.ResolvedAt = StateResolved, &resolved
+		notifications = append(notifications, notification{alert: *a, notifiers: r.notifiers})
+	}
+	return notifications
+}
+
+// Alerts - оповещения в состоянии state (пустое - в любом), упорядоченные по правилу и метрике
+func (e *Engine) Alerts(state string) []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	result := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		if state == "" || a.State == state {
+			result = append(result, *a)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := &result[i], &result[j]
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		if a.MType != b.MType {
+			return a.MType < b.MType
+		}
+		return models.Labels(a.Labels).String() < models.Labels(b.Labels).String()
+	})
+	return result
+}
+
+// Rules - действующие правила
+func (e *Engine) Rules() []Rule {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	result := make([]Rule, 0, len(e.rules.rules))
+	for _, r := range e.rules.rules {
+		result = append(result, r.Rule)
+	}
+	return result
+}
@@ -0,0 +1,313 @@
+package alerting
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"yametrics/internal/metricscrypto"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/webhook"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// source - хранилище с заданным набором метрик
+type source struct {
+	metrics []models.Metrics
+	err     error
+}
+
+func (s *source) GetAll() ([]models.Metrics, error) {
+	return s.metrics, s.err
+}
+
+func (s *source) set(metrics ...models.Metrics) {
+	s.metrics = metrics
+}
+
+// recorder - оповещатель, запоминающий оповещения
+type recorder struct {
+	mutex  sync.Mutex
+	alerts []Alert
+}
+
+func (r *recorder) Notify(_ context.Context, a Alert) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+func (r *recorder) take() []Alert {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	alerts := r.alerts
+	r.alerts = nil
+	return alerts
+}
+
+func gauge(id string, v float64, labels models.Labels) models.Metrics {
+	return models.Metrics{ID: id, MType: models.GAUGE, Labels: labels, Value: &v}
+}
+
+func counter(id string, d int64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.COUNTER, Delta: &d}
+}
+
+// newEngine - проверка правил cfg, все правила сообщают в возвращаемый recorder
+func newEngine(t *testing.T, src Source, cfg *Config) (*Engine, *recorder) {
+	e, err := NewEngine(func() (*Config, error) { return cfg, nil }, src, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	rec := &recorder{}
+	for _, r := range e.rules.rules {
+		r.notifiers = []Notifier{rec}
+	}
+	return e, rec
+}
+
+func TestEvaluate(t *testing.T) {
+	src := &source{}
+	e, rec := newEngine(t, src, &Config{Rules: []Rule{{Name: "low-memory", Expr: "FreeMemory < 500MB for 2m"}}})
+	ctx := context.Background()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	web, db := models.Labels{"host": "web"}, models.Labels{"host": "db"}
+
+	src.set(gauge("FreeMemory", 100<<20, web), gauge("FreeMemory", 1<<30, db), gauge("Alloc", 1, nil))
+	e.Evaluate(ctx, start)
+	alerts := e.Alerts("")
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StatePending, alerts[0].State)
+	assert.Equal(t, map[string]string(web), alerts[0].Labels)
+	assert.Equal(t, float64(500<<20), alerts[0].Threshold)
+	assert.Empty(t, rec.take())
+
+	// условие выполняется 2 минуты
+	e.Evaluate(ctx, start.Add(time.Minute))
+	assert.Equal(t, StatePending, e.Alerts("")[0].State)
+	e.Evaluate(ctx, start.Add(2*time.Minute))
+	alerts = e.Alerts(StateFiring)
+	require.Len(t, alerts, 1)
+	assert.True(t, start.Equal(alerts[0].ActiveAt))
+	notified := rec.take()
+	require.Len(t, notified, 1)
+	assert.Equal(t, StateFiring, notified[0].State)
+	e.Evaluate(ctx, start.Add(3*time.Minute))
+	assert.Empty(t, rec.take(), "firing is notified once")
+
+	src.set(gauge("FreeMemory", 600<<20, web))
+	e.Evaluate(ctx, start.Add(4*time.Minute))
+	alerts = e.Alerts("")
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateResolved, alerts[0].State)
+	assert.Equal(t, float64(600<<20), alerts[0].Value)
+	notified = rec.take()
+	require.Len(t, notified, 1)
+	assert.Equal(t, StateResolved, notified[0].State)
+
+	// решенное оповещение хранится ограниченное время
+	e.Evaluate(ctx, start.Add(4*time.Minute+resolvedRetention))
+	assert.Empty(t, e.Alerts(""))
+}
+
+func TestEvaluatePendingReset(t *testing.T) {
+	src := &source{}
+	e, rec := newEngine(t, src, &Config{Rules: []Rule{
+		{Name: "cpu", Expr: "CPUutilization* > 90 for 1m"},
+		{Name: "polls", Expr: "PollCount >= 10"},
+	}})
+	ctx := context.Background()
+	start := time.Now()
+
+	src.set(gauge("CPUutilization1", 95, nil), counter("PollCount", 5))
+	e.Evaluate(ctx, start)
+	src.set(gauge("CPUutilization1", 50, nil), counter("PollCount", 10))
+	e.Evaluate(ctx, start.Add(30*time.Second))
+	src.set(gauge("CPUutilization1", 95, nil), counter("PollCount", 12))
+	e.Evaluate(ctx, start.Add(70*time.Second))
+
+	// pending сбрасывается, когда условие перестает выполняться; правило без for срабатывает сразу
+	alerts := e.Alerts("")
+	require.Len(t, alerts, 2)
+	assert.Equal(t, "cpu", alerts[0].Rule)
+	assert.Equal(t, StatePending, alerts[0].State)
+	assert.True(t, start.Add(70*time.Second).Equal(alerts[0].ActiveAt))
+	assert.Equal(t, "polls", alerts[1].Rule)
+	assert.Equal(t, StateFiring, alerts[1].State)
+	assert.Equal(t, 12.0, alerts[1].Value)
+	assert.Len(t, rec.take(), 1)
+
+	// метрика удалена из хранилища
+	src.set()
+	e.Evaluate(ctx, start.Add(80*time.Second))
+	alerts = e.Alerts("")
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateResolved, alerts[0].State)
+
+	// ошибка чтения хранилища не меняет состояние
+	src.err = errors.New("db is down")
+	e.Evaluate(ctx, start.Add(90*time.Second))
+	assert.Len(t, e.Alerts(""), 1)
+}
+
+func TestReload(t *testing.T) {
+	src := &source{}
+	src.set(gauge("Alloc", 100, nil), gauge("HeapAlloc", 100, nil))
+	cfg := &Config{Rules: []Rule{
+		{Name: "alloc", Expr: "Alloc > 10"},
+		{Name: "heap", Expr: "HeapAlloc > 10"},
+	}}
+	var loadErr error
+	e, err := NewEngine(func() (*Config, error) { return cfg, loadErr }, src, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	e.Evaluate(context.Background(), time.Now())
+	require.Len(t, e.Alerts(StateFiring), 2)
+
+	// состояние сохраняется только у правил с прежним выражением
+	cfg = &Config{Rules: []Rule{
+		{Name: "alloc", Expr: "Alloc > 10", Description: "too much"},
+		{Name: "heap", Expr: "HeapAlloc > 20"},
+	}}
+	require.NoError(t, e.Reload())
+	alerts := e.Alerts("")
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "alloc", alerts[0].Rule)
+	assert.Equal(t, "too much", alerts[0].Description)
+
+	// ошибочные правила не заменяют действующие
+	cfg = &Config{Rules: []Rule{{Name: "alloc", Expr: "Alloc >"}}}
+	assert.Error(t, e.Reload())
+	loadErr = errors.New("no such file")
+	assert.Error(t, e.Reload())
+	assert.Len(t, e.Rules(), 2)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"ok", Config{
+			Rules:     []Rule{{Name: "a", Expr: "Alloc > 1", Notifiers: []string{"hook"}}},
+			Notifiers: []NotifierConfig{{Name: "hook", Type: NotifierWebhook, URL: "https://example.com"}, {Name: "log", Type: NotifierLog}},
+		}, true},
+		{"no rule name", Config{Rules: []Rule{{Expr: "Alloc > 1"}}}, false},
+		{"duplicate rule", Config{Rules: []Rule{{Name: "a", Expr: "Alloc > 1"}, {Name: "a", Expr: "Alloc > 2"}}}, false},
+		{"wrong expr", Config{Rules: []Rule{{Name: "a", Expr: "Alloc"}}}, false},
+		{"unknown notifier", Config{Rules: []Rule{{Name: "a", Expr: "Alloc > 1", Notifiers: []string{"x"}}}}, false},
+		{"unknown notifier type", Config{Notifiers: []NotifierConfig{{Name: "x", Type: "mail"}}}, false},
+		{"webhook without url", Config{Notifiers: []NotifierConfig{{Name: "x", Type: NotifierWebhook}}}, false},
+		{"file without path", Config{Notifiers: []NotifierConfig{{Name: "x", Type: NotifierFile}}}, false},
+		{"duplicate notifier", Config{Notifiers: []NotifierConfig{{Name: "x", Type: NotifierLog}, {Name: "x", Type: NotifierLog}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.ok, tt.cfg.Validate() == nil)
+		})
+	}
+}
+
+func TestNotifiers(t *testing.T) {
+	var (
+		mutex  sync.Mutex
+		bodies [][]byte
+		signs  []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		defer mutex.Unlock()
+		bodies = append(bodies, body)
+		signs = append(signs, r.Header.Get(webhook.SignatureHeader))
+	}))
+	defer ts.Close()
+	file := filepath.Join(t.TempDir(), "alerts.jsonl")
+
+	src := &source{}
+	src.set(gauge("Alloc", 100, nil))
+	e, err := NewEngine(func() (*Config, error) {
+		return &Config{
+			Rules: []Rule{{Name: "alloc", Expr: "Alloc > 10"}},
+			Notifiers: []NotifierConfig{
+				{Name: "hook", Type: NotifierWebhook, URL: ts.URL, Secret: "secret"},
+				{Name: "file", Type: NotifierFile, Path: file},
+				{Name: "log", Type: NotifierLog},
+			},
+		}, nil
+	}, src, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	e.Evaluate(context.Background(), time.Now())
+	src.set(gauge("Alloc", 1, nil))
+	e.Evaluate(context.Background(), time.Now())
+
+	require.Len(t, bodies, 2)
+	assert.Equal(t, "sha256="+metricscrypto.GetSign(bodies[0], "secret"), signs[0])
+	var a Alert
+	require.NoError(t, json.Unmarshal(bodies[0], &a))
+	assert.Equal(t, StateFiring, a.State)
+
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+	states := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &a))
+		states = append(states, a.State)
+	}
+	assert.Equal(t, []string{StateFiring, StateResolved}, states)
+}
+
+func TestHandlers(t *testing.T) {
+	src := &source{}
+	src.set(gauge("Alloc", 100, nil))
+	cfg := &Config{Rules: []Rule{{Name: "alloc", Expr: "Alloc > 10"}, {Name: "heap", Expr: "HeapAlloc > 10 for 1m"}}}
+	e, _ := newEngine(t, src, cfg)
+	e.Evaluate(context.Background(), time.Now())
+
+	r := chi.NewRouter()
+	e.Routes(r)
+	do := func(method string, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	w := do(http.MethodGet, "/alerts")
+	require.Equal(t, http.StatusOK, w.Code)
+	var alerts []Alert
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &alerts))
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "alloc", alerts[0].Rule)
+
+	w = do(http.MethodGet, "/alerts?state=pending")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &alerts))
+	assert.Empty(t, alerts)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/alerts?state=silenced").Code)
+
+	w = do(http.MethodGet, "/alerts/rules")
+	var rules []Rule
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rules))
+	assert.Len(t, rules, 2)
+
+	cfg.Rules = cfg.Rules[:1]
+	w = do(http.MethodPost, "/alerts/reload")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rules))
+	assert.Len(t, rules, 1)
+
+	cfg.Rules = []Rule{{Name: "alloc", Expr: "Alloc >> 1"}}
+	assert.Equal(t, http.StatusUnprocessableEntity, do(http.MethodPost, "/alerts/reload").Code)
+}
@@ -0,0 +1,173 @@
+package alerting
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"yametrics/internal/server/models"
+)
+
+// condition - разобранное выражение правила
+type condition struct {
+	// metric - имя или шаблон имени метрики
+	metric   string
+	selector models.Labels
+	op       string
+	value    float64
+	// hold - сколько условие должно выполняться, прежде чем оповещение перейдет в firing
+	hold time.Duration
+}
+
+// operators - операторы сравнения, двухсимвольные проверяются раньше односимвольных
+var operators = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+// units - множители единиц порога
+var units = map[string]float64{
+	"":   1,
+	"%":  1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// parseExpr - разбор выражения "<метрика>[{метка=значение,...}] <оператор> <порог>[единица] [for <длительность>]"
+func parseExpr(expr string) (*condition, error) {
+	c := &condition{}
+	left, right, err := splitOperator(expr, &c.op)
+	if err != nil {
+		return nil, err
+	}
+	if c.metric, c.selector, err = parseMetric(strings.TrimSpace(left)); err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(right)
+	switch {
+	case len(fields) == 1:
+	case len(fields) == 3 && fields[1] == "for":
+		if c.hold, err = time.ParseDuration(fields[2]); err != nil {
+			return nil, fmt.Errorf("wrong duration %q: %w", fields[2], err)
+		}
+		if c.hold < 0 {
+			return nil, fmt.Errorf("negative duration %v", c.hold)
+		}
+	default:
+		return nil, fmt.Errorf("expected threshold and optional `for <duration>` after %s", c.op)
+	}
+	if c.value, err = parseValue(fields[0]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// splitOperator - части выражения слева и справа от первого оператора вне фигурных скобок
+func splitOperator(expr string, op *string) (string, string, error) {
+	depth := 0
+	for i := 0; i < len(expr); i++ {
+		switch expr[i] {
+		case '{':
+			depth++
+			continue
+		case '}':
+			depth--
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+		for _, o := range operators {
+			if strings.HasPrefix(expr[i:], o) {
+				*op = o
+				return expr[:i], expr[i+len(o):], nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("expression %q has no comparison operator", expr)
+}
+
+// parseMetric - имя метрики и метки из "name{key=value,...}"
+func parseMetric(s string) (string, models.Labels, error) {
+	name, rest, hasLabels := strings.Cut(s, "{")
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return "", nil, fmt.Errorf("wrong metric name %q", name)
+	}
+	if _, err := path.Match(name, ""); err != nil {
+		return "", nil, fmt.Errorf("wrong metric pattern %q: %w", name, err)
+	}
+	if !hasLabels {
+		return name, nil, nil
+	}
+	if !strings.HasSuffix(rest, "}") {
+		return "", nil, fmt.Errorf("labels of %s must end with }", name)
+	}
+	labels := make(models.Labels)
+	for _, pair := range strings.Split(strings.TrimSuffix(rest, "}"), ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.Trim(strings.TrimSpace(v), `"`)
+		if !ok || k == "" {
+			return "", nil, fmt.Errorf("labels of %s must be in format key=value", name)
+		}
+		labels[k] = v
+	}
+	return name, labels, nil
+}
+
+// parseValue - порог с необязательной единицей, например 500MB или 90%
+func parseValue(s string) (float64, error) {
+	i := len(s)
+	for i > 0 && (s[i-1] == '%' || s[i-1] >= 'A' && s[i-1] <= 'Z' || s[i-1] >= 'a' && s[i-1] <= 'z') {
+		i--
+	}
+	multiplier, ok := units[s[i:]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", s[i:])
+	}
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("wrong threshold %q", s)
+	}
+	return v * multiplier, nil
+}
+
+// match - подходит ли метрика под имя и метки условия
+func (c *condition) match(m *models.Metrics) bool {
+	if ok, _ := path.Match(c.metric, m.ID); !ok {
+		return false
+	}
+	return m.Labels.Match(c.selector)
+}
+
+// test - выполняется ли условие для значения v
+func (c *condition) test(v float64) bool {
+	switch c.op {
+	case "<":
+		return v < c.value
+	case "<=":
+		return v <= c.value
+	case ">":
+		return v > c.value
+	case ">=":
+		return v >= c.value
+	case "==":
+		return v == c.value
+	default:
+		return v != c.value
+	}
+}
+
+// valueOf - числовое значение метрики: значение gauge или накопленная сумма counter.
+// у гистограмм числового значения нет
+func valueOf(m *models.Metrics) (float64, bool) {
+	switch {
+	case m.MType == models.GAUGE && m.Value != nil:
+		return *m.Value, true
+	case m.MType == models.COUNTER && m.Delta != nil:
+		return float64(*m.Delta), true
+	}
+	return 0, false
+}
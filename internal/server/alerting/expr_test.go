@@ -0,0 +1,68 @@
+package alerting
+
+import (
+	"testing"
+	"time"
+	"yametrics/internal/server/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExpr(t *testing.T) {
+	tests := []struct {
+		expr string
+		want condition
+	}{
+		{"FreeMemory < 500MB for 2m", condition{metric: "FreeMemory", op: "<", value: 500 << 20, hold: 2 * time.Minute}},
+		{"CPUutilization1 > 90", condition{metric: "CPUutilization1", op: ">", value: 90}},
+		{"CPUutilization* >= 90%", condition{metric: "CPUutilization*", op: ">=", value: 90}},
+		{"PollCount{host=web, env=\"prod\"}!=0 for 30s", condition{metric: "PollCount", selector: models.Labels{"host": "web", "env": "prod"}, op: "!=", value: 0, hold: 30 * time.Second}},
+		{"GCCPUFraction <= 0.5", condition{metric: "GCCPUFraction", op: "<=", value: 0.5}},
+		{"Alloc == -1.5e3", condition{metric: "Alloc", op: "==", value: -1500}},
+		{"Latency{path=/a<b} > 1", condition{metric: "Latency", selector: models.Labels{"path": "/a<b"}, op: ">", value: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			c, err := parseExpr(tt.expr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *c)
+		})
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, expr := range []string{
+		"FreeMemory",
+		"< 5",
+		"Free Memory < 5",
+		"Alloc[ < 5",
+		"Alloc{host} > 1",
+		"Alloc{host=web > 1",
+		"Alloc > ",
+		"Alloc > five",
+		"Alloc > 5XB",
+		"Alloc > 5 for",
+		"Alloc > 5 for ever",
+		"Alloc > 5 during 2m",
+		"Alloc > 5 for -2m",
+	} {
+		_, err := parseExpr(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestConditionTest(t *testing.T) {
+	ops := map[string][3]bool{
+		"<":  {true, false, false},
+		"<=": {true, true, false},
+		">":  {false, false, true},
+		">=": {false, true, true},
+		"==": {false, true, false},
+		"!=": {true, false, true},
+	}
+	for op, want := range ops {
+		c := condition{op: op, value: 10}
+		assert.Equal(t, want, [3]bool{c.test(5), c.test(10), c.test(15)}, op)
+	}
+}
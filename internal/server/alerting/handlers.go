@@ -0,0 +1,52 @@
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi"
+)
+
+// Routes - регистрация обработчиков состояния оповещений и перезагрузки правил
+func (e *Engine) Routes(r chi.Router) {
+	r.Route("/alerts", func(r chi.Router) {
+		r.Get("/", e.List)
+		r.Get("/rules", e.ListRules)
+		r.Post("/reload", e.HandleReload)
+	})
+}
+
+// List - оповещения: GET /alerts?state=pending|firing|resolved
+func (e *Engine) List(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", StatePending, StateFiring, StateResolved:
+	default:
+		http.Error(w, fmt.Sprintf("wrong state %s", state), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, e.Alerts(state))
+}
+
+// ListRules - действующие правила: GET /alerts/rules
+func (e *Engine) ListRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, e.Rules())
+}
+
+// HandleReload - перечитывание правил из файла конфигурации: POST /alerts/reload.
+// если новые правила содержат ошибку, продолжают действовать прежние
+func (e *Engine) HandleReload(w http.ResponseWriter, r *http.Request) {
+	if err := e.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, e.Rules())
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
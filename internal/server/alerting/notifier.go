@@ -0,0 +1,108 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"yametrics/internal/metricscrypto"
+	"yametrics/internal/server/webhook"
+
+	"go.uber.org/zap"
+)
+
+// notifyTimeout - время на отправку одного оповещения
+const notifyTimeout = 10 * time.Second
+
+// Notifier - получатель сообщений о переходе оповещения в firing или resolved
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// newNotifier - оповещатель по настройкам, настройки должны быть проверены заранее
+func newNotifier(cfg NotifierConfig, logger *zap.SugaredLogger) Notifier {
+	switch cfg.Type {
+	case NotifierWebhook:
+		return &webhookNotifier{url: cfg.URL, secret: cfg.Secret, client: &http.Client{Timeout: notifyTimeout}}
+	case NotifierFile:
+		return &fileNotifier{path: cfg.Path}
+	default:
+		return &logNotifier{logger: logger}
+	}
+}
+
+// logNotifier - запись оповещений в журнал сервера
+type logNotifier struct {
+	logger *zap.SugaredLogger
+}
+
+func (n *logNotifier) Notify(_ context.Context, a Alert) error {
+	if a.State == StateFiring {
+		n.logger.Warnf("alert %s firing: %s%v = %v (%s)", a.Rule, a.Metric, a.Labels, a.Value, a.Expr)
+	} else {
+		n.logger.Infof("alert %s resolved: %s%v = %v (%s)", a.Rule, a.Metric, a.Labels, a.Value, a.Expr)
+	}
+	return nil
+}
+
+// webhookNotifier - отправка оповещения json-запросом POST.
+// подпись тела передается в том же заголовке и формате, что и у уведомлений об обновлении метрик
+type webhookNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		req.Header.Set(webhook.SignatureHeader, "sha256="+metricscrypto.GetSign(body, n.secret))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// fileNotifier - оповещения дописываются в файл по одному json в строке
+type fileNotifier struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func (n *fileNotifier) Notify(_ context.Context, a Alert) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	f, err := os.OpenFile(n.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,128 @@
+// Package anomaly - поиск аномальных значений gauge по статистике самих метрик.
+// для каждой метрики по приходящим значениям поддерживается базовая линия: экспоненциальное
+// скользящее среднее и дисперсия (метод zscore) или медиана и медианное абсолютное отклонение
+// по окну последних значений (метод mad). значение, отклонение которого от базовой линии больше порога,
+// считается аномалией. базовые линии сохраняются в хранилище и переживают перезапуск сервера
+package anomaly
+
+import (
+	"fmt"
+	"path"
+	"time"
+	"yametrics/internal/durationextension"
+)
+
+// методы поиска аномалий
+const (
+	// MethodZScore - отклонение от экспоненциального скользящего среднего в стандартных отклонениях
+	MethodZScore = "zscore"
+	// MethodMAD - отклонение от медианы окна в медианных абсолютных отклонениях (модифицированный z-score),
+	// устойчив к выбросам в самом окне
+	MethodMAD = "mad"
+)
+
+const (
+	// DefaultAlpha - вес нового значения в скользящем среднем
+	DefaultAlpha = 0.1
+	// DefaultZScoreThreshold - порог z-score
+	DefaultZScoreThreshold = 3
+	// DefaultMADThreshold - порог модифицированного z-score
+	DefaultMADThreshold = 3.5
+	// DefaultWindow - число последних значений для метода mad
+	DefaultWindow = 60
+	// DefaultMinSamples - число значений, после которого базовая линия считается готовой
+	DefaultMinSamples = 30
+	// DefaultHistorySize - число последних аномалий, которые отдает /anomalies
+	DefaultHistorySize = 1000
+	// DefaultSaveInterval - период сохранения базовых линий в хранилище
+	DefaultSaveInterval = time.Minute
+	// maxWindow - предел окна, чтобы состояние оставалось небольшим
+	maxWindow = 10000
+)
+
+// Rule - чувствительность для метрик, имена которых подходят под шаблон
+type Rule struct {
+	// Pattern - шаблон имени метрики в формате path.Match
+	Pattern string `json:"pattern"`
+	// Method - zscore (по умолчанию) или mad
+	Method string `json:"method"`
+	// Threshold - порог отклонения, чем он больше, тем реже срабатывает поиск
+	Threshold float64 `json:"threshold"`
+	// Alpha - вес нового значения в скользящем среднем метода zscore, от 0 до 1
+	Alpha float64 `json:"alpha"`
+	// Window - число последних значений метода mad
+	Window int `json:"window"`
+	// MinSamples - до этого числа значений аномалии не ищутся
+	MinSamples int `json:"min_samples"`
+}
+
+// Config - правила поиска аномалий, для метрики применяется первое подходящее.
+// метрики, для которых правила нет, не проверяются
+type Config struct {
+	Rules        []Rule                     `json:"rules"`
+	HistorySize  int                        `json:"history_size"`
+	SaveInterval durationextension.Duration `json:"save_interval"`
+}
+
+// Enabled - задано ли хотя бы одно правило
+func (c *Config) Enabled() bool {
+	return len(c.Rules) > 0
+}
+
+// Validate - проверка шаблонов и параметров правил
+func (c *Config) Validate() error {
+	for _, r := range c.Rules {
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("anomaly rule %s: %w", r.Pattern, err)
+		}
+		if r.Method != "" && r.Method != MethodZScore && r.Method != MethodMAD {
+			return fmt.Errorf("anomaly rule %s: unknown method %q, expected zscore or mad", r.Pattern, r.Method)
+		}
+		if r.Alpha < 0 || r.Alpha > 1 {
+			return fmt.Errorf("anomaly rule %s: alpha must be in [0, 1]", r.Pattern)
+		}
+		if r.Threshold < 0 || r.MinSamples < 0 {
+			return fmt.Errorf("anomaly rule %s: threshold and min_samples must be non-negative", r.Pattern)
+		}
+		if r.Window < 0 || r.Window > maxWindow {
+			return fmt.Errorf("anomaly rule %s: window must be in [0, %d]", r.Pattern, maxWindow)
+		}
+	}
+	if c.HistorySize < 0 {
+		return fmt.Errorf("anomaly history size must be non-negative")
+	}
+	return nil
+}
+
+// Match - правило для метрики с именем id, nil если ни одно не подходит
+func (c *Config) Match(id string) *Rule {
+	for i := range c.Rules {
+		if ok, _ := path.Match(c.Rules[i].Pattern, id); ok {
+			return &c.Rules[i]
+		}
+	}
+	return nil
+}
+
+// withDefaults - правило, в котором незаданные параметры заменены значениями по умолчанию
+func (r Rule) withDefaults() Rule {
+	if r.Method == "" {
+		r.Method = MethodZScore
+	}
+	if r.Threshold == 0 {
+		r.Threshold = DefaultZScoreThreshold
+		if r.Method == MethodMAD {
+			r.Threshold = DefaultMADThreshold
+		}
+	}
+	if r.Alpha == 0 {
+		r.Alpha = DefaultAlpha
+	}
+	if r.Window == 0 {
+		r.Window = DefaultWindow
+	}
+	if r.MinSamples == 0 {
+		r.MinSamples = DefaultMinSamples
+	}
+	return r
+}
@@ -0,0 +1,402 @@
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"yametrics/internal/server/models"
+
+	"go.uber.org/zap"
+)
+
+// stateName - имя состояния базовых линий в хранилище
+const stateName = "anomaly"
+
+// madScale - множитель модифицированного z-score: для нормального распределения
+// медианное абсолютное отклонение равно 0.6745 стандартного
+const madScale = 0.6745
+
+// Store - хранилище служебного состояния, в котором базовые линии переживают перезапуск сервера
+type Store interface {
+	LoadState(name string) ([]byte, error)
+	SaveState(name string, data []byte) error
+}
+
+// Anomaly - аномальное значение метрики
+type Anomaly struct {
+	Metric string            `json:"metric"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+	// Expected - среднее (zscore) или медиана (mad) до этого значения
+	Expected float64 `json:"expected"`
+	// Deviation - стандартное (zscore) или медианное абсолютное (mad) отклонение до этого значения
+	Deviation float64   `json:"deviation"`
+	Score     float64   `json:"score"` // отклонение значения, со знаком
+	Method    string    `json:"method"`
+	Threshold float64   `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+// Baseline - текущая базовая линия метрики
+type Baseline struct {
+	Metric    string            `json:"metric"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Method    string            `json:"method"`
+	Samples   int               `json:"samples"`
+	Expected  float64           `json:"expected"`
+	Deviation float64           `json:"deviation"`
+	// Ready - набрано ли достаточно значений для поиска аномалий
+	Ready bool `json:"ready"`
+}
+
+// baseline - состояние метрики, сохраняется в хранилище.
+// для zscore используются Mean и Variance, для mad - Window
+type baseline struct {
+	ID       string        `json:"id"`
+	Labels   models.Labels `json:"labels,omitempty"`
+	Count    int           `json:"count"`
+	Mean     float64       `json:"mean"`
+	Variance float64       `json:"variance"`
+	Window   []float64     `json:"window,omitempty"`
+}
+
+// estimate - ожидаемое значение и отклонение по правилу r, ok = false - базовая линия не готова
+func (b *baseline) estimate(r *Rule) (expected float64, deviation float64, ok bool) {
+	if r.Method == MethodMAD {
+		if len(b.Window) < 3 {
+			return 0, 0, false
+		}
+		expected = median(b.Window)
+		deviations := make([]float64, len(b.Window))
+		for i, v := range b.Window {
+			deviations[i] = math.Abs(v - expected)
+		}
+		deviation = median(deviations)
+	} else {
+		if b.Count == 0 {
+			return 0, 0, false
+		}
+		expected, deviation = b.Mean, math.Sqrt(b.Variance)
+	}
+	// при нулевом отклонении любое изменение бесконечно далеко от базовой линии, такие метрики не проверяются
+	return expected, deviation, b.Count >= r.MinSamples && deviation > 0
+}
+
+// add - учет нового значения в базовой линии
+func (b *baseline) add(r *Rule, v float64) {
+	if r.Method == MethodMAD {
+		b.Window = append(b.Window, v)
+		if len(b.Window) > r.Window {
+			b.Window = append([]float64(nil), b.Window[len(b.Window)-r.Window:]...)
+		}
+	} else if b.Count == 0 {
+		b.Mean, b.Variance = v, 0
+	} else {
+		// экспоненциально взвешенные среднее и дисперсия
+		diff := v - b.Mean
+		b.Mean += r.Alpha * diff
+		b.Variance = (1 - r.Alpha) * (b.Variance + r.Alpha*diff*diff)
+	}
+	b.Count++
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Subscription - подписка на найденные аномалии. если подписчик не успевает читать,
+// новые аномалии для него отбрасываются
+type Subscription struct {
+	detector *Detector
+	events   chan Anomaly
+	once     sync.Once
+}
+
+// Events - канал аномалий, закрывается при закрытии подписки
+func (s *Subscription) Events() <-chan Anomaly {
+	return s.events
+}
+
+// Close - отписка
+func (s *Subscription) Close() {
+	s.detector.mutex.Lock()
+	defer s.detector.mutex.Unlock()
+	s.once.Do(func() {
+		delete(s.detector.subs, s)
+		close(s.events)
+	})
+}
+
+// Detector - базовые линии метрик и найденные аномалии
+type Detector struct {
+	cfg    Config
+	rules  []Rule
+	store  Store
+	logger *zap.SugaredLogger
+
+	// mutex - защищает baselines, history, subs и dirty
+	mutex     sync.Mutex
+	baselines map[string]*baseline
+	history   []Anomaly
+	next      int
+	full      bool
+	subs      map[*Subscription]struct{}
+	dirty     bool
+	saveMutex sync.Mutex
+}
+
+// NewDetector - создание поиска аномалий по правилам cfg с загрузкой базовых линий из store.
+// store может быть nil, тогда базовые линии не сохраняются
+func NewDetector(cfg *Config, store Store, logger *zap.SugaredLogger) (*Detector, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	d := &Detector{
+		cfg:       *cfg,
+		rules:     make([]Rule, len(cfg.Rules)),
+		store:     store,
+		logger:    logger,
+		baselines: make(map[string]*baseline),
+		subs:      make(map[*Subscription]struct{}),
+	}
+	for i, r := range cfg.Rules {
+		d.rules[i] = r.withDefaults()
+	}
+	historySize := cfg.HistorySize
+	if historySize == 0 {
+		historySize = DefaultHistorySize
+	}
+	d.history = make([]Anomaly, historySize)
+	if store == nil {
+		return d, nil
+	}
+	data, err := store.LoadState(stateName)
+	if err != nil || len(data) == 0 {
+		return d, err
+	}
+	var saved map[string]*baseline
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for key, b := range saved {
+		// правила могли измениться после сохранения
+		r := d.match(b.ID)
+		if r == nil {
+			continue
+		}
+		if len(b.Window) > r.Window {
+			b.Window = b.Window[len(b.Window)-r.Window:]
+		}
+		d.baselines[key] = b
+	}
+	return d, nil
+}
+
+// Patterns - шаблоны имен метрик, значения которых нужно передавать в Observe
+func (d *Detector) Patterns() []string {
+	patterns := make([]string, len(d.rules))
+	for i, r := range d.rules {
+		patterns[i] = r.Pattern
+	}
+	return patterns
+}
+
+func (d *Detector) match(id string) *Rule {
+	for i := range d.rules {
+		if ok, _ := path.Match(d.rules[i].Pattern, id); ok {
+			return &d.rules[i]
+		}
+	}
+	return nil
+}
+
+// Observe - проверка нового значения gauge по базовой линии и учет его в ней.
+// возвращает аномалию или nil
+func (d *Detector) Observe(m models.Metrics, at time.Time) *Anomaly {
+	if m.MType != models.GAUGE || m.Value == nil || math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+		return nil
+	}
+	r := d.match(m.ID)
+	if r == nil {
+		return nil
+	}
+	v := *m.Value
+	key := m.Key()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	b, ok := d.baselines[key]
+	if !ok {
+		b = &baseline{ID: m.ID, Labels: m.Labels}
+		d.baselines[key] = b
+	}
+	expected, deviation, ready := b.estimate(r)
+	b.add(r, v)
+	d.dirty = true
+	if !ready {
+		return nil
+	}
+	score := (v - expected) / deviation
+	if r.Method == MethodMAD {
+		score *= madScale
+	}
+	if math.Abs(score) <= r.Threshold {
+		return nil
+	}
+	a := Anomaly{
+		Metric:    m.ID,
+		Labels:    m.Labels,
+		Value:     v,
+		Expected:  expected,
+		Deviation: deviation,
+		Score:     score,
+		Method:    r.Method,
+		Threshold: r.Threshold,
+		Time:      at,
+	}
+	d.history[d.next] = a
+	d.next = (d.next + 1) % len(d.history)
+	if d.next == 0 {
+		d.full = true
+	}
+	for s := range d.subs {
+		select {
+		case s.events <- a:
+		default:
+		}
+	}
+	return &a
+}
+
+// Subscribe - подписка на аномалии с буфером на size событий
+func (d *Detector) Subscribe(size int) *Subscription {
+	s := &Subscription{detector: d, events: make(chan Anomaly, size)}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.subs[s] = struct{}{}
+	return s
+}
+
+// Anomalies - не больше limit последних аномалий от новых к старым, начиная с since,
+// для метрик, имена которых подходят под шаблон pattern (пустой - любые), а метки содержат selector
+func (d *Detector) Anomalies(pattern string, selector models.Labels, since time.Time, limit int) []Anomaly {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	n := d.next
+	if d.full {
+		n = len(d.history)
+	}
+	result := make([]Anomaly, 0)
+	for i := 1; i <= n && len(result) < limit; i++ {
+		a := d.history[(d.next-i+len(d.history))%len(d.history)]
+		if a.Time.Before(since) {
+			continue
+		}
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, a.Metric); !ok {
+				continue
+			}
+		}
+		if models.Labels(a.Labels).Match(selector) {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// Baselines - базовые линии метрик, имена которых подходят под шаблон pattern (пустой - любые),
+// упорядоченные по имени и меткам
+func (d *Detector) Baselines(pattern string) []Baseline {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	result := make([]Baseline, 0)
+	for _, b := range d.baselines {
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, b.ID); !ok {
+				continue
+			}
+		}
+		r := d.match(b.ID)
+		if r == nil {
+			continue
+		}
+		expected, deviation, ready := b.estimate(r)
+		result = append(result, Baseline{
+			Metric:    b.ID,
+			Labels:    b.Labels,
+			Method:    r.Method,
+			Samples:   b.Count,
+			Expected:  expected,
+			Deviation: deviation,
+			Ready:     ready,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Metric != result[j].Metric {
+			return result[i].Metric < result[j].Metric
+		}
+		return models.Labels(result[i].Labels).String() < models.Labels(result[j].Labels).String()
+	})
+	return result
+}
+
+// Save - сохранение базовых линий в хранилище, если они изменились с прошлого сохранения
+func (d *Detector) Save() error {
+	if d.store == nil {
+		return nil
+	}
+	d.saveMutex.Lock()
+	defer d.saveMutex.Unlock()
+	d.mutex.Lock()
+	if !d.dirty {
+		d.mutex.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(d.baselines)
+	d.dirty = false
+	d.mutex.Unlock()
+
+	if err == nil {
+		err = d.store.SaveState(stateName, data)
+	}
+	if err != nil {
+		d.mutex.Lock()
+		d.dirty = true
+		d.mutex.Unlock()
+	}
+	return err
+}
+
+// Run - периодическое сохранение базовых линий до остановки ctx.
+// последнее сохранение при остановке делает вызывающий через Save, пока хранилище еще открыто
+func (d *Detector) Run(ctx context.Context) {
+	interval := d.cfg.SaveInterval.Duration
+	if interval <= 0 {
+		interval = DefaultSaveInterval
+	}
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.Save(); err != nil {
+				d.logger.Errorf("error on save anomaly baselines: %v", err)
+			}
+
+		case <-ctx.Done():
+			ticker.Stop()
+			d.logger.Info("stop anomaly baselines job")
+			return
+		}
+	}
+}
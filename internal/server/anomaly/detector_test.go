@@ -0,0 +1,208 @@
+package anomaly
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"yametrics/internal/server/models"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memoryStore - хранилище состояния в памяти
+type memoryStore map[string][]byte
+
+func (s memoryStore) LoadState(name string) ([]byte, error) {
+	return s[name], nil
+}
+
+func (s memoryStore) SaveState(name string, data []byte) error {
+	s[name] = data
+	return nil
+}
+
+func gauge(id string, v float64, labels models.Labels) models.Metrics {
+	return models.Metrics{ID: id, MType: models.GAUGE, Labels: labels, Value: &v}
+}
+
+// noisy - значение вокруг 100 с детерминированным шумом
+func noisy(i int) float64 {
+	return 100 + 5*math.Sin(float64(i))
+}
+
+func newDetector(t *testing.T, store Store, rules ...Rule) *Detector {
+	d, err := NewDetector(&Config{Rules: rules}, store, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return d
+}
+
+func TestDetect(t *testing.T) {
+	for _, method := range []string{MethodZScore, MethodMAD} {
+		t.Run(method, func(t *testing.T) {
+			d := newDetector(t, nil, Rule{Pattern: "Heap*", Method: method, MinSamples: 20})
+			at := time.Now()
+			// до набора MinSamples значений аномалии не ищутся
+			assert.Nil(t, d.Observe(gauge("HeapAlloc", 100, nil), at))
+			assert.Nil(t, d.Observe(gauge("HeapAlloc", 1000, nil), at))
+			for i := 0; i < 50; i++ {
+				assert.Nil(t, d.Observe(gauge("HeapAlloc", noisy(i), nil), at), i)
+			}
+
+			a := d.Observe(gauge("HeapAlloc", 200, nil), at)
+			require.NotNil(t, a)
+			assert.Equal(t, method, a.Method)
+			assert.Equal(t, 200.0, a.Value)
+			assert.InDelta(t, 100, a.Expected, 10)
+			assert.Greater(t, a.Score, a.Threshold)
+			assert.Less(t, d.Observe(gauge("HeapAlloc", 0, nil), at).Score, -a.Threshold)
+
+			// метрики без правила, не gauge и нечисловые значения не проверяются
+			assert.Nil(t, d.Observe(gauge("Alloc", 1e9, nil), at))
+			assert.Nil(t, d.Observe(gauge("HeapAlloc", math.NaN(), nil), at))
+			delta := int64(1e9)
+			assert.Nil(t, d.Observe(models.Metrics{ID: "HeapAlloc", MType: models.COUNTER, Delta: &delta}, at))
+			assert.Len(t, d.Anomalies("", nil, time.Time{}, 10), 2)
+		})
+	}
+}
+
+func TestDetectConstant(t *testing.T) {
+	d := newDetector(t, nil, Rule{Pattern: "*", MinSamples: 5})
+	for i := 0; i < 10; i++ {
+		d.Observe(gauge("NumGC", 7, nil), time.Now())
+	}
+	baselines := d.Baselines("")
+	require.Len(t, baselines, 1)
+	assert.False(t, baselines[0].Ready)
+	assert.Equal(t, 10, baselines[0].Samples)
+	// у постоянной метрики нулевое отклонение, с ним изменение нельзя оценить
+	assert.Nil(t, d.Observe(gauge("NumGC", 8, nil), time.Now()))
+	assert.True(t, d.Baselines("")[0].Ready)
+}
+
+func TestMADWindow(t *testing.T) {
+	b := &baseline{}
+	r := Rule{Method: MethodMAD, Window: 5, MinSamples: 1}
+	for _, v := range []float64{1, 2, 3, 100, 4, 5, 6} {
+		b.add(&r, v)
+	}
+	assert.Equal(t, []float64{3, 100, 4, 5, 6}, b.Window)
+	expected, deviation, ready := b.estimate(&r)
+	assert.True(t, ready)
+	assert.Equal(t, 5.0, expected, "outlier does not move median")
+	assert.Equal(t, 1.0, deviation)
+}
+
+func TestSubscribe(t *testing.T) {
+	d := newDetector(t, nil, Rule{Pattern: "*", MinSamples: 10})
+	sub := d.Subscribe(1)
+	for i := 0; i < 30; i++ {
+		d.Observe(gauge("Alloc", noisy(i), models.Labels{"host": "web"}), time.Now())
+	}
+	d.Observe(gauge("Alloc", 500, models.Labels{"host": "web"}), time.Now())
+	// буфер заполнен, вторая аномалия подписчику не достается
+	d.Observe(gauge("Alloc", 600, models.Labels{"host": "web"}), time.Now())
+	a := <-sub.Events()
+	assert.Equal(t, 500.0, a.Value)
+	assert.Equal(t, map[string]string{"host": "web"}, a.Labels)
+	sub.Close()
+	sub.Close()
+	_, ok := <-sub.Events()
+	assert.False(t, ok)
+	assert.Len(t, d.Anomalies("", nil, time.Time{}, 10), 2)
+}
+
+func TestPersistence(t *testing.T) {
+	store := memoryStore{}
+	d := newDetector(t, store, Rule{Pattern: "Heap*", MinSamples: 20}, Rule{Pattern: "Stack*", Method: MethodMAD, Window: 10})
+	for i := 0; i < 30; i++ {
+		d.Observe(gauge("HeapAlloc", noisy(i), nil), time.Now())
+		d.Observe(gauge("StackInuse", noisy(i), nil), time.Now())
+	}
+	require.NoError(t, d.Save())
+	before := d.Baselines("")
+
+	// после перезапуска базовая линия готова сразу
+	restored := newDetector(t, store, Rule{Pattern: "Heap*", MinSamples: 20}, Rule{Pattern: "Stack*", Method: MethodMAD, Window: 10})
+	assert.Equal(t, before, restored.Baselines(""))
+	assert.NotNil(t, restored.Observe(gauge("HeapAlloc", 500, nil), time.Now()))
+
+	// базовые линии метрик без правила не загружаются, окно обрезается под новое правило
+	restored = newDetector(t, store, Rule{Pattern: "Stack*", Method: MethodMAD, Window: 4})
+	baselines := restored.Baselines("")
+	require.Len(t, baselines, 1)
+	assert.Equal(t, "StackInuse", baselines[0].Metric)
+	assert.Len(t, restored.baselines[models.MetricKey("StackInuse", nil)].Window, 4)
+
+	// без изменений состояние не сохраняется повторно
+	delete(store, stateName)
+	require.NoError(t, restored.Save())
+	assert.Empty(t, store)
+}
+
+func TestValidate(t *testing.T) {
+	for _, cfg := range []Config{
+		{Rules: []Rule{{Pattern: "a["}}},
+		{Rules: []Rule{{Pattern: "*", Method: "iqr"}}},
+		{Rules: []Rule{{Pattern: "*", Alpha: 2}}},
+		{Rules: []Rule{{Pattern: "*", Threshold: -1}}},
+		{Rules: []Rule{{Pattern: "*", Window: maxWindow + 1}}},
+		{HistorySize: -1},
+	} {
+		assert.Error(t, cfg.Validate(), cfg)
+	}
+	assert.NoError(t, (&Config{Rules: []Rule{{Pattern: "*", Method: MethodMAD, Threshold: 5, Window: 100}}}).Validate())
+}
+
+func TestHandlers(t *testing.T) {
+	d := newDetector(t, nil, Rule{Pattern: "*", MinSamples: 10})
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, host := range []string{"web", "db"} {
+		labels := models.Labels{"host": host}
+		for i := 0; i < 30; i++ {
+			d.Observe(gauge("HeapAlloc", noisy(i), labels), start)
+		}
+		d.Observe(gauge("HeapAlloc", 500, labels), start.Add(time.Minute))
+	}
+
+	r := chi.NewRouter()
+	d.Routes(r)
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	var anomalies []Anomaly
+	w := get("/anomalies?name=Heap*&label=host:db")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &anomalies))
+	require.Len(t, anomalies, 1)
+	assert.Equal(t, "db", anomalies[0].Labels["host"])
+
+	w = get("/anomalies?limit=1")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &anomalies))
+	require.Len(t, anomalies, 1)
+	assert.Equal(t, "db", anomalies[0].Labels["host"], "newest first")
+
+	w = get("/anomalies?since=2024-05-01T10:02:00Z")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &anomalies))
+	assert.Empty(t, anomalies)
+
+	var baselines []Baseline
+	w = get("/anomalies/baselines?name=HeapAlloc")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &baselines))
+	require.Len(t, baselines, 2)
+	assert.Equal(t, "db", baselines[0].Labels["host"])
+	assert.True(t, baselines[0].Ready)
+
+	for _, url := range []string{"/anomalies?name=a[", "/anomalies?label=host", "/anomalies?since=yesterday", "/anomalies?limit=-1", "/anomalies/baselines?name=a["} {
+		assert.Equal(t, http.StatusBadRequest, get(url).Code, url)
+	}
+}
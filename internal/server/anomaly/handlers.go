@@ -0,0 +1,81 @@
+package anomaly
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"yametrics/internal/server/models"
+
+	"github.com/go-chi/chi"
+)
+
+// defaultLimit - число аномалий в ответе, если limit не задан
+const defaultLimit = 100
+
+// Routes - регистрация обработчиков списка аномалий и базовых линий
+func (d *Detector) Routes(r chi.Router) {
+	r.Route("/anomalies", func(r chi.Router) {
+		r.Get("/", d.List)
+		r.Get("/baselines", d.ListBaselines)
+	})
+}
+
+// List - последние аномалии: GET /anomalies?name=&label=key:value&since=&limit=.
+// name - имя или шаблон path.Match, since - время в формате RFC 3339
+func (d *Detector) List(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	if _, err := path.Match(name, ""); err != nil {
+		http.Error(w, "param `name` must be a name or pattern", http.StatusBadRequest)
+		return
+	}
+	var selector models.Labels
+	for _, l := range query["label"] {
+		k, v, ok := strings.Cut(l, ":")
+		if !ok || k == "" {
+			http.Error(w, "param `label` must be in format key:value", http.StatusBadRequest)
+			return
+		}
+		if selector == nil {
+			selector = make(models.Labels)
+		}
+		selector[k] = v
+	}
+	var since time.Time
+	if v := query.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "param `since` must be in RFC 3339 format", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "param `limit` must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, d.Anomalies(name, selector, since, limit))
+}
+
+// ListBaselines - базовые линии: GET /anomalies/baselines?name=
+func (d *Detector) ListBaselines(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if _, err := path.Match(name, ""); err != nil {
+		http.Error(w, "param `name` must be a name or pattern", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, d.Baselines(name))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
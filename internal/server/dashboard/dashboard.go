@@ -0,0 +1,93 @@
+// Package dashboard - веб-интерфейс сервера: таблица метрик и страница метрики.
+// страницы и статические файлы встроены в бинарный файл, данные страницы получают из json api сервера
+// (/values, /value, /history) и периодически обновляют
+package dashboard
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+)
+
+//go:embed web
+var files embed.FS
+
+// templates - шаблоны страниц разбираются один раз при запуске
+var templates = template.Must(template.ParseFS(files, "web/*.html"))
+
+// metricTypes - типы метрик, для которых есть страница метрики
+var metricTypes = map[string]bool{"gauge": true, "counter": true, "histogram": true}
+
+// Dashboard - обработчики страниц
+type Dashboard struct {
+	logger *zap.SugaredLogger
+	units  unitsConfig
+	static http.Handler
+}
+
+func New(logger *zap.SugaredLogger) *Dashboard {
+	static, _ := fs.Sub(files, "web/static")
+	return &Dashboard{
+		logger: logger,
+		units:  newUnitsConfig(),
+		static: http.StripPrefix("/dashboard/static/", http.FileServer(http.FS(static))),
+	}
+}
+
+// Routes - подключение страниц: / - таблица метрик, /dashboard/metric/{type}/{name} - страница метрики,
+// /dashboard/static/ - скрипты и стили
+func (d *Dashboard) Routes(r chi.Router) {
+	r.Get("/", d.Index)
+	r.Get("/dashboard/metric/{type}/{name}", d.Metric)
+	r.Handle("/dashboard/static/*", d.static)
+}
+
+// Index - таблица метрик по типам с поиском и сортировкой.
+// метки из запроса (/?label=host:web-1) ограничивают выборку
+func (d *Dashboard) Index(w http.ResponseWriter, r *http.Request) {
+	labels := append([]string{}, r.URL.Query()["label"]...)
+	for _, l := range labels {
+		if k, _, ok := strings.Cut(l, ":"); !ok || k == "" {
+			http.Error(w, "param `label` must be in format key:value", http.StatusBadRequest)
+			return
+		}
+	}
+	d.render(w, "index.html", map[string]any{"Units": d.units, "Labels": labels})
+}
+
+// Metric - текущее значение и история метрики: /dashboard/metric/{type}/{name}?label=key:value
+func (d *Dashboard) Metric(w http.ResponseWriter, r *http.Request) {
+	mtype := chi.URLParam(r, "type")
+	if !metricTypes[mtype] {
+		http.NotFound(w, r)
+		return
+	}
+	labels := make(map[string]string)
+	for _, l := range r.URL.Query()["label"] {
+		k, v, ok := strings.Cut(l, ":")
+		if !ok || k == "" {
+			http.Error(w, "param `label` must be in format key:value", http.StatusBadRequest)
+			return
+		}
+		labels[k] = v
+	}
+	d.render(w, "metric.html", map[string]any{
+		"Units":  d.units,
+		"ID":     chi.URLParam(r, "name"),
+		"Type":   mtype,
+		"Labels": labels,
+	})
+}
+
+func (d *Dashboard) render(w http.ResponseWriter, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := templates.ExecuteTemplate(w, name, data); err != nil {
+		d.logger.Errorf("error on render %s: %v", name, err)
+	}
+}
@@ -0,0 +1,62 @@
+package dashboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestDashboard(t *testing.T) {
+	r := chi.NewRouter()
+	New(zap.NewNop().Sugar()).Routes(r)
+
+	tests := []struct {
+		name        string
+		url         string
+		code        int
+		contentType string
+		contains    []string
+		excludes    []string
+	}{
+		{"index", "/", 200, "text/html; charset=utf-8", []string{`"HeapAlloc":"bytes"`, `/dashboard/static/index.js`, `const LABELS = [];`}, nil},
+		{"index with labels", "/?label=host:web", 200, "text/html; charset=utf-8", []string{`const LABELS = ["host:web"];`}, nil},
+		{"index wrong label", "/?label=host", 400, "", nil, nil},
+		{"metric", "/dashboard/metric/gauge/Alloc?label=host:web", 200, "text/html; charset=utf-8",
+			[]string{`<title>Alloc - yametrics</title>`, `id: "Alloc"`, `labels: {"host":"web"}`, `host=web`}, nil},
+		{"metric name is escaped", "/dashboard/metric/gauge/%3Cscript%3E", 200, "text/html; charset=utf-8", []string{`&lt;script&gt;`}, []string{`<script>"`}},
+		{"metric unknown type", "/dashboard/metric/summary/Alloc", 404, "", nil, nil},
+		{"metric wrong label", "/dashboard/metric/gauge/Alloc?label=host", 400, "", nil, nil},
+		{"static", "/dashboard/static/format.js", 200, "text/javascript; charset=utf-8", []string{"function formatValue"}, nil},
+		{"static missing", "/dashboard/static/missing.js", 404, "", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			assert.Equal(t, tt.code, w.Code)
+			if tt.contentType != "" {
+				assert.Equal(t, tt.contentType, w.Header().Get("Content-Type"))
+			}
+			for _, c := range tt.contains {
+				assert.Contains(t, w.Body.String(), c)
+			}
+			for _, c := range tt.excludes {
+				assert.NotContains(t, w.Body.String(), c)
+			}
+		})
+	}
+}
+
+func TestUnit(t *testing.T) {
+	assert.Equal(t, UnitBytes, Unit("HeapAlloc"))
+	assert.Equal(t, UnitPercent, Unit("CPUutilization1"))
+	assert.Equal(t, UnitPercent, Unit("CPUutilization12"))
+	assert.Equal(t, UnitFraction, Unit("GCCPUFraction"))
+	assert.Equal(t, UnitTimestampNs, Unit("LastGC"))
+	assert.Equal(t, "", Unit("PollCount"))
+	assert.Equal(t, "", Unit("CPUutilization"))
+}
@@ -0,0 +1,64 @@
+package dashboard
+
+import "regexp"
+
+// единицы измерения значений, по ним страницы форматируют значения метрик
+const (
+	UnitBytes       = "bytes"
+	UnitPercent     = "percent"
+	UnitFraction    = "fraction"
+	UnitNanoseconds = "nanoseconds"
+	UnitTimestampNs = "timestamp_ns"
+)
+
+// knownUnits - единицы метрик, которые отправляет агент
+var knownUnits = map[string]string{
+	"Alloc":         UnitBytes,
+	"BuckHashSys":   UnitBytes,
+	"GCSys":         UnitBytes,
+	"HeapAlloc":     UnitBytes,
+	"HeapIdle":      UnitBytes,
+	"HeapInuse":     UnitBytes,
+	"HeapReleased":  UnitBytes,
+	"HeapSys":       UnitBytes,
+	"MCacheInuse":   UnitBytes,
+	"MCacheSys":     UnitBytes,
+	"MSpanInuse":    UnitBytes,
+	"MSpanSys":      UnitBytes,
+	"NextGC":        UnitBytes,
+	"OtherSys":      UnitBytes,
+	"StackInuse":    UnitBytes,
+	"StackSys":      UnitBytes,
+	"Sys":           UnitBytes,
+	"TotalAlloc":    UnitBytes,
+	"TotalMemory":   UnitBytes,
+	"FreeMemory":    UnitBytes,
+	"GCCPUFraction": UnitFraction,
+	"PauseTotalNs":  UnitNanoseconds,
+	"GCPauseNs":     UnitNanoseconds,
+	"LastGC":        UnitTimestampNs,
+}
+
+// cpuUtilization - загрузка процессоров в процентах: CPUutilization1, CPUutilization2 ...
+var cpuUtilization = regexp.MustCompile(`^CPUutilization\d+$`)
+
+// Unit - единица измерения метрики агента, пустая строка - единица неизвестна
+func Unit(id string) string {
+	if cpuUtilization.MatchString(id) {
+		return UnitPercent
+	}
+	return knownUnits[id]
+}
+
+// unitsConfig - единицы для скриптов страниц: по именам метрик и по регулярным выражениям для имен
+type unitsConfig struct {
+	Names    map[string]string `json:"names"`
+	Patterns [][2]string       `json:"patterns"`
+}
+
+func newUnitsConfig() unitsConfig {
+	return unitsConfig{
+		Names:    knownUnits,
+		Patterns: [][2]string{{cpuUtilization.String(), UnitPercent}},
+	}
+}
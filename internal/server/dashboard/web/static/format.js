@@ -0,0 +1,77 @@
+'use strict';
+
+// единица измерения метрики по имени
+function unitOf(id) {
+	if (UNITS.names[id]) {
+		return UNITS.names[id];
+	}
+	for (const [pattern, unit] of UNITS.patterns) {
+		if (new RegExp(pattern).test(id)) {
+			return unit;
+		}
+	}
+	return '';
+}
+
+function formatBytes(v) {
+	const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB', 'PiB'];
+	let i = 0;
+	while (Math.abs(v) >= 1024 && i < units.length - 1) {
+		v /= 1024;
+		i++;
+	}
+	return (i === 0 ? v.toString() : v.toFixed(2)) + ' ' + units[i];
+}
+
+function formatDuration(ns) {
+	const units = [['s', 1e9], ['ms', 1e6], ['µs', 1e3]];
+	for (const [unit, size] of units) {
+		if (Math.abs(ns) >= size) {
+			return (ns / size).toFixed(2) + ' ' + unit;
+		}
+	}
+	return ns + ' ns';
+}
+
+function formatNumber(v) {
+	if (Number.isInteger(v)) {
+		return v.toLocaleString('en-US');
+	}
+	return Number(v.toPrecision(6)).toString();
+}
+
+// formatValue - значение в единицах метрики id
+function formatValue(id, v) {
+	if (v === undefined || v === null) {
+		return '';
+	}
+	switch (unitOf(id)) {
+	case 'bytes':
+		return formatBytes(v);
+	case 'percent':
+		return v.toFixed(2) + ' %';
+	case 'fraction':
+		return (v * 100).toFixed(4) + ' %';
+	case 'nanoseconds':
+		return formatDuration(v);
+	case 'timestamp_ns':
+		return v > 0 ? new Date(v / 1e6).toISOString() : 'never';
+	}
+	return formatNumber(v);
+}
+
+// labelsText - метки в виде key=value через запятую, отсортированные по ключу
+function labelsText(labels) {
+	return Object.keys(labels || {}).sort().map(k => k + '=' + labels[k]).join(', ');
+}
+
+// labelsQuery - метки в виде параметров label=key:value
+function labelsQuery(labels) {
+	return Object.keys(labels || {}).sort().map(k => 'label=' + encodeURIComponent(k + ':' + labels[k])).join('&');
+}
+
+function setStatus(text, error) {
+	const status = document.getElementById('status');
+	status.textContent = text;
+	status.className = error ? 'error' : 'muted';
+}
@@ -0,0 +1,123 @@
+'use strict';
+
+const PAGE_SIZE = 1000;
+const state = {metrics: [], sort: {}, timer: null};
+
+// loadMetrics - все метрики постранично через /values
+async function loadMetrics() {
+	const metrics = [];
+	let cursor = '';
+	const labels = LABELS.map(l => '&label=' + encodeURIComponent(l)).join('');
+	do {
+		const response = await fetch('/values?limit=' + PAGE_SIZE + labels + (cursor ? '&cursor=' + cursor : ''));
+		if (!response.ok) {
+			throw new Error(response.status + ' ' + (await response.text()).trim());
+		}
+		const page = await response.json();
+		metrics.push(...page.metrics);
+		cursor = page.next || '';
+	} while (cursor);
+	return metrics;
+}
+
+function metricLink(m) {
+	const query = labelsQuery(m.labels);
+	const a = document.createElement('a');
+	a.href = '/dashboard/metric/' + encodeURIComponent(m.type) + '/' + encodeURIComponent(m.id) + (query ? '?' + query : '');
+	a.textContent = m.id;
+	return a;
+}
+
+// sortValue - значение для сортировки по колонке
+function sortValue(m, column) {
+	switch (column) {
+	case 'labels':
+		return labelsText(m.labels);
+	case 'value':
+		if (m.type === 'histogram') {
+			return m.histogram ? m.histogram.count : 0;
+		}
+		return m.type === 'counter' ? m.delta : m.value;
+	}
+	return m.id;
+}
+
+function cell(row, content, className) {
+	const td = row.insertCell();
+	if (content instanceof Node) {
+		td.appendChild(content);
+	} else {
+		td.textContent = content;
+	}
+	if (className) {
+		td.className = className;
+	}
+}
+
+function render() {
+	const search = document.getElementById('search').value.trim().toLowerCase();
+	for (const section of document.querySelectorAll('section[data-type]')) {
+		const type = section.dataset.type;
+		const sort = state.sort[type] || {column: 'id', desc: false};
+		const metrics = state.metrics
+			.filter(m => m.type === type)
+			.filter(m => !search || m.id.toLowerCase().includes(search) || labelsText(m.labels).toLowerCase().includes(search));
+		metrics.sort((a, b) => {
+			const x = sortValue(a, sort.column), y = sortValue(b, sort.column);
+			const c = x < y ? -1 : x > y ? 1 : 0;
+			return sort.desc ? -c : c;
+		});
+
+		const tbody = section.querySelector('tbody');
+		tbody.replaceChildren();
+		for (const m of metrics) {
+			const row = tbody.insertRow();
+			cell(row, metricLink(m));
+			cell(row, labelsText(m.labels), 'muted');
+			if (type === 'histogram') {
+				const h = m.histogram || {count: 0, sum: 0};
+				cell(row, formatNumber(h.count), 'number');
+				cell(row, formatValue(m.id, h.sum), 'number');
+				cell(row, h.count ? formatValue(m.id, h.sum / h.count) : '', 'number');
+			} else {
+				cell(row, formatValue(m.id, type === 'counter' ? m.delta : m.value), 'number');
+			}
+		}
+		section.querySelector('.count').textContent = '(' + metrics.length + ')';
+		section.hidden = metrics.length === 0 && !search;
+		for (const th of section.querySelectorAll('th[data-sort]')) {
+			th.className = th.dataset.sort === sort.column ? (sort.desc ? 'desc' : 'asc') : '';
+		}
+	}
+}
+
+async function refresh() {
+	try {
+		state.metrics = await loadMetrics();
+		setStatus('updated ' + new Date().toLocaleTimeString());
+		render();
+	} catch (e) {
+		setStatus('error: ' + e.message, true);
+	}
+}
+
+function schedule() {
+	clearInterval(state.timer);
+	if (document.getElementById('refresh').checked) {
+		state.timer = setInterval(refresh, Number(document.getElementById('interval').value));
+	}
+}
+
+for (const th of document.querySelectorAll('th[data-sort]')) {
+	th.addEventListener('click', () => {
+		const type = th.closest('section').dataset.type;
+		const sort = state.sort[type] || {column: 'id', desc: false};
+		state.sort[type] = {column: th.dataset.sort, desc: sort.column === th.dataset.sort && !sort.desc};
+		render();
+	});
+}
+document.getElementById('search').addEventListener('input', render);
+document.getElementById('refresh').addEventListener('change', schedule);
+document.getElementById('interval').addEventListener('change', schedule);
+refresh();
+schedule();
@@ -0,0 +1,120 @@
+'use strict';
+
+const REFRESH_INTERVAL = 10000;
+const state = {timer: null};
+
+async function loadValue() {
+	const response = await fetch('/value/', {
+		method: 'POST',
+		headers: {'Content-Type': 'application/json'},
+		body: JSON.stringify({id: METRIC.id, type: METRIC.type, labels: METRIC.labels}),
+	});
+	if (response.status === 404) {
+		return null;
+	}
+	if (!response.ok) {
+		throw new Error(response.status + ' ' + (await response.text()).trim());
+	}
+	return response.json();
+}
+
+// loadHistory - история за выбранный период, точки прореживаются примерно до 200 на график
+async function loadHistory() {
+	const seconds = Number(document.getElementById('range').value);
+	const to = Math.floor(Date.now() / 1000);
+	const step = Math.max(1, Math.floor(seconds / 200));
+	const query = labelsQuery(METRIC.labels);
+	const url = '/history/' + encodeURIComponent(METRIC.type) + '/' + encodeURIComponent(METRIC.id) +
+		'?from=' + (to - seconds) + '&to=' + to + '&step=' + step + 's' + (query ? '&' + query : '');
+	const response = await fetch(url);
+	if (!response.ok) {
+		throw new Error(response.status + ' ' + (await response.text()).trim());
+	}
+	return {from: to - seconds, to: to, points: await response.json()};
+}
+
+// pointValue - значение точки для графика: у гистограмм - число наблюдений
+function pointValue(p) {
+	if (METRIC.type === 'histogram') {
+		return p.histogram ? p.histogram.count : null;
+	}
+	if (METRIC.type === 'counter') {
+		return p.delta !== undefined ? p.delta : p.sum;
+	}
+	return p.value !== undefined ? p.value : p.avg;
+}
+
+function renderValue(m) {
+	const value = document.getElementById('value');
+	const buckets = document.getElementById('buckets');
+	if (!m) {
+		value.textContent = 'no value';
+		buckets.hidden = true;
+		return;
+	}
+	if (METRIC.type !== 'histogram') {
+		value.textContent = formatValue(METRIC.id, METRIC.type === 'counter' ? m.delta : m.value);
+		return;
+	}
+	const h = m.histogram;
+	value.textContent = 'count ' + formatNumber(h.count) + ', sum ' + formatValue(METRIC.id, h.sum) +
+		(h.count ? ', average ' + formatValue(METRIC.id, h.sum / h.count) : '');
+	const tbody = buckets.querySelector('tbody');
+	tbody.replaceChildren();
+	h.counts.forEach((count, i) => {
+		const row = tbody.insertRow();
+		row.insertCell().textContent = i < h.bounds.length ? formatValue(METRIC.id, h.bounds[i]) : '+Inf';
+		const td = row.insertCell();
+		td.textContent = formatNumber(count);
+		td.className = 'number';
+	});
+	buckets.hidden = false;
+}
+
+function renderChart(history) {
+	const svg = document.getElementById('chart');
+	const points = history.points.map(p => [Date.parse(p.ts) / 1000, pointValue(p)]).filter(p => p[1] !== null && p[1] !== undefined);
+	svg.replaceChildren();
+	const caption = document.getElementById('chart-range');
+	if (points.length === 0) {
+		caption.textContent = 'no points in range';
+		return;
+	}
+	const values = points.map(p => p[1]);
+	let min = Math.min(...values), max = Math.max(...values);
+	if (min === max) {
+		min -= 1;
+		max += 1;
+	}
+	const width = 800, height = 240;
+	const x = t => (t - history.from) / (history.to - history.from) * width;
+	const y = v => height - (v - min) / (max - min) * height;
+	const line = document.createElementNS('http://www.w3.org/2000/svg', 'polyline');
+	line.setAttribute('points', points.map(p => x(p[0]).toFixed(1) + ',' + y(p[1]).toFixed(1)).join(' '));
+	svg.appendChild(line);
+	caption.textContent = 'min ' + formatValue(METRIC.id, Math.min(...values)) + ', max ' + formatValue(METRIC.id, Math.max(...values)) +
+		', ' + points.length + ' points';
+}
+
+async function refresh() {
+	try {
+		const [value, history] = await Promise.all([loadValue(), loadHistory()]);
+		renderValue(value);
+		renderChart(history);
+		setStatus('updated ' + new Date().toLocaleTimeString());
+	} catch (e) {
+		setStatus('error: ' + e.message, true);
+	}
+}
+
+function schedule() {
+	clearInterval(state.timer);
+	if (document.getElementById('refresh').checked) {
+		state.timer = setInterval(refresh, REFRESH_INTERVAL);
+	}
+}
+
+document.getElementById('range').addEventListener('change', refresh);
+document.getElementById('refresh').addEventListener('change', schedule);
+refresh();
+schedule();
@@ -0,0 +1,105 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+	"yametrics/internal/server/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	now := time.Unix(1700000100, 0)
+	tests := []struct {
+		name string
+		line string
+		want Point
+		err  bool
+	}{
+		{name: "full", line: "servers.web1.cpu.load 1.5 1700000000", want: Point{Path: "servers.web1.cpu.load", Value: 1.5, Timestamp: time.Unix(1700000000, 0)}},
+		{name: "no timestamp", line: "jobs.done 3", want: Point{Path: "jobs.done", Value: 3, Timestamp: now}},
+		{name: "negative timestamp", line: "jobs.done 3 -1", want: Point{Path: "jobs.done", Value: 3, Timestamp: now}},
+		{name: "tags", line: "disk.used;dc=eu;host=db 42 1700000000", want: Point{Path: "disk.used", Tags: models.Labels{"dc": "eu", "host": "db"}, Value: 42, Timestamp: time.Unix(1700000000, 0)}},
+		{name: "bad value", line: "jobs.done x 1700000000", err: true},
+		{name: "nan", line: "jobs.done nan 1700000000", err: true},
+		{name: "bad timestamp", line: "jobs.done 1 now", err: true},
+		{name: "bad tag", line: "jobs.done;dc 1 1700000000", err: true},
+		{name: "too many fields", line: "jobs.done 1 2 3", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseLine(tt.line, now)
+			if tt.err {
+				assert.ErrorIs(t, err, ErrBadLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, p)
+		})
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	templates, err := ParseTemplates([]string{
+		"servers.* .host.measurement* env=prod",
+		"stats.*.*.* .app.measurement.measurement",
+		"measurement.measurement.field",
+	})
+	require.NoError(t, err)
+
+	m := templates.ToMetric(Point{Path: "servers.web1.cpu.load", Value: 1.5})
+	assert.Equal(t, "cpu.load", m.ID)
+	assert.Equal(t, models.GAUGE, m.MType)
+	assert.Equal(t, models.Labels{"host": "web1", "env": "prod"}, m.Labels)
+	assert.Equal(t, 1.5, *m.Value)
+
+	m = templates.ToMetric(Point{Path: "stats.api.requests.count"})
+	assert.Equal(t, "requests.count", m.ID)
+	assert.Equal(t, models.Labels{"app": "api"}, m.Labels)
+
+	// правило без фильтра, теги из пути имеют приоритет
+	m = templates.ToMetric(Point{Path: "disk.used.root", Tags: models.Labels{"field": "home"}})
+	assert.Equal(t, "disk.used", m.ID)
+	assert.Equal(t, models.Labels{"field": "home"}, m.Labels)
+
+	// без правил путь целиком - имя метрики
+	m = Templates(nil).ToMetric(Point{Path: "servers.web1.cpu.load", Tags: models.Labels{"dc": "eu"}})
+	assert.Equal(t, "servers.web1.cpu.load", m.ID)
+	assert.Equal(t, models.Labels{"dc": "eu"}, m.Labels)
+
+	for _, bad := range []string{"host.field", "a.[ measurement", "a b c d", "measurement env"} {
+		_, err := ParseTemplate(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestParsePickle(t *testing.T) {
+	// pickle.dumps([("servers.web1.cpu.load", (1700000000, 1.5)), ("disk;dc=eu", (1700000001.5, 42)), ("bad", (1, "x"))], protocol=N)
+	messages := map[string]string{
+		"protocol 0": "(lp0\n(Vservers.web1.cpu.load\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(Vdisk;dc=eu\np4\n(F1700000001.5\nI42\ntp5\ntp6\na(Vbad\np7\n(I1\nVx\np8\ntp9\ntp10\na.",
+		"protocol 2": "\x80\x02]q\x00(X\x15\x00\x00\x00servers.web1.cpu.loadq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\n\x00\x00\x00disk;dc=euq\x04GA\xd9T\xfc@`\x00\x00K*\x86q\x05\x86q\x06X\x03\x00\x00\x00badq\x07K\x01X\x01\x00\x00\x00xq\x08\x86q\t\x86q\ne.",
+		"protocol 4": "\x80\x04\x95[\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x15servers.web1.cpu.load\x94J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\ndisk;dc=eu\x94GA\xd9T\xfc@`\x00\x00K*\x86\x94\x86\x94\x8c\x03bad\x94K\x01\x8c\x01x\x94\x86\x94\x86\x94e.",
+	}
+	want := []Point{
+		{Path: "servers.web1.cpu.load", Value: 1.5, Timestamp: time.Unix(1700000000, 0)},
+		{Path: "disk", Tags: models.Labels{"dc": "eu"}, Value: 42, Timestamp: time.Unix(1700000001, int64(time.Second/2))},
+	}
+	for name, data := range messages {
+		t.Run(name, func(t *testing.T) {
+			points, errs, err := ParsePickle([]byte(data))
+			require.NoError(t, err)
+			assert.Equal(t, want, points)
+			require.Len(t, errs, 1)
+			assert.ErrorIs(t, errs[0], ErrBadLine)
+		})
+	}
+
+	// создание объектов (GLOBAL, REDUCE) не поддерживается
+	_, _, err := ParsePickle([]byte("cos\nsystem\n(S'true'\ntR."))
+	assert.ErrorIs(t, err, ErrBadPickle)
+	_, _, err = ParsePickle([]byte("\x80\x02]q\x00(X\xff\x00\x00\x00"))
+	assert.ErrorIs(t, err, ErrBadPickle)
+	_, _, err = ParsePickle([]byte("I1\n."))
+	assert.ErrorIs(t, err, ErrBadPickle)
+}
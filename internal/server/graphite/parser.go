@@ -0,0 +1,69 @@
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"yametrics/internal/server/models"
+)
+
+// ErrBadLine - строка не соответствует формату graphite
+var ErrBadLine = errors.New("bad graphite line")
+
+// Point - значение метрики graphite: путь, теги формата graphite 1.1 (path;tag=value), значение и время
+type Point struct {
+	Path      string
+	Tags      models.Labels
+	Value     float64
+	Timestamp time.Time
+}
+
+// ParseLine - разбор строки "path value [timestamp]".
+// отсутствующее или отрицательное время (-1) заменяется на now
+func ParseLine(line string, now time.Time) (Point, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return Point{}, fmt.Errorf("%w: expected path, value and timestamp in %q", ErrBadLine, line)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return Point{}, fmt.Errorf("%w: bad value in %q", ErrBadLine, line)
+	}
+	ts := now
+	if len(fields) == 3 {
+		sec, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("%w: bad timestamp in %q", ErrBadLine, line)
+		}
+		if sec >= 0 {
+			ts = time.Unix(0, int64(sec*float64(time.Second)))
+		}
+	}
+	return NewPoint(fields[0], value, ts)
+}
+
+// NewPoint - точка с разбором тегов из пути
+func NewPoint(path string, value float64, ts time.Time) (Point, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return Point{}, fmt.Errorf("%w: value of %q is not a number", ErrBadLine, path)
+	}
+	parts := strings.Split(path, ";")
+	p := Point{Path: parts[0], Value: value, Timestamp: ts}
+	if p.Path == "" {
+		return Point{}, fmt.Errorf("%w: empty path", ErrBadLine)
+	}
+	for _, tag := range parts[1:] {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" || v == "" {
+			return Point{}, fmt.Errorf("%w: bad tag %q in %q", ErrBadLine, tag, path)
+		}
+		if p.Tags == nil {
+			p.Tags = make(models.Labels)
+		}
+		p.Tags[k] = v
+	}
+	return p, nil
+}
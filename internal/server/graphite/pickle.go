@@ -0,0 +1,516 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBadPickle - сообщение протокола pickle не удалось разобрать
+var ErrBadPickle = errors.New("bad graphite pickle")
+
+// опкоды pickle, которые используют клиенты carbon (протоколы 0-4).
+// GLOBAL, REDUCE, BUILD и другие опкоды, создающие произвольные объекты, не поддерживаются намеренно
+const (
+	opMark            = '('
+	opStop            = '.'
+	opPop             = '0'
+	opNone            = 'N'
+	opInt             = 'I'
+	opLong            = 'L'
+	opFloat           = 'F'
+	opString          = 'S'
+	opUnicode         = 'V'
+	opBinInt          = 'J'
+	opBinInt1         = 'K'
+	opBinInt2         = 'M'
+	opBinFloat        = 'G'
+	opBinString       = 'T'
+	opShortBinString  = 'U'
+	opBinUnicode      = 'X'
+	opBinBytes        = 'B'
+	opShortBinBytes   = 'C'
+	opEmptyList       = ']'
+	opList            = 'l'
+	opAppend          = 'a'
+	opAppends         = 'e'
+	opEmptyTuple      = ')'
+	opTuple           = 't'
+	opPut             = 'p'
+	opBinPut          = 'q'
+	opLongBinPut      = 'r'
+	opGet             = 'g'
+	opBinGet          = 'h'
+	opLongBinGet      = 'j'
+	opProto           = 0x80
+	opTuple1          = 0x85
+	opTuple2          = 0x86
+	opTuple3          = 0x87
+	opNewTrue         = 0x88
+	opNewFalse        = 0x89
+	opLong1           = 0x8a
+	opShortBinUnicode = 0x8c
+	opBinUnicode8     = 0x8d
+	opMemoize         = 0x94
+	opFrame           = 0x95
+)
+
+// mark - маркер начала списка элементов на стеке
+type mark struct{}
+
+// list - изменяемый список, на него могут ссылаться несколько записей memo
+type list struct {
+	items []any
+}
+
+// unpickler - разбор данных pickle в значения go: nil, bool, int64, *big.Int, float64, string, []any (tuple), *list
+type unpickler struct {
+	r     *bytes.Reader
+	stack []any
+	memo  map[int]any
+}
+
+// ParsePickle - разбор сообщения carbon pickle: список кортежей (path, (timestamp, value)).
+// некорректные точки пропускаются и возвращаются в errs
+func ParsePickle(data []byte) (points []Point, errs []error, err error) {
+	v, err := unpickle(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, ok := v.(*list)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: expected list, got %T", ErrBadPickle, v)
+	}
+	points = make([]Point, 0, len(l.items))
+	for _, item := range l.items {
+		p, err := pickledPoint(item)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		points = append(points, p)
+	}
+	return points, errs, nil
+}
+
+// pickledPoint - точка из кортежа (path, (timestamp, value))
+func pickledPoint(item any) (Point, error) {
+	t, ok := item.([]any)
+	if !ok || len(t) != 2 {
+		return Point{}, fmt.Errorf("%w: expected (path, (timestamp, value)), got %v", ErrBadLine, item)
+	}
+	path, ok := t[0].(string)
+	if !ok {
+		return Point{}, fmt.Errorf("%w: path %v is not a string", ErrBadLine, t[0])
+	}
+	datapoint, ok := t[1].([]any)
+	if !ok || len(datapoint) != 2 {
+		return Point{}, fmt.Errorf("%w: expected (timestamp, value) for %q", ErrBadLine, path)
+	}
+	sec, err := toFloat(datapoint[0])
+	if err != nil {
+		return Point{}, fmt.Errorf("%w: bad timestamp for %q: %v", ErrBadLine, path, err)
+	}
+	value, err := toFloat(datapoint[1])
+	if err != nil {
+		return Point{}, fmt.Errorf("%w: bad value for %q: %v", ErrBadLine, path, err)
+	}
+	return NewPoint(path, value, time.Unix(0, int64(sec*float64(time.Second))))
+}
+
+func toFloat(v any) (float64, error) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(v).Float64()
+		return f, nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return 0, fmt.Errorf("unexpected type %T", v)
+}
+
+func unpickle(data []byte) (any, error) {
+	u := &unpickler{r: bytes.NewReader(data), memo: make(map[int]any)}
+	for {
+		op, err := u.r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: unexpected end of data", ErrBadPickle)
+		}
+		if op == opStop {
+			if len(u.stack) != 1 {
+				return nil, fmt.Errorf("%w: stack has %d items on stop", ErrBadPickle, len(u.stack))
+			}
+			return u.stack[0], nil
+		}
+		if err := u.exec(op); err != nil {
+			return nil, fmt.Errorf("%w: opcode 0x%02x: %v", ErrBadPickle, op, err)
+		}
+	}
+}
+
+func (u *unpickler) exec(op byte) error {
+	switch op {
+	case opProto:
+		_, err := u.r.ReadByte()
+		return err
+	case opFrame:
+		_, err := u.read(8)
+		return err
+	case opMark:
+		u.push(mark{})
+	case opPop:
+		_, err := u.pop()
+		return err
+	case opNone:
+		u.push(nil)
+	case opNewTrue:
+		u.push(true)
+	case opNewFalse:
+		u.push(false)
+	case opInt:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		// протокол 0 записывает True и False как I01 и I00
+		switch line {
+		case "01":
+			u.push(true)
+			return nil
+		case "00":
+			u.push(false)
+			return nil
+		}
+		i, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return err
+		}
+		u.push(i)
+	case opLong:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		i, ok := new(big.Int).SetString(strings.TrimSuffix(line, "L"), 10)
+		if !ok {
+			return fmt.Errorf("bad long %q", line)
+		}
+		u.pushInt(i)
+	case opFloat:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return err
+		}
+		u.push(f)
+	case opString:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		s, err := unquote(line)
+		if err != nil {
+			return err
+		}
+		u.push(s)
+	case opUnicode:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		u.push(line)
+	case opBinInt:
+		b, err := u.read(4)
+		if err != nil {
+			return err
+		}
+		u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+	case opBinInt1:
+		b, err := u.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		u.push(int64(b))
+	case opBinInt2:
+		b, err := u.read(2)
+		if err != nil {
+			return err
+		}
+		u.push(int64(binary.LittleEndian.Uint16(b)))
+	case opLong1:
+		n, err := u.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		b, err := u.read(int(n))
+		if err != nil {
+			return err
+		}
+		u.pushInt(decodeLong(b))
+	case opBinFloat:
+		b, err := u.read(8)
+		if err != nil {
+			return err
+		}
+		u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case opShortBinString, opShortBinUnicode, opShortBinBytes:
+		n, err := u.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		return u.pushString(int(n))
+	case opBinString, opBinUnicode, opBinBytes:
+		b, err := u.read(4)
+		if err != nil {
+			return err
+		}
+		return u.pushString(int(binary.LittleEndian.Uint32(b)))
+	case opBinUnicode8:
+		b, err := u.read(8)
+		if err != nil {
+			return err
+		}
+		n := binary.LittleEndian.Uint64(b)
+		if n > uint64(u.r.Len()) {
+			return io.ErrUnexpectedEOF
+		}
+		return u.pushString(int(n))
+	case opEmptyList:
+		u.push(&list{})
+	case opList:
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(&list{items: items})
+	case opAppend:
+		v, err := u.pop()
+		if err != nil {
+			return err
+		}
+		l, err := u.topList()
+		if err != nil {
+			return err
+		}
+		l.items = append(l.items, v)
+	case opAppends:
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		l, err := u.topList()
+		if err != nil {
+			return err
+		}
+		l.items = append(l.items, items...)
+	case opEmptyTuple:
+		u.push([]any{})
+	case opTuple:
+		items, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(items)
+	case opTuple1, opTuple2, opTuple3:
+		n := int(op-opTuple1) + 1
+		if len(u.stack) < n {
+			return errors.New("stack underflow")
+		}
+		items := append([]any{}, u.stack[len(u.stack)-n:]...)
+		for _, v := range items {
+			if _, ok := v.(mark); ok {
+				return errors.New("unexpected mark")
+			}
+		}
+		u.stack = u.stack[:len(u.stack)-n]
+		u.push(items)
+	case opPut:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		i, err := strconv.Atoi(line)
+		if err != nil {
+			return err
+		}
+		return u.put(i)
+	case opBinPut:
+		b, err := u.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		return u.put(int(b))
+	case opLongBinPut:
+		b, err := u.read(4)
+		if err != nil {
+			return err
+		}
+		return u.put(int(binary.LittleEndian.Uint32(b)))
+	case opMemoize:
+		return u.put(len(u.memo))
+	case opGet:
+		line, err := u.readLine()
+		if err != nil {
+			return err
+		}
+		i, err := strconv.Atoi(line)
+		if err != nil {
+			return err
+		}
+		return u.get(i)
+	case opBinGet:
+		b, err := u.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		return u.get(int(b))
+	case opLongBinGet:
+		b, err := u.read(4)
+		if err != nil {
+			return err
+		}
+		return u.get(int(binary.LittleEndian.Uint32(b)))
+	default:
+		return errors.New("unsupported opcode")
+	}
+	return nil
+}
+
+func (u *unpickler) push(v any) {
+	u.stack = append(u.stack, v)
+}
+
+// pushInt - целое, которое помещается в int64, хранится как int64
+func (u *unpickler) pushInt(i *big.Int) {
+	if i.IsInt64() {
+		u.push(i.Int64())
+		return
+	}
+	u.push(i)
+}
+
+func (u *unpickler) pushString(n int) error {
+	b, err := u.read(n)
+	if err != nil {
+		return err
+	}
+	u.push(string(b))
+	return nil
+}
+
+func (u *unpickler) pop() (any, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	if _, ok := v.(mark); ok {
+		return nil, errors.New("unexpected mark")
+	}
+	return v, nil
+}
+
+// popMark - элементы стека после последнего маркера, маркер снимается
+func (u *unpickler) popMark() ([]any, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(mark); ok {
+			items := append([]any{}, u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errors.New("mark not found")
+}
+
+func (u *unpickler) topList() (*list, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	l, ok := u.stack[len(u.stack)-1].(*list)
+	if !ok {
+		return nil, fmt.Errorf("append to %T", u.stack[len(u.stack)-1])
+	}
+	return l, nil
+}
+
+func (u *unpickler) put(i int) error {
+	if len(u.stack) == 0 {
+		return errors.New("stack underflow")
+	}
+	u.memo[i] = u.stack[len(u.stack)-1]
+	return nil
+}
+
+func (u *unpickler) get(i int) error {
+	v, ok := u.memo[i]
+	if !ok {
+		return fmt.Errorf("memo key %d not found", i)
+	}
+	u.push(v)
+	return nil
+}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if n < 0 || n > u.r.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(u.r, b)
+	return b, err
+}
+
+func (u *unpickler) readLine() (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := u.r.ReadByte()
+		if err != nil {
+			return "", io.ErrUnexpectedEOF
+		}
+		if b == '\n' {
+			return sb.String(), nil
+		}
+		sb.WriteByte(b)
+	}
+}
+
+// decodeLong - целое со знаком в дополнительном коде, порядок байтов little-endian
+func decodeLong(b []byte) *big.Int {
+	if len(b) == 0 {
+		return new(big.Int)
+	}
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	i := new(big.Int).SetBytes(be)
+	if b[len(b)-1]&0x80 != 0 {
+		i.Sub(i, new(big.Int).Lsh(big.NewInt(1), uint(len(b)*8)))
+	}
+	return i
+}
+
+// unquote - строка протокола 0 в кавычках repr python
+func unquote(s string) (string, error) {
+	if len(s) < 2 || (s[0] != '\'' && s[0] != '"') || s[len(s)-1] != s[0] {
+		return "", fmt.Errorf("bad string %q", s)
+	}
+	body := s[1 : len(s)-1]
+	if s[0] == '\'' {
+		body = strings.ReplaceAll(strings.ReplaceAll(body, `"`, `\"`), `\'`, `'`)
+	}
+	return strconv.Unquote(`"` + body + `"`)
+}
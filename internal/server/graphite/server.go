@@ -0,0 +1,334 @@
+// Package graphite - прием метрик по протоколам graphite/carbon: plaintext (tcp или udp) и pickle (tcp).
+// значения сохраняются как gauge, имена и метки получаются из пути по правилам Templates
+package graphite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultFlushInterval - интервал сохранения принятых значений в хранилище
+	DefaultFlushInterval = time.Second
+	// maxPacketSize - максимальный размер udp-пакета
+	maxPacketSize = 65535
+	// maxPickleSize - максимальный размер сообщения pickle, как в carbon
+	maxPickleSize = 1 << 20
+)
+
+// pendingMetric - принятое значение и его время
+type pendingMetric struct {
+	metric models.Metrics
+	ts     time.Time
+}
+
+// Server - прием метрик graphite
+type Server struct {
+	flushInterval time.Duration
+	templates     Templates
+	storage       storage.MetricsStorage
+	logger        *zap.SugaredLogger
+
+	pending   []pendingMetric
+	pendingMu sync.Mutex
+
+	packetConn     net.PacketConn
+	listener       net.Listener
+	pickleListener net.Listener
+	// wg - горутины чтения и сброса, Close дожидается их завершения
+	wg      sync.WaitGroup
+	stop    chan struct{}
+	conns   map[net.Conn]struct{}
+	connsMu sync.Mutex
+	once    sync.Once
+}
+
+// NewServer - создание и запуск приема plaintext на address (network - tcp или udp)
+// и pickle на pickleAddress. пустой адрес выключает соответствующий прием
+func NewServer(
+	network string,
+	address string,
+	pickleAddress string,
+	flushInterval time.Duration,
+	templates Templates,
+	metricsStorage storage.MetricsStorage,
+	logger *zap.SugaredLogger) (*Server, error) {
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+	s := &Server{
+		flushInterval: flushInterval,
+		templates:     templates,
+		storage:       metricsStorage,
+		logger:        logger,
+		stop:          make(chan struct{}),
+		conns:         make(map[net.Conn]struct{}),
+	}
+	var err error
+	if address != "" {
+		switch network {
+		case "udp":
+			if s.packetConn, err = net.ListenPacket("udp", address); err != nil {
+				return nil, err
+			}
+		case "tcp":
+			if s.listener, err = net.Listen("tcp", address); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown graphite network %q, expected tcp or udp", network)
+		}
+	}
+	if pickleAddress != "" {
+		if s.pickleListener, err = net.Listen("tcp", pickleAddress); err != nil {
+			s.closeListeners()
+			return nil, err
+		}
+	}
+
+	if s.packetConn != nil {
+		s.wg.Add(1)
+		go s.servePackets()
+		logger.Infof("graphite udp listener started, addr: %v", s.packetConn.LocalAddr())
+	}
+	if s.listener != nil {
+		s.wg.Add(1)
+		go s.serveConns(s.listener, s.servePlaintext)
+		logger.Infof("graphite tcp listener started, addr: %v", s.listener.Addr())
+	}
+	if s.pickleListener != nil {
+		s.wg.Add(1)
+		go s.serveConns(s.pickleListener, s.servePickle)
+		logger.Infof("graphite pickle listener started, addr: %v", s.pickleListener.Addr())
+	}
+	s.wg.Add(1)
+	go s.runFlushJob()
+	return s, nil
+}
+
+// Addr - адрес приема plaintext, nil - прием выключен
+func (s *Server) Addr() net.Addr {
+	if s.packetConn != nil {
+		return s.packetConn.LocalAddr()
+	}
+	if s.listener != nil {
+		return s.listener.Addr()
+	}
+	return nil
+}
+
+// PickleAddr - адрес приема pickle, nil - прием выключен
+func (s *Server) PickleAddr() net.Addr {
+	if s.pickleListener != nil {
+		return s.pickleListener.Addr()
+	}
+	return nil
+}
+
+// Close - остановка приема и сохранение принятых значений.
+// хранилище должно закрываться после Close
+func (s *Server) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+		s.closeListeners()
+		s.connsMu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connsMu.Unlock()
+		s.wg.Wait()
+		if err := s.Flush(); err != nil {
+			s.logger.Errorf("error on flush graphite metrics: %v", err)
+		}
+		s.logger.Info("graphite listener stopped")
+	})
+}
+
+func (s *Server) closeListeners() {
+	if s.packetConn != nil {
+		s.packetConn.Close()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.pickleListener != nil {
+		s.pickleListener.Close()
+	}
+}
+
+// Flush - сохранение значений, принятых с прошлого сброса, в порядке их времени,
+// чтобы последним записалось самое новое значение
+func (s *Server) Flush() error {
+	s.pendingMu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.pendingMu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].ts.Before(pending[j].ts) })
+	metrics := make([]models.Metrics, len(pending))
+	for i := range pending {
+		metrics[i] = pending[i].metric
+	}
+	return s.storage.Updates(metrics)
+}
+
+func (s *Server) runFlushJob() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				s.logger.Errorf("error on flush graphite metrics: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// servePackets - в одном udp-пакете может быть несколько строк
+func (s *Server) servePackets() {
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := s.packetConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Errorf("error on read graphite packet: %v", err)
+			continue
+		}
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			s.handleLine(string(line))
+		}
+	}
+}
+
+func (s *Server) serveConns(listener net.Listener, serve func(net.Conn)) {
+	defer s.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Errorf("error on accept graphite connection: %v", err)
+			continue
+		}
+		s.connsMu.Lock()
+		select {
+		case <-s.stop:
+			// соединение принято во время остановки, Close его уже не закроет
+			s.connsMu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.connsMu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.connsMu.Lock()
+				delete(s.conns, conn)
+				s.connsMu.Unlock()
+				conn.Close()
+			}()
+			serve(conn)
+		}()
+	}
+}
+
+// servePlaintext - по tcp строки разделены переводом строки
+func (s *Server) servePlaintext(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.handleLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Errorf("error on read graphite connection: %v", err)
+	}
+}
+
+// servePickle - сообщения pickle: 4 байта длины (big-endian) и данные.
+// при ошибке в сообщении соединение закрывается, как в carbon
+func (s *Server) servePickle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Errorf("error on read graphite pickle: %v", err)
+			}
+			return
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > maxPickleSize {
+			s.logger.Warnf("graphite pickle message of %d bytes exceeds limit, closing connection", size)
+			return
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Errorf("error on read graphite pickle: %v", err)
+			}
+			return
+		}
+		points, errs, err := ParsePickle(data)
+		if err != nil {
+			s.logger.Warnf("closing graphite pickle connection: %v", err)
+			return
+		}
+		for _, err := range errs {
+			s.logger.Warnf("skip graphite point: %v", err)
+		}
+		s.add(points...)
+	}
+}
+
+func (s *Server) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	point, err := ParseLine(line, time.Now())
+	if err != nil {
+		s.logger.Warnf("skip graphite line: %v", err)
+		return
+	}
+	s.add(point)
+}
+
+func (s *Server) add(points ...Point) {
+	pending := make([]pendingMetric, 0, len(points))
+	for _, p := range points {
+		m := s.templates.ToMetric(p)
+		if err := m.Validate(); err != nil {
+			s.logger.Warnf("skip graphite metric %q: %v", p.Path, err)
+			continue
+		}
+		pending = append(pending, pendingMetric{metric: m, ts: p.Timestamp})
+	}
+	s.pendingMu.Lock()
+	s.pending = append(s.pending, pending...)
+	s.pendingMu.Unlock()
+}
@@ -0,0 +1,114 @@
+package graphite
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+	"yametrics/internal/server/config"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestServer - прием на свободных локальных портах с хранилищем в памяти
+func newTestServer(t *testing.T, network string, templates ...string) (*Server, storage.MetricsStorage) {
+	metricStorage, err := storage.NewFileMetricsStorage(&config.ServerConfig{}, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	ts, err := ParseTemplates(templates)
+	require.NoError(t, err)
+	s, err := NewServer(network, "127.0.0.1:0", "127.0.0.1:0", time.Hour, ts, metricStorage, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return s, metricStorage
+}
+
+// waitPending - ожидание, пока сервер примет n значений
+func waitPending(t *testing.T, s *Server, n int) {
+	require.Eventually(t, func() bool {
+		s.pendingMu.Lock()
+		defer s.pendingMu.Unlock()
+		return len(s.pending) >= n
+	}, time.Second, 5*time.Millisecond)
+}
+
+func value(t *testing.T, metricStorage storage.MetricsStorage, id string, labels models.Labels) float64 {
+	m, err := metricStorage.Get(id, models.GAUGE, labels)
+	require.NoError(t, err)
+	require.NotNil(t, m, id)
+	return *m.Value
+}
+
+func TestServerTCP(t *testing.T) {
+	s, metricStorage := newTestServer(t, "tcp", "servers.* .host.measurement*")
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	// значения сохраняются в порядке времени, последним - самое новое
+	_, err = conn.Write([]byte("servers.web1.cpu.load 2 1700000010\nbroken\nservers.web1.cpu.load 1 1700000000\njobs.done;dc=eu 5 -1\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	waitPending(t, s, 3)
+	require.NoError(t, s.Flush())
+
+	assert.Equal(t, 2.0, value(t, metricStorage, "cpu.load", models.Labels{"host": "web1"}))
+	assert.Equal(t, 5.0, value(t, metricStorage, "jobs.done", models.Labels{"dc": "eu"}))
+
+	conn, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("jobs.done;dc=eu 6\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	waitPending(t, s, 1)
+	// при остановке принятые значения сохраняются
+	s.Close()
+	assert.Equal(t, 6.0, value(t, metricStorage, "jobs.done", models.Labels{"dc": "eu"}))
+}
+
+func TestServerUDP(t *testing.T) {
+	s, metricStorage := newTestServer(t, "udp")
+	defer s.Close()
+
+	conn, err := net.Dial("udp", s.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("a.b 1.5 1700000000\nc.d 2 1700000000"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	waitPending(t, s, 2)
+	require.NoError(t, s.Flush())
+
+	assert.Equal(t, 1.5, value(t, metricStorage, "a.b", nil))
+	assert.Equal(t, 2.0, value(t, metricStorage, "c.d", nil))
+}
+
+func TestServerPickle(t *testing.T) {
+	s, metricStorage := newTestServer(t, "tcp")
+	defer s.Close()
+
+	// pickle.dumps([("a.b", (1700000000, 7))], protocol=2)
+	payload := []byte("\x80\x02]q\x00X\x03\x00\x00\x00a.bq\x01J\x00\xf1SeK\x07\x86q\x02\x86q\x03a.")
+	message := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	message = append(message, payload...)
+
+	conn, err := net.Dial("tcp", s.PickleAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(append(message, message...))
+	require.NoError(t, err)
+	waitPending(t, s, 2)
+	require.NoError(t, s.Flush())
+	assert.Equal(t, 7.0, value(t, metricStorage, "a.b", nil))
+
+	// некорректное сообщение закрывает соединение
+	_, err = conn.Write([]byte("\x00\x00\x00\x02I1"))
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, os.ErrDeadlineExceeded))
+}
@@ -0,0 +1,150 @@
+package graphite
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"yametrics/internal/server/models"
+)
+
+// части шаблона
+const (
+	// measurementPart - сегмент входит в имя метрики
+	measurementPart = "measurement"
+	// measurementRest - этот и все следующие сегменты входят в имя метрики
+	measurementRest = "measurement*"
+)
+
+// Template - правило преобразования пути graphite в имя метрики и метки.
+// запись: "[filter] template [tag=value,...]", например "servers.* .host.measurement* env=prod":
+// filter - шаблон пути по сегментам (path.Match для каждого сегмента),
+// template - назначение сегментов через точку: measurement - часть имени, measurement* - остаток пути в имени,
+// другое слово - имя метки со значением сегмента, пусто - сегмент пропускается.
+// теги в конце добавляются ко всем метрикам, подходящим под правило
+type Template struct {
+	filter []string
+	parts  []string
+	tags   models.Labels
+}
+
+// ParseTemplate - разбор записи правила
+func ParseTemplate(s string) (*Template, error) {
+	fields := strings.Fields(s)
+	t := &Template{}
+	switch {
+	case len(fields) == 1:
+		t.parts = strings.Split(fields[0], ".")
+	case len(fields) == 2 && strings.Contains(fields[1], "="):
+		t.parts = strings.Split(fields[0], ".")
+		fields = append(fields[:1], "", fields[1])
+	case len(fields) == 2 || len(fields) == 3:
+		t.filter = strings.Split(fields[0], ".")
+		t.parts = strings.Split(fields[1], ".")
+	default:
+		return nil, fmt.Errorf("bad graphite template %q, expected [filter] template [tags]", s)
+	}
+	for _, segment := range t.filter {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("bad filter in graphite template %q: %w", s, err)
+		}
+	}
+	hasMeasurement := false
+	for _, part := range t.parts {
+		hasMeasurement = hasMeasurement || part == measurementPart || part == measurementRest
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("graphite template %q has no measurement part", s)
+	}
+	if len(fields) == 3 {
+		t.tags = make(models.Labels)
+		for _, tag := range strings.Split(fields[2], ",") {
+			k, v, ok := strings.Cut(tag, "=")
+			if !ok || k == "" {
+				return nil, fmt.Errorf("bad tag %q in graphite template %q", tag, s)
+			}
+			t.tags[k] = v
+		}
+	}
+	return t, nil
+}
+
+// match - подходит ли путь под фильтр правила, правило без фильтра подходит под любой путь
+func (t *Template) match(segments []string) bool {
+	if len(t.filter) > len(segments) {
+		return false
+	}
+	for i, f := range t.filter {
+		if ok, _ := path.Match(f, segments[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// apply - имя метрики и метки по правилу
+func (t *Template) apply(segments []string) (string, models.Labels) {
+	name := make([]string, 0, len(segments))
+	labels := make(models.Labels, len(t.tags))
+	for k, v := range t.tags {
+		labels[k] = v
+	}
+	for i, segment := range segments {
+		if i >= len(t.parts) {
+			break
+		}
+		switch part := t.parts[i]; part {
+		case measurementRest:
+			name = append(name, segments[i:]...)
+			return strings.Join(name, "."), labels
+		case measurementPart:
+			name = append(name, segment)
+		case "":
+		default:
+			labels[part] = segment
+		}
+	}
+	return strings.Join(name, "."), labels
+}
+
+// Templates - правила в порядке применения: к пути применяется первое подходящее правило
+type Templates []*Template
+
+// ParseTemplates - разбор списка правил
+func ParseTemplates(records []string) (Templates, error) {
+	templates := make(Templates, 0, len(records))
+	for _, r := range records {
+		t, err := ParseTemplate(r)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// ToMetric - gauge из точки. путь без подходящего правила целиком становится именем метрики.
+// теги graphite 1.1 из пути имеют приоритет над метками из правила
+func (ts Templates) ToMetric(p Point) models.Metrics {
+	name, labels := p.Path, models.Labels(nil)
+	segments := strings.Split(p.Path, ".")
+	for _, t := range ts {
+		if t.match(segments) {
+			name, labels = t.apply(segments)
+			break
+		}
+	}
+	if name == "" {
+		name = p.Path
+	}
+	for k, v := range p.Tags {
+		if labels == nil {
+			labels = make(models.Labels, len(p.Tags))
+		}
+		labels[k] = v
+	}
+	if len(labels) == 0 {
+		labels = nil
+	}
+	v := p.Value
+	return models.Metrics{ID: name, MType: models.GAUGE, Labels: labels, Value: &v}
+}
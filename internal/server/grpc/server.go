@@ -2,14 +2,31 @@ package grpc
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
 	"net"
+	"net/http"
+	"path"
+	"time"
+	"yametrics/internal/histogram"
+	"yametrics/internal/metricscrypto"
+	"yametrics/internal/protocol"
 	pb "yametrics/internal/protocol/proto"
+	"yametrics/internal/server/idempotency"
 	"yametrics/internal/server/models"
+	"yametrics/internal/server/otlp"
 	"yametrics/internal/server/storage"
 )
 
@@ -17,9 +34,34 @@ type MetricsServer struct {
 	pb.UnimplementedMetricsServer
 	logger         *zap.SugaredLogger
 	metricsStorage storage.MetricsStorage
+	// verifier - проверка подписей метрик, nil - подписи не проверяются
+	verifier *metricscrypto.Verifier
+	// idempotency - окно ключей примененных пакетов, nil - повторы не отслеживаются
+	idempotency *idempotency.Window
+	// allowUnsigned - удалять ли метрики по запросу без подписи при заданном ключе
+	allowUnsigned bool
 }
 
-func RunMetricsServer(logger *zap.SugaredLogger, ctx context.Context, metricsStorage storage.MetricsStorage) {
+// unsignedOTLP - прием OTLP/gRPC при заданном ключе подписи: запросы OTLP не подписываются и отклоняются
+type unsignedOTLP struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+}
+
+func (unsignedOTLP) Export(context.Context, *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	return nil, status.Error(codes.PermissionDenied, "unsigned writes are rejected while sign key is set, use allow-unsigned to accept them")
+}
+
+// RunMetricsServer - запуск grpc-сервера метрик, на нем же работает прием OTLP/gRPC через receiver.
+// verifier - проверка подписей метрик SaveMetrics, nil - подписи не проверяются.
+// allowUnsigned - принимать ли OTLP и удаление метрик без подписи, false отклоняет их с PermissionDenied
+func RunMetricsServer(
+	logger *zap.SugaredLogger,
+	ctx context.Context,
+	metricsStorage storage.MetricsStorage,
+	verifier *metricscrypto.Verifier,
+	window *idempotency.Window,
+	receiver *otlp.Receiver,
+	allowUnsigned bool) {
 	creds, err := credentials.NewServerTLSFromFile("cert/service.pem", "cert/service.key")
 	if err != nil {
 		logger.Fatalf("Failed to setup TLS: %v", err)
@@ -33,7 +75,12 @@ func RunMetricsServer(logger *zap.SugaredLogger, ctx context.Context, metricsSto
 	// создаём gRPC-сервер без зарегистрированной службы
 	server := grpc.NewServer(grpc.Creds(creds))
 	// регистрируем сервис
-	pb.RegisterMetricsServer(server, &MetricsServer{logger: logger, metricsStorage: metricsStorage})
+	pb.RegisterMetricsServer(server, &MetricsServer{logger: logger, metricsStorage: metricsStorage, verifier: verifier, idempotency: window, allowUnsigned: allowUnsigned})
+	if allowUnsigned {
+		colmetricspb.RegisterMetricsServiceServer(server, receiver)
+	} else {
+		colmetricspb.RegisterMetricsServiceServer(server, unsignedOTLP{})
+	}
 
 	logger.Info("Сервер gRPC начал работу")
 	// получаем запрос gRPC
@@ -47,35 +94,212 @@ func RunMetricsServer(logger *zap.SugaredLogger, ctx context.Context, metricsSto
 	logger.Info("server stopped")
 }
 
+// SaveMetrics - прием потока метрик. при заданном ключе подписи поток подписывается целиком
+// метаданными x-batch-sign или каждая метрика полем hash. пакет применяется только целиком:
+// если хотя бы одна метрика не прошла проверку, ответ InvalidArgument с ошибками по метрикам
+// в деталях errdetails.BadRequest
 func (s *MetricsServer) SaveMetrics(stream pb.Metrics_SaveMetricsServer) error {
-	mtrcs := make([]models.Metrics, 0)
-
+	received := make([]protocol.Metrics, 0)
 	for {
 		metric, err := stream.Recv()
-
 		if err == io.EOF {
-			err = s.metricsStorage.Updates(mtrcs)
-			if err != nil {
-				return err
-			}
-			s.logger.Info("metrics saved successful")
-			return stream.SendAndClose(&emptypb.Empty{})
+			break
 		}
 		if err != nil {
 			return err
 		}
-		t := ""
-		switch metric.Type {
-		case 0:
-			t = "counter"
-		case 1:
-			t = "gauge"
+		received = append(received, pb.MetricToProtocol(metric))
+	}
+
+	claim, errs, err := s.verifier.VerifyBatch(received, batchSign(stream.Context()), time.Now())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	mtrcs := make([]models.Metrics, len(received))
+	violations := make([]*errdetails.BadRequest_FieldViolation, 0)
+	for i, metric := range received {
+		mtrcs[i] = models.Metrics{
+			ID:          metric.ID,
+			MType:       metric.MType,
+			Labels:      metric.Labels,
+			Delta:       metric.Delta,
+			Value:       metric.Value,
+			Histogram:   metric.Histogram,
+			Temporality: metric.Temporality,
+		}
+		if _, ok := errs[i]; !ok {
+			if err := mtrcs[i].Validate(); err != nil {
+				errs[i] = err
+			}
+		}
+		if err, ok := errs[i]; ok {
+			violations = append(violations, &errdetails.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("metrics[%d]", i),
+				Description: fmt.Sprintf("%s %s: %v", metric.MType, metric.ID, err),
+			})
+		}
+	}
+	if len(violations) > 0 {
+		st := status.Newf(codes.InvalidArgument, "%d of %d metrics rejected", len(violations), len(received))
+		if detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations}); err == nil {
+			st = detailed
+		}
+		return st.Err()
+	}
+
+	if err := s.saveMetrics(stream.Context(), mtrcs, claim); err != nil {
+		return err
+	}
+	return stream.SendAndClose(&emptypb.Empty{})
+}
+
+// batchSign - подпись пакета из метаданных, пустая - подписаны отдельные метрики
+func batchSign(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(metricscrypto.BatchSignMetadataKey); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// deleteSign - подпись запроса удаления из метаданных
+func deleteSign(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(metricscrypto.DeleteSignMetadataKey); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// saveMetrics - применение пакета, повтор пакета с уже примененным ключом из метаданных
+// получает исходный результат без повторного применения. nonce подписей claim занимаются,
+// только если пакета нет в окне, и освобождаются, если пакет не применен
+func (s *MetricsServer) saveMetrics(ctx context.Context, mtrcs []models.Metrics, claim *metricscrypto.Claim) error {
+	agent, key := idempotencyKey(ctx)
+	result, replayed := s.idempotency.Do(agent, key, func() idempotency.Result {
+		if err := claim.Use(time.Now()); err != nil {
+			return idempotency.Result{Status: http.StatusBadRequest, Message: err.Error()}
+		}
+		err := s.metricsStorage.Updates(mtrcs)
+		if err != nil {
+			claim.Release()
+		}
+		if errors.Is(err, histogram.ErrIncompatibleBuckets) {
+			return idempotency.Result{Status: http.StatusBadRequest, Message: err.Error()}
+		} else if err != nil {
+			s.logger.Errorf("error on save metrics: %v", err)
+			return idempotency.Result{Status: http.StatusInternalServerError, Message: err.Error()}
+		}
+		s.logger.Info("metrics saved successful")
+		return idempotency.Result{Status: http.StatusOK}
+	})
+	if replayed {
+		s.logger.Infof("metrics batch %s from %s already saved", key, agent)
+	}
+	switch {
+	case result.Status == http.StatusOK:
+		return nil
+	case result.Status < http.StatusInternalServerError:
+		return status.Error(codes.InvalidArgument, result.Message)
+	default:
+		return status.Error(codes.Internal, result.Message)
+	}
+}
+
+// idempotencyKey - агент и ключ пакета из метаданных, без x-agent-id агент определяется по адресу
+func idempotencyKey(ctx context.Context) (agent string, key string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(idempotency.MetadataKey); len(v) > 0 {
+		key = v[0]
+	}
+	if v := md.Get(idempotency.AgentMetadataKey); len(v) > 0 {
+		return v[0], key
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host, key
+		}
+		return p.Addr.String(), key
+	}
+	return "", key
+}
+
+// GetHistory - история значений метрики.
+// если границы не заданы, отдается история за storage.DefaultHistoryWindow
+func (s *MetricsServer) GetHistory(ctx context.Context, in *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	to := time.Now()
+	if in.To != nil {
+		to = in.To.AsTime()
+	}
+	from := to.Add(-storage.DefaultHistoryWindow)
+	if in.From != nil {
+		from = in.From.AsTime()
+	}
+	var step time.Duration
+	if in.Step != nil {
+		step = in.Step.AsDuration()
+	}
+	if step < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "wrong step: %v", step)
+	}
+
+	points, err := s.metricsStorage.History(in.Id, toModelType(in.Type), in.Labels, from, to, step)
+	if err != nil {
+		s.logger.Errorf("error on GetHistory: %v", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	response := &pb.HistoryResponse{Points: make([]*pb.MetricPoint, len(points))}
+	for i := 0; i < len(points); i++ {
+		response.Points[i] = &pb.MetricPoint{
+			Ts:        timestamppb.New(points[i].Timestamp),
+			Delta:     points[i].Delta,
+			Value:     points[i].Value,
+			Histogram: pb.HistogramToProto(points[i].Histogram),
+			Min:       points[i].Min,
+			Max:       points[i].Max,
+			Avg:       points[i].Avg,
+			Sum:       points[i].Sum,
 		}
-		mtrcs = append(mtrcs, models.Metrics{
-			ID:    metric.Id,
-			MType: t,
-			Delta: metric.Delta,
-			Value: metric.Value,
-		})
 	}
+	return response, nil
+}
+
+// DeleteMetrics - удаление метрики или всех метрик, подходящих под шаблон.
+// при заданном ключе запрос подписывается метаданными x-delete-sign, если удаление без подписи не разрешено явно
+func (s *MetricsServer) DeleteMetrics(ctx context.Context, in *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	mtype := toModelType(in.Type)
+	if !s.allowUnsigned {
+		if err := s.verifier.VerifyDelete(in.Id, mtype, in.Labels, deleteSign(ctx), time.Now()); err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+	}
+	var deleted int
+	var err error
+	if storage.IsPattern(in.Id) {
+		deleted, err = s.metricsStorage.DeleteByPattern(in.Id, mtype, in.Labels)
+	} else {
+		var ok bool
+		if ok, err = s.metricsStorage.Delete(in.Id, mtype, in.Labels); ok {
+			deleted = 1
+		}
+	}
+	if errors.Is(err, path.ErrBadPattern) {
+		return nil, status.Errorf(codes.InvalidArgument, "wrong pattern: %v", in.Id)
+	} else if err != nil {
+		s.logger.Errorf("error on DeleteMetrics: %v", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.DeleteResponse{Deleted: int64(deleted)}, nil
+}
+
+func toModelType(t pb.MetricTypes) string {
+	switch t {
+	case pb.MetricTypes_COUNTER:
+		return models.COUNTER
+	case pb.MetricTypes_GAUGE:
+		return models.GAUGE
+	case pb.MetricTypes_HISTOGRAM:
+		return models.HISTOGRAM
+	}
+	return ""
 }
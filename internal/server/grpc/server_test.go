@@ -0,0 +1,207 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	"yametrics/internal/metricscrypto"
+	"yametrics/internal/protocol"
+	pb "yametrics/internal/protocol/proto"
+	"yametrics/internal/server/idempotency"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// countingStorage - хранилище, которое считает примененные пакеты и удаленные метрики
+type countingStorage struct {
+	storage.MetricsStorage
+	batches int
+	deleted int
+}
+
+func (s *countingStorage) Updates(metrics []models.Metrics) error {
+	s.batches++
+	return nil
+}
+
+func (s *countingStorage) Delete(id string, mtype string, labels models.Labels) (bool, error) {
+	s.deleted++
+	return true, nil
+}
+
+// startServer - сервер метрик на соединении в памяти, возвращает клиентское соединение
+func startServer(t *testing.T, metricsStorage storage.MetricsStorage, verifier *metricscrypto.Verifier, allowUnsigned bool) *grpc.ClientConn {
+	logger := zap.NewNop().Sugar()
+	window, err := idempotency.NewWindow(nil, 10, 0, time.Hour, logger)
+	require.NoError(t, err)
+
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterMetricsServer(server, &MetricsServer{logger: logger, metricsStorage: metricsStorage, verifier: verifier, idempotency: window, allowUnsigned: allowUnsigned})
+	colmetricspb.RegisterMetricsServiceServer(server, unsignedOTLP{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// saveMetrics - отправка метрик одним потоком SaveMetrics с метаданными md
+func saveMetrics(conn *grpc.ClientConn, metrics []*pb.Metric, md ...string) error {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), md...)
+	stream, err := pb.NewMetricsClient(conn).SaveMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range metrics {
+		if err := stream.Send(m); err != nil {
+			return err
+		}
+	}
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+func toProtocol(metrics []*pb.Metric) []protocol.Metrics {
+	result := make([]protocol.Metrics, len(metrics))
+	for i, m := range metrics {
+		result[i] = pb.MetricToProtocol(m)
+	}
+	return result
+}
+
+func testMetrics() []*pb.Metric {
+	v, d := 1.5, int64(2)
+	return []*pb.Metric{
+		{Id: "Alloc", Type: pb.MetricTypes_GAUGE, Value: &v, Labels: map[string]string{"host": "web"}},
+		{Id: "PollCount", Type: pb.MetricTypes_COUNTER, Delta: &d, Temporality: pb.Temporality_CUMULATIVE},
+	}
+}
+
+func TestSaveMetricsBatchSign(t *testing.T) {
+	metricsStorage := new(countingStorage)
+	conn := startServer(t, metricsStorage, metricscrypto.NewVerifier("key", 0, true), false)
+	metrics := testMetrics()
+
+	sign := metricscrypto.SignBatch(toProtocol(metrics), "key", metricscrypto.SignV2, time.Now())
+	require.NoError(t, saveMetrics(conn, metrics, metricscrypto.BatchSignMetadataKey, sign, idempotency.MetadataKey, "batch1"))
+	assert.Equal(t, 1, metricsStorage.batches)
+
+	// повтор с тем же ключом и подписью получает исходный результат и не применяется второй раз
+	require.NoError(t, saveMetrics(conn, metrics, metricscrypto.BatchSignMetadataKey, sign, idempotency.MetadataKey, "batch1"))
+	assert.Equal(t, 1, metricsStorage.batches)
+
+	err := saveMetrics(conn, metrics, metricscrypto.BatchSignMetadataKey, sign, idempotency.MetadataKey, "batch2")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, metricscrypto.ErrReplayed.Error(), status.Convert(err).Message())
+
+	sign = metricscrypto.SignBatch(toProtocol(metrics), "other", metricscrypto.SignV2, time.Now())
+	err = saveMetrics(conn, metrics, metricscrypto.BatchSignMetadataKey, sign)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, metricscrypto.ErrBadBatchSign.Error(), status.Convert(err).Message())
+	assert.Equal(t, 1, metricsStorage.batches)
+}
+
+func TestSaveMetricsRejected(t *testing.T) {
+	metricsStorage := new(countingStorage)
+	conn := startServer(t, metricsStorage, metricscrypto.NewVerifier("key", 0, true), false)
+
+	violations := func(err error) []*errdetails.BadRequest_FieldViolation {
+		for _, detail := range status.Convert(err).Details() {
+			if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+				return badRequest.FieldViolations
+			}
+		}
+		return nil
+	}
+
+	// метрика с чужой подписью отклоняется с указанием индекса, пакет не применяется
+	metrics := testMetrics()
+	signed := toProtocol(metrics)
+	metrics[0].Hash = new(string)
+	*metrics[0].Hash = metricscrypto.SignMetric(signed[0], "key", metricscrypto.SignV2, time.Now())
+	metrics[1].Hash = new(string)
+	*metrics[1].Hash = metricscrypto.SignMetric(signed[1], "other", metricscrypto.SignV2, time.Now())
+	err := saveMetrics(conn, metrics)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "1 of 2 metrics rejected", status.Convert(err).Message())
+	rejected := violations(err)
+	require.Len(t, rejected, 1)
+	assert.Equal(t, "metrics[1]", rejected[0].Field)
+	assert.Equal(t, "counter PollCount: "+metricscrypto.ErrBadSign.Error(), rejected[0].Description)
+
+	// поток без подписей при заданном ключе отклоняется целиком
+	err = saveMetrics(conn, testMetrics())
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "2 of 2 metrics rejected", status.Convert(err).Message())
+	rejected = violations(err)
+	require.Len(t, rejected, 2)
+	assert.Equal(t, "metrics[0]", rejected[0].Field)
+	assert.Equal(t, "metrics[1]", rejected[1].Field)
+	assert.Zero(t, metricsStorage.batches)
+
+	// OTLP не несет подписи и отклоняется
+	_, err = colmetricspb.NewMetricsServiceClient(conn).Export(context.Background(), &colmetricspb.ExportMetricsServiceRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestSaveMetricsWithoutKey(t *testing.T) {
+	metricsStorage := new(countingStorage)
+	conn := startServer(t, metricsStorage, metricscrypto.NewVerifier("", 0, true), true)
+
+	require.NoError(t, saveMetrics(conn, testMetrics()))
+	assert.Equal(t, 1, metricsStorage.batches)
+}
+
+func TestDeleteMetricsSign(t *testing.T) {
+	metricsStorage := new(countingStorage)
+	conn := startServer(t, metricsStorage, metricscrypto.NewVerifier("key", 0, true), false)
+	client := pb.NewMetricsClient(conn)
+	request := &pb.DeleteRequest{Id: "Alloc", Type: pb.MetricTypes_GAUGE, Labels: map[string]string{"host": "web"}}
+	remove := func(sign string) error {
+		ctx := context.Background()
+		if sign != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, metricscrypto.DeleteSignMetadataKey, sign)
+		}
+		_, err := client.DeleteMetrics(ctx, request)
+		return err
+	}
+
+	assert.Equal(t, codes.PermissionDenied, status.Code(remove("")))
+	// подпись записи метрики не подходит для удаления
+	write := protocol.Metrics{ID: "Alloc", MType: models.GAUGE, Labels: request.Labels}
+	assert.Equal(t, codes.PermissionDenied, status.Code(remove(metricscrypto.GetMetricSignV2(write, "key", time.Now()))))
+	assert.Equal(t, codes.PermissionDenied, status.Code(remove(metricscrypto.GetDeleteSignV2("Alloc", models.GAUGE, nil, "key", time.Now()))))
+	assert.Equal(t, codes.PermissionDenied, status.Code(remove(metricscrypto.GetDeleteSignV2("Alloc", models.GAUGE, request.Labels, "other", time.Now()))))
+	assert.Zero(t, metricsStorage.deleted)
+
+	sign := metricscrypto.GetDeleteSignV2("Alloc", models.GAUGE, request.Labels, "key", time.Now())
+	require.NoError(t, remove(sign))
+	assert.Equal(t, 1, metricsStorage.deleted)
+	err := remove(sign)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, metricscrypto.ErrReplayed.Error(), status.Convert(err).Message())
+
+	// с разрешенными записями без подписи удаление подписи не требует
+	allowed := startServer(t, metricsStorage, metricscrypto.NewVerifier("key", 0, true), true)
+	_, err = pb.NewMetricsClient(allowed).DeleteMetrics(context.Background(), request)
+	require.NoError(t, err)
+	assert.Equal(t, 2, metricsStorage.deleted)
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"yametrics/internal/histogram"
+	"yametrics/internal/protocol"
+	"yametrics/internal/server/models"
+)
+
+// labelQueryParam - метки в query-параметрах передаются в виде label=key:value
+const labelQueryParam = "label"
+
+func toModel(m protocol.Metrics) models.Metrics {
+	return models.Metrics{ID: m.ID, MType: m.MType, Labels: models.Labels(m.Labels), Delta: m.Delta, Value: m.Value, Histogram: m.Histogram, Temporality: m.Temporality}
+}
+
+func toProtocol(m models.Metrics) protocol.Metrics {
+	return protocol.Metrics{ID: m.ID, MType: m.MType, Labels: m.Labels, Delta: m.Delta, Value: m.Value, Histogram: m.Histogram}
+}
+
+func isKnownType(mtype string) bool {
+	return mtype == models.COUNTER || mtype == models.GAUGE || mtype == models.HISTOGRAM
+}
+
+// updateErrorStatus - ошибки объединения гистограмм вызваны некорректными данными клиента
+func updateErrorStatus(err error) int {
+	if errors.Is(err, histogram.ErrIncompatibleBuckets) || errors.Is(err, histogram.ErrInvalidHistogram) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// labelsFromQuery - разбор меток из query-параметров запроса
+func labelsFromQuery(r *http.Request) (models.Labels, bool) {
+	params := r.URL.Query()[labelQueryParam]
+	if len(params) == 0 {
+		return nil, true
+	}
+	labels := make(models.Labels, len(params))
+	for _, p := range params {
+		k, v, ok := strings.Cut(p, ":")
+		if !ok || k == "" {
+			return nil, false
+		}
+		labels[k] = v
+	}
+	return labels, true
+}
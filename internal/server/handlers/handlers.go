@@ -1,16 +1,28 @@
 package handlers
 
 import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"html/template"
+	"io"
+	"net"
 	"net/http"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"yametrics/internal/histogram"
 	"yametrics/internal/metricscrypto"
 	"yametrics/internal/protocol"
+	"yametrics/internal/server/idempotency"
+	"yametrics/internal/server/influx"
 	"yametrics/internal/server/models"
+	"yametrics/internal/server/prometheus"
 	"yametrics/internal/server/storage"
 
 	"github.com/go-chi/chi"
@@ -21,32 +33,263 @@ type handler struct {
 	logger         *zap.SugaredLogger
 	metricsStorage storage.MetricsStorage
 	signKey        string
+	// verifier - проверка подписей принимаемых метрик, nil - подписи не проверяются
+	verifier         *metricscrypto.Verifier
+	histogramBuckets []float64
+	// idempotency - окно ключей примененных пакетов, nil - повторы не отслеживаются
+	idempotency *idempotency.Window
+	// influxCounters - шаблоны имен метрик, целые поля которых в line protocol - накопленные counter
+	influxCounters []string
 }
 
+// NewHandler - создание обработчиков http запросов.
+// signKey - ключ подписи отдаваемых метрик, verifier - проверка подписей принимаемых метрик.
+// histogramBuckets - границы бакетов для гистограмм, значения которых приходят по одному через UpdateV1.
+// window - окно ключей идемпотентности для UpdatesV2, nil - повторы пакетов применяются заново.
+// influxCounters - шаблоны имен метрик для WriteInflux, целые поля которых считаются counter
 func NewHandler(
 	logger *zap.SugaredLogger,
 	metricsStorage storage.MetricsStorage,
-	signKey string) handler {
-	return handler{logger: logger, metricsStorage: metricsStorage, signKey: signKey}
+	signKey string,
+	verifier *metricscrypto.Verifier,
+	histogramBuckets []float64,
+	window *idempotency.Window,
+	influxCounters []string) handler {
+	return handler{
+		logger:           logger,
+		metricsStorage:   metricsStorage,
+		signKey:          signKey,
+		verifier:         verifier,
+		histogramBuckets: histogramBuckets,
+		idempotency:      window,
+		influxCounters:   influxCounters,
+	}
+}
+
+// agentID - агент, приславший запрос: заголовок X-Agent-ID или ip-адрес
+func agentID(r *http.Request) string {
+	if id := r.Header.Get(idempotency.AgentHeader); id != "" {
+		return id
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// rejectedMetric - метрика пакета, не прошедшая проверку
+type rejectedMetric struct {
+	Index int    `json:"index"`
+	ID    string `json:"id"`
+	MType string `json:"type"`
+	Error string `json:"error"`
+}
+
+// batchError - тело ответа на отклоненный пакет, Rejected - ошибки отдельных метрик
+type batchError struct {
+	Error    string           `json:"error"`
+	Rejected []rejectedMetric `json:"rejected,omitempty"`
 }
 
+func writeBatchError(w http.ResponseWriter, e batchError) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(e)
+}
+
+// UpdatesV2 - прием пакета метрик. при заданном ключе подписи пакет подписывается целиком
+// заголовком X-Batch-Sign или каждая метрика полем hash, подписи v1 принимаются на время перехода на v2. пакет применяется только целиком:
+// если хотя бы одна метрика не прошла проверку, ответ 400 с ошибками по метрикам
 func (h *handler) UpdatesV2(w http.ResponseWriter, r *http.Request) {
 	var metrics []protocol.Metrics
 	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	claim, errs, err := h.verifier.VerifyBatch(metrics, r.Header.Get(metricscrypto.BatchSignHeader), time.Now())
+	if err != nil {
+		writeBatchError(w, batchError{Error: err.Error()})
+		return
+	}
 	modelMetrics := make([]models.Metrics, len(metrics))
+	rejected := make([]rejectedMetric, 0)
 	for i := 0; i < len(modelMetrics); i++ {
-		modelMetrics[i] = models.Metrics{ID: metrics[i].ID, MType: metrics[i].MType, Delta: metrics[i].Delta, Value: metrics[i].Value}
+		modelMetrics[i] = toModel(metrics[i])
+		if _, ok := errs[i]; !ok {
+			if err := modelMetrics[i].Validate(); err != nil {
+				errs[i] = err
+			}
+		}
+		if err, ok := errs[i]; ok {
+			rejected = append(rejected, rejectedMetric{Index: i, ID: metrics[i].ID, MType: metrics[i].MType, Error: err.Error()})
+		}
+	}
+	if len(rejected) > 0 {
+		writeBatchError(w, batchError{
+			Error:    fmt.Sprintf("%d of %d metrics rejected", len(rejected), len(metrics)),
+			Rejected: rejected,
+		})
+		return
 	}
 
-	if err := h.metricsStorage.Updates(modelMetrics); err != nil {
-		h.logger.Errorf("error on UpdatesV2: %w", err)
-		w.WriteHeader(http.StatusInternalServerError)
-	} else {
-		w.WriteHeader(http.StatusOK)
+	// повтор пакета с уже примененным ключом получает исходный ответ, а counter не увеличивается второй раз.
+	// nonce подписей занимаются только для пакета, которого нет в окне, поэтому повтор с тем же ключом
+	// и той же подписью не считается атакой повтора
+	result, replayed := h.idempotency.Do(agentID(r), r.Header.Get(idempotency.Header), func() idempotency.Result {
+		if err := claim.Use(time.Now()); err != nil {
+			return idempotency.Result{Status: http.StatusBadRequest, Message: err.Error()}
+		}
+		if err := h.metricsStorage.Updates(modelMetrics); err != nil {
+			// пакет не применен, его повтор после сбоя должен быть принят
+			claim.Release()
+			h.logger.Errorf("error on UpdatesV2: %w", err)
+			return idempotency.Result{Status: updateErrorStatus(err)}
+		}
+		return idempotency.Result{Status: http.StatusOK}
+	})
+	if replayed {
+		w.Header().Set(idempotency.ReplayedHeader, "true")
+	}
+	if result.Status == http.StatusBadRequest && result.Message != "" {
+		writeBatchError(w, batchError{Error: result.Message})
+		return
+	}
+	w.WriteHeader(result.Status)
+}
+
+// maxInfluxBodySize - максимальный размер тела WriteInflux до и после распаковки
+const maxInfluxBodySize = 32 << 20
+
+// errBodyTooLarge - тело запроса больше допустимого
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedReader - чтение не больше n байт, дальше - ошибка errBodyTooLarge.
+// в отличие от io.LimitReader превышение предела не выглядит как конец данных
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
+
+// influxError - тело ответа с ошибкой в формате InfluxDB, Lines - ошибки отдельных строк
+type influxError struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Lines   []string `json:"lines,omitempty"`
+}
+
+func writeInfluxError(w http.ResponseWriter, status int, e influxError) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// writeInfluxReadError - ошибка чтения тела: превышение размера или некорректные данные
+func writeInfluxReadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errBodyTooLarge) {
+		writeInfluxError(w, http.StatusRequestEntityTooLarge, influxError{Code: "request too large", Message: err.Error()})
+		return
+	}
+	writeInfluxError(w, http.StatusBadRequest, influxError{Code: "invalid", Message: err.Error()})
+}
+
+// WriteInflux - прием метрик в формате InfluxDB line protocol (/api/v2/write, /write).
+// тело может быть сжато gzip, единица времени задается параметром precision.
+// корректные строки сохраняются, даже если в запросе есть ошибочные: тогда ответ 400 с ошибками по строкам.
+// время точек определяет только порядок применения значений одной метрики в запросе.
+// тело больше maxInfluxBodySize до или после распаковки отклоняется с ответом 413
+func (h *handler) WriteInflux(w http.ResponseWriter, r *http.Request) {
+	precision, err := influx.ParsePrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		writeInfluxError(w, http.StatusBadRequest, influxError{Code: "invalid", Message: err.Error()})
+		return
+	}
+	var body io.Reader = &limitedReader{r: http.MaxBytesReader(w, r.Body, maxInfluxBodySize+1), n: maxInfluxBodySize}
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeInfluxReadError(w, err)
+			return
+		}
+		defer gz.Close()
+		body = &limitedReader{r: gz, n: maxInfluxBodySize}
+	}
+
+	type timedMetric struct {
+		ts time.Time
+		m  models.Metrics
+	}
+	received := time.Now()
+	metrics := make([]timedMetric, 0)
+	lineErrors := make([]string, 0)
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := influx.ParseLine(line, precision)
+		if err != nil {
+			lineErrors = append(lineErrors, fmt.Sprintf("line %d: %v", n, err))
+			continue
+		}
+		pointMetrics, err := point.ToMetrics(h.influxCounters)
+		if err != nil {
+			lineErrors = append(lineErrors, fmt.Sprintf("line %d: %v", n, err))
+			continue
+		}
+		ts := point.Time
+		if ts.IsZero() {
+			ts = received
+		}
+		for i := range pointMetrics {
+			metrics = append(metrics, timedMetric{ts, pointMetrics[i]})
+		}
 	}
+	if err := scanner.Err(); err != nil {
+		writeInfluxReadError(w, err)
+		return
+	}
+
+	// значения одной метрики применяются в порядке времени точек, а не строк
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].ts.Before(metrics[j].ts) })
+	batch := make([]models.Metrics, len(metrics))
+	for i := range metrics {
+		batch[i] = metrics[i].m
+	}
+	if len(batch) > 0 {
+		if err := h.metricsStorage.Updates(batch); err != nil {
+			h.logger.Errorf("error on WriteInflux: %v", err)
+			status := updateErrorStatus(err)
+			code := "internal error"
+			if status == http.StatusBadRequest {
+				code = "invalid"
+			}
+			writeInfluxError(w, status, influxError{Code: code, Message: err.Error()})
+			return
+		}
+	}
+	if len(lineErrors) > 0 {
+		writeInfluxError(w, http.StatusBadRequest, influxError{
+			Code:    "invalid",
+			Message: fmt.Sprintf("partial write: %d lines rejected", len(lineErrors)),
+			Lines:   lineErrors,
+		})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *handler) UpdateV2(w http.ResponseWriter, r *http.Request) {
@@ -55,12 +298,19 @@ func (h *handler) UpdateV2(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if h.signKey == "" || metricscrypto.GetMetricSign(metric, h.signKey) == metric.Hash {
-		h.metricsStorage.Update(&models.Metrics{ID: metric.ID, MType: metric.MType, Delta: metric.Delta, Value: metric.Value})
+	if err := h.verifier.VerifyMetric(metric, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	modelMetric := toModel(metric)
+	if err := modelMetric.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if err := h.metricsStorage.Update(&modelMetric); err != nil {
+		h.logger.Errorf("error on UpdateV2: %w", err)
+		w.WriteHeader(updateErrorStatus(err))
+	} else {
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
-	} else {
-		http.Error(w, "bad sign", http.StatusBadRequest)
 	}
 }
 
@@ -71,16 +321,13 @@ func (h *handler) GetV2(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if metric, err := h.metricsStorage.Get(metric.ID, metric.MType); err != nil {
+	if metric, err := h.metricsStorage.Get(metric.ID, metric.MType, metric.Labels); err != nil {
 		h.logger.Errorf("error on GetV2: %w", err)
 		w.WriteHeader(http.StatusInternalServerError)
 	} else if metric == nil {
 		w.WriteHeader(http.StatusNotFound)
 	} else {
-		protocolMetric := protocol.Metrics{ID: metric.ID, MType: metric.MType, Value: metric.Value, Delta: metric.Delta}
-		if h.signKey != "" {
-			protocolMetric.Hash = metricscrypto.GetMetricSign(protocolMetric, h.signKey)
-		}
+		protocolMetric := h.signed(toProtocol(*metric))
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(protocolMetric)
@@ -95,27 +342,47 @@ func (h *handler) UpdateV1(w http.ResponseWriter, r *http.Request) {
 	var reqError error
 	var metric models.Metrics
 
-	if name != "" {
+	labels, ok := labelsFromQuery(r)
+	if !ok {
+		reqError = errors.New("param `label` must be in format key:value")
+	} else if name != "" {
 		switch mtype {
 		case protocol.GAUGE:
 			if f, err := strconv.ParseFloat(value, 64); err == nil {
-				metric = models.Metrics{ID: name, MType: protocol.GAUGE, Value: &f}
+				metric = models.Metrics{ID: name, MType: protocol.GAUGE, Labels: labels, Value: &f}
 			} else {
 				reqError = fmt.Errorf("wrong gauge param: %v", value)
 			}
 		case protocol.COUNTER:
 			if f, err := strconv.ParseInt(value, 10, 64); err == nil {
-				metric = models.Metrics{ID: name, MType: protocol.COUNTER, Delta: &f}
+				metric = models.Metrics{ID: name, MType: protocol.COUNTER, Labels: labels, Delta: &f}
 			} else {
 				reqError = fmt.Errorf("wrong counter param: %v", value)
 			}
+		case protocol.HISTOGRAM:
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				hist := histogram.New(h.histogramBuckets)
+				hist.Observe(f)
+				metric = models.Metrics{ID: name, MType: protocol.HISTOGRAM, Labels: labels, Histogram: hist}
+			} else {
+				reqError = fmt.Errorf("wrong histogram param: %v", value)
+			}
 		}
 	} else {
 		reqError = errors.New("param `name` must be nonempty")
 	}
 
 	if reqError == nil {
-		h.metricsStorage.Update(&metric)
+		// накопленное значение counter: /update/counter/PollCount/42?temporality=cumulative
+		metric.Temporality = r.URL.Query().Get("temporality")
+		reqError = metric.Validate()
+	}
+	if reqError == nil {
+		if err := h.metricsStorage.Update(&metric); err != nil {
+			h.logger.Errorf("error on UpdateV1: %w", err)
+			w.WriteHeader(updateErrorStatus(err))
+			return
+		}
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 	} else {
@@ -127,15 +394,22 @@ func (h *handler) UpdateV1(w http.ResponseWriter, r *http.Request) {
 func (h *handler) GetV1(w http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "type")
 	metricName := chi.URLParam(r, "name")
+	labels, labelsOk := labelsFromQuery(r)
 
-	if metricType != models.COUNTER && metricType != models.GAUGE {
+	if !isKnownType(metricType) {
 		h.logger.Errorf("wrong metric type: %v", metricType)
 		w.WriteHeader(http.StatusBadRequest)
-	} else if metric, err := h.metricsStorage.Get(metricName, metricType); err != nil {
+	} else if !labelsOk {
+		http.Error(w, "param `label` must be in format key:value", http.StatusBadRequest)
+	} else if metric, err := h.metricsStorage.Get(metricName, metricType, labels); err != nil {
 		h.logger.Errorf("error on GetV1, %w", err)
 		w.WriteHeader(http.StatusInternalServerError)
 	} else if metric == nil {
 		w.WriteHeader(http.StatusNotFound)
+	} else if metric.MType == models.HISTOGRAM {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(metric.Histogram)
 	} else {
 		var result string
 		if metric.MType == models.GAUGE {
@@ -149,45 +423,293 @@ func (h *handler) GetV1(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// GetAllAsHTML - отображение всех метрик в html вормате
-func (h *handler) GetAllAsHTML(w http.ResponseWriter, r *http.Request) {
-	if storageMetrics, err := h.metricsStorage.GetAll(); err != nil {
-		h.logger.Errorf("error on GetAllAsHTML: %w", err)
-		w.WriteHeader(http.StatusInternalServerError)
+// Delete - удаление метрики вместе с историей: DELETE /value/{type}/{name}?label=key:value
+//
+// если имя содержит метасимволы шаблона (*, ?, [), удаляются все метрики типа type,
+// имена которых подходят под шаблон, а метки содержат все метки из запроса.
+// в ответе число удаленных метрик, 404 - если удалять нечего.
+func (h *handler) Delete(w http.ResponseWriter, r *http.Request) {
+	metricType := chi.URLParam(r, "type")
+	metricName := chi.URLParam(r, "name")
+
+	if !isKnownType(metricType) {
+		h.logger.Errorf("wrong metric type: %v", metricType)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	labels, ok := labelsFromQuery(r)
+	if !ok {
+		http.Error(w, "param `label` must be in format key:value", http.StatusBadRequest)
+		return
+	}
+
+	var deleted int
+	var err error
+	if storage.IsPattern(metricName) {
+		deleted, err = h.metricsStorage.DeleteByPattern(metricName, metricType, labels)
 	} else {
-		allmtrcs := make([]string, len(storageMetrics))
+		var ok bool
+		if ok, err = h.metricsStorage.Delete(metricName, metricType, labels); ok {
+			deleted = 1
+		}
+	}
+	if errors.Is(err, path.ErrBadPattern) {
+		http.Error(w, fmt.Sprintf("wrong pattern: %v", metricName), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		h.logger.Errorf("error on Delete: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if deleted == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(strconv.Itoa(deleted)))
+}
 
-		for v, i := "", 0; i < len(storageMetrics); i++ {
-			if storageMetrics[i].MType == protocol.GAUGE {
-				v = fmt.Sprintf("%v", storageMetrics[i].Value)
-			} else {
-				v = fmt.Sprintf("%v", storageMetrics[i].Delta)
-			}
-			allmtrcs[i] = fmt.Sprintf("name: %v value: %v", storageMetrics[i].ID, v)
+// History - история значений метрики: GET /history/{type}/{name}?from=&to=&step=
+//
+// from и to принимаются в формате RFC3339 или unix-времени в секундах,
+// step - в формате time.ParseDuration.
+func (h *handler) History(w http.ResponseWriter, r *http.Request) {
+	metricType := chi.URLParam(r, "type")
+	metricName := chi.URLParam(r, "name")
+
+	if !isKnownType(metricType) {
+		h.logger.Errorf("wrong metric type: %v", metricType)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	labels, ok := labelsFromQuery(r)
+	if !ok {
+		http.Error(w, "param `label` must be in format key:value", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	to, err := parseTime(query.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("wrong param `to`: %v", err), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTime(query.Get("from"), to.Add(-storage.DefaultHistoryWindow))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("wrong param `from`: %v", err), http.StatusBadRequest)
+		return
+	}
+	var step time.Duration
+	if v := query.Get("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil || step < 0 {
+			http.Error(w, fmt.Sprintf("wrong param `step`: %v", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	points, err := h.metricsStorage.History(metricName, metricType, labels, from, to, step)
+	if err != nil {
+		h.logger.Errorf("error on History: %w", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	result := make([]protocol.MetricPoint, len(points))
+	for i := 0; i < len(points); i++ {
+		result[i] = protocol.MetricPoint{
+			Timestamp: points[i].Timestamp,
+			Delta:     points[i].Delta,
+			Value:     points[i].Value,
+			Histogram: points[i].Histogram,
+			Min:       points[i].Min,
+			Max:       points[i].Max,
+			Avg:       points[i].Avg,
+			Sum:       points[i].Sum,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// лимиты выборки метрик /values
+const (
+	defaultValuesLimit = 100
+	maxValuesLimit     = 1000
+)
+
+// valuesCursor - курсор страницы /values: позиция и сортировка, для которой она получена
+type valuesCursor struct {
+	storage.Cursor
+	SortBy string `json:"sort"`
+	Desc   bool   `json:"desc"`
+}
+
+// Values - выборка метрик в json: GET /values?type=&prefix=&match=&regex=&label=key:value&sort=&limit=&cursor=
+//
+// match - шаблон имени в формате path.Match, regex - регулярное выражение для имени.
+// sort - id (по умолчанию), type или updated, знак "-" перед полем - обратный порядок.
+// cursor - значение next из предыдущей страницы, передается с той же сортировкой.
+func (h *handler) Values(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	selector, ok := labelsFromQuery(r)
+	if !ok {
+		http.Error(w, "param `label` must be in format key:value", http.StatusBadRequest)
+		return
+	}
+	q := storage.Query{
+		MType:    query.Get("type"),
+		Prefix:   query.Get("prefix"),
+		Pattern:  query.Get("match"),
+		Regexp:   query.Get("regex"),
+		Selector: selector,
+		Limit:    defaultValuesLimit,
+	}
+	if q.MType != "" && !isKnownType(q.MType) {
+		http.Error(w, fmt.Sprintf("wrong metric type: %v", q.MType), http.StatusBadRequest)
+		return
+	}
+	q.SortBy = query.Get("sort")
+	if strings.HasPrefix(q.SortBy, "-") {
+		q.SortBy, q.Desc = q.SortBy[1:], true
+	}
+	if q.SortBy == "" {
+		q.SortBy = storage.SortByID
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxValuesLimit {
+			http.Error(w, fmt.Sprintf("wrong param `limit`: %v, expected 1..%d", v, maxValuesLimit), http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+	if v := query.Get("cursor"); v != "" {
+		var cursor valuesCursor
+		data, err := base64.RawURLEncoding.DecodeString(v)
+		if err == nil {
+			err = json.Unmarshal(data, &cursor)
+		}
+		if err != nil || cursor.SortBy != q.SortBy || cursor.Desc != q.Desc {
+			http.Error(w, "wrong param `cursor`", http.StatusBadRequest)
+			return
 		}
+		q.After = &cursor.Cursor
+	}
 
-		tmpl, err := template.New("test").Parse(`
-		<html>
-			<head>
-			<title></title>
-			</head>
-			<body>
-			{{ range $key, $value := . }}
-			<li>{{ $value }}</li>
-			{{ end }}
-			</body>
-		</html>`)
+	// лишняя метрика показывает, что есть следующая страница
+	limit := q.Limit
+	q.Limit++
+	metrics, err := h.metricsStorage.Query(q)
+	if errors.Is(err, storage.ErrBadQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		h.logger.Errorf("error on Values: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
+	page := protocol.MetricsPage{Metrics: make([]protocol.Metrics, 0, len(metrics))}
+	if len(metrics) > limit {
+		metrics = metrics[:limit]
+		data, err := json.Marshal(valuesCursor{Cursor: *storage.CursorOf(&metrics[limit-1]), SortBy: q.SortBy, Desc: q.Desc})
 		if err != nil {
-			h.logger.Errorf("Error Parsing template: %w", err)
+			h.logger.Errorf("error on Values: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		err1 := tmpl.Execute(w, allmtrcs)
-		if err1 != nil {
-			h.logger.Errorf("Error executing template: %w", err1)
+		page.Next = base64.RawURLEncoding.EncodeToString(data)
+	}
+	for i := range metrics {
+		page.Metrics = append(page.Metrics, h.signed(toProtocol(metrics[i])))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(page)
+}
+
+// ValuesBatch - метрики по списку ключей (id, type, labels): POST /values.
+// в ответе найденные метрики в порядке запроса, отсутствующие пропускаются.
+// если задан ключ подписи, метрики подписываются, как в GetV2
+func (h *handler) ValuesBatch(w http.ResponseWriter, r *http.Request) {
+	var keys []protocol.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(keys) > maxValuesLimit {
+		http.Error(w, fmt.Sprintf("too many metrics requested: %d, max %d", len(keys), maxValuesLimit), http.StatusBadRequest)
+		return
+	}
+	result := make([]protocol.Metrics, 0, len(keys))
+	for _, key := range keys {
+		if !isKnownType(key.MType) {
+			http.Error(w, fmt.Sprintf("wrong metric type: %v", key.MType), http.StatusBadRequest)
+			return
 		}
+		metric, err := h.metricsStorage.Get(key.ID, key.MType, key.Labels)
+		if err != nil {
+			h.logger.Errorf("error on ValuesBatch: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if metric != nil {
+			result = append(result, h.signed(toProtocol(*metric)))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// signed - метрика с подписью, если задан ключ подписи. схема подписи та же, что принимается от агентов
+func (h *handler) signed(m protocol.Metrics) protocol.Metrics {
+	if h.signKey != "" {
+		m.Hash = metricscrypto.SignMetric(m, h.signKey, h.verifier.SignVersion(), time.Now())
+	}
+	return m
+}
+
+// parseTime - разбор времени в формате RFC3339 или unix-времени в секундах
+func parseTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// Metrics - все метрики в текстовом формате prometheus или в OpenMetrics, если клиент принимает его (Accept).
+// метрики можно отфильтровать по меткам: /metrics?label=host:web-1
+func (h *handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	selector, ok := labelsFromQuery(r)
+	if !ok {
+		http.Error(w, "param `label` must be in format key:value", http.StatusBadRequest)
+		return
+	}
+	storageMetrics, err := h.metricsStorage.GetAll()
+	if err != nil {
+		h.logger.Errorf("error on Metrics: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	selected := make([]models.Metrics, 0, len(storageMetrics))
+	for i := range storageMetrics {
+		if storageMetrics[i].Labels.Match(selector) {
+			selected = append(selected, storageMetrics[i])
+		}
+	}
+
+	format := prometheus.Negotiate(r.Header.Get("Accept"))
+	w.Header().Set("Content-Type", format.ContentType())
+	skipped, err := prometheus.Write(w, selected, format)
+	if err != nil {
+		h.logger.Errorf("error on write metrics: %v", err)
+	}
+	for i := range skipped {
+		h.logger.Warnf("metric %s (%s) skipped: name conflicts with metric of another type", skipped[i].Key(), skipped[i].MType)
 	}
 }
 
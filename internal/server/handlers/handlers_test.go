@@ -2,19 +2,30 @@ package handlers
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path"
+	"strings"
 	"testing"
+	"time"
+	"yametrics/internal/histogram"
+	"yametrics/internal/metricscrypto"
 	"yametrics/internal/protocol"
+	"yametrics/internal/server/config"
+	"yametrics/internal/server/idempotency"
 	"yametrics/internal/server/models"
+	"yametrics/internal/server/prometheus"
 	"yametrics/internal/server/storage"
 
 	"github.com/go-chi/chi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
 
@@ -27,8 +38,8 @@ func getLogger() *zap.SugaredLogger {
 	return l.Sugar()
 }
 
-func (s *MockMetricStorage) Get(id string, mtype string) (*models.Metrics, error) {
-	rs := s.Called(id, mtype)
+func (s *MockMetricStorage) Get(id string, mtype string, labels models.Labels) (*models.Metrics, error) {
+	rs := s.Called(id, mtype, labels)
 	if result := rs.Get(0); result != nil {
 		return result.(*models.Metrics), nil
 	} else {
@@ -41,6 +52,26 @@ func (s *MockMetricStorage) GetAll() ([]models.Metrics, error) {
 	return rs.Get(0).([]models.Metrics), nil
 }
 
+func (s *MockMetricStorage) Query(q storage.Query) ([]models.Metrics, error) {
+	rs := s.Called(q)
+	return rs.Get(0).([]models.Metrics), rs.Error(1)
+}
+
+func (s *MockMetricStorage) History(id string, mtype string, labels models.Labels, from time.Time, to time.Time, step time.Duration) ([]models.MetricPoint, error) {
+	rs := s.Called(id, mtype, labels, from, to, step)
+	return rs.Get(0).([]models.MetricPoint), nil
+}
+
+func (s *MockMetricStorage) Delete(id string, mtype string, labels models.Labels) (bool, error) {
+	rs := s.Called(id, mtype, labels)
+	return rs.Bool(0), rs.Error(1)
+}
+
+func (s *MockMetricStorage) DeleteByPattern(pattern string, mtype string, selector models.Labels) (int, error) {
+	rs := s.Called(pattern, mtype, selector)
+	return rs.Int(0), rs.Error(1)
+}
+
 func (s *MockMetricStorage) Update(m *models.Metrics) error { return nil }
 
 func (s *MockMetricStorage) Check() error                   { return nil }
@@ -49,7 +80,7 @@ func (s *MockMetricStorage) Updates([]models.Metrics) error { return nil }
 
 func TestGetV2(t *testing.T) {
 	metricStorage := new(MockMetricStorage)
-	handler := &handler{getLogger(), metricStorage, ""}
+	handler := &handler{logger: getLogger(), metricsStorage: metricStorage}
 	tests := []struct {
 		name     string
 		code     int
@@ -63,7 +94,7 @@ func TestGetV2(t *testing.T) {
 				r := protocol.Metrics{ID: "1", MType: "gauge"}
 				json, _ := json.Marshal(r)
 				v := 1.0
-				metricStorage.On("Get", "1", "gauge").Return(&models.Metrics{ID: "1", MType: "gauge", Value: &v}, true)
+				metricStorage.On("Get", "1", "gauge", models.Labels(nil)).Return(&models.Metrics{ID: "1", MType: "gauge", Value: &v}, true)
 				return json
 			}(),
 			func() *protocol.Metrics {
@@ -101,7 +132,7 @@ func TestGetV2(t *testing.T) {
 
 func TestUpdateV2(t *testing.T) {
 	v := 1.0
-	handler := &handler{getLogger(), new(MockMetricStorage), ""}
+	handler := &handler{logger: getLogger(), metricsStorage: new(MockMetricStorage)}
 	tests := []struct {
 		name string
 		code int
@@ -111,7 +142,17 @@ func TestUpdateV2(t *testing.T) {
 			"200",
 			200,
 			func() []byte {
-				json, _ := json.Marshal(&models.Metrics{ID: "1", MType: "gauge", Value: &v})
+				json, _ := json.Marshal(&protocol.Metrics{ID: "1", MType: "gauge", Value: &v})
+				return json
+			}(),
+		},
+		{
+			"200 histogram",
+			200,
+			func() []byte {
+				h := histogram.New([]float64{1, 10})
+				h.Observe(5)
+				json, _ := json.Marshal(&protocol.Metrics{ID: "1", MType: "histogram", Histogram: h})
 				return json
 			}(),
 		},
@@ -123,6 +164,22 @@ func TestUpdateV2(t *testing.T) {
 				return json
 			}(),
 		},
+		{
+			"400 gauge without value",
+			400,
+			func() []byte {
+				json, _ := json.Marshal(&protocol.Metrics{ID: "1", MType: "gauge"})
+				return json
+			}(),
+		},
+		{
+			"400 broken histogram",
+			400,
+			func() []byte {
+				json, _ := json.Marshal(&protocol.Metrics{ID: "1", MType: "histogram", Histogram: &histogram.Histogram{Bounds: []float64{1}, Counts: []uint64{1}, Count: 1}})
+				return json
+			}(),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -138,7 +195,7 @@ func TestUpdateV2(t *testing.T) {
 }
 
 func TestUpdateV1(t *testing.T) {
-	handler := &handler{getLogger(), new(MockMetricStorage), ""}
+	handler := &handler{logger: getLogger(), metricsStorage: new(MockMetricStorage)}
 	tests := []struct {
 		name string
 		code int
@@ -190,6 +247,22 @@ func TestUpdateV1(t *testing.T) {
 			return rctx
 		}(),
 		},
+		{"200", 200, func() (c *chi.Context) {
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("name", "metric_name")
+			rctx.URLParams.Add("value", "0.3")
+			rctx.URLParams.Add("type", "histogram")
+			return rctx
+		}(),
+		},
+		{"400 Bad Request - incorrect value", 400, func() (c *chi.Context) {
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("name", "metric_name")
+			rctx.URLParams.Add("value", "a")
+			rctx.URLParams.Add("type", "histogram")
+			return rctx
+		}(),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -205,6 +278,205 @@ func TestUpdateV1(t *testing.T) {
 	}
 }
 
+// countingStorage - хранилище, которое считает примененные пакеты и запоминает последний.
+// пока задана ошибка err, пакеты не применяются
+type countingStorage struct {
+	MockMetricStorage
+	batches int
+	last    []models.Metrics
+	err     error
+}
+
+func (s *countingStorage) Updates(metrics []models.Metrics) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.batches++
+	s.last = metrics
+	return nil
+}
+
+func TestUpdatesV2Idempotency(t *testing.T) {
+	metricStorage := new(countingStorage)
+	window, err := idempotency.NewWindow(nil, 10, 0, time.Hour, getLogger())
+	assert.NoError(t, err)
+	handler := &handler{logger: getLogger(), metricsStorage: metricStorage, idempotency: window}
+	delta := int64(1)
+	body, _ := json.Marshal([]protocol.Metrics{{ID: "PollCount", MType: models.COUNTER, Delta: &delta}})
+
+	send := func(agent string, key string) *http.Response {
+		request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		request.Header.Set(idempotency.AgentHeader, agent)
+		request.Header.Set(idempotency.Header, key)
+		w := httptest.NewRecorder()
+		http.HandlerFunc(handler.UpdatesV2).ServeHTTP(w, request)
+		res := w.Result()
+		res.Body.Close()
+		return res
+	}
+
+	res := send("agent1", "batch1")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get(idempotency.ReplayedHeader))
+
+	res = send("agent1", "batch1")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "true", res.Header.Get(idempotency.ReplayedHeader))
+	assert.Equal(t, 1, metricStorage.batches, "replayed batch is not applied")
+
+	send("agent2", "batch1")
+	send("agent1", "batch2")
+	send("agent1", "")
+	send("agent1", "")
+	assert.Equal(t, 5, metricStorage.batches)
+}
+
+func TestUpdatesV2Sign(t *testing.T) {
+	metricStorage := new(countingStorage)
+	handler := &handler{logger: getLogger(), metricsStorage: metricStorage, signKey: "key", verifier: metricscrypto.NewVerifier("key", 0, true)}
+	v, d := 1.5, int64(2)
+	signed := []protocol.Metrics{
+		{ID: "Alloc", MType: models.GAUGE, Value: &v, Labels: map[string]string{"host": "web"}},
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d, Temporality: protocol.CUMULATIVE},
+	}
+	for i := range signed {
+		signed[i].Hash = metricscrypto.GetMetricSign(signed[i], "key")
+	}
+	unsigned := []protocol.Metrics{{ID: "Alloc", MType: models.GAUGE, Value: &v}, {ID: "PollCount", MType: models.COUNTER, Delta: &d}}
+
+	send := func(metrics []protocol.Metrics, batchSign string) (int, batchError) {
+		body, _ := json.Marshal(metrics)
+		request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		if batchSign != "" {
+			request.Header.Set(metricscrypto.BatchSignHeader, batchSign)
+		}
+		w := httptest.NewRecorder()
+		handler.UpdatesV2(w, request)
+		var e batchError
+		if w.Code != http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&e))
+		}
+		return w.Code, e
+	}
+
+	code, _ := send(signed, "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = send(unsigned, metricscrypto.GetBatchSign(unsigned, "key"))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2, metricStorage.batches)
+
+	batchSign := metricscrypto.GetBatchSignV2(unsigned, "key", time.Now())
+	code, _ = send(unsigned, batchSign)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3, metricStorage.batches)
+	code, e := send(unsigned, batchSign)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, metricscrypto.ErrReplayed.Error(), e.Error)
+
+	code, e = send(unsigned, metricscrypto.GetBatchSign(unsigned, "other"))
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, metricscrypto.ErrBadBatchSign.Error(), e.Error)
+	assert.Empty(t, e.Rejected)
+
+	// пакет с неподписанной и некорректной метриками не применяется, ошибки возвращаются по метрикам
+	v2 := 2.5
+	tampered := append([]protocol.Metrics{}, signed...)
+	tampered[0].Value = &v2
+	tampered = append(tampered, unsigned[1], protocol.Metrics{ID: "Alloc", MType: "summary"})
+	tampered[3].Hash = metricscrypto.GetMetricSignV2(tampered[3], "key", time.Now())
+	tampered = append(tampered, signed[1])
+	tampered[4].Hash = metricscrypto.GetMetricSignV2(tampered[4], "key", time.Now().Add(-time.Hour))
+	code, e = send(tampered, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "4 of 5 metrics rejected", e.Error)
+	require.Len(t, e.Rejected, 4)
+	assert.Equal(t, rejectedMetric{Index: 0, ID: "Alloc", MType: models.GAUGE, Error: "bad sign"}, e.Rejected[0])
+	assert.Equal(t, rejectedMetric{Index: 2, ID: "PollCount", MType: models.COUNTER, Error: "bad sign"}, e.Rejected[1])
+	assert.Equal(t, 3, e.Rejected[2].Index)
+	assert.NotEqual(t, "bad sign", e.Rejected[2].Error)
+	assert.Equal(t, rejectedMetric{Index: 4, ID: "PollCount", MType: models.COUNTER, Error: metricscrypto.ErrSignExpired.Error()}, e.Rejected[3])
+	assert.Equal(t, 3, metricStorage.batches)
+}
+
+func TestUpdatesV2SignRetry(t *testing.T) {
+	metricStorage := new(countingStorage)
+	window, err := idempotency.NewWindow(nil, 10, 0, time.Hour, getLogger())
+	require.NoError(t, err)
+	handler := &handler{logger: getLogger(), metricsStorage: metricStorage, verifier: metricscrypto.NewVerifier("key", 0, true), idempotency: window}
+	delta := int64(1)
+	metrics := []protocol.Metrics{{ID: "PollCount", MType: models.COUNTER, Delta: &delta}}
+	body, _ := json.Marshal(metrics)
+
+	send := func(key string, batchSign string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		request.Header.Set(idempotency.AgentHeader, "agent1")
+		request.Header.Set(idempotency.Header, key)
+		request.Header.Set(metricscrypto.BatchSignHeader, batchSign)
+		w := httptest.NewRecorder()
+		handler.UpdatesV2(w, request)
+		return w
+	}
+
+	// повтор с тем же ключом и той же подписью получает сохраненный ответ, а не ошибку повтора подписи
+	batchSign := metricscrypto.GetBatchSignV2(metrics, "key", time.Now())
+	w := send("batch1", batchSign)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = send("batch1", batchSign)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get(idempotency.ReplayedHeader))
+	assert.Equal(t, 1, metricStorage.batches)
+
+	// та же подпись с другим ключом - повтор
+	w = send("batch2", batchSign)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var e batchError
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&e))
+	assert.Equal(t, metricscrypto.ErrReplayed.Error(), e.Error)
+	assert.Equal(t, 1, metricStorage.batches)
+
+	// пакет, не примененный из-за ошибки хранилища, принимается при повторе
+	batchSign = metricscrypto.GetBatchSignV2(metrics, "key", time.Now())
+	metricStorage.err = errors.New("storage is unavailable")
+	w = send("batch3", batchSign)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	metricStorage.err = nil
+	w = send("batch3", batchSign)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(idempotency.ReplayedHeader))
+	assert.Equal(t, 2, metricStorage.batches)
+}
+
+func TestUpdateV1Temporality(t *testing.T) {
+	handler := &handler{logger: getLogger(), metricsStorage: new(MockMetricStorage)}
+	tests := []struct {
+		name  string
+		code  int
+		mtype string
+		query string
+	}{
+		{"200 cumulative counter", 200, models.COUNTER, "?temporality=cumulative"},
+		{"200 delta counter", 200, models.COUNTER, "?temporality=delta"},
+		{"400 cumulative gauge", 400, models.GAUGE, "?temporality=cumulative"},
+		{"400 unknown temporality", 400, models.COUNTER, "?temporality=monotonic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("name", "PollCount")
+			rctx.URLParams.Add("value", "5")
+			rctx.URLParams.Add("type", tt.mtype)
+			request := httptest.NewRequest(http.MethodPost, "/update/"+tt.query, nil)
+			request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(handler.UpdateV1)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+		})
+	}
+}
+
 func TestGetV1(t *testing.T) {
 	existMetricName := "existMetricName"
 	ubsentMetricName := "ubsentMetricName"
@@ -221,7 +493,7 @@ func TestGetV1(t *testing.T) {
 				r := new(MockMetricStorage)
 				v := 1.0
 				model := models.Metrics{ID: "1", MType: models.GAUGE, Value: &v}
-				r.On("Get", existMetricName, models.GAUGE).Return(&model, true)
+				r.On("Get", existMetricName, models.GAUGE, models.Labels(nil)).Return(&model, true)
 				return r
 			}(),
 			200,
@@ -237,7 +509,7 @@ func TestGetV1(t *testing.T) {
 			"guage, 404 Not Found",
 			func() storage.MetricsStorage {
 				r := new(MockMetricStorage)
-				r.On("Get", ubsentMetricName, models.GAUGE).Return(nil, false)
+				r.On("Get", ubsentMetricName, models.GAUGE, models.Labels(nil)).Return(nil, false)
 				return r
 			}(),
 			404,
@@ -262,7 +534,7 @@ func TestGetV1(t *testing.T) {
 				r := new(MockMetricStorage)
 				var d int64 = 1
 				model := models.Metrics{ID: "1", MType: models.COUNTER, Delta: &d}
-				r.On("Get", existMetricName, models.COUNTER).Return(&model, true)
+				r.On("Get", existMetricName, models.COUNTER, models.Labels(nil)).Return(&model, true)
 				return r
 			}(),
 			200,
@@ -278,7 +550,7 @@ func TestGetV1(t *testing.T) {
 			"counter, 404 Not Found",
 			func() storage.MetricsStorage {
 				r := new(MockMetricStorage)
-				r.On("Get", ubsentMetricName, models.COUNTER).Return(nil, false)
+				r.On("Get", ubsentMetricName, models.COUNTER, models.Labels(nil)).Return(nil, false)
 				return r
 			}(),
 			404,
@@ -296,7 +568,7 @@ func TestGetV1(t *testing.T) {
 			request := httptest.NewRequest(http.MethodPost, "/", nil)
 			request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, tt.rctx))
 			w := httptest.NewRecorder()
-			handler := &handler{getLogger(), tt.metricStorage, ""}
+			handler := &handler{logger: getLogger(), metricsStorage: tt.metricStorage}
 			h := http.HandlerFunc(handler.GetV1)
 			h.ServeHTTP(w, request)
 			res := w.Result()
@@ -314,3 +586,313 @@ func TestGetV1(t *testing.T) {
 		})
 	}
 }
+
+func TestHistory(t *testing.T) {
+	from := time.Unix(1000, 0)
+	to := time.Unix(2000, 0)
+	v := 1.0
+	points := []models.MetricPoint{{Timestamp: time.Unix(1500, 0).UTC(), Value: &v}}
+
+	metricStorage := new(MockMetricStorage)
+	metricStorage.On("History", "Alloc", models.GAUGE, models.Labels(nil), from, to, time.Minute).Return(points)
+	handler := &handler{logger: getLogger(), metricsStorage: metricStorage}
+
+	tests := []struct {
+		name     string
+		code     int
+		mtype    string
+		query    string
+		response []protocol.MetricPoint
+	}{
+		{"200", 200, models.GAUGE, "?from=1000&to=2000&step=1m", []protocol.MetricPoint{{Timestamp: time.Unix(1500, 0).UTC(), Value: &v}}},
+		{"400 wrong type", 400, "unknown", "?from=1000&to=2000", nil},
+		{"400 wrong from", 400, models.GAUGE, "?from=yesterday&to=2000", nil},
+		{"400 wrong step", 400, models.GAUGE, "?from=1000&to=2000&step=-1m", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("type", tt.mtype)
+			rctx.URLParams.Add("name", "Alloc")
+			request := httptest.NewRequest(http.MethodGet, "/history/"+tt.mtype+"/Alloc"+tt.query, nil)
+			request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(handler.History)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			if tt.response != nil {
+				var result []protocol.MetricPoint
+				json.NewDecoder(res.Body).Decode(&result)
+				assert.Equal(t, tt.response, result)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	web := models.Labels{"host": "web"}
+	metricStorage := new(MockMetricStorage)
+	metricStorage.On("Delete", "Alloc", models.GAUGE, models.Labels(nil)).Return(true, nil)
+	metricStorage.On("Delete", "Unknown", models.GAUGE, models.Labels(nil)).Return(false, nil)
+	metricStorage.On("DeleteByPattern", "Heap*", models.GAUGE, web).Return(3, nil)
+	metricStorage.On("DeleteByPattern", "Heap[", models.GAUGE, models.Labels(nil)).Return(0, path.ErrBadPattern)
+	handler := &handler{logger: getLogger(), metricsStorage: metricStorage}
+
+	tests := []struct {
+		name       string
+		code       int
+		mtype      string
+		metricName string
+		query      string
+		response   string
+	}{
+		{"200", 200, models.GAUGE, "Alloc", "", "1"},
+		{"200 pattern", 200, models.GAUGE, "Heap*", "?label=host:web", "3"},
+		{"404", 404, models.GAUGE, "Unknown", "", ""},
+		{"400 wrong type", 400, "unknown", "Alloc", "", ""},
+		{"400 wrong pattern", 400, models.GAUGE, "Heap[", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("type", tt.mtype)
+			rctx.URLParams.Add("name", tt.metricName)
+			request := httptest.NewRequest(http.MethodDelete, "/value/"+tt.mtype+"/metric"+tt.query, nil)
+			request = request.WithContext(context.WithValue(request.Context(), chi.RouteCtxKey, rctx))
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(handler.Delete)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			if tt.code == http.StatusOK {
+				body, _ := io.ReadAll(res.Body)
+				assert.Equal(t, tt.response, string(body))
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	web := 1.0
+	delta := int64(3)
+	metricStorage := new(MockMetricStorage)
+	metricStorage.On("GetAll").Return([]models.Metrics{
+		{ID: "Alloc", MType: models.GAUGE, Labels: models.Labels{"host": "web"}, Value: &web},
+		{ID: "PollCount", MType: models.COUNTER, Labels: models.Labels{"host": "db"}, Delta: &delta},
+	})
+	handler := &handler{logger: getLogger(), metricsStorage: metricStorage}
+
+	tests := []struct {
+		name        string
+		code        int
+		query       string
+		accept      string
+		contentType string
+		contains    []string
+		excludes    []string
+	}{
+		{"text", 200, "", "", prometheus.TextContentType,
+			[]string{"# TYPE Alloc gauge\nAlloc{host=\"web\"} 1\n", "# TYPE PollCount counter\nPollCount{host=\"db\"} 3\n"}, []string{"# EOF"}},
+		{"openmetrics", 200, "", "application/openmetrics-text; version=1.0.0", prometheus.OpenMetricsContentType,
+			[]string{"PollCount_total{host=\"db\"} 3\n", "# EOF\n"}, nil},
+		{"filter by label", 200, "?label=host:web", "", prometheus.TextContentType, []string{"Alloc"}, []string{"PollCount"}},
+		{"wrong label", 400, "?label=host", "", "", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/metrics"+tt.query, nil)
+			request.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			h := http.HandlerFunc(handler.Metrics)
+			h.ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			if tt.contentType != "" {
+				assert.Equal(t, tt.contentType, res.Header.Get("Content-Type"))
+			}
+			data, err := io.ReadAll(res.Body)
+			if assert.NoError(t, err) {
+				for _, c := range tt.contains {
+					assert.Contains(t, string(data), c)
+				}
+				for _, c := range tt.excludes {
+					assert.NotContains(t, string(data), c)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteInflux(t *testing.T) {
+	gzipped := func(body string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(body))
+		gz.Close()
+		return buf.Bytes()
+	}
+	// тело из комментариев чуть больше предела: строки пропускаются без разбора
+	comments := strings.Repeat("#"+strings.Repeat("x", 1022)+"\n", maxInfluxBodySize/1024+1)
+	tests := []struct {
+		name     string
+		url      string
+		body     []byte
+		gzip     bool
+		code     int
+		ids      []string
+		contains string
+	}{
+		{"v2", "/api/v2/write?precision=s", []byte("cpu,host=a usage=2 20\ncpu,host=a usage=1 10\nnet bytes_recv=5i\n"), false, 204,
+			[]string{"cpu_usage", "cpu_usage", "net_bytes_recv"}, ""},
+		{"gzip", "/write", gzipped("# comment\nmem free=1\n"), true, 204, []string{"mem_free"}, ""},
+		{"partial write", "/api/v2/write", []byte("mem free=1\nbroken\nmem used=x\n"), false, 400, []string{"mem_free"}, `"line 2: bad line protocol`},
+		{"bad precision", "/api/v2/write?precision=h", []byte("mem free=1"), false, 400, nil, "unknown precision"},
+		{"bad gzip", "/write", []byte("mem free=1"), true, 400, nil, `"invalid"`},
+		{"too large", "/write", []byte(comments), false, 413, nil, "too large"},
+		// небольшое сжатое тело, распаковка которого превышает предел
+		{"gzip bomb", "/write", gzipped(comments), true, 413, nil, "too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metricStorage := new(countingStorage)
+			handler := &handler{logger: getLogger(), metricsStorage: metricStorage, influxCounters: []string{"*_bytes_*"}}
+			request := httptest.NewRequest(http.MethodPost, tt.url, bytes.NewReader(tt.body))
+			if tt.gzip {
+				request.Header.Set("Content-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+			http.HandlerFunc(handler.WriteInflux).ServeHTTP(w, request)
+			res := w.Result()
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode, "wrong status")
+			data, err := io.ReadAll(res.Body)
+			assert.NoError(t, err)
+			assert.Contains(t, string(data), tt.contains)
+			ids := make([]string, 0)
+			for _, m := range metricStorage.last {
+				ids = append(ids, m.ID)
+			}
+			assert.ElementsMatch(t, tt.ids, ids)
+		})
+	}
+
+	// значения одной метрики применяются в порядке времени, а не строк
+	metricStorage := new(countingStorage)
+	handler := &handler{logger: getLogger(), metricsStorage: metricStorage, influxCounters: []string{"net_bytes_*"}}
+	request := httptest.NewRequest(http.MethodPost, "/write?precision=s", bytes.NewBufferString("cpu usage=2 20\ncpu usage=1 10\nnet bytes_recv=5i 15"))
+	http.HandlerFunc(handler.WriteInflux).ServeHTTP(httptest.NewRecorder(), request)
+	if assert.Len(t, metricStorage.last, 3) {
+		assert.Equal(t, 1.0, *metricStorage.last[0].Value)
+		assert.Equal(t, models.CUMULATIVE, metricStorage.last[1].Temporality)
+		assert.Equal(t, 2.0, *metricStorage.last[2].Value)
+	}
+}
+
+func TestValues(t *testing.T) {
+	metricStorage, err := storage.NewFileMetricsStorage(&config.ServerConfig{}, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	v, d := 1.5, int64(2)
+	require.NoError(t, metricStorage.Updates([]models.Metrics{
+		{ID: "HeapAlloc", MType: models.GAUGE, Labels: models.Labels{"host": "web"}, Value: &v},
+		{ID: "HeapInuse", MType: models.GAUGE, Labels: models.Labels{"host": "web"}, Value: &v},
+		{ID: "HeapInuse", MType: models.GAUGE, Labels: models.Labels{"host": "db"}, Value: &v},
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d},
+	}))
+	handler := &handler{logger: getLogger(), metricsStorage: metricStorage, signKey: "key"}
+
+	get := func(query string) (int, protocol.MetricsPage) {
+		w := httptest.NewRecorder()
+		handler.Values(w, httptest.NewRequest(http.MethodGet, "/values"+query, nil))
+		var page protocol.MetricsPage
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		}
+		return w.Code, page
+	}
+	keys := func(page protocol.MetricsPage) []string {
+		result := make([]string, len(page.Metrics))
+		for i, m := range page.Metrics {
+			result[i] = models.MetricKey(m.ID, m.Labels)
+		}
+		return result
+	}
+
+	code, page := get("")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"HeapAlloc{host=web}", "HeapInuse{host=db}", "HeapInuse{host=web}", "PollCount"}, keys(page))
+	assert.Empty(t, page.Next)
+	// без подписей v1 ответы подписываются по схеме v2
+	assert.True(t, strings.HasPrefix(page.Metrics[3].Hash, "v2:"))
+	assert.NoError(t, metricscrypto.NewVerifier("key", 0, false).VerifyMetric(page.Metrics[3], time.Now()))
+
+	_, page = get("?type=gauge&prefix=Heap&match=*Inuse&label=host:web")
+	assert.Equal(t, []string{"HeapInuse{host=web}"}, keys(page))
+	_, page = get("?regex=Alloc$|Count$&sort=-id")
+	assert.Equal(t, []string{"PollCount", "HeapAlloc{host=web}"}, keys(page))
+
+	// постраничная выборка в обратном порядке
+	collected := make([]string, 0)
+	query := "?sort=-id&limit=3"
+	for {
+		code, page = get(query)
+		require.Equal(t, http.StatusOK, code)
+		collected = append(collected, keys(page)...)
+		if page.Next == "" {
+			break
+		}
+		query = "?sort=-id&limit=3&cursor=" + page.Next
+	}
+	assert.Equal(t, []string{"PollCount", "HeapInuse{host=web}", "HeapInuse{host=db}", "HeapAlloc{host=web}"}, collected)
+
+	_, page = get("?limit=2")
+	for _, query := range []string{"?type=summary", "?match=Heap[", "?regex=(", "?sort=value", "?limit=0", "?limit=1001", "?label=host",
+		"?cursor=bad", "?sort=-id&cursor=" + page.Next} {
+		code, _ = get(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
+
+func TestValuesBatch(t *testing.T) {
+	v := 1.5
+	metricStorage := new(MockMetricStorage)
+	metricStorage.On("Get", "Alloc", models.GAUGE, models.Labels{"host": "web"}).Return(&models.Metrics{ID: "Alloc", MType: models.GAUGE, Labels: models.Labels{"host": "web"}, Value: &v})
+	metricStorage.On("Get", "Missing", models.GAUGE, models.Labels(nil)).Return(nil)
+	// пока принимаются подписи v1, ответы подписываются по схеме v1
+	handler := &handler{logger: getLogger(), metricsStorage: metricStorage, signKey: "key", verifier: metricscrypto.NewVerifier("key", 0, true)}
+
+	tests := []struct {
+		name string
+		body string
+		code int
+		want []string
+	}{
+		{"found and missing", `[{"id":"Missing","type":"gauge"},{"id":"Alloc","type":"gauge","labels":{"host":"web"}}]`, 200, []string{"Alloc"}},
+		{"wrong type", `[{"id":"Alloc","type":"summary"}]`, 400, nil},
+		{"wrong body", `{"id":"Alloc"}`, 400, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ValuesBatch(w, httptest.NewRequest(http.MethodPost, "/values", bytes.NewBufferString(tt.body)))
+			require.Equal(t, tt.code, w.Code)
+			if tt.code != http.StatusOK {
+				return
+			}
+			var result []protocol.Metrics
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+			require.Len(t, result, len(tt.want))
+			for i, m := range result {
+				assert.Equal(t, tt.want[i], m.ID)
+				assert.Equal(t, metricscrypto.GetMetricSign(m, "key"), m.Hash)
+			}
+		})
+	}
+}
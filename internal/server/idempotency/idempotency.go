@@ -0,0 +1,302 @@
+// Package idempotency - защита от повторного применения пакетов метрик.
+// клиент помечает пакет ключом (заголовок Idempotency-Key или метаданные grpc),
+// сервер запоминает результат применения последних пакетов каждого агента
+// и на повторную отправку того же пакета возвращает запомненный результат, не применяя пакет снова
+package idempotency
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Header - заголовок http-запроса с ключом пакета
+	Header = "Idempotency-Key"
+	// AgentHeader - заголовок с идентификатором агента, без него агент определяется по ip-адресу
+	AgentHeader = "X-Agent-ID"
+	// MetadataKey - ключ метаданных grpc с ключом пакета
+	MetadataKey = "idempotency-key"
+	// AgentMetadataKey - ключ метаданных grpc с идентификатором агента
+	AgentMetadataKey = "x-agent-id"
+	// ReplayedHeader - заголовок ответа на повтор уже примененного пакета
+	ReplayedHeader = "Idempotent-Replayed"
+
+	// DefaultSize - число ключей, запоминаемых для каждого агента
+	DefaultSize = 1000
+	// DefaultLimit - число ключей, запоминаемых для всех агентов вместе
+	DefaultLimit = 100000
+	// DefaultTTL - время, в течение которого ключ считается повтором
+	DefaultTTL = 24 * time.Hour
+	// DefaultSaveInterval - период сохранения окна в хранилище
+	DefaultSaveInterval = time.Second
+
+	// stateName - имя состояния окна в хранилище
+	stateName = "idempotency"
+)
+
+// Store - хранилище служебного состояния, в котором окно переживает перезапуск сервера
+type Store interface {
+	LoadState(name string) ([]byte, error)
+	SaveState(name string, data []byte) error
+}
+
+// Result - результат применения пакета в виде http-статуса и текста ошибки
+type Result struct {
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// entry - запомненный результат пакета
+type entry struct {
+	Key string    `json:"key"`
+	At  time.Time `json:"at"`
+	Result
+}
+
+// record - ключ в окне: элемент общего списка ключей и списка ключей агента
+type record struct {
+	agent string
+	entry
+	all   *list.Element
+	local *list.Element
+}
+
+// agentWindow - ключи последних пакетов агента в порядке применения
+type agentWindow struct {
+	entries *list.List
+	byKey   map[string]*record
+}
+
+// Window - ограниченное окно ключей последних пакетов каждого агента.
+// идентификатор агента задает клиент, поэтому число ключей ограничено и для всех агентов вместе:
+// при переполнении вытесняется самый старый ключ окна.
+// методы безопасны для вызова из разных горутин
+type Window struct {
+	mutex sync.Mutex
+	// saveMutex - сохранения не должны пересекаться, иначе старое состояние может записаться поверх нового
+	saveMutex sync.Mutex
+	agents    map[string]*agentWindow
+	// entries - ключи всех агентов в порядке применения
+	entries *list.List
+	// inflight - пакеты, которые применяются прямо сейчас, повтор ждет завершения исходного
+	inflight map[string]chan struct{}
+	dirty    bool
+	size     int
+	limit    int
+	ttl      time.Duration
+	store    Store
+	logger   *zap.SugaredLogger
+}
+
+// NewWindow - окно из size ключей на агента и limit ключей всего, ключи старше ttl забываются.
+// сохраненное ранее окно загружается из store, store = nil - окно только в памяти
+func NewWindow(store Store, size int, limit int, ttl time.Duration, logger *zap.SugaredLogger) (*Window, error) {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	w := &Window{
+		agents:   make(map[string]*agentWindow),
+		entries:  list.New(),
+		inflight: make(map[string]chan struct{}),
+		size:     size,
+		limit:    limit,
+		ttl:      ttl,
+		store:    store,
+		logger:   logger,
+	}
+	if store == nil {
+		return w, nil
+	}
+	data, err := store.LoadState(stateName)
+	if err != nil || len(data) == 0 {
+		return w, err
+	}
+	var saved map[string][]entry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	// ключи восстанавливаются в порядке применения, чтобы вытеснялись самые старые
+	restored := make([]record, 0)
+	now := time.Now()
+	for agent, entries := range saved {
+		for _, e := range entries {
+			if now.Sub(e.At) < ttl {
+				restored = append(restored, record{agent: agent, entry: e})
+			}
+		}
+	}
+	sort.SliceStable(restored, func(i, j int) bool { return restored[i].At.Before(restored[j].At) })
+	for _, r := range restored {
+		w.add(r.agent, r.entry)
+	}
+	return w, nil
+}
+
+// Do - применение пакета с ключом key от агента agent.
+// если пакет с этим ключом уже применялся, apply не вызывается и возвращается запомненный результат, replayed = true.
+// пустой ключ или окно nil отключают проверку. результаты с ошибкой сервера (5xx) не запоминаются,
+// чтобы повтор после временного сбоя применил пакет
+func (w *Window) Do(agent string, key string, apply func() Result) (result Result, replayed bool) {
+	if w == nil || key == "" {
+		return apply(), false
+	}
+	id := agent + "\x00" + key
+	for {
+		w.mutex.Lock()
+		if e, ok := w.lookup(agent, key); ok {
+			w.mutex.Unlock()
+			return e.Result, true
+		}
+		done, busy := w.inflight[id]
+		if !busy {
+			done = make(chan struct{})
+			w.inflight[id] = done
+			w.mutex.Unlock()
+			break
+		}
+		w.mutex.Unlock()
+		<-done
+	}
+
+	result = apply()
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if result.Status < http.StatusInternalServerError {
+		w.add(agent, entry{Key: key, At: time.Now(), Result: result})
+		w.dirty = true
+	}
+	close(w.inflight[id])
+	delete(w.inflight, id)
+	return result, false
+}
+
+// lookup - запомненный результат, вызывается под mutex
+func (w *Window) lookup(agent string, key string) (entry, bool) {
+	a, ok := w.agents[agent]
+	if !ok {
+		return entry{}, false
+	}
+	r, ok := a.byKey[key]
+	if !ok || time.Since(r.At) >= w.ttl {
+		return entry{}, false
+	}
+	return r.entry, true
+}
+
+// add - добавление ключа в окно агента. самый старый ключ агента вытесняется, когда у агента size ключей,
+// самый старый ключ окна - когда в окне limit ключей. вызывается под mutex
+func (w *Window) add(agent string, e entry) {
+	a, ok := w.agents[agent]
+	if !ok {
+		a = &agentWindow{entries: list.New(), byKey: make(map[string]*record)}
+		w.agents[agent] = a
+	}
+	if r, ok := a.byKey[e.Key]; ok {
+		// ключ с истекшим ttl применяется заново и становится самым новым
+		w.remove(r)
+		if _, ok := w.agents[agent]; !ok {
+			w.agents[agent] = a
+		}
+	}
+	if a.entries.Len() >= w.size {
+		w.remove(a.entries.Front().Value.(*record))
+	}
+	if w.entries.Len() >= w.limit {
+		w.remove(w.entries.Front().Value.(*record))
+	}
+	r := &record{agent: agent, entry: e}
+	r.all = w.entries.PushBack(r)
+	r.local = a.entries.PushBack(r)
+	a.byKey[e.Key] = r
+}
+
+// remove - удаление ключа из окна, агент без ключей забывается. вызывается под mutex
+func (w *Window) remove(r *record) {
+	a := w.agents[r.agent]
+	w.entries.Remove(r.all)
+	a.entries.Remove(r.local)
+	delete(a.byKey, r.Key)
+	if a.entries.Len() == 0 {
+		delete(w.agents, r.agent)
+	}
+}
+
+// expire - удаление ключей старше ttl, вызывается под mutex
+func (w *Window) expire(now time.Time) {
+	for e := w.entries.Front(); e != nil && now.Sub(e.Value.(*record).At) >= w.ttl; e = w.entries.Front() {
+		w.remove(e.Value.(*record))
+	}
+}
+
+// Save - сохранение окна в хранилище, если оно изменилось с прошлого сохранения
+func (w *Window) Save() error {
+	if w.store == nil {
+		return nil
+	}
+	w.saveMutex.Lock()
+	defer w.saveMutex.Unlock()
+	w.mutex.Lock()
+	if !w.dirty {
+		w.mutex.Unlock()
+		return nil
+	}
+	w.expire(time.Now())
+	saved := make(map[string][]entry, len(w.agents))
+	for agent, a := range w.agents {
+		entries := make([]entry, 0, a.entries.Len())
+		for e := a.entries.Front(); e != nil; e = e.Next() {
+			entries = append(entries, e.Value.(*record).entry)
+		}
+		saved[agent] = entries
+	}
+	w.dirty = false
+	w.mutex.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = w.store.SaveState(stateName, data)
+	}
+	if err != nil {
+		w.mutex.Lock()
+		w.dirty = true
+		w.mutex.Unlock()
+	}
+	return err
+}
+
+// Run - периодическое сохранение окна до остановки ctx.
+// последнее сохранение при остановке делает вызывающий через Save, пока хранилище еще открыто
+func (w *Window) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSaveInterval
+	}
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Save(); err != nil {
+				w.logger.Errorf("error on save idempotency window: %v", err)
+			}
+
+		case <-ctx.Done():
+			ticker.Stop()
+			w.logger.Info("stop idempotency window job")
+			return
+		}
+	}
+}
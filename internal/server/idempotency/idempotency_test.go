@@ -0,0 +1,173 @@
+package idempotency
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// memoryStore - хранилище состояния в памяти
+type memoryStore struct {
+	states map[string][]byte
+	err    error
+}
+
+func (s *memoryStore) LoadState(name string) ([]byte, error) {
+	return s.states[name], nil
+}
+
+func (s *memoryStore) SaveState(name string, data []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.states[name] = data
+	return nil
+}
+
+func newTestWindow(t *testing.T, store Store, size int, ttl time.Duration) *Window {
+	w, err := NewWindow(store, size, 0, ttl, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return w
+}
+
+// counting - apply, который считает вызовы и возвращает заданный статус
+func counting(calls *int32, status int) func() Result {
+	return func() Result {
+		atomic.AddInt32(calls, 1)
+		return Result{Status: status}
+	}
+}
+
+func TestWindowReplay(t *testing.T) {
+	w := newTestWindow(t, nil, 10, time.Hour)
+	var calls int32
+
+	result, replayed := w.Do("agent", "k1", counting(&calls, http.StatusOK))
+	assert.Equal(t, Result{Status: http.StatusOK}, result)
+	assert.False(t, replayed)
+
+	result, replayed = w.Do("agent", "k1", counting(&calls, http.StatusBadRequest))
+	assert.Equal(t, Result{Status: http.StatusOK}, result, "replay returns original result")
+	assert.True(t, replayed)
+	assert.Equal(t, int32(1), calls)
+
+	// ключи разных агентов не пересекаются, пустой ключ не отслеживается
+	_, replayed = w.Do("other", "k1", counting(&calls, http.StatusOK))
+	assert.False(t, replayed)
+	w.Do("agent", "", counting(&calls, http.StatusOK))
+	w.Do("agent", "", counting(&calls, http.StatusOK))
+	assert.Equal(t, int32(4), calls)
+
+	var nilWindow *Window
+	_, replayed = nilWindow.Do("agent", "k1", counting(&calls, http.StatusOK))
+	assert.False(t, replayed)
+}
+
+func TestWindowServerErrorNotRemembered(t *testing.T) {
+	w := newTestWindow(t, nil, 10, time.Hour)
+	var calls int32
+
+	result, _ := w.Do("agent", "k1", counting(&calls, http.StatusInternalServerError))
+	assert.Equal(t, http.StatusInternalServerError, result.Status)
+	result, replayed := w.Do("agent", "k1", counting(&calls, http.StatusOK))
+	assert.Equal(t, http.StatusOK, result.Status)
+	assert.False(t, replayed, "retry after server error is applied")
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestWindowBounded(t *testing.T) {
+	w := newTestWindow(t, nil, 2, time.Hour)
+	var calls int32
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		w.Do("agent", key, counting(&calls, http.StatusOK))
+	}
+	_, replayed := w.Do("agent", "k3", counting(&calls, http.StatusOK))
+	assert.True(t, replayed)
+	_, replayed = w.Do("agent", "k1", counting(&calls, http.StatusOK))
+	assert.False(t, replayed, "oldest key is evicted")
+	assert.Equal(t, int32(4), calls)
+}
+
+func TestWindowLimit(t *testing.T) {
+	w, err := NewWindow(nil, 10, 3, time.Hour, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	var calls int32
+
+	// агенты с новыми идентификаторами вытесняют самые старые ключи, а не увеличивают окно
+	w.Do("agent", "k1", counting(&calls, http.StatusOK))
+	w.Do("agent", "k2", counting(&calls, http.StatusOK))
+	for _, agent := range []string{"a1", "a2", "a3", "a4"} {
+		w.Do(agent, "k", counting(&calls, http.StatusOK))
+	}
+	assert.Equal(t, 3, w.entries.Len())
+	assert.Len(t, w.agents, 3)
+	_, replayed := w.Do("a4", "k", counting(&calls, http.StatusOK))
+	assert.True(t, replayed)
+	_, replayed = w.Do("agent", "k2", counting(&calls, http.StatusOK))
+	assert.False(t, replayed, "oldest key of the window is evicted")
+	assert.Len(t, w.agents, 3)
+}
+
+func TestWindowTTL(t *testing.T) {
+	w := newTestWindow(t, nil, 10, 50*time.Millisecond)
+	var calls int32
+
+	w.Do("agent", "k1", counting(&calls, http.StatusOK))
+	time.Sleep(60 * time.Millisecond)
+	_, replayed := w.Do("agent", "k1", counting(&calls, http.StatusOK))
+	assert.False(t, replayed)
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestWindowConcurrentReplay(t *testing.T) {
+	w := newTestWindow(t, nil, 10, time.Hour)
+	var calls int32
+	apply := func() Result {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		return Result{Status: http.StatusOK}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, _ := w.Do("agent", "k1", apply)
+			assert.Equal(t, http.StatusOK, result.Status)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), calls, "concurrent retry waits for the original batch")
+}
+
+func TestWindowPersistence(t *testing.T) {
+	store := &memoryStore{states: make(map[string][]byte)}
+	w := newTestWindow(t, store, 10, time.Hour)
+	var calls int32
+
+	w.Do("agent", "k1", counting(&calls, http.StatusOK))
+	w.Do("agent", "k2", counting(&calls, http.StatusBadRequest))
+
+	store.err = errors.New("disk full")
+	require.Error(t, w.Save())
+	store.err = nil
+	require.NoError(t, w.Save(), "failed save is retried")
+
+	restored := newTestWindow(t, store, 10, time.Hour)
+	result, replayed := restored.Do("agent", "k1", counting(&calls, http.StatusOK))
+	assert.True(t, replayed)
+	assert.Equal(t, http.StatusOK, result.Status)
+	result, replayed = restored.Do("agent", "k2", counting(&calls, http.StatusOK))
+	assert.True(t, replayed)
+	assert.Equal(t, http.StatusBadRequest, result.Status)
+	assert.Equal(t, int32(2), calls)
+}
@@ -0,0 +1,216 @@
+// Package influx - разбор строк в формате InfluxDB line protocol:
+// measurement[,tag=value...] field=value[,field=value...] [timestamp]
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"yametrics/internal/server/models"
+)
+
+// FieldType - тип значения поля
+type FieldType int
+
+const (
+	Float FieldType = iota
+	Integer
+	Unsigned
+	Boolean
+	String
+)
+
+// ErrBadLine - строка не соответствует line protocol
+var ErrBadLine = errors.New("bad line protocol")
+
+// Field - поле точки, значение хранится в Float, Int или Str в зависимости от Type
+type Field struct {
+	Key   string
+	Type  FieldType
+	Float float64
+	Int   int64
+	Str   string
+}
+
+// Point - точка: измерение, теги, поля и время, нулевое время - в строке не задано
+type Point struct {
+	Measurement string
+	Tags        models.Labels
+	Fields      []Field
+	Time        time.Time
+}
+
+// ParsePrecision - единица времени в строках по параметру precision, пустое значение - наносекунды
+func ParsePrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "ns", "n":
+		return time.Nanosecond, nil
+	case "us", "u":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	}
+	return 0, fmt.Errorf("unknown precision %q, expected ns, us, ms or s", precision)
+}
+
+// ParseLine - разбор одной строки, precision - единица времени из ParsePrecision
+func ParseLine(line string, precision time.Duration) (Point, error) {
+	sections := split(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return Point{}, fmt.Errorf("%w: expected measurement, fields and optional timestamp", ErrBadLine)
+	}
+
+	var p Point
+	series := split(sections[0], ',', false)
+	p.Measurement = unescape(series[0])
+	if p.Measurement == "" {
+		return Point{}, fmt.Errorf("%w: empty measurement", ErrBadLine)
+	}
+	for _, tag := range series[1:] {
+		k, v, ok := cutUnescaped(tag, '=')
+		if !ok || k == "" || v == "" {
+			return Point{}, fmt.Errorf("%w: bad tag %q", ErrBadLine, tag)
+		}
+		if p.Tags == nil {
+			p.Tags = make(models.Labels)
+		}
+		p.Tags[unescape(k)] = unescape(v)
+	}
+
+	for _, field := range split(sections[1], ',', true) {
+		k, v, ok := cutUnescaped(field, '=')
+		if !ok || k == "" {
+			return Point{}, fmt.Errorf("%w: bad field %q", ErrBadLine, field)
+		}
+		f, err := parseFieldValue(v)
+		if err != nil {
+			return Point{}, fmt.Errorf("%w: field %q: %v", ErrBadLine, k, err)
+		}
+		f.Key = unescape(k)
+		p.Fields = append(p.Fields, f)
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("%w: bad timestamp %q", ErrBadLine, sections[2])
+		}
+		p.Time = time.Unix(0, 0).Add(time.Duration(ts) * precision)
+	}
+	return p, nil
+}
+
+func parseFieldValue(v string) (Field, error) {
+	switch {
+	case v == "":
+		return Field{}, errors.New("empty value")
+	case strings.HasPrefix(v, `"`):
+		if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+			return Field{}, errors.New("unterminated string")
+		}
+		s := strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(v[1 : len(v)-1])
+		return Field{Type: String, Str: s}, nil
+	case strings.HasSuffix(v, "i"):
+		i, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return Field{Type: Integer, Int: i}, err
+	case strings.HasSuffix(v, "u"):
+		u, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		if err == nil && u > math.MaxInt64 {
+			err = errors.New("unsigned value is out of range")
+		}
+		return Field{Type: Unsigned, Int: int64(u)}, err
+	}
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return Field{Type: Boolean, Float: 1}, nil
+	case "f", "F", "false", "False", "FALSE":
+		return Field{Type: Boolean, Float: 0}, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	return Field{Type: Float, Float: f}, err
+}
+
+// ToMetrics - метрики точки: measurement_field для каждого числового поля, теги становятся метками.
+// целые поля, имена метрик которых подходят под один из шаблонов counters (path.Match),
+// становятся накопленными значениями counter, остальные числовые и логические поля - gauge.
+// строковые поля пропускаются
+func (p *Point) ToMetrics(counters []string) ([]models.Metrics, error) {
+	metrics := make([]models.Metrics, 0, len(p.Fields))
+	for _, f := range p.Fields {
+		m := models.Metrics{ID: p.Measurement + "_" + f.Key, Labels: p.Tags}
+		switch f.Type {
+		case String:
+			continue
+		case Integer, Unsigned:
+			if isCounter(m.ID, counters) {
+				v := f.Int
+				m.MType, m.Delta, m.Temporality = models.COUNTER, &v, models.CUMULATIVE
+				break
+			}
+			v := float64(f.Int)
+			m.MType, m.Value = models.GAUGE, &v
+		default:
+			v := f.Float
+			m.MType, m.Value = models.GAUGE, &v
+		}
+		if err := m.Validate(); err != nil {
+			return nil, fmt.Errorf("field %q: %w", f.Key, err)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+func isCounter(id string, counters []string) bool {
+	for _, pattern := range counters {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// split - разбиение по неэкранированному sep, внутри строк в кавычках (если quotes) sep не учитывается
+func split(s string, sep byte, quotes bool) []string {
+	parts := make([]string, 0)
+	start, inQuote := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quotes:
+			inQuote = !inQuote
+		case s[i] == sep && !inQuote:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// cutUnescaped - разделение по первому неэкранированному sep
+func cutUnescaped(s string, sep byte) (string, string, bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+// unescape - снятие экранирования запятых, пробелов и знаков равенства в именах и тегах
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\,`, `,`, `\ `, ` `, `\=`, `=`, `\\`, `\`).Replace(s)
+}
@@ -0,0 +1,103 @@
+package influx
+
+import (
+	"testing"
+	"time"
+	"yametrics/internal/server/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		line      string
+		precision time.Duration
+		want      Point
+	}{
+		{
+			"fields of all types",
+			`cpu,host=web-1,region=eu usage=0.5,procs=12i,bytes=42u,up=true,state="running" 1700000000000000000`,
+			time.Nanosecond,
+			Point{
+				Measurement: "cpu",
+				Tags:        models.Labels{"host": "web-1", "region": "eu"},
+				Fields: []Field{
+					{Key: "usage", Type: Float, Float: 0.5},
+					{Key: "procs", Type: Integer, Int: 12},
+					{Key: "bytes", Type: Unsigned, Int: 42},
+					{Key: "up", Type: Boolean, Float: 1},
+					{Key: "state", Type: String, Str: "running"},
+				},
+				Time: time.Unix(1700000000, 0),
+			},
+		},
+		{
+			"escapes and precision",
+			`disk\ io,path=C:\,\ data msg="a \"quoted\", spaced value",free=1 1700000000`,
+			time.Second,
+			Point{
+				Measurement: "disk io",
+				Tags:        models.Labels{"path": `C:, data`},
+				Fields: []Field{
+					{Key: "msg", Type: String, Str: `a "quoted", spaced value`},
+					{Key: "free", Type: Float, Float: 1},
+				},
+				Time: time.Unix(1700000000, 0),
+			},
+		},
+		{
+			"without timestamp",
+			"mem free=1",
+			time.Nanosecond,
+			Point{Measurement: "mem", Fields: []Field{{Key: "free", Type: Float, Float: 1}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := ParseLine(tt.line, tt.precision)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.Measurement, p.Measurement)
+			assert.Equal(t, tt.want.Tags, p.Tags)
+			assert.Equal(t, tt.want.Fields, p.Fields)
+			assert.True(t, tt.want.Time.Equal(p.Time), "time %v", p.Time)
+		})
+	}
+
+	for _, line := range []string{"cpu", "cpu,host usage=1", "cpu usage=", "cpu usage=x", `cpu msg="open`, "cpu usage=1 abc", "cpu usage=1 1 2", "cpu big=18446744073709551615u"} {
+		_, err := ParseLine(line, time.Nanosecond)
+		assert.ErrorIs(t, err, ErrBadLine, line)
+	}
+}
+
+func TestParsePrecision(t *testing.T) {
+	p, err := ParsePrecision("")
+	require.NoError(t, err)
+	assert.Equal(t, time.Nanosecond, p)
+	p, err = ParsePrecision("ms")
+	require.NoError(t, err)
+	assert.Equal(t, time.Millisecond, p)
+	_, err = ParsePrecision("h")
+	assert.Error(t, err)
+}
+
+func TestToMetrics(t *testing.T) {
+	p, err := ParseLine(`net,iface=eth0 bytes_recv=100i,drops=-1i,speed=1.5,up=f,name="eth0"`, time.Nanosecond)
+	require.NoError(t, err)
+
+	metrics, err := p.ToMetrics([]string{"net_bytes_*"})
+	require.NoError(t, err)
+	require.Len(t, metrics, 4)
+	labels := models.Labels{"iface": "eth0"}
+	assert.Equal(t, models.Metrics{ID: "net_bytes_recv", MType: models.COUNTER, Labels: labels, Delta: metrics[0].Delta, Temporality: models.CUMULATIVE}, metrics[0])
+	assert.Equal(t, int64(100), *metrics[0].Delta)
+	for i, want := range map[int]float64{1: -1, 2: 1.5, 3: 0} {
+		assert.Equal(t, models.GAUGE, metrics[i].MType)
+		assert.Equal(t, want, *metrics[i].Value)
+	}
+
+	// накопленное значение counter не может быть отрицательным
+	_, err = p.ToMetrics([]string{"net_*"})
+	assert.Error(t, err)
+}
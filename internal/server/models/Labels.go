@@ -0,0 +1,83 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels - набор меток метрики (host, service, env ...).
+// метрика однозначно определяется именем и набором меток
+type Labels map[string]string
+
+// String - каноничное представление меток: пары key=value, отсортированные по ключу
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + l[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Match - проверка, что метрика содержит все метки из selector
+func (l Labels) Match(selector Labels) bool {
+	for k, v := range selector {
+		if lv, ok := l[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Value - метки хранятся в бд в виде json с отсортированными ключами,
+// поэтому одинаковые наборы меток дают одинаковое значение
+func (l Labels) Value() (driver.Value, error) {
+	if len(l) == 0 {
+		return "{}", nil
+	}
+	data, err := json.Marshal(map[string]string(l))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (l *Labels) Scan(src any) error {
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("can't scan labels from %T", src)
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return err
+	}
+	if len(labels) == 0 {
+		*l = nil
+	} else {
+		*l = labels
+	}
+	return nil
+}
+
+// MetricKey - ключ метрики с учетом меток
+func MetricKey(id string, labels Labels) string {
+	if len(labels) == 0 {
+		return id
+	}
+	return id + "{" + labels.String() + "}"
+}
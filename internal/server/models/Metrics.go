@@ -1,13 +1,105 @@
 package models
 
+import (
+	"fmt"
+	"time"
+	"yametrics/internal/histogram"
+)
+
 const (
-	GAUGE   = "gauge"
-	COUNTER = "counter"
+	GAUGE     = "gauge"
+	COUNTER   = "counter"
+	HISTOGRAM = "histogram"
+)
+
+// временная семантика значения counter в обновлении
+const (
+	// DELTA - приращение с прошлой отправки, складывается с сохраненным значением
+	DELTA = "delta"
+	// CUMULATIVE - накопленное агентом значение, сервер сам вычисляет приращение
+	CUMULATIVE = "cumulative"
 )
 
 type Metrics struct {
-	ID    string   `db:"id"`
-	MType string   `db:"mtype"`
-	Delta *int64   `db:"delta"`
-	Value *float64 `db:"value"`
+	ID        string               `db:"id"`
+	MType     string               `db:"mtype"`
+	Labels    Labels               `db:"labels" json:",omitempty"`
+	Delta     *int64               `db:"delta"`
+	Value     *float64             `db:"value"`
+	Histogram *histogram.Histogram `db:"histogram" json:",omitempty"`
+	// Temporality - семантика Delta в обновлении, пустое значение - DELTA.
+	// хранилища принимают только приращения, накопленные значения переводятся в них при обновлении
+	Temporality string `db:"-" json:",omitempty"`
+	// Cumulative - последнее накопленное значение counter, присланное с CUMULATIVE.
+	// в обновлении - значение, которое нужно запомнить вместе с приращением
+	Cumulative *int64 `db:"cumulative" json:",omitempty"`
+	// UpdatedAt - время последнего обновления, заполняется в GetAll, нулевое - хранилище его не знает
+	UpdatedAt time.Time `db:"-" json:"-"`
+}
+
+// Key - ключ метрики с учетом меток
+func (m *Metrics) Key() string {
+	return MetricKey(m.ID, m.Labels)
+}
+
+// Validate - проверка, что у метрики заполнено значение, соответствующее ее типу
+func (m *Metrics) Validate() error {
+	if m.ID == "" {
+		return fmt.Errorf("metric id must be nonempty")
+	}
+	switch m.MType {
+	case COUNTER:
+		if m.Delta == nil {
+			return fmt.Errorf("counter %s: delta must be defined", m.ID)
+		}
+		if m.Temporality == CUMULATIVE && *m.Delta < 0 {
+			return fmt.Errorf("counter %s: cumulative value must be non-negative", m.ID)
+		}
+	case GAUGE:
+		if m.Value == nil {
+			return fmt.Errorf("gauge %s: value must be defined", m.ID)
+		}
+	case HISTOGRAM:
+		if err := m.Histogram.Validate(); err != nil {
+			return fmt.Errorf("histogram %s: %w", m.ID, err)
+		}
+	default:
+		return fmt.Errorf("unknown metric type: %v", m.MType)
+	}
+	switch m.Temporality {
+	case "", DELTA:
+	case CUMULATIVE:
+		if m.MType != COUNTER {
+			return fmt.Errorf("%s %s: only counters can be cumulative", m.MType, m.ID)
+		}
+	default:
+		return fmt.Errorf("unknown temporality: %v", m.Temporality)
+	}
+	return nil
+}
+
+// MetricPoint - значение метрики в определенный момент времени.
+// для counter и histogram хранится накопленное значение на момент обновления.
+// точки, построенные из агрегатов, дополнительно содержат min/max/avg для gauge
+// и сумму приращений за интервал для counter
+type MetricPoint struct {
+	Timestamp time.Time            `db:"ts"`
+	Delta     *int64               `db:"delta"`
+	Value     *float64             `db:"value"`
+	Histogram *histogram.Histogram `db:"histogram" json:",omitempty"`
+	Min       *float64             `db:"-" json:",omitempty"`
+	Max       *float64             `db:"-" json:",omitempty"`
+	Avg       *float64             `db:"-" json:",omitempty"`
+	Sum       *float64             `db:"-" json:",omitempty"`
+}
+
+// Rollup - агрегат значений метрики за интервал, начинающийся в Timestamp.
+// для counter агрегируются приращения, а Last - накопленное значение на конец интервала
+type Rollup struct {
+	Timestamp time.Time `db:"ts"`
+	Min       float64   `db:"min"`
+	Max       float64   `db:"max"`
+	Sum       float64   `db:"sum"`
+	Count     int64     `db:"count"`
+	Last      float64   `db:"last"`
 }
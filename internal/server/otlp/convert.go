@@ -0,0 +1,192 @@
+package otlp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"yametrics/internal/histogram"
+	"yametrics/internal/server/models"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// batch - результат преобразования запроса: метрики, отклоненные точки
+// и новые накопленные гистограммы, которые запоминаются после сохранения метрик
+type batch struct {
+	metrics    []models.Metrics
+	rejected   int64
+	reason     string
+	histograms map[string]cumulativeHistogram
+}
+
+func (b *batch) reject(name string, format string, args ...any) {
+	b.rejected++
+	if b.reason == "" {
+		b.reason = fmt.Sprintf("metric %q: ", name) + fmt.Sprintf(format, args...)
+	}
+}
+
+// convert - преобразование точек запроса в метрики.
+// атрибуты ресурса и точки становятся метками, атрибуты точки имеют приоритет.
+// sum с монотонным ростом - counter, без него - gauge; gauge - gauge; histogram с явными границами - histogram.
+// exponential histogram и summary не поддерживаются, их точки отклоняются
+func (r *Receiver) convert(req *colmetricspb.ExportMetricsServiceRequest) *batch {
+	b := &batch{histograms: make(map[string]cumulativeHistogram)}
+	for _, rm := range req.GetResourceMetrics() {
+		resource := attributes(nil, rm.GetResource().GetAttributes())
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, metric := range sm.GetMetrics() {
+				r.convertMetric(b, resource, metric)
+			}
+		}
+	}
+	return b
+}
+
+func (r *Receiver) convertMetric(b *batch, resource models.Labels, metric *metricspb.Metric) {
+	name := metric.GetName()
+	switch data := metric.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		for _, p := range data.Gauge.GetDataPoints() {
+			if noRecordedValue(p.GetFlags()) {
+				continue
+			}
+			v := numberValue(p)
+			b.add(name, models.Metrics{ID: name, MType: models.GAUGE, Labels: attributes(resource, p.GetAttributes()), Value: &v})
+		}
+	case *metricspb.Metric_Sum:
+		r.convertSum(b, resource, name, data.Sum)
+	case *metricspb.Metric_Histogram:
+		r.convertHistogram(b, resource, name, data.Histogram)
+	default:
+		b.reject(name, "unsupported data type %T", metric.GetData())
+	}
+}
+
+// convertSum - монотонная сумма - counter: накопленные значения сервер сам переводит в приращения.
+// немонотонная накопленная сумма (UpDownCounter) - текущее значение, то есть gauge.
+// немонотонные приращения без текущего значения сохранить нельзя, они отклоняются
+func (r *Receiver) convertSum(b *batch, resource models.Labels, name string, sum *metricspb.Sum) {
+	temporality := sum.GetAggregationTemporality()
+	for _, p := range sum.GetDataPoints() {
+		if noRecordedValue(p.GetFlags()) {
+			continue
+		}
+		labels := attributes(resource, p.GetAttributes())
+		switch {
+		case !sum.GetIsMonotonic() && temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+			v := numberValue(p)
+			b.add(name, models.Metrics{ID: name, MType: models.GAUGE, Labels: labels, Value: &v})
+		case !sum.GetIsMonotonic():
+			b.reject(name, "non-monotonic sum with %v temporality is not supported", temporality)
+		case temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+			v := counterValue(p)
+			b.add(name, models.Metrics{ID: name, MType: models.COUNTER, Labels: labels, Delta: &v, Temporality: models.CUMULATIVE})
+		case temporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+			v := counterValue(p)
+			b.add(name, models.Metrics{ID: name, MType: models.COUNTER, Labels: labels, Delta: &v, Temporality: models.DELTA})
+		default:
+			b.reject(name, "unspecified aggregation temporality")
+		}
+	}
+}
+
+// convertHistogram - хранилища объединяют гистограммы сложением, поэтому накопленные гистограммы
+// переводятся в приращения относительно предыдущей точки того же ряда
+func (r *Receiver) convertHistogram(b *batch, resource models.Labels, name string, h *metricspb.Histogram) {
+	temporality := h.GetAggregationTemporality()
+	for _, p := range h.GetDataPoints() {
+		if noRecordedValue(p.GetFlags()) {
+			continue
+		}
+		m := models.Metrics{ID: name, MType: models.HISTOGRAM, Labels: attributes(resource, p.GetAttributes())}
+		m.Histogram = &histogram.Histogram{
+			Bounds: append([]float64{}, p.GetExplicitBounds()...),
+			Counts: append([]uint64{}, p.GetBucketCounts()...),
+			Count:  p.GetCount(),
+			Sum:    p.GetSum(),
+		}
+		if len(m.Histogram.Bounds) == 0 && len(m.Histogram.Counts) == 0 {
+			// точка без бакетов - только количество и сумма
+			m.Histogram.Counts = []uint64{m.Histogram.Count}
+		}
+		if err := m.Histogram.Validate(); err != nil {
+			b.reject(name, "%v", err)
+			continue
+		}
+		switch temporality {
+		case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+			b.add(name, m)
+		case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+			key := m.Key()
+			current := cumulativeHistogram{start: p.GetStartTimeUnixNano(), histogram: m.Histogram}
+			prev, ok := b.histograms[key]
+			if !ok {
+				prev, ok = r.histograms[key]
+			}
+			b.histograms[key] = current
+			if m.Histogram = r.increment(prev, ok, current); m.Histogram != nil {
+				b.add(name, m)
+			}
+		default:
+			b.reject(name, "unspecified aggregation temporality")
+		}
+	}
+}
+
+func (b *batch) add(name string, m models.Metrics) {
+	if err := m.Validate(); err != nil {
+		b.reject(name, "%v", err)
+		return
+	}
+	b.metrics = append(b.metrics, m)
+}
+
+// attributes - метки из атрибутов поверх base. значения массивов и вложенных списков пропускаются
+func attributes(base models.Labels, attrs []*commonpb.KeyValue) models.Labels {
+	if len(base) == 0 && len(attrs) == 0 {
+		return nil
+	}
+	labels := make(models.Labels, len(base)+len(attrs))
+	for k, v := range base {
+		labels[k] = v
+	}
+	for _, kv := range attrs {
+		v := kv.GetValue()
+		switch v.GetValue().(type) {
+		case *commonpb.AnyValue_StringValue:
+			labels[kv.GetKey()] = v.GetStringValue()
+		case *commonpb.AnyValue_BoolValue:
+			labels[kv.GetKey()] = strconv.FormatBool(v.GetBoolValue())
+		case *commonpb.AnyValue_IntValue:
+			labels[kv.GetKey()] = strconv.FormatInt(v.GetIntValue(), 10)
+		case *commonpb.AnyValue_DoubleValue:
+			labels[kv.GetKey()] = strconv.FormatFloat(v.GetDoubleValue(), 'g', -1, 64)
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+func numberValue(p *metricspb.NumberDataPoint) float64 {
+	if v, ok := p.GetValue().(*metricspb.NumberDataPoint_AsInt); ok {
+		return float64(v.AsInt)
+	}
+	return p.GetAsDouble()
+}
+
+// counterValue - значение counter, дробная часть округляется
+func counterValue(p *metricspb.NumberDataPoint) int64 {
+	if v, ok := p.GetValue().(*metricspb.NumberDataPoint_AsInt); ok {
+		return v.AsInt
+	}
+	return int64(math.Round(p.GetAsDouble()))
+}
+
+func noRecordedValue(flags uint32) bool {
+	return flags&uint32(metricspb.DataPointFlags_FLAG_NO_RECORDED_VALUE) != 0
+}
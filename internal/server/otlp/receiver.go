@@ -0,0 +1,192 @@
+// Package otlp - прием метрик OpenTelemetry по OTLP/HTTP (protobuf и json) и OTLP/gRPC
+package otlp
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+	"yametrics/internal/histogram"
+	"yametrics/internal/server/storage"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	protobufContentType = "application/x-protobuf"
+	jsonContentType     = "application/json"
+	// maxBodySize - максимальный размер тела запроса после распаковки
+	maxBodySize = 32 << 20
+)
+
+// cumulativeHistogram - последняя накопленная гистограмма ряда и начало периода накопления
+type cumulativeHistogram struct {
+	start     uint64
+	histogram *histogram.Histogram
+}
+
+// Receiver - прием метрик OTLP, реализует сервис MetricsService для grpc и http.Handler для /v1/metrics
+type Receiver struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	// mutex - запросы применяются по одному, чтобы накопленные гистограммы одного ряда не обгоняли друг друга
+	mutex sync.Mutex
+	// histograms - последние накопленные гистограммы рядов, от них считаются приращения
+	histograms map[string]cumulativeHistogram
+	// started - время создания, ряды, начавшиеся раньше, могли уже прислать значения до перезапуска сервера
+	started time.Time
+	storage storage.MetricsStorage
+	logger  *zap.SugaredLogger
+}
+
+func NewReceiver(metricsStorage storage.MetricsStorage, logger *zap.SugaredLogger) *Receiver {
+	return &Receiver{
+		histograms: make(map[string]cumulativeHistogram),
+		started:    time.Now(),
+		storage:    metricsStorage,
+		logger:     logger,
+	}
+}
+
+// Export - сохранение метрик запроса, отклоненные точки возвращаются в PartialSuccess
+func (r *Receiver) Export(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b := r.convert(req)
+	if len(b.metrics) > 0 {
+		if err := r.storage.Updates(b.metrics); err != nil {
+			r.logger.Errorf("error on save otlp metrics: %v", err)
+			if errors.Is(err, histogram.ErrIncompatibleBuckets) || errors.Is(err, histogram.ErrInvalidHistogram) {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+	}
+	for key, h := range b.histograms {
+		r.histograms[key] = h
+	}
+
+	response := &colmetricspb.ExportMetricsServiceResponse{}
+	if b.rejected > 0 {
+		r.logger.Warnf("otlp: %d data points rejected: %s", b.rejected, b.reason)
+		response.PartialSuccess = &colmetricspb.ExportMetricsPartialSuccess{
+			RejectedDataPoints: b.rejected,
+			ErrorMessage:       b.reason,
+		}
+	}
+	return response, nil
+}
+
+// increment - приращение накопленной гистограммы current относительно предыдущей точки ряда, nil - приращения нет.
+// новый период накопления, уменьшение значений или другие границы бакетов означают сброс: приращение - вся гистограмма.
+// если предыдущей точки нет, вся гистограмма - приращение, только если ряд начался после запуска приема,
+// иначе ее значения могли быть сохранены до перезапуска сервера, и точка только запоминается
+func (r *Receiver) increment(prev cumulativeHistogram, known bool, current cumulativeHistogram) *histogram.Histogram {
+	h := current.histogram
+	if !known {
+		if current.start != 0 && !time.Unix(0, int64(current.start)).Before(r.started) {
+			return h.Copy()
+		}
+		return nil
+	}
+	p := prev.histogram
+	if current.start != prev.start || h.Count < p.Count || len(h.Counts) != len(p.Counts) {
+		return h.Copy()
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != p.Bounds[i] {
+			return h.Copy()
+		}
+	}
+	delta := histogram.New(h.Bounds)
+	for i := range h.Counts {
+		if h.Counts[i] < p.Counts[i] {
+			return h.Copy()
+		}
+		delta.Counts[i] = h.Counts[i] - p.Counts[i]
+	}
+	delta.Count = h.Count - p.Count
+	delta.Sum = h.Sum - p.Sum
+	if delta.Count == 0 {
+		return nil
+	}
+	return delta
+}
+
+// ServeHTTP - OTLP/HTTP: тело в protobuf или json, ответ в том же формате.
+// ошибки возвращаются в виде google.rpc.Status
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if contentType != protobufContentType && contentType != jsonContentType {
+		http.Error(w, "unsupported content type, expected application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var body io.Reader = http.MaxBytesReader(w, req.Body, maxBodySize)
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeStatus(w, contentType, http.StatusBadRequest, status.New(codes.InvalidArgument, err.Error()))
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, maxBodySize)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		writeStatus(w, contentType, http.StatusBadRequest, status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	request := &colmetricspb.ExportMetricsServiceRequest{}
+	if contentType == jsonContentType {
+		err = protojson.Unmarshal(data, request)
+	} else {
+		err = proto.Unmarshal(data, request)
+	}
+	if err != nil {
+		writeStatus(w, contentType, http.StatusBadRequest, status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	response, err := r.Export(req.Context(), request)
+	if err != nil {
+		s := status.Convert(err)
+		code := http.StatusServiceUnavailable
+		if s.Code() == codes.InvalidArgument {
+			code = http.StatusBadRequest
+		}
+		writeStatus(w, contentType, code, s)
+		return
+	}
+	writeMessage(w, contentType, http.StatusOK, response)
+}
+
+func writeStatus(w http.ResponseWriter, contentType string, code int, s *status.Status) {
+	writeMessage(w, contentType, code, s.Proto())
+}
+
+func writeMessage(w http.ResponseWriter, contentType string, code int, m proto.Message) {
+	var data []byte
+	var err error
+	if contentType == jsonContentType {
+		data, err = protojson.Marshal(m)
+	} else {
+		data, err = proto.Marshal(m)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	w.Write(data)
+}
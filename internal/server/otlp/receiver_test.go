@@ -0,0 +1,185 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"yametrics/internal/server/config"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	cumulative = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	delta      = metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+)
+
+func newTestReceiver(t *testing.T) (*Receiver, storage.MetricsStorage) {
+	metricStorage, err := storage.NewFileMetricsStorage(&config.ServerConfig{}, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	return NewReceiver(metricStorage, zap.NewNop().Sugar()), metricStorage
+}
+
+func attr(k string, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: k, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}}
+}
+
+// request - запрос с ресурсом service=api и метриками
+func request(metrics ...*metricspb.Metric) *colmetricspb.ExportMetricsServiceRequest {
+	return &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource:     &resourcepb.Resource{Attributes: []*commonpb.KeyValue{attr("service", "api"), attr("host", "resource")}},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: metrics}},
+	}}}
+}
+
+func sum(name string, temporality metricspb.AggregationTemporality, monotonic bool, v int64) *metricspb.Metric {
+	return &metricspb.Metric{Name: name, Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+		AggregationTemporality: temporality,
+		IsMonotonic:            monotonic,
+		DataPoints: []*metricspb.NumberDataPoint{{
+			Attributes: []*commonpb.KeyValue{attr("host", "web")},
+			Value:      &metricspb.NumberDataPoint_AsInt{AsInt: v},
+		}},
+	}}}
+}
+
+func hist(name string, start time.Time, counts []uint64, total float64) *metricspb.Metric {
+	var count uint64
+	for _, c := range counts {
+		count += c
+	}
+	return &metricspb.Metric{Name: name, Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+		AggregationTemporality: cumulative,
+		DataPoints: []*metricspb.HistogramDataPoint{{
+			Attributes:        []*commonpb.KeyValue{attr("host", "web")},
+			StartTimeUnixNano: uint64(start.UnixNano()),
+			ExplicitBounds:    []float64{1},
+			BucketCounts:      counts,
+			Count:             count,
+			Sum:               &total,
+		}},
+	}}}
+}
+
+var labels = models.Labels{"service": "api", "host": "web"}
+
+func get(t *testing.T, metricStorage storage.MetricsStorage, id string, mtype string) *models.Metrics {
+	m, err := metricStorage.Get(id, mtype, labels)
+	require.NoError(t, err)
+	require.NotNil(t, m, id)
+	return m
+}
+
+func export(t *testing.T, r *Receiver, metrics ...*metricspb.Metric) *colmetricspb.ExportMetricsServiceResponse {
+	response, err := r.Export(context.Background(), request(metrics...))
+	require.NoError(t, err)
+	return response
+}
+
+func TestExportSums(t *testing.T) {
+	r, metricStorage := newTestReceiver(t)
+
+	response := export(t, r,
+		sum("requests", cumulative, true, 10),
+		sum("sent", delta, true, 5),
+		sum("queue", cumulative, false, 7),
+		sum("inflight", delta, false, 1),
+		&metricspb.Metric{Name: "quantiles", Data: &metricspb.Metric_Summary{Summary: &metricspb.Summary{}}},
+	)
+	assert.Equal(t, int64(2), response.GetPartialSuccess().GetRejectedDataPoints())
+	assert.Contains(t, response.GetPartialSuccess().GetErrorMessage(), "inflight")
+
+	export(t, r, sum("requests", cumulative, true, 15), sum("sent", delta, true, 5), sum("queue", cumulative, false, 3))
+	assert.Equal(t, int64(15), *get(t, metricStorage, "requests", models.COUNTER).Delta)
+	assert.Equal(t, int64(10), *get(t, metricStorage, "sent", models.COUNTER).Delta)
+	assert.Equal(t, 3.0, *get(t, metricStorage, "queue", models.GAUGE).Value)
+
+	// сброс накопленного значения: приращение - все новое значение
+	export(t, r, sum("requests", cumulative, true, 4))
+	assert.Equal(t, int64(19), *get(t, metricStorage, "requests", models.COUNTER).Delta)
+}
+
+func TestExportCumulativeHistogram(t *testing.T) {
+	r, metricStorage := newTestReceiver(t)
+	start := time.Now()
+
+	export(t, r, hist("latency", start, []uint64{1, 1}, 2.5))
+	export(t, r, hist("latency", start, []uint64{3, 1}, 3.5))
+	h := get(t, metricStorage, "latency", models.HISTOGRAM).Histogram
+	assert.Equal(t, []uint64{3, 1}, h.Counts)
+	assert.Equal(t, 3.5, h.Sum)
+
+	// новый период накопления - сброс
+	export(t, r, hist("latency", start.Add(time.Minute), []uint64{1, 0}, 0.5))
+	h = get(t, metricStorage, "latency", models.HISTOGRAM).Histogram
+	assert.Equal(t, []uint64{4, 1}, h.Counts)
+
+	// ряд начался до запуска приема: первая точка только запоминается
+	export(t, r, hist("old", r.started.Add(-time.Hour), []uint64{5, 5}, 50))
+	m, err := metricStorage.Get("old", models.HISTOGRAM, labels)
+	require.NoError(t, err)
+	assert.Nil(t, m)
+	export(t, r, hist("old", r.started.Add(-time.Hour), []uint64{6, 5}, 50.5))
+	assert.Equal(t, []uint64{1, 0}, get(t, metricStorage, "old", models.HISTOGRAM).Histogram.Counts)
+}
+
+func TestServeHTTP(t *testing.T) {
+	r, metricStorage := newTestReceiver(t)
+	gauge := &metricspb.Metric{Name: "temp", Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+		DataPoints: []*metricspb.NumberDataPoint{{
+			Attributes: []*commonpb.KeyValue{attr("host", "web")},
+			Value:      &metricspb.NumberDataPoint_AsDouble{AsDouble: 21.5},
+		}},
+	}}}
+	protobufBody, err := proto.Marshal(request(gauge))
+	require.NoError(t, err)
+	jsonBody, err := protojson.Marshal(request(gauge))
+	require.NoError(t, err)
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(protobufBody)
+	gz.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		gzip        bool
+		body        []byte
+		code        int
+	}{
+		{"protobuf", "application/x-protobuf", false, protobufBody, http.StatusOK},
+		{"json", "application/json; charset=utf-8", false, jsonBody, http.StatusOK},
+		{"gzip", "application/x-protobuf", true, gzipped.Bytes(), http.StatusOK},
+		{"broken body", "application/x-protobuf", false, []byte("broken"), http.StatusBadRequest},
+		{"unsupported content type", "text/plain", false, protobufBody, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/metrics", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, tt.code, res.StatusCode)
+		})
+	}
+	assert.Equal(t, 21.5, *get(t, metricStorage, "temp", models.GAUGE).Value)
+}
@@ -0,0 +1,251 @@
+// Package prometheus - вывод метрик в текстовом формате prometheus и в формате OpenMetrics
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"yametrics/internal/server/models"
+)
+
+// Format - формат вывода метрик
+type Format int
+
+const (
+	// TextFormat - текстовый формат prometheus 0.0.4
+	TextFormat Format = iota
+	// OpenMetricsFormat - формат OpenMetrics 1.0.0
+	OpenMetricsFormat
+)
+
+const (
+	// TextContentType - Content-Type текстового формата prometheus
+	TextContentType = "text/plain; version=0.0.4; charset=utf-8"
+	// OpenMetricsContentType - Content-Type формата OpenMetrics
+	OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+	openMetricsMediaType = "application/openmetrics-text"
+	// totalSuffix - в OpenMetrics значения counter имеют суффикс _total, а семейство - нет
+	totalSuffix = "_total"
+)
+
+// Negotiate - формат по заголовку Accept: OpenMetrics, только если клиент его явно принимает
+func Negotiate(accept string) Format {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(mediaType) == openMetricsMediaType {
+			return OpenMetricsFormat
+		}
+	}
+	return TextFormat
+}
+
+// ContentType - Content-Type ответа в формате f
+func (f Format) ContentType() string {
+	if f == OpenMetricsFormat {
+		return OpenMetricsContentType
+	}
+	return TextContentType
+}
+
+// family - метрики с одним именем и типом, в выводе идут одной группой под общей строкой # TYPE
+type family struct {
+	name    string
+	mtype   string
+	metrics []*models.Metrics
+}
+
+// Write - вывод метрик в формате format.
+// имена метрик и меток приводятся к допустимым в prometheus, метрики с одинаковым после этого именем,
+// но другим типом пропускаются и возвращаются в skipped
+func Write(w io.Writer, metrics []models.Metrics, format Format) (skipped []models.Metrics, err error) {
+	families := make(map[string]*family)
+	for i := range metrics {
+		m := &metrics[i]
+		name := SanitizeName(m.ID)
+		if format == OpenMetricsFormat && m.MType == models.COUNTER {
+			name = strings.TrimSuffix(name, totalSuffix)
+		}
+		f, ok := families[name]
+		if !ok {
+			f = &family{name: name, mtype: m.MType}
+			families[name] = f
+		} else if f.mtype != m.MType {
+			skipped = append(skipped, *m)
+			continue
+		}
+		f.metrics = append(f.metrics, m)
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		writeFamily(bw, families[name], format)
+	}
+	if format == OpenMetricsFormat {
+		bw.WriteString("# EOF\n")
+	}
+	return skipped, bw.Flush()
+}
+
+// writeFamily - строка # TYPE и значения метрик семейства, отсортированные по меткам
+func writeFamily(w *bufio.Writer, f *family, format Format) {
+	sort.Slice(f.metrics, func(i, j int) bool {
+		return f.metrics[i].Labels.String() < f.metrics[j].Labels.String()
+	})
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.mtype)
+	for _, m := range f.metrics {
+		labels := sanitizeLabels(m.Labels)
+		switch m.MType {
+		case models.GAUGE:
+			if m.Value != nil {
+				writeSample(w, f.name, labels, "", "", formatFloat(*m.Value), m, format)
+			}
+		case models.COUNTER:
+			if m.Delta == nil {
+				continue
+			}
+			name := f.name
+			if format == OpenMetricsFormat {
+				name += totalSuffix
+			}
+			writeSample(w, name, labels, "", "", strconv.FormatInt(*m.Delta, 10), m, format)
+		case models.HISTOGRAM:
+			h := m.Histogram
+			if h == nil {
+				continue
+			}
+			// в prometheus бакеты накопительные: le - верхняя граница, значение - число значений <= le
+			var cumulative uint64
+			for i, bound := range h.Bounds {
+				cumulative += h.Counts[i]
+				writeSample(w, f.name+"_bucket", labels, "le", formatFloat(bound), strconv.FormatUint(cumulative, 10), m, format)
+			}
+			writeSample(w, f.name+"_bucket", labels, "le", "+Inf", strconv.FormatUint(h.Count, 10), m, format)
+			writeSample(w, f.name+"_sum", labels, "", "", formatFloat(h.Sum), m, format)
+			writeSample(w, f.name+"_count", labels, "", "", strconv.FormatUint(h.Count, 10), m, format)
+		}
+	}
+}
+
+// writeSample - строка значения: имя, метки (и дополнительная метка extraName, если задана), значение и время обновления
+func writeSample(w *bufio.Writer, name string, labels [][2]string, extraName string, extraValue string, value string, m *models.Metrics, format Format) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, l[0], l[1])
+		}
+		if extraName != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(value)
+	if !m.UpdatedAt.IsZero() {
+		// prometheus ожидает миллисекунды, OpenMetrics - секунды
+		if format == OpenMetricsFormat {
+			ms := m.UpdatedAt.UnixMilli()
+			fmt.Fprintf(w, " %d.%03d", ms/1000, ms%1000)
+		} else {
+			fmt.Fprintf(w, " %d", m.UpdatedAt.UnixMilli())
+		}
+	}
+	w.WriteByte('\n')
+}
+
+func writeLabel(w *bufio.Writer, name string, value string) {
+	w.WriteString(name)
+	w.WriteString(`="`)
+	w.WriteString(escapeLabelValue(value))
+	w.WriteByte('"')
+}
+
+// sanitizeLabels - метки с допустимыми именами, отсортированные по имени.
+// метка le зарезервирована для бакетов гистограмм, при совпадении имен после приведения остается первая
+func sanitizeLabels(labels models.Labels) [][2]string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([][2]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		name := SanitizeLabelName(k)
+		if seen[name] || name == "le" {
+			continue
+		}
+		seen[name] = true
+		result = append(result, [2]string{name, labels[k]})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i][0] < result[j][0] })
+	return result
+}
+
+// SanitizeName - имя метрики, допустимое в prometheus: [a-zA-Z_:][a-zA-Z0-9_:]*.
+// недопустимые символы заменяются на _, перед цифрой в начале добавляется _
+func SanitizeName(name string) string {
+	return sanitize(name, true)
+}
+
+// SanitizeLabelName - имя метки, допустимое в prometheus: [a-zA-Z_][a-zA-Z0-9_]*
+func SanitizeLabelName(name string) string {
+	return sanitize(name, false)
+}
+
+func sanitize(name string, allowColon bool) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':' && allowColon:
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// escapeLabelValue - в значениях меток экранируются \, " и перевод строки
+func escapeLabelValue(v string) string {
+	if !strings.ContainsAny(v, "\\\"\n") {
+		return v
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
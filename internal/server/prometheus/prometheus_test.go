@@ -0,0 +1,90 @@
+package prometheus
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+	"yametrics/internal/histogram"
+	"yametrics/internal/server/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMetrics() []models.Metrics {
+	value := 1.5
+	delta := int64(42)
+	h := histogram.New([]float64{1, 10})
+	h.Observe(0.5)
+	h.Observe(5)
+	h.Observe(50)
+	return []models.Metrics{
+		{ID: "Alloc", MType: models.GAUGE, Value: &value, Labels: models.Labels{"host": `web"1`}, UpdatedAt: time.UnixMilli(1700000000123)},
+		{ID: "poll.count", MType: models.COUNTER, Delta: &delta},
+		{ID: "latency", MType: models.HISTOGRAM, Histogram: h, Labels: models.Labels{"le": "x", "svc-name": "api"}},
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	skipped, err := Write(&buf, testMetrics(), TextFormat)
+	require.NoError(t, err)
+	assert.Empty(t, skipped)
+	assert.Equal(t, `# TYPE Alloc gauge
+Alloc{host="web\"1"} 1.5 1700000000123
+# TYPE latency histogram
+latency_bucket{svc_name="api",le="1"} 1
+latency_bucket{svc_name="api",le="10"} 2
+latency_bucket{svc_name="api",le="+Inf"} 3
+latency_sum{svc_name="api"} 55.5
+latency_count{svc_name="api"} 3
+# TYPE poll_count counter
+poll_count 42
+`, buf.String())
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	delta := int64(7)
+	metrics := append(testMetrics()[:2], models.Metrics{ID: "requests_total", MType: models.COUNTER, Delta: &delta})
+	var buf bytes.Buffer
+	_, err := Write(&buf, metrics, OpenMetricsFormat)
+	require.NoError(t, err)
+	assert.Equal(t, `# TYPE Alloc gauge
+Alloc{host="web\"1"} 1.5 1700000000.123
+# TYPE poll_count counter
+poll_count_total 42
+# TYPE requests counter
+requests_total 7
+# EOF
+`, buf.String())
+}
+
+func TestWriteTypeConflict(t *testing.T) {
+	value := 1.0
+	delta := int64(1)
+	metrics := []models.Metrics{
+		{ID: "a.b", MType: models.GAUGE, Value: &value},
+		{ID: "a_b", MType: models.COUNTER, Delta: &delta},
+	}
+	var buf bytes.Buffer
+	skipped, err := Write(&buf, metrics, TextFormat)
+	require.NoError(t, err)
+	require.Len(t, skipped, 1)
+	assert.Equal(t, "a_b", skipped[0].ID)
+	assert.Equal(t, "# TYPE a_b gauge\na_b 1\n", buf.String())
+}
+
+func TestSanitize(t *testing.T) {
+	assert.Equal(t, "http_requests:rate", SanitizeName("http.requests:rate"))
+	assert.Equal(t, "_5xx_errors", SanitizeName("5xx-errors"))
+	assert.Equal(t, "_", SanitizeName(""))
+	assert.Equal(t, "a_b", SanitizeLabelName("a:b"))
+	assert.Equal(t, "+Inf", formatFloat(math.Inf(1)))
+}
+
+func TestNegotiate(t *testing.T) {
+	assert.Equal(t, TextFormat, Negotiate(""))
+	assert.Equal(t, TextFormat, Negotiate("text/plain;version=0.0.4;q=0.5,*/*;q=0.1"))
+	assert.Equal(t, OpenMetricsFormat, Negotiate("application/openmetrics-text;version=1.0.0,text/plain;q=0.5"))
+}
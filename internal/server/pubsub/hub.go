@@ -0,0 +1,184 @@
+// Package pubsub - рассылка обновлений метрик подписчикам внутри сервера
+// и их трансляция клиентам через Server-Sent Events и WebSocket
+package pubsub
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+	"yametrics/internal/server/models"
+)
+
+// DefaultBufferSize - число событий, которые подписчик может не успеть прочитать,
+// прежде чем новые события для него начнут отбрасываться
+const DefaultBufferSize = 256
+
+// Filter - условия подписки, пустое условие подходит под любую метрику
+type Filter struct {
+	// Names - имена или шаблоны имен в формате path.Match
+	Names []string
+	// Types - типы метрик
+	Types []string
+	// Selector - метки, которые должны быть у метрики
+	Selector models.Labels
+}
+
+// Validate - проверка шаблонов имен
+func (f *Filter) Validate() error {
+	for _, name := range f.Names {
+		if _, err := path.Match(name, ""); err != nil {
+			return fmt.Errorf("wrong name pattern %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Match - подходит ли метрика под условия
+func (f *Filter) Match(m *models.Metrics) bool {
+	if len(f.Types) > 0 && !contains(f.Types, m.MType) {
+		return false
+	}
+	if !m.Labels.Match(f.Selector) {
+		return false
+	}
+	if len(f.Names) == 0 {
+		return true
+	}
+	for _, name := range f.Names {
+		if ok, _ := path.Match(name, m.ID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Event - обновление метрики: порядковый номер, время публикации и значение метрики после обновления
+type Event struct {
+	Seq    uint64
+	Time   time.Time
+	Metric models.Metrics
+}
+
+// Subscription - подписка на обновления. события читаются из Events,
+// если подписчик не успевает их читать, новые события отбрасываются, а их число накапливается в Dropped
+type Subscription struct {
+	hub     *Hub
+	filter  Filter
+	events  chan Event
+	dropped uint64
+	once    sync.Once
+}
+
+// Events - канал событий, закрывается при закрытии подписки или хаба
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// TakeDropped - число событий, отброшенных с прошлого вызова
+func (s *Subscription) TakeDropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+// Close - отписка
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+// Hub - подписчики и рассылка им событий. публикация не блокируется на медленных подписчиках
+type Hub struct {
+	mutex      sync.RWMutex
+	subs       map[*Subscription]struct{}
+	closed     bool
+	seq        uint64
+	bufferSize int
+}
+
+func NewHub(bufferSize int) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	return &Hub{subs: make(map[*Subscription]struct{}), bufferSize: bufferSize}
+}
+
+// Subscribe - новая подписка, у закрытого хаба канал событий подписки сразу закрыт
+func (h *Hub) Subscribe(filter Filter) *Subscription {
+	s := &Subscription{hub: h, filter: filter, events: make(chan Event, h.bufferSize)}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.closed {
+		close(s.events)
+		s.once.Do(func() {})
+		return s
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+func (h *Hub) unsubscribe(s *Subscription) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s.once.Do(func() {
+		delete(h.subs, s)
+		close(s.events)
+	})
+}
+
+// Close - закрытие всех подписок, например при остановке сервера
+func (h *Hub) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		s.once.Do(func() {
+			delete(h.subs, s)
+			close(s.events)
+		})
+	}
+}
+
+// Interested - есть ли подписчик, которому нужна метрика
+func (h *Hub) Interested(m *models.Metrics) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for s := range h.subs {
+		if s.filter.Match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish - рассылка метрик подходящим подписчикам.
+// если буфер подписчика заполнен, событие для него отбрасывается
+func (h *Hub) Publish(metrics []models.Metrics) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	now := time.Now()
+	for i := range metrics {
+		e := Event{Seq: atomic.AddUint64(&h.seq, 1), Time: now, Metric: metrics[i]}
+		for s := range h.subs {
+			if !s.filter.Match(&metrics[i]) {
+				continue
+			}
+			select {
+			case s.events <- e:
+			default:
+				atomic.AddUint64(&s.dropped, 1)
+			}
+		}
+	}
+}
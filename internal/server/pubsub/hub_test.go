@@ -0,0 +1,117 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"yametrics/internal/server/config"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func gauge(id string, v float64, labels models.Labels) models.Metrics {
+	return models.Metrics{ID: id, MType: models.GAUGE, Labels: labels, Value: &v}
+}
+
+func TestFilter(t *testing.T) {
+	web := models.Labels{"host": "web"}
+	m := gauge("HeapAlloc", 1, web)
+	tests := []struct {
+		name   string
+		filter Filter
+		match  bool
+	}{
+		{"empty", Filter{}, true},
+		{"name", Filter{Names: []string{"Alloc", "HeapAlloc"}}, true},
+		{"pattern", Filter{Names: []string{"Heap*"}}, true},
+		{"other name", Filter{Names: []string{"Alloc"}}, false},
+		{"type", Filter{Types: []string{models.GAUGE}}, true},
+		{"other type", Filter{Types: []string{models.COUNTER}}, false},
+		{"labels", Filter{Selector: web}, true},
+		{"other labels", Filter{Selector: models.Labels{"host": "db"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.match, tt.filter.Match(&m))
+		})
+	}
+	assert.Error(t, (&Filter{Names: []string{"Heap["}}).Validate())
+}
+
+func TestHub(t *testing.T) {
+	hub := NewHub(2)
+	heap := hub.Subscribe(Filter{Names: []string{"Heap*"}})
+	all := hub.Subscribe(Filter{})
+
+	hub.Publish([]models.Metrics{gauge("HeapAlloc", 1, nil), gauge("Alloc", 2, nil)})
+	e := <-heap.Events()
+	assert.Equal(t, "HeapAlloc", e.Metric.ID)
+	assert.Equal(t, uint64(1), e.Seq)
+	assert.Equal(t, "HeapAlloc", (<-all.Events()).Metric.ID)
+	assert.Equal(t, "Alloc", (<-all.Events()).Metric.ID)
+
+	// медленный подписчик не блокирует публикацию: лишние события отбрасываются
+	for i := 0; i < 5; i++ {
+		hub.Publish([]models.Metrics{gauge("HeapAlloc", float64(i), nil)})
+	}
+	assert.Len(t, heap.Events(), 2)
+	assert.Equal(t, uint64(3), heap.TakeDropped())
+	assert.Equal(t, uint64(0), heap.TakeDropped())
+	assert.Equal(t, 0.0, *(<-heap.Events()).Metric.Value)
+
+	assert.True(t, hub.Interested(&models.Metrics{ID: "Alloc", MType: models.GAUGE}))
+	heap.Close()
+	heap.Close()
+	hub.Close()
+	assert.False(t, hub.Interested(&models.Metrics{ID: "Alloc", MType: models.GAUGE}))
+	_, ok := <-all.Events()
+	for ok {
+		_, ok = <-all.Events()
+	}
+	all.Close()
+	_, ok = <-hub.Subscribe(Filter{}).Events()
+	assert.False(t, ok, "subscription of closed hub")
+}
+
+func TestPublishingStorage(t *testing.T) {
+	memory, err := storage.NewFileMetricsStorage(&config.ServerConfig{}, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	hub := NewHub(10)
+	s := NewPublishingStorage(memory, hub)
+	sub := hub.Subscribe(Filter{Types: []string{models.COUNTER}})
+	defer sub.Close()
+
+	d := int64(2)
+	counter := models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}
+	require.NoError(t, s.Updates([]models.Metrics{counter, counter, gauge("Alloc", 1, nil)}))
+	require.NoError(t, s.Update(&counter))
+
+	// подписчик получает накопленное значение после каждого обновления, в том числе повторов в пакете
+	assert.Equal(t, int64(2), *(<-sub.Events()).Metric.Delta)
+	assert.Equal(t, int64(4), *(<-sub.Events()).Metric.Delta)
+	assert.Equal(t, int64(6), *(<-sub.Events()).Metric.Delta)
+	assert.Len(t, sub.Events(), 0)
+
+	// неуспешное обновление не публикуется
+	s = NewPublishingStorage(failingStorage{memory}, hub)
+	assert.Error(t, s.Update(&counter))
+	assert.Len(t, sub.Events(), 0)
+
+	// без подписчиков значения после обновления не запрашиваются
+	sub.Close()
+	s = NewPublishingStorage(failingStorage{memory}, hub)
+	require.NoError(t, s.Update(&counter))
+}
+
+// failingStorage - хранилище, которое не может вернуть значения после обновления
+type failingStorage struct {
+	storage.MetricsStorage
+}
+
+func (failingStorage) UpdatesApplied([]models.Metrics) ([]models.Metrics, error) {
+	return nil, errors.New("db is down")
+}
@@ -0,0 +1,62 @@
+package pubsub
+
+import (
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/storage"
+)
+
+// publishingStorage - хранилище, которое после успешного обновления публикует новые значения метрик в хаб
+type publishingStorage struct {
+	storage.MetricsStorage
+	hub *Hub
+}
+
+// NewPublishingStorage - обертка над хранилищем, публикующая обновления всех источников (http, grpc, statsd ...).
+// подписчики получают значение метрики после каждого обновления, у counter - накопленную сумму, а не приращение.
+// значения возвращает само хранилище при записи (storage.AppliedUpdater), хранилище без этого не публикует ничего
+func NewPublishingStorage(metricsStorage storage.MetricsStorage, hub *Hub) storage.MetricsStorage {
+	return &publishingStorage{MetricsStorage: metricsStorage, hub: hub}
+}
+
+func (s *publishingStorage) Update(m *models.Metrics) error {
+	return s.Updates([]models.Metrics{*m})
+}
+
+// Updates - если метрики пакета никому не нужны, значения после обновления не запрашиваются
+func (s *publishingStorage) Updates(metrics []models.Metrics) error {
+	updater, ok := s.MetricsStorage.(storage.AppliedUpdater)
+	if !ok || !s.interested(metrics) {
+		return s.MetricsStorage.Updates(metrics)
+	}
+	applied, err := updater.UpdatesApplied(metrics)
+	if err != nil {
+		return err
+	}
+	s.hub.Publish(applied)
+	return nil
+}
+
+// interested - нужна ли подписчикам хотя бы одна метрика пакета
+func (s *publishingStorage) interested(metrics []models.Metrics) bool {
+	for i := range metrics {
+		if s.hub.Interested(&metrics[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadState - состояние хранится в основном хранилище, если оно это поддерживает
+func (s *publishingStorage) LoadState(name string) ([]byte, error) {
+	if store, ok := s.MetricsStorage.(storage.StateStore); ok {
+		return store.LoadState(name)
+	}
+	return nil, nil
+}
+
+func (s *publishingStorage) SaveState(name string, data []byte) error {
+	if store, ok := s.MetricsStorage.(storage.StateStore); ok {
+		return store.SaveState(name, data)
+	}
+	return nil
+}
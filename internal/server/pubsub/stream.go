@@ -0,0 +1,218 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"yametrics/internal/protocol"
+	"yametrics/internal/server/models"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// heartbeatInterval - интервал служебных сообщений, по которым клиент и прокси видят, что соединение живо
+	heartbeatInterval = 15 * time.Second
+	// writeTimeout - время на отправку сообщения websocket, клиент, не принявший его за это время, отключается
+	writeTimeout = 10 * time.Second
+)
+
+// типы сообщений потока
+const (
+	updateMessage  = "update"
+	droppedMessage = "dropped"
+)
+
+// message - сообщение потока: обновление метрики или число отброшенных событий,
+// которые клиент не успел принять
+type message struct {
+	Type    string            `json:"type"`
+	Seq     uint64            `json:"seq,omitempty"`
+	Time    *time.Time        `json:"time,omitempty"`
+	Metric  *protocol.Metrics `json:"metric,omitempty"`
+	Dropped uint64            `json:"dropped,omitempty"`
+}
+
+func updateOf(e Event) message {
+	m := e.Metric
+	return message{
+		Type: updateMessage,
+		Seq:  e.Seq,
+		Time: &e.Time,
+		Metric: &protocol.Metrics{
+			ID:        m.ID,
+			MType:     m.MType,
+			Labels:    m.Labels,
+			Delta:     m.Delta,
+			Value:     m.Value,
+			Histogram: m.Histogram,
+		},
+	}
+}
+
+// Streams - http-обработчики подписки на обновления метрик
+type Streams struct {
+	hub      *Hub
+	logger   *zap.SugaredLogger
+	upgrader websocket.Upgrader
+}
+
+func NewStreams(hub *Hub, logger *zap.SugaredLogger) *Streams {
+	return &Streams{hub: hub, logger: logger}
+}
+
+// filterFromQuery - условия подписки из параметров: name (имя или шаблон path.Match), type и label=key:value,
+// каждый параметр можно указать несколько раз
+func filterFromQuery(r *http.Request) (Filter, error) {
+	query := r.URL.Query()
+	f := Filter{Names: query["name"], Types: query["type"]}
+	for _, t := range f.Types {
+		if t != models.GAUGE && t != models.COUNTER && t != models.HISTOGRAM {
+			return Filter{}, fmt.Errorf("wrong metric type: %v", t)
+		}
+	}
+	for _, l := range query["label"] {
+		k, v, ok := strings.Cut(l, ":")
+		if !ok || k == "" {
+			return Filter{}, fmt.Errorf("param `label` must be in format key:value")
+		}
+		if f.Selector == nil {
+			f.Selector = make(models.Labels)
+		}
+		f.Selector[k] = v
+	}
+	return f, f.Validate()
+}
+
+// SSE - поток обновлений в формате Server-Sent Events: GET /stream?name=&type=&label=key:value
+//
+// обновления приходят событиями update с номером в id, данные - json с метрикой.
+// если клиент не успевает читать поток, часть обновлений отбрасывается, и перед следующим
+// обновлением приходит событие dropped с их числом.
+func (s *Streams) SSE(w http.ResponseWriter, r *http.Request) {
+	filter, err := filterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	sub := s.hub.Subscribe(filter)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	writeEvent := func(m message) error {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if m.Seq > 0 {
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", m.Seq, m.Type, data)
+		} else {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", m.Type, data)
+		}
+		return err
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			if dropped := sub.TakeDropped(); dropped > 0 {
+				err = writeEvent(message{Type: droppedMessage, Dropped: dropped})
+			}
+			if err == nil {
+				err = writeEvent(updateOf(e))
+			}
+		}
+		if err != nil {
+			s.logger.Debugf("stream client disconnected: %v", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// WebSocket - поток обновлений через websocket: GET /stream/ws?name=&type=&label=key:value
+//
+// каждое сообщение - json с полем type: update (seq, time, metric) или dropped (dropped - число
+// отброшенных обновлений). клиент, не принимающий сообщения, отключается.
+func (s *Streams) WebSocket(w http.ResponseWriter, r *http.Request) {
+	filter, err := filterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// ответ с ошибкой уже отправлен
+		s.logger.Debugf("websocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+	sub := s.hub.Subscribe(filter)
+	defer sub.Close()
+
+	// входящие сообщения не ожидаются, чтение нужно для обработки ping, pong и закрытия соединения
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(m message) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteJSON(m)
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+		case e, ok := <-sub.Events():
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"), time.Now().Add(writeTimeout))
+				return
+			}
+			if dropped := sub.TakeDropped(); dropped > 0 {
+				err = write(message{Type: droppedMessage, Dropped: dropped})
+			}
+			if err == nil {
+				err = write(updateOf(e))
+			}
+		}
+		if err != nil {
+			s.logger.Debugf("websocket client disconnected: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"yametrics/internal/server/models"
+
+	"github.com/go-chi/chi"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newStreamServer(t *testing.T, hub *Hub) *httptest.Server {
+	streams := NewStreams(hub, zap.NewNop().Sugar())
+	r := chi.NewRouter()
+	r.Get("/stream", streams.SSE)
+	r.Get("/stream/ws", streams.WebSocket)
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// waitSubscribers - ожидание подписки клиента, чтобы опубликованное событие не было пропущено
+func waitSubscribers(t *testing.T, hub *Hub, n int) {
+	require.Eventually(t, func() bool {
+		hub.mutex.RLock()
+		defer hub.mutex.RUnlock()
+		return len(hub.subs) == n
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSSE(t *testing.T) {
+	hub := NewHub(10)
+	ts := newStreamServer(t, hub)
+
+	resp, err := http.Get(ts.URL + "/stream?type=gauge&label=host:web")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	waitSubscribers(t, hub, 1)
+
+	web := models.Labels{"host": "web"}
+	hub.Publish([]models.Metrics{gauge("Alloc", 1, nil), gauge("Alloc", 2, web)})
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, 3)
+	assert.Equal(t, "id: 2", lines[0])
+	assert.Equal(t, "event: update", lines[1])
+	var m message
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &m))
+	assert.Equal(t, "Alloc", m.Metric.ID)
+	assert.Equal(t, 2.0, *m.Metric.Value)
+	assert.Equal(t, map[string]string(web), m.Metric.Labels)
+
+	// при закрытии хаба поток завершается
+	hub.Close()
+	_, err = reader.ReadString('\n')
+	assert.Error(t, err)
+}
+
+func TestSSEBadRequest(t *testing.T) {
+	ts := newStreamServer(t, NewHub(10))
+	for _, query := range []string{"type=summary", "label=host", "name=Heap["} {
+		resp, err := http.Get(ts.URL + "/stream?" + query)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	hub := NewHub(1)
+	ts := newStreamServer(t, hub)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/stream/ws?name=Heap*", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	waitSubscribers(t, hub, 1)
+
+	hub.Publish([]models.Metrics{gauge("Alloc", 1, nil), gauge("HeapAlloc", 1, nil)})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var m message
+	require.NoError(t, conn.ReadJSON(&m))
+	assert.Equal(t, updateMessage, m.Type)
+	assert.Equal(t, uint64(2), m.Seq)
+	assert.Equal(t, "HeapAlloc", m.Metric.ID)
+
+	hub.Close()
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+}
@@ -0,0 +1,219 @@
+// Package retention - политики хранения истории метрик и агрегирование старых значений (rollup).
+// сырые точки хранятся ограниченное время, дальше остаются только агрегаты по интервалам:
+// min/max/avg/last для gauge и сумма приращений для counter.
+// агрегаты каждого следующего уровня строятся из агрегатов предыдущего.
+// метрики, которые давно не обновлялись, можно удалять целиком
+package retention
+
+import (
+	"fmt"
+	"path"
+	"time"
+	"yametrics/internal/durationextension"
+	"yametrics/internal/server/models"
+)
+
+const (
+	// DefaultInterval - период запуска задачи применения политик
+	DefaultInterval = time.Minute
+	// DefaultRawLimit - число последних сырых точек метрики, которые хранятся в памяти независимо от политик
+	DefaultRawLimit = 10000
+)
+
+// Tier - уровень агрегирования: длина интервала и время хранения агрегатов
+type Tier struct {
+	Step durationextension.Duration `json:"step"`
+	// TTL - время хранения, 0 - хранить всегда
+	TTL durationextension.Duration `json:"ttl"`
+}
+
+// Policy - политика хранения для метрик, имена которых подходят под шаблон
+type Policy struct {
+	// Pattern - шаблон имени метрики в формате path.Match, например "*Alloc*"
+	Pattern string `json:"pattern"`
+	// Raw - время хранения сырых точек, 0 - хранить всегда
+	Raw     durationextension.Duration `json:"raw"`
+	Rollups []Tier                     `json:"rollups"`
+	// Expire - метрика, которая не обновлялась дольше этого времени, удаляется вместе с историей.
+	// 0 - не удалять
+	Expire durationextension.Duration `json:"expire"`
+}
+
+// Config - политики хранения, для метрики применяется первая подходящая
+type Config struct {
+	Policies []Policy                   `json:"policies"`
+	Interval durationextension.Duration `json:"interval"`
+}
+
+// Enabled - задана ли хотя бы одна политика
+func (c *Config) Enabled() bool {
+	return len(c.Policies) > 0
+}
+
+// Match - политика для метрики с именем id, nil если ни одна не подходит
+func (c *Config) Match(id string) *Policy {
+	for i := range c.Policies {
+		if ok, _ := path.Match(c.Policies[i].Pattern, id); ok {
+			return &c.Policies[i]
+		}
+	}
+	return nil
+}
+
+// Validate - каждый уровень агрегирования строится из предыдущего,
+// поэтому интервал уровня должен быть кратен интервалу предыдущего,
+// а данные предыдущего уровня должны храниться не меньше этого интервала
+func (c *Config) Validate() error {
+	for _, p := range c.Policies {
+		if _, err := path.Match(p.Pattern, ""); err != nil {
+			return fmt.Errorf("retention policy %s: %w", p.Pattern, err)
+		}
+		if p.Expire.Duration < 0 {
+			return fmt.Errorf("retention policy %s: negative expire %v", p.Pattern, p.Expire.Duration)
+		}
+		prevStep, prevTTL := time.Duration(0), p.Raw.Duration
+		for _, t := range p.Rollups {
+			step := t.Step.Duration
+			if step < time.Second || step%time.Second != 0 {
+				return fmt.Errorf("retention policy %s: rollup step %v must be a whole number of seconds", p.Pattern, step)
+			}
+			if prevStep > 0 && (step <= prevStep || step%prevStep != 0) {
+				return fmt.Errorf("retention policy %s: rollup step %v must be a multiple of %v", p.Pattern, step, prevStep)
+			}
+			if prevTTL > 0 && prevTTL < step {
+				return fmt.Errorf("retention policy %s: data for rollup step %v is kept only %v", p.Pattern, step, prevTTL)
+			}
+			prevStep, prevTTL = step, t.TTL.Duration
+		}
+	}
+	return nil
+}
+
+// Source - откуда читать историю в интервале [from, now] с шагом step:
+// -1 - сырые точки, иначе номер уровня агрегирования.
+// выбирается самый грубый уровень, не превышающий step, а если сырые точки
+// за этот интервал уже удалены - самый подробный уровень, в котором они еще есть
+func (p *Policy) Source(from time.Time, now time.Time, step time.Duration) int {
+	if p == nil {
+		return -1
+	}
+	age := now.Sub(from)
+	covers := func(ttl time.Duration) bool { return ttl == 0 || age <= ttl }
+
+	source := -1
+	for i, t := range p.Rollups {
+		if step >= t.Step.Duration && covers(t.TTL.Duration) {
+			source = i
+		}
+	}
+	if source >= 0 || covers(p.Raw.Duration) {
+		return source
+	}
+	for i, t := range p.Rollups {
+		if covers(t.TTL.Duration) {
+			return i
+		}
+	}
+	return len(p.Rollups) - 1
+}
+
+// Expired - истек ли срок хранения метрики, последний раз обновленной в updatedAt
+func (p *Policy) Expired(updatedAt time.Time, now time.Time) bool {
+	return p != nil && p.Expire.Duration > 0 && updatedAt.Before(now.Add(-p.Expire.Duration))
+}
+
+// Rollupable - агрегируются только gauge и counter, у гистограмм удаляются старые точки
+func Rollupable(mtype string) bool {
+	return mtype == models.GAUGE || mtype == models.COUNTER
+}
+
+// bucketStart - начало интервала, интервалы выровнены по unix-времени
+func bucketStart(ts time.Time, step time.Duration) time.Time {
+	return time.Unix(0, ts.UnixNano()/int64(step)*int64(step))
+}
+
+// Aggregate - агрегаты завершенных к моменту until интервалов из сырых точек, отсортированных по времени.
+// для counter точки содержат накопленное значение, агрегируются приращения,
+// prev - накопленное значение до первой точки
+func Aggregate(mtype string, points []models.MetricPoint, prev float64, step time.Duration, until time.Time) []models.Rollup {
+	rollups := make([]models.Rollup, 0)
+	for _, p := range points {
+		bucket := bucketStart(p.Timestamp, step)
+		if bucket.Add(step).After(until) {
+			break
+		}
+		var v, last float64
+		if mtype == models.COUNTER && p.Delta != nil {
+			last = float64(*p.Delta)
+			v = last - prev
+			prev = last
+		} else if mtype == models.GAUGE && p.Value != nil {
+			v, last = *p.Value, *p.Value
+		} else {
+			continue
+		}
+		rollups = add(rollups, models.Rollup{Timestamp: bucket, Min: v, Max: v, Sum: v, Count: 1, Last: last})
+	}
+	return rollups
+}
+
+// Merge - агрегаты завершенных к моменту until интервалов step из агрегатов более мелкого уровня
+func Merge(source []models.Rollup, step time.Duration, until time.Time) []models.Rollup {
+	rollups := make([]models.Rollup, 0)
+	for _, r := range source {
+		bucket := bucketStart(r.Timestamp, step)
+		if bucket.Add(step).After(until) {
+			break
+		}
+		r.Timestamp = bucket
+		rollups = add(rollups, r)
+	}
+	return rollups
+}
+
+// Resample - объединение агрегатов в интервалы step, отсчитываемые от from, как при прореживании сырых точек
+func Resample(source []models.Rollup, from time.Time, step time.Duration) []models.Rollup {
+	if step <= 0 {
+		return source
+	}
+	rollups := make([]models.Rollup, 0)
+	for _, r := range source {
+		r.Timestamp = from.Add(r.Timestamp.Sub(from) / step * step)
+		rollups = add(rollups, r)
+	}
+	return rollups
+}
+
+// add - добавление значения к последнему агрегату, если он за тот же интервал
+func add(rollups []models.Rollup, r models.Rollup) []models.Rollup {
+	n := len(rollups)
+	if n == 0 || !rollups[n-1].Timestamp.Equal(r.Timestamp) {
+		return append(rollups, r)
+	}
+	last := &rollups[n-1]
+	if r.Min < last.Min {
+		last.Min = r.Min
+	}
+	if r.Max > last.Max {
+		last.Max = r.Max
+	}
+	last.Sum += r.Sum
+	last.Count += r.Count
+	last.Last = r.Last
+	return rollups
+}
+
+// ToPoint - агрегат в виде точки истории: значение метрики на конец интервала
+// и агрегаты, соответствующие типу метрики
+func ToPoint(mtype string, r models.Rollup) models.MetricPoint {
+	p := models.MetricPoint{Timestamp: r.Timestamp}
+	if mtype == models.COUNTER {
+		last, sum := int64(r.Last), r.Sum
+		p.Delta, p.Sum = &last, &sum
+	} else {
+		last, min, max := r.Last, r.Min, r.Max
+		avg := r.Sum / float64(r.Count)
+		p.Value, p.Min, p.Max, p.Avg = &last, &min, &max, &avg
+	}
+	return p
+}
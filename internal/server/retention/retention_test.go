@@ -0,0 +1,145 @@
+package retention
+
+import (
+	"testing"
+	"time"
+	"yametrics/internal/durationextension"
+	"yametrics/internal/server/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func duration(d time.Duration) durationextension.Duration {
+	return durationextension.Duration{Duration: d}
+}
+
+func gaugePoint(ts time.Time, v float64) models.MetricPoint {
+	return models.MetricPoint{Timestamp: ts, Value: &v}
+}
+
+func counterPoint(ts time.Time, d int64) models.MetricPoint {
+	return models.MetricPoint{Timestamp: ts, Delta: &d}
+}
+
+func TestAggregate(t *testing.T) {
+	start := time.Unix(1_000_000_020, 0)
+	bucket := time.Unix(1_000_000_020/60*60, 0)
+
+	t.Run("gauge", func(t *testing.T) {
+		points := []models.MetricPoint{
+			gaugePoint(start, 3),
+			gaugePoint(start.Add(10*time.Second), 1),
+			gaugePoint(start.Add(20*time.Second), 2),
+			gaugePoint(start.Add(60*time.Second), 10),
+		}
+		// второй интервал еще не завершен
+		rollups := Aggregate(models.GAUGE, points, 0, time.Minute, start.Add(90*time.Second))
+		require.Len(t, rollups, 1)
+		assert.Equal(t, models.Rollup{Timestamp: bucket, Min: 1, Max: 3, Sum: 6, Count: 3, Last: 2}, rollups[0])
+	})
+
+	t.Run("counter", func(t *testing.T) {
+		points := []models.MetricPoint{
+			counterPoint(start, 12),
+			counterPoint(start.Add(10*time.Second), 15),
+			counterPoint(start.Add(60*time.Second), 20),
+		}
+		rollups := Aggregate(models.COUNTER, points, 10, time.Minute, start.Add(5*time.Minute))
+		require.Len(t, rollups, 2)
+		assert.Equal(t, models.Rollup{Timestamp: bucket, Min: 2, Max: 3, Sum: 5, Count: 2, Last: 15}, rollups[0])
+		assert.Equal(t, models.Rollup{Timestamp: bucket.Add(time.Minute), Min: 5, Max: 5, Sum: 5, Count: 1, Last: 20}, rollups[1])
+	})
+}
+
+func TestMerge(t *testing.T) {
+	hour := time.Unix(1_000_000_000/3600*3600, 0)
+	source := []models.Rollup{
+		{Timestamp: hour, Min: 1, Max: 5, Sum: 10, Count: 4, Last: 2},
+		{Timestamp: hour.Add(time.Minute), Min: 0, Max: 3, Sum: 6, Count: 2, Last: 3},
+		{Timestamp: hour.Add(time.Hour), Min: 7, Max: 7, Sum: 7, Count: 1, Last: 7},
+	}
+	rollups := Merge(source, time.Hour, hour.Add(90*time.Minute))
+	require.Len(t, rollups, 1)
+	assert.Equal(t, models.Rollup{Timestamp: hour, Min: 0, Max: 5, Sum: 16, Count: 6, Last: 3}, rollups[0])
+
+	point := ToPoint(models.GAUGE, rollups[0])
+	assert.Equal(t, 3.0, *point.Value)
+	assert.Equal(t, 16.0/6, *point.Avg)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			policy: Policy{Pattern: "*", Raw: duration(24 * time.Hour), Rollups: []Tier{
+				{Step: duration(time.Minute), TTL: duration(30 * 24 * time.Hour)},
+				{Step: duration(time.Hour), TTL: duration(365 * 24 * time.Hour)},
+			}},
+		},
+		{
+			name: "step is not a multiple",
+			policy: Policy{Pattern: "*", Rollups: []Tier{
+				{Step: duration(time.Minute)},
+				{Step: duration(90 * time.Second)},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "raw is kept less than step",
+			policy:  Policy{Pattern: "*", Raw: duration(time.Minute), Rollups: []Tier{{Step: duration(time.Hour)}}},
+			wantErr: true,
+		},
+		{
+			name:    "bad pattern",
+			policy:  Policy{Pattern: "[", Raw: duration(time.Minute)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Policies: []Policy{tt.policy}}
+			if tt.wantErr {
+				assert.Error(t, cfg.Validate())
+			} else {
+				assert.NoError(t, cfg.Validate())
+			}
+		})
+	}
+}
+
+func TestSource(t *testing.T) {
+	cfg := Config{Policies: []Policy{
+		{Pattern: "Alloc", Raw: duration(time.Hour)},
+		{Pattern: "*", Raw: duration(24 * time.Hour), Rollups: []Tier{
+			{Step: duration(time.Minute), TTL: duration(30 * 24 * time.Hour)},
+			{Step: duration(time.Hour)},
+		}},
+	}}
+	now := time.Now()
+
+	assert.Equal(t, 0, len(cfg.Match("Alloc").Rollups))
+	policy := cfg.Match("PollCount")
+	require.NotNil(t, policy)
+
+	assert.Equal(t, -1, policy.Source(now.Add(-time.Hour), now, 0))
+	assert.Equal(t, 0, policy.Source(now.Add(-time.Hour), now, 5*time.Minute))
+	assert.Equal(t, 1, policy.Source(now.Add(-time.Hour), now, 2*time.Hour))
+	// сырые точки уже удалены
+	assert.Equal(t, 0, policy.Source(now.Add(-48*time.Hour), now, 0))
+	assert.Equal(t, 1, policy.Source(now.Add(-60*24*time.Hour), now, 0))
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	policy := &Policy{Pattern: "*", Expire: duration(time.Hour)}
+
+	assert.False(t, policy.Expired(now.Add(-time.Minute), now))
+	assert.True(t, policy.Expired(now.Add(-2*time.Hour), now))
+	assert.False(t, (&Policy{Pattern: "*"}).Expired(now.Add(-24*time.Hour), now))
+	assert.False(t, (*Policy)(nil).Expired(now.Add(-24*time.Hour), now))
+}
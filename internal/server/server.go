@@ -13,9 +13,17 @@ import (
 	_ "net/http/pprof"
 	"yametrics/internal/crypto"
 	"yametrics/internal/iputils"
+	"yametrics/internal/metricscrypto"
+	"yametrics/internal/server/alerting"
+	"yametrics/internal/server/anomaly"
 	"yametrics/internal/server/config"
+	"yametrics/internal/server/dashboard"
 	"yametrics/internal/server/handlers"
+	"yametrics/internal/server/idempotency"
+	"yametrics/internal/server/otlp"
+	"yametrics/internal/server/pubsub"
 	"yametrics/internal/server/storage"
+	"yametrics/internal/server/webhook"
 )
 
 func checkIP(trustedSubnet string, logger *zap.SugaredLogger) func(next http.Handler) http.Handler {
@@ -38,14 +46,44 @@ func checkIP(trustedSubnet string, logger *zap.SugaredLogger) func(next http.Han
 	}
 }
 
+// requireSign - при заданном ключе подписи запросы, которые не могут нести подпись, отклоняются с 403,
+// если их прием не разрешен явно
+func requireSign(cfg *config.ServerConfig) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if cfg.UnsignedAllowed() {
+			return next
+		}
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			http.Error(rw, "unsigned writes are rejected while sign key is set, use allow-unsigned to accept them", http.StatusForbidden)
+		})
+	}
+}
+
+// valueRoutes - чтение и удаление метрик. запрос удаления не может нести подпись,
+// поэтому при заданном ключе он отклоняется requireSign
+func valueRoutes(cfg *config.ServerConfig, get http.HandlerFunc, remove http.HandlerFunc, getV2 http.HandlerFunc) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Get("/{type}/{name}", get)
+		r.With(requireSign(cfg)).Delete("/{type}/{name}", remove)
+		r.Post("/", getV2)
+	}
+}
+
 // Run - запуск сервера
 func Run(
 	logger *zap.SugaredLogger,
 	cfg *config.ServerConfig,
 	storage storage.MetricsStorage,
 	ctx context.Context,
-	privateKey *rsa.PrivateKey) {
-	handler := handlers.NewHandler(logger, storage, cfg.SignKey)
+	privateKey *rsa.PrivateKey,
+	window *idempotency.Window,
+	verifier *metricscrypto.Verifier,
+	receiver *otlp.Receiver,
+	hub *pubsub.Hub,
+	webhooks *webhook.Dispatcher,
+	alerts *alerting.Engine,
+	detector *anomaly.Detector) {
+	handler := handlers.NewHandler(logger, storage, cfg.SignKey, verifier, cfg.HistogramBuckets, window, cfg.InfluxCounters)
 
 	r := chi.NewRouter()
 
@@ -57,7 +95,7 @@ func Run(
 	r.Use(checkIP(cfg.TrustedSubnet, logger))
 
 	r.Route("/update", func(r chi.Router) {
-		r.Post("/{type:gauge|counter}/{name}/{value}", handler.UpdateV1)
+		r.With(requireSign(cfg)).Post("/{type:gauge|counter|histogram}/{name}/{value}", handler.UpdateV1)
 		r.Post("/{type}/{name}/{value}", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotImplemented) })
 		r.Post("/", handler.UpdateV2)
 	})
@@ -66,6 +104,13 @@ func Run(
 		r.Post("/", handler.UpdatesV2)
 	})
 
+	// совместимость с InfluxDB 2.x и 1.x
+	r.With(requireSign(cfg)).Post("/api/v2/write", handler.WriteInflux)
+	r.With(requireSign(cfg)).Post("/write", handler.WriteInflux)
+
+	// OpenTelemetry OTLP/HTTP
+	r.With(requireSign(cfg)).Method(http.MethodPost, "/v1/metrics", receiver)
+
 	if privateKey != nil {
 		r.Route("/update_enc", func(r chi.Router) {
 			r.Post("/", func(writer http.ResponseWriter, request *http.Request) {
@@ -87,19 +132,43 @@ func Run(
 		})
 	}
 
-	r.Route("/value", func(r chi.Router) {
-		r.Get("/{type}/{name}", handler.GetV1)
-		r.Post("/", handler.GetV2)
+	r.Route("/value", valueRoutes(cfg, handler.GetV1, handler.Delete, handler.GetV2))
+
+	r.Route("/values", func(r chi.Router) {
+		r.Get("/", handler.Values)
+		r.Post("/", handler.ValuesBatch)
+	})
+
+	streams := pubsub.NewStreams(hub, logger)
+	r.Route("/stream", func(r chi.Router) {
+		r.Get("/", streams.SSE)
+		r.Get("/ws", streams.WebSocket)
+	})
+
+	if webhooks != nil {
+		webhooks.Routes(r)
+	}
+
+	alerts.Routes(r)
+	if detector != nil {
+		detector.Routes(r)
+	}
+
+	r.Route("/history", func(r chi.Router) {
+		r.Get("/{type}/{name}", handler.History)
 	})
 
 	r.Route("/", func(r chi.Router) {
 		r.Get("/ping", handler.PingDB)
-		r.Get("/", handler.GetAllAsHTML)
+		r.Get("/metrics", handler.Metrics)
 	})
+	dashboard.New(logger).Routes(r)
 
 	runProfileServer(logger)
 
 	server := &http.Server{Addr: cfg.Address, Handler: r}
+	// потоки обновлений открыты, пока клиент не отключится, поэтому при остановке они закрываются
+	server.RegisterOnShutdown(hub.Close)
 
 	go func() {
 		if err := server.ListenAndServe(); err != nil && errors.Is(err, http.ErrServerClosed) {
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"yametrics/internal/server/config"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireSign(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.ServerConfig
+		code int
+	}{
+		{"without sign key", config.ServerConfig{}, http.StatusOK},
+		{"with sign key", config.ServerConfig{SignKey: "key"}, http.StatusForbidden},
+		{"with sign key and allow unsigned", config.ServerConfig{SignKey: "key", AllowUnsigned: true}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+			w := httptest.NewRecorder()
+			requireSign(&tt.cfg)(next).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/write", nil))
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
+
+func TestValueRoutesDelete(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	tests := []struct {
+		name   string
+		cfg    config.ServerConfig
+		method string
+		code   int
+	}{
+		{"delete without sign key", config.ServerConfig{}, http.MethodDelete, http.StatusOK},
+		{"delete with sign key", config.ServerConfig{SignKey: "key"}, http.MethodDelete, http.StatusForbidden},
+		{"delete with sign key and allow unsigned", config.ServerConfig{SignKey: "key", AllowUnsigned: true}, http.MethodDelete, http.StatusOK},
+		{"get with sign key", config.ServerConfig{SignKey: "key"}, http.MethodGet, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Route("/value", valueRoutes(&tt.cfg, ok, ok, ok))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, "/value/gauge/Alloc*", nil))
+			assert.Equal(t, tt.code, w.Code)
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package statsd
+
+import (
+	"math"
+	"sync"
+	"yametrics/internal/histogram"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/storage"
+)
+
+// aggregator - значения, накопленные за интервал сброса.
+// counter складываются, gauge - последнее значение, timer/histogram/distribution - гистограмма,
+// set - число уникальных значений за интервал в виде gauge
+type aggregator struct {
+	mutex    sync.Mutex
+	counters map[string]*counterValue
+	gauges   map[string]*models.Metrics
+	timers   map[string]*models.Metrics
+	sets     map[string]*setValue
+	// lastGauges - последние значения gauge для относительных изменений, переживают сброс
+	lastGauges map[string]float64
+	buckets    []float64
+	storage    storage.MetricsStorage
+}
+
+type counterValue struct {
+	id     string
+	labels models.Labels
+	sum    float64
+}
+
+type setValue struct {
+	id      string
+	labels  models.Labels
+	members map[string]struct{}
+}
+
+func newAggregator(metricsStorage storage.MetricsStorage, buckets []float64) *aggregator {
+	a := &aggregator{buckets: buckets, storage: metricsStorage, lastGauges: make(map[string]float64)}
+	a.reset()
+	return a
+}
+
+func (a *aggregator) reset() {
+	a.counters = make(map[string]*counterValue)
+	a.gauges = make(map[string]*models.Metrics)
+	a.timers = make(map[string]*models.Metrics)
+	a.sets = make(map[string]*setValue)
+}
+
+// add - учет значения в текущем интервале
+func (a *aggregator) add(s Sample) error {
+	key := models.MetricKey(s.Name, s.Tags)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	switch s.Type {
+	case typeCounter:
+		c, ok := a.counters[key]
+		if !ok {
+			c = &counterValue{id: s.Name, labels: s.Tags}
+			a.counters[key] = c
+		}
+		// прореженные значения восстанавливаются делением на долю отправленных
+		c.sum += s.Value / s.Rate
+	case typeGauge:
+		v := s.Value
+		if s.Relative {
+			last, err := a.lastGauge(key, s)
+			if err != nil {
+				return err
+			}
+			v += last
+		}
+		a.lastGauges[key] = v
+		a.gauges[key] = &models.Metrics{ID: s.Name, MType: models.GAUGE, Labels: s.Tags, Value: &v}
+	case typeTimer, typeHistogram, typeDistribution:
+		m, ok := a.timers[key]
+		if !ok {
+			m = &models.Metrics{ID: s.Name, MType: models.HISTOGRAM, Labels: s.Tags, Histogram: histogram.New(a.buckets)}
+			a.timers[key] = m
+		}
+		v := s.Value
+		if s.Type == typeTimer {
+			// timer приходит в миллисекундах, границы бакетов - в секундах
+			v /= 1000
+		}
+		for i := int(math.Round(1 / s.Rate)); i > 0; i-- {
+			m.Histogram.Observe(v)
+		}
+	case typeSet:
+		set, ok := a.sets[key]
+		if !ok {
+			set = &setValue{id: s.Name, labels: s.Tags, members: make(map[string]struct{})}
+			a.sets[key] = set
+		}
+		set.members[s.Member] = struct{}{}
+	}
+	return nil
+}
+
+// lastGauge - текущее значение gauge: из предыдущих значений или из хранилища, вызывается под mutex
+func (a *aggregator) lastGauge(key string, s Sample) (float64, error) {
+	if v, ok := a.lastGauges[key]; ok {
+		return v, nil
+	}
+	stored, err := a.storage.Get(s.Name, models.GAUGE, s.Tags)
+	if err != nil || stored == nil || stored.Value == nil {
+		return 0, err
+	}
+	return *stored.Value, nil
+}
+
+// take - метрики за интервал, после чего начинается новый интервал
+func (a *aggregator) take() []models.Metrics {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	metrics := make([]models.Metrics, 0, len(a.counters)+len(a.gauges)+len(a.timers)+len(a.sets))
+	for _, c := range a.counters {
+		delta := int64(math.Round(c.sum))
+		metrics = append(metrics, models.Metrics{ID: c.id, MType: models.COUNTER, Labels: c.labels, Delta: &delta})
+	}
+	for _, g := range a.gauges {
+		metrics = append(metrics, *g)
+	}
+	for _, t := range a.timers {
+		metrics = append(metrics, *t)
+	}
+	for _, set := range a.sets {
+		v := float64(len(set.members))
+		metrics = append(metrics, models.Metrics{ID: set.id, MType: models.GAUGE, Labels: set.labels, Value: &v})
+	}
+	a.reset()
+	return metrics
+}
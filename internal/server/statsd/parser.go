@@ -0,0 +1,97 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"yametrics/internal/server/models"
+)
+
+// типы метрик statsd
+const (
+	typeCounter      = "c"
+	typeGauge        = "g"
+	typeTimer        = "ms"
+	typeHistogram    = "h"
+	typeDistribution = "d"
+	typeSet          = "s"
+)
+
+// ErrBadLine - строка не соответствует формату statsd
+var ErrBadLine = errors.New("bad statsd line")
+
+// Sample - одно значение из строки вида name:value|type[|@rate][|#tag:value,...]
+type Sample struct {
+	Name string
+	Type string
+	// Value - значение, для set не используется
+	Value float64
+	// Member - значение set как есть
+	Member string
+	// Relative - изменение gauge относительно текущего значения (+3, -3)
+	Relative bool
+	// Rate - доля отправленных значений, 1 - без прореживания
+	Rate float64
+	// Tags - метки в формате dogstatsd
+	Tags models.Labels
+}
+
+// ParseLine - разбор строки statsd. несколько значений одной метрики (name:1|c:2|c) не поддерживаются
+func ParseLine(line string) (Sample, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return Sample{}, fmt.Errorf("%w: %q", ErrBadLine, line)
+	}
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 || parts[0] == "" {
+		return Sample{}, fmt.Errorf("%w: %q", ErrBadLine, line)
+	}
+	s := Sample{Name: name, Type: parts[1], Rate: 1}
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return Sample{}, fmt.Errorf("%w: bad sample rate in %q", ErrBadLine, line)
+			}
+			s.Rate = rate
+		case strings.HasPrefix(p, "#"):
+			s.Tags = parseTags(p[1:])
+		}
+	}
+
+	value := parts[0]
+	switch s.Type {
+	case typeSet:
+		s.Member = value
+		return s, nil
+	case typeGauge:
+		s.Relative = strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")
+	case typeCounter, typeTimer, typeHistogram, typeDistribution:
+	default:
+		return Sample{}, fmt.Errorf("%w: unknown type in %q", ErrBadLine, line)
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return Sample{}, fmt.Errorf("%w: bad value in %q", ErrBadLine, line)
+	}
+	s.Value = v
+	return s, nil
+}
+
+// parseTags - теги dogstatsd: tag:value через запятую, тег без значения получает пустое значение
+func parseTags(tags string) models.Labels {
+	labels := make(models.Labels)
+	for _, tag := range strings.Split(tags, ",") {
+		if tag == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(tag, ":")
+		labels[k] = v
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
@@ -0,0 +1,37 @@
+package statsd
+
+import (
+	"testing"
+	"yametrics/internal/server/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want Sample
+	}{
+		{"counter", "hits:1|c", Sample{Name: "hits", Type: "c", Value: 1, Rate: 1}},
+		{"sampled counter", "hits:2|c|@0.1", Sample{Name: "hits", Type: "c", Value: 2, Rate: 0.1}},
+		{"gauge", "temp:3.2|g", Sample{Name: "temp", Type: "g", Value: 3.2, Rate: 1}},
+		{"relative gauge", "temp:-1|g", Sample{Name: "temp", Type: "g", Value: -1, Relative: true, Rate: 1}},
+		{"timer with tags", "req.time:320|ms|#host:web-1,env:prod", Sample{Name: "req.time", Type: "ms", Value: 320, Rate: 1,
+			Tags: models.Labels{"host": "web-1", "env": "prod"}}},
+		{"set", "users:alice|s", Sample{Name: "users", Type: "s", Member: "alice", Rate: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseLine(tt.line)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, s)
+		})
+	}
+
+	for _, line := range []string{"hits", ":1|c", "hits:1", "hits:x|c", "hits:1|x", "hits:1|c|@0", "hits:1|c|@2"} {
+		_, err := ParseLine(line)
+		assert.ErrorIs(t, err, ErrBadLine, line)
+	}
+}
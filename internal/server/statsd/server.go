@@ -0,0 +1,231 @@
+// Package statsd - прием метрик по протоколу statsd (udp или tcp).
+// значения агрегируются за интервал сброса и сохраняются в хранилище одним пакетом
+package statsd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"yametrics/internal/histogram"
+	"yametrics/internal/server/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultFlushInterval - интервал сброса накопленных значений в хранилище
+	DefaultFlushInterval = 10 * time.Second
+	// maxPacketSize - максимальный размер udp-пакета
+	maxPacketSize = 65535
+)
+
+// Server - прием метрик statsd
+type Server struct {
+	flushInterval time.Duration
+	aggregator    *aggregator
+	storage       storage.MetricsStorage
+	logger        *zap.SugaredLogger
+
+	packetConn net.PacketConn
+	listener   net.Listener
+	// wg - горутины чтения и сброса, Close дожидается их завершения
+	wg      sync.WaitGroup
+	stop    chan struct{}
+	conns   map[net.Conn]struct{}
+	connsMu sync.Mutex
+	once    sync.Once
+}
+
+// NewServer - создание и запуск приема на address. network - udp или tcp.
+// buckets - границы бакетов гистограмм для timer, histogram и distribution
+func NewServer(
+	network string,
+	address string,
+	flushInterval time.Duration,
+	buckets []float64,
+	metricsStorage storage.MetricsStorage,
+	logger *zap.SugaredLogger) (*Server, error) {
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+	s := &Server{
+		flushInterval: flushInterval,
+		aggregator:    newAggregator(metricsStorage, buckets),
+		storage:       metricsStorage,
+		logger:        logger,
+		stop:          make(chan struct{}),
+		conns:         make(map[net.Conn]struct{}),
+	}
+	var err error
+	switch network {
+	case "udp":
+		if s.packetConn, err = net.ListenPacket("udp", address); err != nil {
+			return nil, err
+		}
+		s.wg.Add(1)
+		go s.servePackets()
+	case "tcp":
+		if s.listener, err = net.Listen("tcp", address); err != nil {
+			return nil, err
+		}
+		s.wg.Add(1)
+		go s.serveConns()
+	default:
+		return nil, fmt.Errorf("unknown statsd network %q, expected udp or tcp", network)
+	}
+	s.wg.Add(1)
+	go s.runFlushJob()
+	logger.Infof("statsd %s listener started, addr: %v", network, s.Addr())
+	return s, nil
+}
+
+// Addr - адрес, на котором принимаются метрики
+func (s *Server) Addr() net.Addr {
+	if s.packetConn != nil {
+		return s.packetConn.LocalAddr()
+	}
+	return s.listener.Addr()
+}
+
+// Close - остановка приема и сброс накопленных значений в хранилище.
+// хранилище должно закрываться после Close
+func (s *Server) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+		if s.packetConn != nil {
+			s.packetConn.Close()
+		}
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		s.connsMu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connsMu.Unlock()
+		s.wg.Wait()
+		if err := s.Flush(); err != nil {
+			s.logger.Errorf("error on flush statsd metrics: %v", err)
+		}
+		s.logger.Info("statsd listener stopped")
+	})
+}
+
+// Flush - сохранение значений, накопленных с прошлого сброса.
+// если гистограмма несовместима с сохраненной, остальные метрики сохраняются по одной
+func (s *Server) Flush() error {
+	metrics := s.aggregator.take()
+	if len(metrics) == 0 {
+		return nil
+	}
+	err := s.storage.Updates(metrics)
+	if !errors.Is(err, histogram.ErrIncompatibleBuckets) {
+		return err
+	}
+	for i := range metrics {
+		if err := s.storage.Update(&metrics[i]); err != nil {
+			s.logger.Errorf("error on save statsd metric %s: %v", metrics[i].Key(), err)
+		}
+	}
+	return nil
+}
+
+func (s *Server) runFlushJob() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				s.logger.Errorf("error on flush statsd metrics: %v", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// servePackets - в одном udp-пакете может быть несколько строк
+func (s *Server) servePackets() {
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := s.packetConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Errorf("error on read statsd packet: %v", err)
+			continue
+		}
+		for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+			s.handleLine(string(line))
+		}
+	}
+}
+
+func (s *Server) serveConns() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Errorf("error on accept statsd connection: %v", err)
+			continue
+		}
+		s.connsMu.Lock()
+		select {
+		case <-s.stop:
+			// соединение принято во время остановки, Close его уже не закроет
+			s.connsMu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.connsMu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn - по tcp строки разделены переводом строки
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.connsMu.Lock()
+		delete(s.conns, conn)
+		s.connsMu.Unlock()
+		conn.Close()
+	}()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.handleLine(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Errorf("error on read statsd connection: %v", err)
+	}
+}
+
+func (s *Server) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	sample, err := ParseLine(line)
+	if err != nil {
+		s.logger.Warnf("skip statsd line: %v", err)
+		return
+	}
+	if err := s.aggregator.add(sample); err != nil {
+		s.logger.Errorf("error on add statsd sample: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	"yametrics/internal/server/config"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// newTestServer - прием на свободном локальном порту с хранилищем в памяти
+func newTestServer(t *testing.T, network string) (*Server, storage.MetricsStorage) {
+	metricStorage, err := storage.NewFileMetricsStorage(&config.ServerConfig{}, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	s, err := NewServer(network, "127.0.0.1:0", time.Hour, []float64{0.1, 1}, metricStorage, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return s, metricStorage
+}
+
+// send - отправка строк и ожидание, пока сервер их учтет.
+// последней отправляется служебная строка: строки разбираются по порядку, значит после нее учтены все
+func send(t *testing.T, s *Server, network string, payload string) {
+	conn, err := net.Dial(network, s.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(payload + "\nsync:1|c\n"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		s.aggregator.mutex.Lock()
+		defer s.aggregator.mutex.Unlock()
+		_, ok := s.aggregator.counters["sync"]
+		return ok
+	}, time.Second, 5*time.Millisecond)
+}
+
+func get(t *testing.T, metricStorage storage.MetricsStorage, id string, mtype string, labels models.Labels) *models.Metrics {
+	m, err := metricStorage.Get(id, mtype, labels)
+	require.NoError(t, err)
+	require.NotNil(t, m, id)
+	return m
+}
+
+func TestServerUDP(t *testing.T) {
+	s, metricStorage := newTestServer(t, "udp")
+	defer s.Close()
+
+	send(t, s, "udp", "hits:1|c\nhits:2|c|@0.5\ntemp:10|g\ntemp:+5|g\nreq:250|ms\nreq:2000|ms\nusers:a|s\nusers:b|s\nusers:a|s\nbroken\n")
+	require.NoError(t, s.Flush())
+
+	assert.Equal(t, int64(5), *get(t, metricStorage, "hits", models.COUNTER, nil).Delta)
+	assert.Equal(t, 15.0, *get(t, metricStorage, "temp", models.GAUGE, nil).Value)
+	assert.Equal(t, 2.0, *get(t, metricStorage, "users", models.GAUGE, nil).Value)
+	h := get(t, metricStorage, "req", models.HISTOGRAM, nil).Histogram
+	assert.Equal(t, []uint64{0, 1, 1}, h.Counts)
+	assert.Equal(t, 2.25, h.Sum)
+
+	// следующий интервал: counter накапливаются в хранилище, относительный gauge считается от последнего значения
+	send(t, s, "udp", "hits:1|c\ntemp:-3|g")
+	require.NoError(t, s.Flush())
+	assert.Equal(t, int64(6), *get(t, metricStorage, "hits", models.COUNTER, nil).Delta)
+	assert.Equal(t, 12.0, *get(t, metricStorage, "temp", models.GAUGE, nil).Value)
+}
+
+func TestServerTCP(t *testing.T) {
+	s, metricStorage := newTestServer(t, "tcp")
+
+	send(t, s, "tcp", "hits:3|c|#host:web\nhits:4|c|#host:db\n")
+	// при остановке накопленные значения сохраняются
+	s.Close()
+
+	assert.Equal(t, int64(3), *get(t, metricStorage, "hits", models.COUNTER, models.Labels{"host": "web"}).Delta)
+	assert.Equal(t, int64(4), *get(t, metricStorage, "hits", models.COUNTER, models.Labels{"host": "db"}).Delta)
+}
+
+func TestNewServerUnknownNetwork(t *testing.T) {
+	_, err := NewServer("unix", "127.0.0.1:0", time.Second, nil, nil, zap.NewNop().Sugar())
+	assert.Error(t, err)
+}
@@ -0,0 +1,542 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+	"yametrics/internal/server/models"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultFlushInterval - период сброса буфера, если он не заполнился раньше
+	DefaultFlushInterval = time.Second
+	// MaxFlushAttempts - число неудачных сбросов подряд, после которого накопленные обновления отбрасываются
+	MaxFlushAttempts = 10
+)
+
+// bufferedMetricsStorage - буфер обновлений перед хранилищем (write-behind).
+// обновления одной метрики объединяются в памяти: приращения counter складываются,
+// от gauge остается последнее значение, гистограммы объединяются.
+// накопленные обновления сбрасываются одним вызовом Updates при заполнении буфера или по таймеру.
+// чтения значений учитывают еще не сброшенные обновления, точки истории появляются при сбросе
+type bufferedMetricsStorage struct {
+	storage MetricsStorage
+	// mutex - защищает pending, stored и failures
+	mutex   sync.Mutex
+	pending map[string]*models.Metrics
+	// stored - состояние накопленных counter и гистограмм в хранилище по ключу storedKey, nil - метрики нет.
+	// заполняется до взятия mutex при первом обновлении метрики и поддерживается сбросами,
+	// поэтому Updates не ждет хранилище под mutex
+	stored map[string]*models.Metrics
+	// failures - число неудачных сбросов подряд
+	failures int
+	// flushMutex - на время сброса чтения ждут, чтобы не учесть сбрасываемые обновления дважды
+	flushMutex sync.RWMutex
+	flushing   map[string]*models.Metrics
+	maxSize    int
+	flushCh    chan struct{}
+	logger     *zap.SugaredLogger
+}
+
+// NewBufferedMetricsStorage - буфер размером maxSize метрик, сбрасываемый не реже чем раз в interval
+func NewBufferedMetricsStorage(
+	storage MetricsStorage,
+	maxSize int,
+	interval time.Duration,
+	ctx context.Context,
+	logger *zap.SugaredLogger) MetricsStorage {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	s := &bufferedMetricsStorage{
+		storage: storage,
+		pending: make(map[string]*models.Metrics),
+		stored:  make(map[string]*models.Metrics),
+		maxSize: maxSize,
+		flushCh: make(chan struct{}, 1),
+		logger:  logger,
+	}
+	go s.runFlushJob(ctx, interval)
+	return s
+}
+
+// Updates - метрики добавляются в буфер, накопленные значения counter сразу переводятся в приращения.
+// если хотя бы одна гистограмма несовместима с накопленной или сохраненной, не добавляется ни одна метрика
+func (s *bufferedMetricsStorage) Updates(metrics []models.Metrics) error {
+	_, err := s.updates(metrics, false)
+	return err
+}
+
+// UpdatesApplied - значения считаются по состоянию в stored и буферу. состояние counter и гистограмм
+// читается из хранилища только при первом обновлении метрики, дальше его поддерживают сбросы
+func (s *bufferedMetricsStorage) UpdatesApplied(metrics []models.Metrics) ([]models.Metrics, error) {
+	return s.updates(metrics, true)
+}
+
+// updates - добавление метрик в буфер, withApplied - вернуть значения метрик после обновления
+func (s *bufferedMetricsStorage) updates(metrics []models.Metrics, withApplied bool) ([]models.Metrics, error) {
+	need := needsStored
+	if withApplied {
+		need = hasStoredState
+	}
+	if err := s.loadStored(metrics, need); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	metrics, err := toIncrements(metrics, s.lastCumulative)
+	if err != nil {
+		return nil, err
+	}
+	batch, err := coalesce(metrics)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range batch {
+		batch[i].UpdatedAt = now
+	}
+
+	for i := range batch {
+		m := &batch[i]
+		if m.MType != models.HISTOGRAM {
+			continue
+		}
+		if p, ok := s.pending[m.Key()]; ok && p.MType == models.HISTOGRAM {
+			if err := p.Histogram.Copy().Merge(m.Histogram); err != nil {
+				return nil, err
+			}
+		} else if err := s.checkStoredHistogram(m); err != nil {
+			return nil, err
+		}
+	}
+	var applied []models.Metrics
+	if withApplied {
+		applied = s.applied(metrics, now)
+	}
+	for i := range batch {
+		key := batch[i].Key()
+		if p, ok := s.pending[key]; ok {
+			// совместимость гистограмм проверена выше
+			_ = mergeMetric(p, &batch[i])
+		} else {
+			s.pending[key] = &batch[i]
+		}
+	}
+	if len(s.pending) >= s.maxSize {
+		select {
+		case s.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	return applied, nil
+}
+
+// storedKey - ключ состояния метрики в stored: хранилище отдает метрику только запрошенного типа
+func storedKey(mtype string, key string) string {
+	return mtype + "\x00" + key
+}
+
+// needsStored - нужно ли для обновления состояние из хранилища
+func needsStored(m *models.Metrics) bool {
+	return m.MType == models.HISTOGRAM || (m.MType == models.COUNTER && m.Temporality == models.CUMULATIVE)
+}
+
+// hasStoredState - значение метрики после обновления зависит от сохраненного
+func hasStoredState(m *models.Metrics) bool {
+	return m.MType == models.COUNTER || m.MType == models.HISTOGRAM
+}
+
+// loadStored - чтение из хранилища состояния метрик пакета, для которых need, которого еще нет в stored,
+// без взятия mutex. сбросы и удаления на время чтения остановлены, как при Get:
+// иначе сброшенные обновления попали бы в stored дважды, из хранилища и при applyStored
+func (s *bufferedMetricsStorage) loadStored(metrics []models.Metrics, need func(m *models.Metrics) bool) error {
+	s.mutex.Lock()
+	missing := make(map[string]*models.Metrics)
+	for i := range metrics {
+		m := &metrics[i]
+		key := storedKey(m.MType, m.Key())
+		if _, ok := s.stored[key]; need(m) && !ok {
+			missing[key] = m
+		}
+	}
+	s.mutex.Unlock()
+	if len(missing) == 0 {
+		return nil
+	}
+
+	s.flushMutex.RLock()
+	defer s.flushMutex.RUnlock()
+	loaded := make(map[string]*models.Metrics, len(missing))
+	for key, m := range missing {
+		stored, err := s.storage.Get(m.ID, m.MType, m.Labels)
+		if err != nil {
+			return err
+		}
+		loaded[key] = stored
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// пока ждали сброс, состояние могло загрузить другое обновление, оно уже учитывает сброс
+	for key, stored := range loaded {
+		if _, ok := s.stored[key]; !ok {
+			s.stored[key] = stored
+		}
+	}
+	return nil
+}
+
+// lastCumulative - последнее накопленное значение counter с учетом буфера, вызывается под mutex.
+// обновления в буфере новее сбрасываемых, а сбрасываемые новее сохраненных.
+// приращения без накопленного значения его не меняют, поэтому поиск продолжается глубже
+func (s *bufferedMetricsStorage) lastCumulative(m *models.Metrics) (*int64, error) {
+	key := m.Key()
+	for _, buffer := range []map[string]*models.Metrics{s.pending, s.flushing} {
+		if p, ok := buffer[key]; ok {
+			if p.MType != models.COUNTER {
+				return nil, nil
+			} else if p.Cumulative != nil {
+				return storedCumulative(p), nil
+			}
+		}
+	}
+	return storedCumulative(s.stored[storedKey(models.COUNTER, key)]), nil
+}
+
+// checkStoredHistogram - гистограмма должна объединяться с сохраненной, иначе сброс буфера не пройдет.
+// вызывается под mutex
+func (s *bufferedMetricsStorage) checkStoredHistogram(m *models.Metrics) error {
+	stored := s.stored[storedKey(models.HISTOGRAM, m.Key())]
+	if stored == nil || stored.Histogram == nil {
+		return nil
+	}
+	return stored.Histogram.Copy().Merge(m.Histogram)
+}
+
+// applyStored - учет в stored сброшенных обновлений, вызывается под mutex.
+// метрика другого типа с тем же ключом заменяется в хранилище, поэтому ее состояние забывается
+func (s *bufferedMetricsStorage) applyStored(flushed map[string]*models.Metrics) {
+	for key, f := range flushed {
+		for _, mtype := range []string{models.COUNTER, models.HISTOGRAM} {
+			k := storedKey(mtype, key)
+			stored, ok := s.stored[k]
+			if !ok {
+				continue
+			}
+			if mtype != f.MType {
+				s.stored[k] = nil
+			} else {
+				s.stored[k] = overlay(stored, f)
+			}
+		}
+	}
+}
+
+// applied - значения метрик пакета после обновления по порядку, вызывается под mutex до добавления пакета в буфер.
+// обновления в буфере применяются поверх сохраненного состояния, а метрики пакета - поверх них
+func (s *bufferedMetricsStorage) applied(metrics []models.Metrics, now time.Time) []models.Metrics {
+	current := make(map[string]*models.Metrics)
+	result := make([]models.Metrics, len(metrics))
+	for i := range metrics {
+		m := &metrics[i]
+		key := m.Key()
+		v, ok := current[key]
+		if !ok {
+			v = s.stored[storedKey(m.MType, key)]
+			for _, buffer := range []map[string]*models.Metrics{s.flushing, s.pending} {
+				if p, ok := buffer[key]; ok {
+					v = overlay(v, p)
+				}
+			}
+		}
+		v = overlay(v, m)
+		v.UpdatedAt = now
+		current[key] = v
+		result[i] = *copyMetric(v)
+	}
+	return result
+}
+
+// forgetStored - удаленные метрики отсутствуют в хранилище, вызывается под mutex
+func (s *bufferedMetricsStorage) forgetStored(match func(m *models.Metrics) bool) {
+	for k, stored := range s.stored {
+		if stored != nil && match(stored) {
+			s.stored[k] = nil
+		}
+	}
+}
+
+func (s *bufferedMetricsStorage) Update(m *models.Metrics) error {
+	return s.Updates([]models.Metrics{*m})
+}
+
+func (s *bufferedMetricsStorage) Get(id string, mtype string, labels models.Labels) (*models.Metrics, error) {
+	s.flushMutex.RLock()
+	defer s.flushMutex.RUnlock()
+
+	stored, err := s.storage.Get(id, mtype, labels)
+	if err != nil {
+		return nil, err
+	}
+	key := models.MetricKey(id, labels)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, buffer := range []map[string]*models.Metrics{s.flushing, s.pending} {
+		if p, ok := buffer[key]; ok {
+			stored = overlay(stored, p)
+		}
+	}
+	if stored != nil && stored.MType != mtype {
+		return nil, nil
+	}
+	return stored, nil
+}
+
+func (s *bufferedMetricsStorage) GetAll() ([]models.Metrics, error) {
+	s.flushMutex.RLock()
+	defer s.flushMutex.RUnlock()
+
+	stored, err := s.storage.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]int, len(stored))
+	for i := range stored {
+		byKey[stored[i].Key()] = i
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, buffer := range []map[string]*models.Metrics{s.flushing, s.pending} {
+		for key, p := range buffer {
+			if i, ok := byKey[key]; ok {
+				stored[i] = *overlay(&stored[i], p)
+			} else {
+				byKey[key] = len(stored)
+				stored = append(stored, *overlay(nil, p))
+			}
+		}
+	}
+	return stored, nil
+}
+
+// Query - выборка учитывает несброшенные обновления, поэтому условия проверяются на стороне сервиса
+func (s *bufferedMetricsStorage) Query(q Query) ([]models.Metrics, error) {
+	metrics, err := s.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	return applyQuery(metrics, q)
+}
+
+// Delete - несброшенные обновления метрики отбрасываются.
+// сброс буфера на это время остановлен, поэтому удаленное не вернется в хранилище
+func (s *bufferedMetricsStorage) Delete(id string, mtype string, labels models.Labels) (bool, error) {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+
+	key := models.MetricKey(id, labels)
+	s.mutex.Lock()
+	p, buffered := s.pending[key]
+	buffered = buffered && p.MType == mtype
+	if buffered {
+		delete(s.pending, key)
+	}
+	s.mutex.Unlock()
+
+	deleted, err := s.storage.Delete(id, mtype, labels)
+	s.mutex.Lock()
+	s.forgetStored(func(m *models.Metrics) bool { return m.MType == mtype && m.Key() == key })
+	s.mutex.Unlock()
+	return deleted || buffered, err
+}
+
+// DeleteByPattern - метрики, которые есть только в буфере, тоже учитываются в числе удаленных
+func (s *bufferedMetricsStorage) DeleteByPattern(pattern string, mtype string, selector models.Labels) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, err
+	}
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+
+	s.mutex.Lock()
+	buffered := make([]*models.Metrics, 0)
+	for key, p := range s.pending {
+		if matchMetric(p, pattern, mtype, selector) {
+			buffered = append(buffered, p)
+			delete(s.pending, key)
+		}
+	}
+	s.mutex.Unlock()
+
+	onlyBuffered := 0
+	for _, p := range buffered {
+		stored, err := s.storage.Get(p.ID, p.MType, p.Labels)
+		if err != nil {
+			return 0, err
+		}
+		if stored == nil {
+			onlyBuffered++
+		}
+	}
+	deleted, err := s.storage.DeleteByPattern(pattern, mtype, selector)
+	s.mutex.Lock()
+	s.forgetStored(func(m *models.Metrics) bool { return matchMetric(m, pattern, mtype, selector) })
+	s.mutex.Unlock()
+	return deleted + onlyBuffered, err
+}
+
+// History - точки истории появляются только после сброса буфера
+func (s *bufferedMetricsStorage) History(id string, mtype string, labels models.Labels, from time.Time, to time.Time, step time.Duration) ([]models.MetricPoint, error) {
+	return s.storage.History(id, mtype, labels, from, to, step)
+}
+
+// LoadState - состояние хранится в основном хранилище, если оно это поддерживает
+func (s *bufferedMetricsStorage) LoadState(name string) ([]byte, error) {
+	if store, ok := s.storage.(StateStore); ok {
+		return store.LoadState(name)
+	}
+	return nil, nil
+}
+
+func (s *bufferedMetricsStorage) SaveState(name string, data []byte) error {
+	if store, ok := s.storage.(StateStore); ok {
+		return store.SaveState(name, data)
+	}
+	return nil
+}
+
+func (s *bufferedMetricsStorage) Check() error {
+	return s.storage.Check()
+}
+
+func (s *bufferedMetricsStorage) Close() {
+	if err := s.flush(); err != nil {
+		s.logger.Errorf("error on flush buffered metrics: %v", err)
+	}
+	s.storage.Close()
+}
+
+func (s *bufferedMetricsStorage) runFlushJob(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.flushCh:
+		case <-ctx.Done():
+			ticker.Stop()
+			s.logger.Info("stop runFlushJob")
+			return
+		}
+		if err := s.flush(); err != nil {
+			s.logger.Errorf("error on flush buffered metrics: %v", err)
+		}
+	}
+}
+
+// flush - сброс накопленных обновлений одним вызовом Updates.
+// при ошибке обновления возвращаются в буфер и будут сброшены в следующий раз,
+// после MaxFlushAttempts неудачных сбросов подряд они отбрасываются
+func (s *bufferedMetricsStorage) flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+
+	s.mutex.Lock()
+	if len(s.pending) == 0 {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.flushing, s.pending = s.pending, make(map[string]*models.Metrics)
+	s.mutex.Unlock()
+
+	batch := make([]models.Metrics, 0, len(s.flushing))
+	for _, m := range s.flushing {
+		batch = append(batch, *m)
+	}
+	err := s.storage.Updates(batch)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case err == nil:
+		s.failures = 0
+		s.applyStored(s.flushing)
+	case s.failures+1 >= MaxFlushAttempts:
+		s.failures = 0
+		s.logger.Errorf("%d buffered metrics dropped after %d failed flushes: %v", len(s.flushing), MaxFlushAttempts, err)
+	default:
+		s.failures++
+		// более новые обновления применяются поверх вернувшихся
+		for key, p := range s.pending {
+			if f, ok := s.flushing[key]; ok && mergeMetric(f, p) == nil {
+				continue
+			}
+			s.flushing[key] = p
+		}
+		s.pending = s.flushing
+	}
+	s.flushing = nil
+	return err
+}
+
+// overlay - значение метрики с учетом несброшенного обновления p
+func overlay(stored *models.Metrics, p *models.Metrics) *models.Metrics {
+	v := copyMetric(p)
+	if stored == nil || stored.MType != p.MType {
+		return v
+	}
+	result := copyMetric(stored)
+	if mergeMetric(result, v) != nil {
+		return v
+	}
+	return result
+}
+
+// mergeMetric - применение обновления m к значению dst той же метрики
+func mergeMetric(dst *models.Metrics, m *models.Metrics) error {
+	if dst.MType != m.MType {
+		*dst = *copyMetric(m)
+		return nil
+	}
+	switch m.MType {
+	case models.COUNTER:
+		d := *dst.Delta + *m.Delta
+		dst.Delta = &d
+		if m.Cumulative != nil {
+			c := *m.Cumulative
+			dst.Cumulative = &c
+		}
+	case models.HISTOGRAM:
+		if err := dst.Histogram.Merge(m.Histogram); err != nil {
+			return err
+		}
+	default:
+		*dst = *copyMetric(m)
+	}
+	dst.UpdatedAt = m.UpdatedAt
+	return nil
+}
+
+// coalesce - объединение обновлений одной метрики в пакете, порядок первых вхождений сохраняется.
+// значения исходного пакета не изменяются
+func coalesce(metrics []models.Metrics) ([]models.Metrics, error) {
+	result := make([]models.Metrics, 0, len(metrics))
+	byKey := make(map[string]int, len(metrics))
+	for i := range metrics {
+		key := metrics[i].Key()
+		if j, ok := byKey[key]; ok {
+			if err := mergeMetric(&result[j], &metrics[i]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		byKey[key] = len(result)
+		result = append(result, *copyMetric(&metrics[i]))
+	}
+	return result, nil
+}
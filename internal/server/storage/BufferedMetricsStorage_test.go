@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+	"yametrics/internal/histogram"
+	"yametrics/internal/server/config"
+	"yametrics/internal/server/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// failingStorage - хранилище, обновления которого можно заставить завершаться ошибкой.
+// считает чтения Get, пока задан block, чтения ждут его закрытия
+type failingStorage struct {
+	MetricsStorage
+	err   error
+	gets  int32
+	block chan struct{}
+}
+
+func (s *failingStorage) Get(id string, mtype string, labels models.Labels) (*models.Metrics, error) {
+	atomic.AddInt32(&s.gets, 1)
+	if s.block != nil {
+		<-s.block
+	}
+	return s.MetricsStorage.Get(id, mtype, labels)
+}
+
+func (s *failingStorage) Updates(metrics []models.Metrics) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.MetricsStorage.Updates(metrics)
+}
+
+func newTestBufferedStorage(t *testing.T, maxSize int) (*bufferedMetricsStorage, *failingStorage) {
+	memory, err := NewFileMetricsStorage(&config.ServerConfig{}, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	underlying := &failingStorage{MetricsStorage: memory}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	storage := NewBufferedMetricsStorage(underlying, maxSize, time.Hour, ctx, zap.NewNop().Sugar())
+	return storage.(*bufferedMetricsStorage), underlying
+}
+
+func TestBufferedMetricsStorage(t *testing.T) {
+	storage, underlying := newTestBufferedStorage(t, 100)
+
+	d := int64(2)
+	v1, v2 := 1.0, 2.0
+	web := models.Labels{"host": "web"}
+	require.NoError(t, storage.Updates([]models.Metrics{
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d},
+		{ID: "Alloc", MType: models.GAUGE, Labels: web, Value: &v1},
+	}))
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	require.NoError(t, storage.Update(&models.Metrics{ID: "Alloc", MType: models.GAUGE, Labels: web, Value: &v2}))
+
+	// до сброса хранилище пустое, но чтения видят буфер
+	stored, err := underlying.Get("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Nil(t, stored)
+	counter, err := storage.Get("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *counter.Delta)
+	all, err := storage.GetAll()
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	require.NoError(t, storage.flush())
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+
+	stored, err = underlying.Get("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *stored.Delta)
+	counter, err = storage.Get("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), *counter.Delta)
+	gauge, err := storage.Get("Alloc", models.GAUGE, web)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *gauge.Value)
+
+	// обновления объединены: в истории одна точка на сброс
+	points, err := storage.History("Alloc", models.GAUGE, web, time.Now().Add(-time.Minute), time.Now(), 0)
+	require.NoError(t, err)
+	assert.Len(t, points, 1)
+}
+
+func TestBufferedMetricsStorageFlushBySize(t *testing.T) {
+	storage, underlying := newTestBufferedStorage(t, 2)
+
+	v := 1.0
+	require.NoError(t, storage.Updates([]models.Metrics{
+		{ID: "Alloc", MType: models.GAUGE, Value: &v},
+		{ID: "HeapInuse", MType: models.GAUGE, Value: &v},
+	}))
+	assert.Eventually(t, func() bool {
+		all, err := underlying.GetAll()
+		return err == nil && len(all) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBufferedMetricsStorageFlushError(t *testing.T) {
+	storage, underlying := newTestBufferedStorage(t, 100)
+
+	d := int64(1)
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	underlying.err = errors.New("db is down")
+	assert.Error(t, storage.flush())
+
+	// обновления вернулись в буфер и объединились с новыми
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	underlying.err = nil
+	require.NoError(t, storage.flush())
+	stored, err := underlying.Get("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *stored.Delta)
+}
+
+func TestBufferedMetricsStorageDropsFailedFlush(t *testing.T) {
+	storage, underlying := newTestBufferedStorage(t, 100)
+
+	d := int64(1)
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	underlying.err = errors.New("constraint violation")
+	for i := 1; i < MaxFlushAttempts; i++ {
+		assert.Error(t, storage.flush())
+		assert.Len(t, storage.pending, 1)
+	}
+	// после последней попытки обновления отбрасываются, а не возвращаются в буфер навсегда
+	assert.Error(t, storage.flush())
+	assert.Empty(t, storage.pending)
+
+	underlying.err = nil
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	require.NoError(t, storage.flush())
+	stored, err := underlying.Get("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), *stored.Delta)
+}
+
+func TestBufferedMetricsStorageStoredState(t *testing.T) {
+	storage, underlying := newTestBufferedStorage(t, 100)
+	cumulative := func(id string, v int64) *models.Metrics {
+		return &models.Metrics{ID: id, MType: models.COUNTER, Delta: &v, Temporality: models.CUMULATIVE}
+	}
+
+	// состояние из хранилища читается один раз, дальше его поддерживают сбросы
+	require.NoError(t, storage.Update(cumulative("Requests", 10)))
+	require.NoError(t, storage.flush())
+	require.NoError(t, storage.Update(cumulative("Requests", 15)))
+	require.NoError(t, storage.flush())
+	require.NoError(t, storage.Update(cumulative("Requests", 18)))
+	require.NoError(t, storage.flush())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&underlying.gets))
+	stored, err := underlying.Get("Requests", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(18), *stored.Delta)
+
+	// пока хранилище отвечает на чтение, другие обновления не ждут
+	underlying.block = make(chan struct{})
+	done := make(chan error)
+	go func() { done <- storage.Update(cumulative("Slow", 1)) }()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&underlying.gets) == 3 }, time.Second, time.Millisecond)
+	v := 1.0
+	require.NoError(t, storage.Update(&models.Metrics{ID: "Alloc", MType: models.GAUGE, Value: &v}))
+	require.NoError(t, storage.Update(cumulative("Requests", 20)))
+	close(underlying.block)
+	require.NoError(t, <-done)
+	underlying.block = nil
+
+	// после удаления накопленное значение считается заново
+	_, err = storage.Delete("Requests", models.COUNTER, nil)
+	require.NoError(t, err)
+	require.NoError(t, storage.Update(cumulative("Requests", 5)))
+	counter, err := storage.Get("Requests", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *counter.Delta)
+}
+
+func TestBufferedMetricsStorageHistogram(t *testing.T) {
+	storage, underlying := newTestBufferedStorage(t, 100)
+
+	h := histogram.New([]float64{1, 10})
+	h.Observe(5)
+	require.NoError(t, underlying.Update(&models.Metrics{ID: "GCPauseNs", MType: models.HISTOGRAM, Histogram: h}))
+	require.NoError(t, storage.Update(&models.Metrics{ID: "GCPauseNs", MType: models.HISTOGRAM, Histogram: h}))
+
+	// несовместимая с сохраненной гистограмма не попадает в буфер
+	err := storage.Update(&models.Metrics{ID: "GCPauseNs", MType: models.HISTOGRAM, Histogram: histogram.New([]float64{2})})
+	assert.ErrorIs(t, err, histogram.ErrIncompatibleBuckets)
+
+	stored, err := storage.Get("GCPauseNs", models.HISTOGRAM, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), stored.Histogram.Count)
+}
+
+func TestCoalesce(t *testing.T) {
+	d1, d2 := int64(1), int64(2)
+	v1, v2 := 1.0, 2.0
+	metrics := []models.Metrics{
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d1},
+		{ID: "Alloc", MType: models.GAUGE, Value: &v1},
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d2},
+		{ID: "Alloc", MType: models.GAUGE, Value: &v2},
+		{ID: "Alloc", MType: models.GAUGE, Labels: models.Labels{"host": "web"}, Value: &v1},
+	}
+	result, err := coalesce(metrics)
+	require.NoError(t, err)
+	require.Len(t, result, 3)
+	assert.Equal(t, int64(3), *result[0].Delta)
+	assert.Equal(t, 2.0, *result[1].Value)
+	assert.Equal(t, 1.0, *result[2].Value)
+	// исходный пакет не изменился
+	assert.Equal(t, int64(1), *metrics[0].Delta)
+}
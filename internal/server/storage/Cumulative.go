@@ -0,0 +1,58 @@
+package storage
+
+import "yametrics/internal/server/models"
+
+// toIncrements - перевод накопленных значений counter (models.CUMULATIVE) в приращения.
+// приращение считается от последнего присланного накопленного значения, которое возвращает lastCumulative.
+// если значение уменьшилось, счетчик агента был сброшен (например, при перезапуске),
+// и приращением считается все новое значение. первое накопленное значение тоже целиком считается приращением.
+// в результате у метрики остается приращение в Delta и новое накопленное значение в Cumulative.
+// обновления пакета обрабатываются по порядку, исходный пакет не изменяется
+func toIncrements(metrics []models.Metrics, lastCumulative func(m *models.Metrics) (*int64, error)) ([]models.Metrics, error) {
+	result := metrics
+	copied := false
+	// last - накопленные значения, полученные в этом пакете; nil, если метрика в пакете сменила тип
+	last := make(map[string]*int64)
+	for i := range metrics {
+		m := &metrics[i]
+		key := m.Key()
+		if m.MType != models.COUNTER {
+			last[key] = nil
+			continue
+		}
+		if m.Temporality != models.CUMULATIVE {
+			continue
+		}
+		if !copied {
+			result = append(make([]models.Metrics, 0, len(metrics)), metrics...)
+			copied = true
+		}
+
+		prev, ok := last[key]
+		if !ok {
+			var err error
+			if prev, err = lastCumulative(m); err != nil {
+				return nil, err
+			}
+		}
+		value := *m.Delta
+		increment := value
+		if prev != nil && value >= *prev {
+			increment = value - *prev
+		}
+		c := copyMetric(m)
+		c.Delta, c.Cumulative, c.Temporality = &increment, &value, ""
+		result[i] = *c
+		last[key] = &value
+	}
+	return result, nil
+}
+
+// storedCumulative - последнее накопленное значение из сохраненной метрики, nil если метрика не counter
+func storedCumulative(stored *models.Metrics) *int64 {
+	if stored == nil || stored.MType != models.COUNTER || stored.Cumulative == nil {
+		return nil
+	}
+	v := *stored.Cumulative
+	return &v
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"yametrics/internal/server/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cumulative(id string, v int64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.COUNTER, Delta: &v, Temporality: models.CUMULATIVE}
+}
+
+func TestToIncrements(t *testing.T) {
+	stored := int64(10)
+	lastCumulative := func(m *models.Metrics) (*int64, error) {
+		if m.ID == "PollCount" {
+			return &stored, nil
+		}
+		return nil, nil
+	}
+	d := int64(7)
+	metrics := []models.Metrics{
+		cumulative("PollCount", 15),
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d},
+		cumulative("PollCount", 18),
+		// сброс счетчика агента
+		cumulative("PollCount", 4),
+		// первое значение новой метрики
+		cumulative("Requests", 3),
+	}
+	result, err := toIncrements(metrics, lastCumulative)
+	require.NoError(t, err)
+	require.Len(t, result, len(metrics))
+
+	increments := []int64{5, 7, 3, 4, 3}
+	for i, inc := range increments {
+		assert.Equal(t, inc, *result[i].Delta, "metric %d", i)
+		assert.Empty(t, result[i].Temporality)
+	}
+	assert.Equal(t, int64(4), *result[3].Cumulative)
+	assert.Nil(t, result[1].Cumulative)
+	// исходный пакет не изменился
+	assert.Equal(t, int64(15), *metrics[0].Delta)
+	assert.Equal(t, models.CUMULATIVE, metrics[0].Temporality)
+}
+
+// testCumulative - повторная отправка одного накопленного значения не меняет счетчик,
+// а после сброса счетчика агента его значение продолжает расти
+func testCumulative(t *testing.T, storage MetricsStorage) {
+	for _, v := range []int64{3, 5, 5, 5} {
+		require.NoError(t, storage.Updates([]models.Metrics{cumulative("PollCount", v)}))
+	}
+	assert.Equal(t, int64(5), getCounter(t, storage, "PollCount"))
+
+	// агент перезапущен
+	require.NoError(t, storage.Updates([]models.Metrics{cumulative("PollCount", 2), cumulative("PollCount", 4)}))
+	assert.Equal(t, int64(9), getCounter(t, storage, "PollCount"))
+
+	// приращения по-прежнему складываются
+	d := int64(1)
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	require.NoError(t, storage.Updates([]models.Metrics{cumulative("PollCount", 6)}))
+	assert.Equal(t, int64(12), getCounter(t, storage, "PollCount"))
+}
+
+func TestFileMetricsStorageCumulative(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	storage := newTestFileStorage(t, file)
+	testCumulative(t, storage)
+
+	// последнее накопленное значение восстанавливается из журнала и из сохраненного состояния
+	require.NoError(t, storage.wal.close())
+	storage = newTestFileStorage(t, file)
+	require.NoError(t, storage.Updates([]models.Metrics{cumulative("PollCount", 7)}))
+	assert.Equal(t, int64(13), getCounter(t, storage, "PollCount"))
+	storage.saveMetrics()
+	require.NoError(t, storage.wal.close())
+
+	storage = newTestFileStorage(t, file)
+	defer storage.Close()
+	require.NoError(t, storage.Updates([]models.Metrics{cumulative("PollCount", 7)}))
+	assert.Equal(t, int64(13), getCounter(t, storage, "PollCount"))
+}
+
+func TestSQLiteMetricStorageCumulative(t *testing.T) {
+	storage := newTestSQLiteStorage(t, filepath.Join(t.TempDir(), "metrics.db"))
+	defer storage.Close()
+	testCumulative(t, storage)
+}
+
+func TestBufferedMetricsStorageCumulative(t *testing.T) {
+	storage, underlying := newTestBufferedStorage(t, 100)
+	testCumulative(t, storage)
+
+	// после сброса буфера приращение считается от сохраненного значения
+	require.NoError(t, storage.flush())
+	require.NoError(t, storage.Updates([]models.Metrics{cumulative("PollCount", 8)}))
+	require.NoError(t, storage.flush())
+	assert.Equal(t, int64(14), getCounter(t, underlying, "PollCount"))
+}
@@ -4,49 +4,155 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+	"yametrics/internal/histogram"
 	"yametrics/internal/server/models"
+	"yametrics/internal/server/retention"
+	"yametrics/internal/server/storage/migrations"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"go.uber.org/zap"
 )
 
+// likePrefix - экранирование символов шаблона like в начале имени
+var likePrefix = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 const (
-	createTableIfNeedSQL = `create table if not exists metrics(
-		id varchar not null primary key,
-		mtype varchar not null,
-		delta bigint,
-		value double precision)`
-
-	upInsertSQL = `insert into metrics(
-		id,
-		mtype,
-		delta,
-		value)
-
-		values(
-		:id,
-		:mtype,
-		:delta,
-		:value)
-		
-		on conflict(id) do update set 
-		mtype = :mtype, 
-		delta = case when metrics.mtype = 'counter' then metrics.delta + :delta end,
-		value = case when metrics.mtype = 'gauge' then CAST(:value AS DOUBLE PRECISION) end`
-	getSQL    = `select id, mtype, delta, value from metrics where id = $1 and mtype = $2`
-	getAllSQL = `select id, mtype, delta, value from metrics`
+	// values - строки вида ($1, $2, $3, $4, $5, $6, $7), по строке на метрику
+	upInsertSQL = `insert into metrics(id, mtype, labels, delta, value, histogram, cumulative)
+		values %s
+		on conflict(id, labels) do update set
+		mtype = excluded.mtype,
+		updated_at = now(),
+		delta = case when metrics.mtype = 'counter' then metrics.delta + excluded.delta end,
+		cumulative = case when metrics.mtype = 'counter' then coalesce(excluded.cumulative, metrics.cumulative) end,
+		value = case when metrics.mtype = 'gauge' then excluded.value end,
+		histogram = case when metrics.mtype = 'histogram' then excluded.histogram end
+		returning id, mtype, labels, delta, value, histogram, cumulative, updated_at`
+	// upInsertColumns - число параметров в строке upInsertSQL
+	upInsertColumns = 7
+	// upInsertMaxRows - postgres допускает не больше 65535 параметров в запросе
+	upInsertMaxRows = 1000
+	getSQL          = `select id, mtype, labels, delta, value, histogram, cumulative from metrics where id = $1 and mtype = $2 and labels = $3`
+	getAllSQL       = `select id, mtype, labels, delta, value, histogram, cumulative, updated_at from metrics`
+
+	// гистограммы объединяются на стороне сервиса, строка блокируется до конца транзакции
+	getHistogramForUpdateSQL = `select mtype, histogram from metrics where id = $1 and labels = $2 for update`
+	// приращение из накопленного значения считается на стороне сервиса, строка блокируется до конца транзакции
+	getCumulativeForUpdateSQL = `select mtype, cumulative from metrics where id = $1 and labels = $2 for update`
+
+	insertHistorySQL = `insert into metrics_history(id, mtype, labels, delta, value, histogram, ts)
+		select m.id, m.mtype, m.labels, m.delta, m.value, m.histogram, now()
+		from metrics m
+		join unnest($1::varchar[], $2::varchar[], $3::varchar[]) as u(id, mtype, labels)
+		on m.id = u.id and m.mtype = u.mtype and m.labels = u.labels`
+	getHistorySQL = `select ts, delta, value, histogram from metrics_history
+		where id = $1 and mtype = $2 and labels = $3 and ts between $4 and $5
+		order by ts`
+
+	getRollupsSQL = `select ts, min, max, sum, count, last from metrics_rollups
+		where id = $1 and mtype = $2 and labels = $3 and step = $4 and ts > $5 and ts <= $6
+		order by ts`
+	getMetricIDsSQL = `select distinct id from metrics`
+
+	// агрегаты первого уровня из сырых точек интервалов, завершенных к моменту now и еще не агрегированных.
+	// для counter агрегируются приращения относительно предыдущей точки,
+	// если ее уже нет - относительно последнего агрегата
+	rollupHistorySQL = `with params as (select $1::varchar[] as ids, $2::bigint as step, $3::timestamptz as now),
+		last_rollups as (
+			select distinct on (r.id, r.labels, r.mtype) r.id, r.labels, r.mtype, r.ts, r.last
+			from metrics_rollups r, params
+			where r.step = params.step and r.id = any(params.ids)
+			order by r.id, r.labels, r.mtype, r.ts desc),
+		points as (
+			select h.id, h.mtype, h.labels, h.ts,
+				to_timestamp(floor(extract(epoch from h.ts) / params.step) * params.step) as bucket,
+				case when h.mtype = 'counter'
+					then h.delta - coalesce(lag(h.delta) over (partition by h.id, h.labels, h.mtype order by h.ts), r.last, 0)
+					else h.value end as v,
+				coalesce(h.delta::double precision, h.value) as last,
+				r.ts as watermark
+			from metrics_history h
+			cross join params
+			left join last_rollups r on r.id = h.id and r.labels = h.labels and r.mtype = h.mtype
+			where h.id = any(params.ids) and h.mtype in ('gauge', 'counter'))
+		insert into metrics_rollups(id, mtype, labels, step, ts, min, max, sum, count, last)
+		select p.id, p.mtype, p.labels, params.step, p.bucket, min(p.v), max(p.v), sum(p.v), count(*),
+			(array_agg(p.last order by p.ts desc))[1]
+		from points p cross join params
+		where (p.watermark is null or p.bucket > p.watermark)
+			and p.bucket + make_interval(secs => params.step) <= params.now
+		group by p.id, p.mtype, p.labels, p.bucket, params.step
+		on conflict do nothing`
+	// агрегаты следующего уровня из агрегатов предыдущего
+	rollupTierSQL = `with params as (select $1::varchar[] as ids, $2::bigint as step, $3::bigint as source_step, $4::timestamptz as now),
+		watermarks as (
+			select r.id, r.labels, r.mtype, max(r.ts) as ts
+			from metrics_rollups r, params
+			where r.step = params.step and r.id = any(params.ids)
+			group by r.id, r.labels, r.mtype),
+		src as (
+			select s.id, s.mtype, s.labels, s.ts, s.min, s.max, s.sum, s.count, s.last,
+				to_timestamp(floor(extract(epoch from s.ts) / params.step) * params.step) as bucket,
+				w.ts as watermark
+			from metrics_rollups s
+			cross join params
+			left join watermarks w on w.id = s.id and w.labels = s.labels and w.mtype = s.mtype
+			where s.step = params.source_step and s.id = any(params.ids))
+		insert into metrics_rollups(id, mtype, labels, step, ts, min, max, sum, count, last)
+		select s.id, s.mtype, s.labels, params.step, s.bucket, min(s.min), max(s.max), sum(s.sum), sum(s.count),
+			(array_agg(s.last order by s.ts desc))[1]
+		from src s cross join params
+		where (s.watermark is null or s.bucket > s.watermark)
+			and s.bucket + make_interval(secs => params.step) <= params.now
+		group by s.id, s.mtype, s.labels, s.bucket, params.step
+		on conflict do nothing`
+	deleteExpiredHistorySQL = `delete from metrics_history where id = any($1::varchar[]) and ts < $2`
+	deleteExpiredRollupsSQL = `delete from metrics_rollups where id = any($1::varchar[]) and step = $2 and ts < $3`
+	// удаление метрик вместе с историей и агрегатами, возвращает число удаленных метрик
+	deleteMetricsSQL = `with deleted as (
+			delete from metrics m
+			using unnest($1::varchar[], $2::varchar[], $3::varchar[]) as u(id, mtype, labels)
+			where m.id = u.id and m.mtype = u.mtype and m.labels = u.labels
+			returning m.id, m.labels),
+		history as (delete from metrics_history h using deleted d where h.id = d.id and h.labels = d.labels),
+		rollups as (delete from metrics_rollups r using deleted d where r.id = d.id and r.labels = d.labels)
+		select count(*) from deleted`
+	// удаление метрик, не обновлявшихся с момента $2
+	deleteExpiredMetricsSQL = `with deleted as (
+			delete from metrics where id = any($1::varchar[]) and updated_at < $2
+			returning id, labels),
+		history as (delete from metrics_history h using deleted d where h.id = d.id and h.labels = d.labels),
+		rollups as (delete from metrics_rollups r using deleted d where r.id = d.id and r.labels = d.labels)
+		select count(*) from deleted`
+	// агрегаты, оставшиеся от удаленных метрик или метрик с тем же именем, но другим типом
+	deleteStaleRollupsSQL = `delete from metrics_rollups r where not exists (
+		select 1 from metrics m where m.id = r.id and m.labels = r.labels and m.mtype = r.mtype)`
+	loadStateSQL = `select data from server_state where name = $1`
+	saveStateSQL = `insert into server_state(name, data) values ($1, $2)
+		on conflict(name) do update set data = excluded.data`
 )
 
 // dbMetricStorage - сервис по работе с бд
 type dbMetricStorage struct {
-	url    string
-	ctx    context.Context
-	xdb    *sqlx.DB
-	logger *zap.SugaredLogger
+	url       string
+	ctx       context.Context
+	xdb       *sqlx.DB
+	retention *retention.Config
+	logger    *zap.SugaredLogger
 }
 
-func NewDBMetricStorage(url string, ctx context.Context, logger *zap.SugaredLogger) (MetricsStorage, error) {
+// dbMetric - метрика со временем последнего обновления
+type dbMetric struct {
+	models.Metrics
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func NewDBMetricStorage(url string, retentionCfg *retention.Config, ctx context.Context, logger *zap.SugaredLogger) (MetricsStorage, error) {
 	logger.Infow("start init dbstorage ...")
 	xdb, err := sqlx.Connect("postgres", url)
 	if err != nil {
@@ -54,32 +160,30 @@ func NewDBMetricStorage(url string, ctx context.Context, logger *zap.SugaredLogg
 		return nil, NewStorageInitError(err)
 	}
 
-	storage := &dbMetricStorage{url, ctx, xdb, logger}
+	storage := &dbMetricStorage{url, ctx, xdb, retentionCfg, logger}
 	if err := storage.initDB(); err != nil {
 		logger.Errorf("error on connect to init db: %v", err)
 		return nil, NewStorageInitError(err)
 	}
+	if retentionCfg.Enabled() {
+		go runRetentionJob(ctx, retentionCfg, logger, storage.compact)
+	}
 	logger.Info("dbstorage initialized successfully")
 	return storage, nil
 }
 
-var upInsertStmt *sqlx.NamedStmt
-
 func (db *dbMetricStorage) initDB() error {
-	_, err := db.xdb.ExecContext(db.ctx, createTableIfNeedSQL)
-
+	migrator, err := migrations.NewMigrator(db.xdb, db.logger)
 	if err != nil {
 		return err
 	}
-
-	upInsertStmt, err = db.xdb.PrepareNamed(upInsertSQL)
-
+	_, err = migrator.Up(db.ctx)
 	return err
 }
 
-func (db *dbMetricStorage) Get(id string, mtype string) (*models.Metrics, error) {
+func (db *dbMetricStorage) Get(id string, mtype string, labels models.Labels) (*models.Metrics, error) {
 	metric := models.Metrics{}
-	err := db.xdb.GetContext(db.ctx, &metric, getSQL, id, mtype)
+	err := db.xdb.GetContext(db.ctx, &metric, getSQL, id, mtype, labels)
 	if err == nil {
 		return &metric, nil
 	} else if errors.Is(err, sql.ErrNoRows) {
@@ -90,38 +194,422 @@ func (db *dbMetricStorage) Get(id string, mtype string) (*models.Metrics, error)
 }
 
 func (db *dbMetricStorage) GetAll() ([]models.Metrics, error) {
-	metrics := []models.Metrics{}
-	if err := db.xdb.SelectContext(db.ctx, &metrics, getAllSQL); err != nil {
+	stored := []dbMetric{}
+	if err := db.xdb.SelectContext(db.ctx, &stored, getAllSQL); err != nil {
+		return nil, err
+	}
+	metrics := make([]models.Metrics, len(stored))
+	for i := range stored {
+		metrics[i] = stored[i].Metrics
+		metrics[i].UpdatedAt = stored[i].UpdatedAt
+	}
+	return metrics, nil
+}
+
+// Query - условия, сортировка и позиция выборки выполняются в бд.
+// строки сравниваются побайтово (collate "C"), как в остальных хранилищах
+func (db *dbMetricStorage) Query(q Query) ([]models.Metrics, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	query, args, err := querySQL(q)
+	if err != nil {
 		return nil, err
 	}
+	stored := []dbMetric{}
+	if err := db.xdb.SelectContext(db.ctx, &stored, query, args...); err != nil {
+		return nil, err
+	}
+	metrics := make([]models.Metrics, len(stored))
+	for i := range stored {
+		metrics[i] = stored[i].Metrics
+		metrics[i].UpdatedAt = stored[i].UpdatedAt
+	}
 	return metrics, nil
+}
+
+// querySQL - запрос выборки по условиям q и его параметры
+func querySQL(q Query) (string, []any, error) {
+	conditions := make([]string, 0)
+	args := make([]any, 0)
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if q.MType != "" {
+		conditions = append(conditions, "mtype = "+arg(q.MType))
+	}
+	if q.Prefix != "" {
+		conditions = append(conditions, `id like `+arg(likePrefix.Replace(q.Prefix)+"%")+` escape '\'`)
+	}
+	if q.Pattern != "" {
+		conditions = append(conditions, "id ~ "+arg(globRegexp(q.Pattern)))
+	}
+	if q.Regexp != "" {
+		conditions = append(conditions, "id ~ "+arg(q.Regexp))
+	}
+	if len(q.Selector) > 0 {
+		selector, err := labelsString(q.Selector)
+		if err != nil {
+			return "", nil, err
+		}
+		conditions = append(conditions, "labels::jsonb @> "+arg(selector)+"::jsonb")
+	}
+
+	// столбцы ключа сортировки, как в queryKey.compare
+	columns := []string{`id collate "C"`, `labels collate "C"`, `mtype collate "C"`}
+	switch q.SortBy {
+	case SortByType:
+		columns = []string{`mtype collate "C"`, `id collate "C"`, `labels collate "C"`}
+	case SortByUpdated:
+		columns = append([]string{"updated_at"}, columns...)
+	}
+	if q.After != nil {
+		labels, err := labelsString(q.After.Labels)
+		if err != nil {
+			return "", nil, err
+		}
+		values := map[string]any{
+			`id collate "C"`:     q.After.ID,
+			`labels collate "C"`: labels,
+			`mtype collate "C"`:  q.After.MType,
+			"updated_at":         q.After.UpdatedAt,
+		}
+		placeholders := make([]string, len(columns))
+		for i, c := range columns {
+			placeholders[i] = arg(values[c])
+		}
+		op := ">"
+		if q.Desc {
+			op = "<"
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s) %s (%s)", strings.Join(columns, ", "), op, strings.Join(placeholders, ", ")))
+	}
 
+	query := getAllSQL
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	order := make([]string, len(columns))
+	for i, c := range columns {
+		order[i] = c
+		if q.Desc {
+			order[i] += " desc"
+		}
+	}
+	query += " order by " + strings.Join(order, ", ")
+	if q.Limit > 0 {
+		query += " limit " + arg(q.Limit)
+	}
+	return query, args, nil
+}
+
+func (db *dbMetricStorage) History(id string, mtype string, labels models.Labels, from time.Time, to time.Time, step time.Duration) ([]models.MetricPoint, error) {
+	if policy, source := historySource(db.retention, id, mtype, from, step); source >= 0 {
+		rollups := []models.Rollup{}
+		tierStep := policy.Rollups[source].Step.Duration
+		// агрегат попадает в историю, если его интервал пересекается с [from, to]
+		if err := db.xdb.SelectContext(db.ctx, &rollups, getRollupsSQL,
+			id, mtype, labels, int64(tierStep.Seconds()), from.Add(-tierStep), to); err != nil {
+			return nil, err
+		}
+		return rollupHistory(mtype, rollups, from, step), nil
+	}
+
+	points := []models.MetricPoint{}
+	if err := db.xdb.SelectContext(db.ctx, &points, getHistorySQL, id, mtype, labels, from, to); err != nil {
+		return nil, err
+	}
+	return downsample(points, from, step), nil
 }
 
 func (db *dbMetricStorage) Update(m *models.Metrics) error {
-	if _, err := upInsertStmt.ExecContext(db.ctx, m); err != nil {
+	return db.Updates([]models.Metrics{*m})
+}
+
+// Updates - все метрики сохраняются в одной транзакции многострочными запросами.
+// накопленные значения counter переводятся в приращения
+func (db *dbMetricStorage) Updates(mtrcs []models.Metrics) error {
+	_, err := db.UpdatesApplied(mtrcs)
+	return err
+}
+
+// UpdatesApplied - значения возвращает сам upsert. upsert не может обновить строку дважды,
+// поэтому пакет с повторами метрики применяется частями без повторов, по порядку
+func (db *dbMetricStorage) UpdatesApplied(mtrcs []models.Metrics) ([]models.Metrics, error) {
+	if len(mtrcs) == 0 {
+		return []models.Metrics{}, nil
+	}
+
+	tx, err := db.xdb.BeginTxx(db.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rollback := func(err error) ([]models.Metrics, error) {
+		if txErr := tx.Rollback(); txErr != nil {
+			return nil, txErr
+		}
+		return nil, err
+	}
+
+	mtrcs, err = toIncrements(mtrcs, func(m *models.Metrics) (*int64, error) {
+		return db.lastCumulative(tx, m)
+	})
+	if err != nil {
+		return rollback(err)
+	}
+
+	applied := make([]models.Metrics, len(mtrcs))
+	// current - значения метрик после уже примененных частей
+	current := make(map[string]*models.Metrics, len(mtrcs))
+	parts := uniqueParts(mtrcs)
+	for _, part := range parts {
+		batch := make([]models.Metrics, len(part))
+		for i, n := range part {
+			batch[i] = mtrcs[n]
+			if batch[i].MType != models.HISTOGRAM {
+				continue
+			}
+			if prev := current[batch[i].Key()]; prev != nil && prev.MType == models.HISTOGRAM && prev.Histogram != nil {
+				h := prev.Histogram.Copy()
+				if err := h.Merge(batch[i].Histogram); err != nil {
+					return rollback(err)
+				}
+				batch[i].Histogram = h
+			} else if batch[i].Histogram, err = db.mergeHistogram(tx, &batch[i]); err != nil {
+				return rollback(err)
+			}
+		}
+		for start := 0; start < len(batch); start += upInsertMaxRows {
+			end := start + upInsertMaxRows
+			if end > len(batch) {
+				end = len(batch)
+			}
+			query, args := upInsertQuery(batch[start:end])
+			stored := []dbMetric{}
+			if err := tx.SelectContext(db.ctx, &stored, query, args...); err != nil {
+				return rollback(err)
+			}
+			for i := range stored {
+				m := stored[i].Metrics
+				m.UpdatedAt = stored[i].UpdatedAt
+				current[m.Key()] = &m
+			}
+		}
+		for _, n := range part {
+			applied[n] = *copyMetric(current[mtrcs[n].Key()])
+		}
+	}
+
+	// точка истории - значение метрики после всего пакета. первая часть содержит каждую метрику пакета
+	ids, mtypes, labels := make([]string, len(parts[0])), make([]string, len(parts[0])), make([]string, len(parts[0]))
+	for i, n := range parts[0] {
+		m := &mtrcs[n]
+		ids[i], mtypes[i] = m.ID, current[m.Key()].MType
+		if labels[i], err = labelsString(m.Labels); err != nil {
+			return rollback(err)
+		}
+	}
+	if _, err := tx.ExecContext(db.ctx, insertHistorySQL, pq.Array(ids), pq.Array(mtypes), pq.Array(labels)); err != nil {
+		return rollback(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// uniqueParts - номера обновлений пакета, разбитые на части без повторов метрики:
+// k-е обновление каждой метрики попадает в k-ю часть, порядок внутри части сохраняется
+func uniqueParts(metrics []models.Metrics) [][]int {
+	parts := make([][]int, 0, 1)
+	seen := make(map[string]int, len(metrics))
+	for i := range metrics {
+		key := metrics[i].Key()
+		k := seen[key]
+		seen[key] = k + 1
+		if k == len(parts) {
+			parts = append(parts, make([]int, 0, len(metrics)-i))
+		}
+		parts[k] = append(parts[k], i)
+	}
+	return parts
+}
+
+func (db *dbMetricStorage) Delete(id string, mtype string, labels models.Labels) (bool, error) {
+	deleted, err := db.deleteMetrics([]models.Metrics{{ID: id, MType: mtype, Labels: labels}})
+	return deleted > 0, err
+}
+
+// DeleteByPattern - шаблон проверяется на стороне сервиса, подходящие метрики удаляются одним запросом
+func (db *dbMetricStorage) DeleteByPattern(pattern string, mtype string, selector models.Labels) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, err
+	}
+	metrics, err := db.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	matched := make([]models.Metrics, 0)
+	for i := range metrics {
+		if matchMetric(&metrics[i], pattern, mtype, selector) {
+			matched = append(matched, metrics[i])
+		}
+	}
+	if len(matched) == 0 {
+		return 0, nil
+	}
+	return db.deleteMetrics(matched)
+}
+
+func (db *dbMetricStorage) deleteMetrics(mtrcs []models.Metrics) (int, error) {
+	var err error
+	ids, mtypes, labels := make([]string, len(mtrcs)), make([]string, len(mtrcs)), make([]string, len(mtrcs))
+	for i, m := range mtrcs {
+		ids[i], mtypes[i] = m.ID, m.MType
+		if labels[i], err = labelsString(m.Labels); err != nil {
+			return 0, err
+		}
+	}
+	var deleted int
+	err = db.xdb.GetContext(db.ctx, &deleted, deleteMetricsSQL, pq.Array(ids), pq.Array(mtypes), pq.Array(labels))
+	return deleted, err
+}
+
+// upInsertQuery - многострочный upsert и его параметры
+func upInsertQuery(mtrcs []models.Metrics) (string, []any) {
+	rows := make([]string, len(mtrcs))
+	args := make([]any, 0, len(mtrcs)*upInsertColumns)
+	for i, m := range mtrcs {
+		n := i * upInsertColumns
+		rows[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6, n+7)
+		args = append(args, m.ID, m.MType, m.Labels, m.Delta, m.Value, m.Histogram, m.Cumulative)
+	}
+	return fmt.Sprintf(upInsertSQL, strings.Join(rows, ", ")), args
+}
+
+// labelsString - метки в том виде, в котором они хранятся в бд
+func labelsString(labels models.Labels) (string, error) {
+	v, err := labels.Value()
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// lastCumulative - последнее накопленное значение counter, сохраненное в бд
+func (db *dbMetricStorage) lastCumulative(tx *sqlx.Tx, m *models.Metrics) (*int64, error) {
+	stored := models.Metrics{}
+	err := tx.GetContext(db.ctx, &stored, getCumulativeForUpdateSQL, m.ID, m.Labels)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return storedCumulative(&stored), nil
+}
+
+// mergeHistogram - объединение гистограммы с сохраненным в бд значением
+func (db *dbMetricStorage) mergeHistogram(tx *sqlx.Tx, m *models.Metrics) (*histogram.Histogram, error) {
+	stored := models.Metrics{}
+	err := tx.GetContext(db.ctx, &stored, getHistogramForUpdateSQL, m.ID, m.Labels)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (stored.MType != models.HISTOGRAM || stored.Histogram == nil)) {
+		return m.Histogram.Copy(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := stored.Histogram.Merge(m.Histogram); err != nil {
+		return nil, err
+	}
+	return stored.Histogram, nil
+}
+
+// compact - применение политик хранения sql-запросами, метрики одной политики обрабатываются вместе
+func (db *dbMetricStorage) compact(now time.Time) error {
+	ids := []string{}
+	if err := db.xdb.SelectContext(db.ctx, &ids, getMetricIDsSQL); err != nil {
 		return err
 	}
+	byPolicy := make(map[*retention.Policy][]string)
+	for _, id := range ids {
+		if policy := db.retention.Match(id); policy != nil {
+			byPolicy[policy] = append(byPolicy[policy], id)
+		}
+	}
+
+	if _, err := db.xdb.ExecContext(db.ctx, deleteStaleRollupsSQL); err != nil {
+		return err
+	}
+	for policy, ids := range byPolicy {
+		if err := db.compactPolicy(policy, ids, now); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (db *dbMetricStorage) Updates(mtrcs []models.Metrics) error {
-	tx, err := db.xdb.Beginx()
+func (db *dbMetricStorage) compactPolicy(policy *retention.Policy, ids []string, now time.Time) error {
+	tx, err := db.xdb.BeginTxx(db.ctx, nil)
 	if err != nil {
 		return err
 	}
+	rollback := func(err error) error {
+		if txErr := tx.Rollback(); txErr != nil {
+			return txErr
+		}
+		return err
+	}
 
-	for i := 0; i < len(mtrcs); i++ {
-		if _, err := upInsertStmt.ExecContext(db.ctx, &mtrcs[i]); err != nil {
-			if txErr := tx.Rollback(); txErr != nil {
-				return txErr
+	if expire := policy.Expire.Duration; expire > 0 {
+		var expired int
+		if err := tx.GetContext(db.ctx, &expired, deleteExpiredMetricsSQL, pq.Array(ids), now.Add(-expire)); err != nil {
+			return rollback(err)
+		}
+		if expired > 0 {
+			db.logger.Infof("%d expired metrics deleted", expired)
+		}
+	}
+	for i, t := range policy.Rollups {
+		step := int64(t.Step.Seconds())
+		if i == 0 {
+			_, err = tx.ExecContext(db.ctx, rollupHistorySQL, pq.Array(ids), step, now)
+		} else {
+			_, err = tx.ExecContext(db.ctx, rollupTierSQL, pq.Array(ids), step, int64(policy.Rollups[i-1].Step.Seconds()), now)
+		}
+		if err != nil {
+			return rollback(err)
+		}
+	}
+	if raw := policy.Raw.Duration; raw > 0 {
+		if _, err := tx.ExecContext(db.ctx, deleteExpiredHistorySQL, pq.Array(ids), now.Add(-raw)); err != nil {
+			return rollback(err)
+		}
+	}
+	for _, t := range policy.Rollups {
+		if ttl := t.TTL.Duration; ttl > 0 {
+			if _, err := tx.ExecContext(db.ctx, deleteExpiredRollupsSQL, pq.Array(ids), int64(t.Step.Seconds()), now.Add(-ttl)); err != nil {
+				return rollback(err)
 			}
-			return err
 		}
 	}
 	return tx.Commit()
 }
 
+func (db *dbMetricStorage) LoadState(name string) ([]byte, error) {
+	var data []byte
+	err := db.xdb.GetContext(db.ctx, &data, loadStateSQL, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (db *dbMetricStorage) SaveState(name string, data []byte) error {
+	_, err := db.xdb.ExecContext(db.ctx, saveStateSQL, name, data)
+	return err
+}
+
 func (db *dbMetricStorage) Check() error {
 	return db.xdb.PingContext(db.ctx)
 }
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+	"yametrics/internal/server/models"
+)
+
+// shardsCount - число сегментов состояния, метрики распределяются по сегментам по хешу ключа
+const shardsCount = 64
+
+// metricsShard - сегмент состояния со своей блокировкой.
+// значения метрик не изменяются после записи в сегмент, обновление заменяет значение целиком,
+// поэтому прочитанное под блокировкой значение можно использовать и после ее снятия
+type metricsShard struct {
+	sync.RWMutex
+	metrics map[string]*models.Metrics
+	history map[string][]models.MetricPoint
+	// rollups - агрегаты истории по уровням политики хранения
+	rollups map[string]map[time.Duration][]models.Rollup
+	// updated - время последнего обновления метрики, по нему истекает срок хранения
+	updated map[string]time.Time
+}
+
+// metricsShards - состояние хранилища, разбитое на сегменты.
+// обновления разных сегментов не блокируют друг друга, чтение блокирует только свой сегмент
+type metricsShards [shardsCount]*metricsShard
+
+func newMetricsShards() *metricsShards {
+	var shards metricsShards
+	for i := range shards {
+		shards[i] = &metricsShard{
+			metrics: make(map[string]*models.Metrics),
+			history: make(map[string][]models.MetricPoint),
+			rollups: make(map[string]map[time.Duration][]models.Rollup),
+			updated: make(map[string]time.Time),
+		}
+	}
+	return &shards
+}
+
+// remove - удаление метрики вместе с историей и агрегатами, вызывается под блокировкой сегмента
+func (s *metricsShard) remove(key string) {
+	delete(s.metrics, key)
+	delete(s.history, key)
+	delete(s.rollups, key)
+	delete(s.updated, key)
+}
+
+func shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % shardsCount)
+}
+
+func (s *metricsShards) shard(key string) *metricsShard {
+	return s[shardIndex(key)]
+}
+
+// lockFor - блокировка сегментов всех метрик пакета, возвращает функцию разблокировки.
+// сегменты блокируются по возрастанию номера, поэтому пакеты не блокируют друг друга навсегда
+func (s *metricsShards) lockFor(metrics []models.Metrics) func() {
+	indexes := make([]int, 0, len(metrics))
+	seen := make(map[int]bool, len(metrics))
+	for i := range metrics {
+		if idx := shardIndex(metrics[i].Key()); !seen[idx] {
+			seen[idx] = true
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Ints(indexes)
+	for _, idx := range indexes {
+		s[idx].Lock()
+	}
+	return func() {
+		for i := len(indexes) - 1; i >= 0; i-- {
+			s[indexes[i]].Unlock()
+		}
+	}
+}
+
+// rlockAll - блокировка всех сегментов на чтение для согласованного снимка состояния
+func (s *metricsShards) rlockAll() func() {
+	for _, shard := range s {
+		shard.RLock()
+	}
+	return func() {
+		for i := len(s) - 1; i >= 0; i-- {
+			s[i].RUnlock()
+		}
+	}
+}
@@ -1,53 +1,161 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path"
+	"sort"
 	"sync"
 	"time"
 	"yametrics/internal/server/config"
 	"yametrics/internal/server/models"
+	"yametrics/internal/server/retention"
 
 	"go.uber.org/zap"
 )
 
 // fileMetricsStorage - файловое хранилище метрик
-// умеет периодически сохранять даные в файл и вычитывает его при старте
+// каждое обновление дописывается в журнал (wal), периодически состояние сохраняется в файл,
+// после чего журнал сжимается. при старте читается сохраненное состояние и воспроизводится журнал.
+// состояние в памяти разбито на сегменты с отдельными блокировками
 type fileMetricsStorage struct {
-	mutex   sync.Mutex
-	metrics map[string]*models.Metrics
-	logger  *zap.SugaredLogger
-	cfg     *config.ServerConfig
+	// saveMutex - сохранения состояния не должны пересекаться
+	saveMutex sync.Mutex
+	shards    *metricsShards
+	wal       *metricsWAL
+	logger    *zap.SugaredLogger
+	cfg       *config.ServerConfig
+}
+
+// historyRecord - формат хранения точки истории в файле
+type historyRecord struct {
+	ID     string
+	MType  string
+	Labels models.Labels `json:",omitempty"`
+	models.MetricPoint
+}
+
+// rollupRecord - формат хранения агрегата в файле
+type rollupRecord struct {
+	ID     string
+	MType  string
+	Labels models.Labels `json:",omitempty"`
+	Step   time.Duration
+	models.Rollup
+}
+
+// snapshotHeader - первая строка файлов состояния:
+// номер последней записи журнала, учтенной в файле
+type snapshotHeader struct {
+	Seq *uint64 `json:",omitempty"`
+}
+
+// snapshotLine - строка файла состояния: заголовок или метрика со временем последнего обновления
+type snapshotLine struct {
+	snapshotHeader
+	models.Metrics
+	UpdatedAt *time.Time `json:",omitempty"`
+}
+
+// historySnapshotLine - строка файла истории: заголовок или точка истории
+type historySnapshotLine struct {
+	snapshotHeader
+	historyRecord
 }
 
 func NewFileMetricsStorage(
 	cfg *config.ServerConfig,
 	logger *zap.SugaredLogger,
 	ctx context.Context) (MetricsStorage, error) {
-	storage := &fileMetricsStorage{metrics: make(map[string]*models.Metrics), cfg: cfg, logger: logger}
+	storage := &fileMetricsStorage{
+		shards: newMetricsShards(),
+		cfg:    cfg,
+		logger: logger}
+	if cfg.Retention.Enabled() {
+		go runRetentionJob(ctx, &cfg.Retention, logger, storage.compact)
+	}
+	if cfg.StoreFile == "" {
+		return storage, nil
+	}
+
+	wal, err := openMetricsWAL(storage.walFile(), logger)
+	if err != nil {
+		logger.Errorf("error on open wal: %v", err)
+		return nil, err
+	}
+	storage.wal = wal
 	if cfg.Restore {
 		if err := storage.loadMetrics(); err != nil {
 			return nil, err
 		}
+	} else if err := storage.wal.truncate(); err != nil {
+		// без восстановления журнал предыдущего запуска не нужен
+		return nil, err
 	}
-	if cfg.StoreFile != "" {
-		go storage.runSaveMetricsJob(ctx)
-	}
+	go storage.runSaveMetricsJob(ctx)
 	return storage, nil
 }
 
+// Updates - метрики сначала записываются в журнал, затем применяются к состоянию.
+// сегменты метрик пакета заблокированы на время записи в журнал,
+// поэтому порядок обновлений одной метрики в журнале и в памяти совпадает.
+// накопленные значения counter переводятся в приращения до записи в журнал.
+// если хотя бы одна гистограмма несовместима с сохраненной или с предыдущей в пакете, не применяется ни одна метрика
 func (s *fileMetricsStorage) Updates(metrics []models.Metrics) error {
+	_, err := s.UpdatesApplied(metrics)
+	return err
+}
+
+// UpdatesApplied - значения копируются из памяти сразу после применения, пока сегменты пакета заблокированы
+func (s *fileMetricsStorage) UpdatesApplied(metrics []models.Metrics) ([]models.Metrics, error) {
+	unlock := s.shards.lockFor(metrics)
+	defer unlock()
+
+	metrics, err := toIncrements(metrics, func(m *models.Metrics) (*int64, error) {
+		return storedCumulative(s.shards.shard(m.Key()).metrics[m.Key()]), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkUpdates(metrics); err != nil {
+		return nil, err
+	}
+	ts := time.Now()
+	if s.wal != nil {
+		if err := s.wal.append(walRecord{Timestamp: ts, Metrics: metrics}); err != nil {
+			s.logger.Errorf("error on write wal: %v", err)
+			return nil, err
+		}
+	}
+	applied := make([]models.Metrics, len(metrics))
 	for i := 0; i < len(metrics); i++ {
-		s.Update(&metrics[i])
+		if err := s.apply(&metrics[i], ts, true); err != nil {
+			// пакет проверен до записи в журнал, сюда попадает только ошибка в самой проверке
+			s.logger.Errorf("error on apply %s after wal write: %v", metrics[i].Key(), err)
+			return nil, err
+		}
+		key := metrics[i].Key()
+		applied[i] = *copyMetric(s.shards.shard(key).metrics[key])
+		applied[i].UpdatedAt = ts
 	}
-	return nil
+	return applied, nil
 }
 
-func (s *fileMetricsStorage) Get(id string, mtype string) (*models.Metrics, error) {
-	if metric, ok := s.metrics[id]; ok && metric.MType == mtype {
+func (s *fileMetricsStorage) Get(id string, mtype string, labels models.Labels) (*models.Metrics, error) {
+	key := models.MetricKey(id, labels)
+	shard := s.shards.shard(key)
+	shard.RLock()
+	metric, ok := shard.metrics[key]
+	shard.RUnlock()
+
+	if ok && metric.MType == mtype {
 		v := *metric
+		v.Histogram = metric.Histogram.Copy()
 		return &v, nil
 	} else {
 		return nil, nil
@@ -55,29 +163,243 @@ func (s *fileMetricsStorage) Get(id string, mtype string) (*models.Metrics, erro
 }
 
 func (s *fileMetricsStorage) GetAll() ([]models.Metrics, error) {
-	m := make([]models.Metrics, len(s.metrics))
-	i := 0
-	for _, v := range s.metrics {
-		m[i] = *v
-		i++
+	m := make([]models.Metrics, 0)
+	for _, shard := range s.shards {
+		shard.RLock()
+		for key, v := range shard.metrics {
+			m = append(m, *v)
+			m[len(m)-1].UpdatedAt = shard.updated[key]
+		}
+		shard.RUnlock()
+	}
+	for i := range m {
+		m[i].Histogram = m[i].Histogram.Copy()
 	}
 	return m, nil
 }
 
+func (s *fileMetricsStorage) Query(q Query) ([]models.Metrics, error) {
+	metrics, err := s.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	return applyQuery(metrics, q)
+}
+
+func (s *fileMetricsStorage) History(id string, mtype string, labels models.Labels, from time.Time, to time.Time, step time.Duration) ([]models.MetricPoint, error) {
+	key := models.MetricKey(id, labels)
+	shard := s.shards.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+
+	points := make([]models.MetricPoint, 0)
+	if metric, ok := shard.metrics[key]; !ok || metric.MType != mtype {
+		return points, nil
+	}
+	if policy, source := historySource(&s.cfg.Retention, id, mtype, from, step); source >= 0 {
+		rollups := make([]models.Rollup, 0)
+		tierStep := policy.Rollups[source].Step.Duration
+		// агрегат попадает в историю, если его интервал пересекается с [from, to]
+		for _, r := range shard.rollups[key][tierStep] {
+			if r.Timestamp.After(from.Add(-tierStep)) && !r.Timestamp.After(to) {
+				rollups = append(rollups, r)
+			}
+		}
+		return rollupHistory(mtype, rollups, from, step), nil
+	}
+	for _, p := range shard.history[key] {
+		if !p.Timestamp.Before(from) && !p.Timestamp.After(to) {
+			points = append(points, p)
+		}
+	}
+	return downsample(points, from, step), nil
+}
+
 func (s *fileMetricsStorage) Update(m *models.Metrics) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	return s.Updates([]models.Metrics{*m})
+}
 
-	if v, ok := s.metrics[m.ID]; ok && v.MType == models.COUNTER {
-		*v.Delta += *m.Delta
-	} else {
-		s.metrics[m.ID] = m
+func (s *fileMetricsStorage) Delete(id string, mtype string, labels models.Labels) (bool, error) {
+	key := models.MetricKey(id, labels)
+	shard := s.shards.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if m, ok := shard.metrics[key]; !ok || m.MType != mtype {
+		return false, nil
+	}
+	if err := s.removeMetrics(shard, []string{key}, time.Now()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteByPattern - сегменты обрабатываются по очереди, как при применении политик хранения
+func (s *fileMetricsStorage) DeleteByPattern(pattern string, mtype string, selector models.Labels) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, shard := range s.shards {
+		n, err := s.deleteFromShard(shard, pattern, mtype, selector)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+func (s *fileMetricsStorage) deleteFromShard(shard *metricsShard, pattern string, mtype string, selector models.Labels) (int, error) {
+	shard.Lock()
+	defer shard.Unlock()
+
+	keys := make([]string, 0)
+	for key, m := range shard.metrics {
+		if matchMetric(m, pattern, mtype, selector) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if err := s.removeMetrics(shard, keys, time.Now()); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// removeMetrics - удаление метрик сегмента, вызывается под блокировкой сегмента.
+// удаление записывается в журнал, иначе при восстановлении метрики вернулись бы из более ранних записей
+func (s *fileMetricsStorage) removeMetrics(shard *metricsShard, keys []string, ts time.Time) error {
+	if s.wal != nil {
+		if err := s.wal.append(walRecord{Timestamp: ts, Deleted: keys}); err != nil {
+			s.logger.Errorf("error on write wal: %v", err)
+			return err
+		}
+	}
+	for _, key := range keys {
+		shard.remove(key)
 	}
 	return nil
 }
 
+// checkUpdates - проверка, что пакет можно применить к текущему состоянию: метрики пакета по порядку
+// объединяются с сохраненными значениями и с предыдущими метриками пакета, как при применении.
+// вызывается под блокировкой сегментов пакета
+func (s *fileMetricsStorage) checkUpdates(metrics []models.Metrics) error {
+	state := make(map[string]*models.Metrics)
+	for i := range metrics {
+		m := &metrics[i]
+		key := m.Key()
+		current, ok := state[key]
+		if !ok {
+			stored, found := s.shards.shard(key).metrics[key]
+			if !found {
+				state[key] = copyMetric(m)
+				continue
+			}
+			current = copyMetric(stored)
+			state[key] = current
+		}
+		if err := mergeMetric(current, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply - применение метрики к состоянию, вызывается под блокировкой сегмента.
+// сохраненное значение не изменяется, а заменяется новым, чтобы не мешать читателям.
+// withHistory = false при воспроизведении журнала, если точка уже есть в сохраненной истории.
+// при несовместимой гистограмме состояние не изменяется
+func (s *fileMetricsStorage) apply(m *models.Metrics, ts time.Time, withHistory bool) error {
+	key := m.Key()
+	shard := s.shards.shard(key)
+	old, ok := shard.metrics[key]
+	v := copyMetric(m)
+	if ok && old.MType == models.COUNTER && m.MType == models.COUNTER {
+		d := *old.Delta + *m.Delta
+		v.Delta = &d
+		if v.Cumulative == nil {
+			v.Cumulative = old.Cumulative
+		}
+	} else if ok && old.MType == models.HISTOGRAM && m.MType == models.HISTOGRAM {
+		v.Histogram = old.Histogram.Copy()
+		if err := v.Histogram.Merge(m.Histogram); err != nil {
+			return fmt.Errorf("histogram %s: %w", key, err)
+		}
+	} else if ok && old.MType != m.MType {
+		delete(shard.history, key)
+		delete(shard.rollups, key)
+	}
+	shard.metrics[key] = v
+	shard.updated[key] = ts
+	if withHistory {
+		shard.history[key] = limitHistory(append(shard.history[key], newMetricPoint(v, ts)), s.historyLimit())
+	}
+	return nil
+}
+
+// historyLimit - число последних сырых точек метрики, которые хранятся в памяти
+func (s *fileMetricsStorage) historyLimit() int {
+	if s.cfg.HistoryLimit > 0 {
+		return s.cfg.HistoryLimit
+	}
+	return retention.DefaultRawLimit
+}
+
+// limitHistory - последние limit точек истории. срез сдвигается, а не копируется: следующее
+// расширение при append копирует только оставшиеся точки, поэтому память не растет
+func limitHistory(points []models.MetricPoint, limit int) []models.MetricPoint {
+	if len(points) > limit {
+		return points[len(points)-limit:]
+	}
+	return points
+}
+
+// copyMetric - копия метрики, не разделяющая значения с исходной
+func copyMetric(m *models.Metrics) *models.Metrics {
+	c := *m
+	if m.Delta != nil {
+		d := *m.Delta
+		c.Delta = &d
+	}
+	if m.Value != nil {
+		v := *m.Value
+		c.Value = &v
+	}
+	if m.Cumulative != nil {
+		v := *m.Cumulative
+		c.Cumulative = &v
+	}
+	c.Histogram = m.Histogram.Copy()
+	return &c
+}
+
+// newMetricPoint - снимок текущего значения метрики
+func newMetricPoint(m *models.Metrics, ts time.Time) models.MetricPoint {
+	p := models.MetricPoint{Timestamp: ts}
+	if m.Delta != nil {
+		d := *m.Delta
+		p.Delta = &d
+	}
+	if m.Value != nil {
+		v := *m.Value
+		p.Value = &v
+	}
+	p.Histogram = m.Histogram.Copy()
+	return p
+}
+
 func (s *fileMetricsStorage) Close() {
+	if s.wal == nil {
+		return
+	}
 	s.saveMetrics()
+	if err := s.wal.close(); err != nil {
+		s.logger.Errorf("error on close wal: %v", err)
+	}
 }
 
 func (s *fileMetricsStorage) Check() error {
@@ -101,42 +423,445 @@ func (s *fileMetricsStorage) runSaveMetricsJob(ctx context.Context) {
 	}
 }
 
+// fileSnapshot - согласованный снимок состояния для сохранения в файлы.
+// значения и точки истории не изменяются после записи, поэтому копируются только ссылки на них
+type fileSnapshot struct {
+	seq       uint64
+	walOffset int64
+	metrics   map[string]*models.Metrics
+	history   map[string][]models.MetricPoint
+	rollups   map[string]map[time.Duration][]models.Rollup
+	updated   map[string]time.Time
+}
+
+// snapshot - снимок состояния, соответствующий позиции журнала.
+// все сегменты блокируются на чтение, поэтому ни одно обновление не выполняется в этот момент
+func (s *fileMetricsStorage) snapshot() *fileSnapshot {
+	unlock := s.shards.rlockAll()
+	defer unlock()
+
+	snap := &fileSnapshot{
+		metrics: make(map[string]*models.Metrics),
+		history: make(map[string][]models.MetricPoint),
+		rollups: make(map[string]map[time.Duration][]models.Rollup),
+		updated: make(map[string]time.Time),
+	}
+	snap.seq, snap.walOffset = s.wal.position()
+	for _, shard := range s.shards {
+		for key, m := range shard.metrics {
+			snap.metrics[key] = m
+		}
+		for key, points := range shard.history {
+			snap.history[key] = points
+		}
+		for key, ts := range shard.updated {
+			snap.updated[key] = ts
+		}
+		for key, tiers := range shard.rollups {
+			copied := make(map[time.Duration][]models.Rollup, len(tiers))
+			for step, rollups := range tiers {
+				copied[step] = rollups
+			}
+			snap.rollups[key] = copied
+		}
+	}
+	return snap
+}
+
+// saveMetrics - сохранение состояния и сжатие журнала.
+// под блокировками снимается только снимок состояния, сериализация и запись на диск идут без них,
+// поэтому обновления не блокируются на время записи файлов
 func (s *fileMetricsStorage) saveMetrics() {
+	s.saveMutex.Lock()
+	defer s.saveMutex.Unlock()
+
 	s.logger.Info("starting save metrics...")
-	if file, err := os.OpenFile(s.cfg.StoreFile, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0777); err != nil {
-		s.logger.Errorf("error on save metrics: %w", err)
+	snap := s.snapshot()
+	metricsData, err := snap.encodeMetrics()
+	if err != nil {
+		s.logger.Errorf("error on encode metrics: %v", err)
+		return
+	}
+	historyData, err := snap.encodeHistory()
+	if err != nil {
+		s.logger.Errorf("error on encode history: %v", err)
+		return
+	}
+	rollupsData, err := snap.encodeRollups()
+	if err != nil {
+		s.logger.Errorf("error on encode rollups: %v", err)
+		return
+	}
 
-	} else {
-		defer file.Close()
-		encoder := json.NewEncoder(file)
-		for _, m := range s.metrics {
-			encoder.Encode(m)
+	// агрегаты пишутся до истории, чтобы при сбое не потерять точки, уже удаленные после агрегирования.
+	// история пишется до состояния: при сбое между записями файлов точки из журнала
+	// будут отфильтрованы по номеру, сохраненному в истории
+	if err := writeFileAtomic(s.rollupsFile(), rollupsData); err != nil {
+		s.logger.Errorf("error on save rollups: %v", err)
+		return
+	}
+	if err := writeFileAtomic(s.historyFile(), historyData); err != nil {
+		s.logger.Errorf("error on save history: %v", err)
+		return
+	}
+	if err := writeFileAtomic(s.cfg.StoreFile, metricsData); err != nil {
+		s.logger.Errorf("error on save metrics: %v", err)
+		return
+	}
+	s.logger.Info("metrics saved")
+
+	if err := s.wal.compact(snap.walOffset); err != nil && !errors.Is(err, errWALClosed) {
+		s.logger.Errorf("error on compact wal: %v", err)
+	}
+}
+
+func (snap *fileSnapshot) encodeMetrics() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if err := encoder.Encode(snapshotHeader{Seq: &snap.seq}); err != nil {
+		return nil, err
+	}
+	for key, m := range snap.metrics {
+		line := snapshotLine{Metrics: *m}
+		if ts, ok := snap.updated[key]; ok {
+			line.UpdatedAt = &ts
+		}
+		if err := encoder.Encode(line); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (snap *fileSnapshot) encodeHistory() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if err := encoder.Encode(snapshotHeader{Seq: &snap.seq}); err != nil {
+		return nil, err
+	}
+	for key, points := range snap.history {
+		m := snap.metrics[key]
+		for _, p := range points {
+			if err := encoder.Encode(historyRecord{ID: m.ID, MType: m.MType, Labels: m.Labels, MetricPoint: p}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (snap *fileSnapshot) encodeRollups() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for key, tiers := range snap.rollups {
+		m := snap.metrics[key]
+		for step, rollups := range tiers {
+			for _, r := range rollups {
+				if err := encoder.Encode(rollupRecord{ID: m.ID, MType: m.MType, Labels: m.Labels, Step: step, Rollup: r}); err != nil {
+					return nil, err
+				}
+			}
 		}
-		s.logger.Info("metrics saved")
 	}
+	return buf.Bytes(), nil
+}
+
+// rollupsFile - агрегаты хранятся рядом с основным файлом
+func (s *fileMetricsStorage) rollupsFile() string {
+	return s.cfg.StoreFile + ".rollups"
+}
+
+// historyFile - история хранится рядом с основным файлом
+func (s *fileMetricsStorage) historyFile() string {
+	return s.cfg.StoreFile + ".history"
+}
+
+// stateFile - служебное состояние хранится рядом с основным файлом
+func (s *fileMetricsStorage) stateFile(name string) string {
+	return s.cfg.StoreFile + "." + name
+}
+
+// LoadState - без восстановления метрик предыдущего запуска его состояние тоже не загружается
+func (s *fileMetricsStorage) LoadState(name string) ([]byte, error) {
+	if s.cfg.StoreFile == "" || !s.cfg.Restore {
+		return nil, nil
+	}
+	data, err := os.ReadFile(s.stateFile(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (s *fileMetricsStorage) SaveState(name string, data []byte) error {
+	if s.cfg.StoreFile == "" {
+		return nil
+	}
+	return writeFileAtomic(s.stateFile(name), data)
+}
+
+// walFile - журнал хранится рядом с основным файлом
+func (s *fileMetricsStorage) walFile() string {
+	return s.cfg.StoreFile + ".wal"
 }
 
+// loadMetrics - загрузка сохраненного состояния и воспроизведение журнала.
+// записи журнала, уже учтенные в файлах состояния, пропускаются
 func (s *fileMetricsStorage) loadMetrics() error {
 	s.logger.Info("starting load metrics...")
-	if file, err := os.OpenFile(s.cfg.StoreFile, os.O_RDONLY|os.O_CREATE, 0777); err != nil {
+	metricsSeq, err := s.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	historySeq, err := s.loadHistory()
+	if err != nil {
+		return err
+	}
+	if err := s.loadRollups(); err != nil {
+		return err
+	}
+
+	replayed := 0
+	_, err = s.wal.replay(func(r walRecord) {
+		if r.Seq <= metricsSeq {
+			return
+		}
+		for _, key := range r.Deleted {
+			s.shards.shard(key).remove(key)
+		}
+		for i := 0; i < len(r.Metrics); i++ {
+			// такие записи могли попасть в журнал до проверки пакета целиком, они пропускаются
+			if err := s.apply(&r.Metrics[i], r.Timestamp, r.Seq > historySeq); err != nil {
+				s.logger.Errorf("error on replay wal record %d: %v", r.Seq, err)
+			}
+		}
+		replayed++
+	})
+	if err != nil {
+		s.logger.Errorf("error on replay wal: %v", err)
+		return err
+	}
+	// журнал мог быть полностью сжат, новые записи должны идти после сохраненных
+	s.wal.skipTo(metricsSeq)
+	s.logger.Infof("load metrics completed, %d wal records replayed", replayed)
+	return nil
+}
+
+// loadSnapshot - загрузка сохраненного состояния.
+// файлы, сохраненные до появления журнала, не содержат заголовка,
+// а без времени обновления метрика считается обновленной при загрузке
+func (s *fileMetricsStorage) loadSnapshot() (uint64, error) {
+	file, err := os.OpenFile(s.cfg.StoreFile, os.O_RDONLY|os.O_CREATE, 0777)
+	if err != nil {
 		s.logger.Errorf("error on load metrics: %w", err)
+		return 0, err
+	}
+	defer file.Close()
+
+	var seq uint64
+	now := time.Now()
+	decoder := json.NewDecoder(file)
+	for {
+		var line snapshotLine
+		if err := decoder.Decode(&line); err == io.EOF {
+			return seq, nil
+		} else if err != nil {
+			s.logger.Errorf("error on read from file: %w", err)
+			return 0, err
+		} else if line.Seq != nil {
+			seq = *line.Seq
+		} else {
+			m := line.Metrics
+			shard := s.shards.shard(m.Key())
+			shard.metrics[m.Key()] = &m
+			if line.UpdatedAt != nil {
+				shard.updated[m.Key()] = *line.UpdatedAt
+			} else {
+				shard.updated[m.Key()] = now
+			}
+		}
+	}
+}
+
+func (s *fileMetricsStorage) loadHistory() (uint64, error) {
+	s.logger.Info("starting load history...")
+	file, err := os.OpenFile(s.historyFile(), os.O_RDONLY|os.O_CREATE, 0777)
+	if err != nil {
+		s.logger.Errorf("error on load history: %w", err)
+		return 0, err
+	}
+	defer file.Close()
+
+	var seq uint64
+	decoder := json.NewDecoder(file)
+	history := make(map[string][]models.MetricPoint)
+	for {
+		var line historySnapshotLine
+		if err := decoder.Decode(&line); err == io.EOF {
+			for key, points := range history {
+				sort.Slice(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+				s.shards.shard(key).history[key] = limitHistory(points, s.historyLimit())
+			}
+			s.logger.Info("load history completed")
+			return seq, nil
+		} else if err != nil {
+			s.logger.Errorf("error on read history from file: %w", err)
+			return 0, err
+		} else if line.Seq != nil {
+			seq = *line.Seq
+		} else {
+			r := line.historyRecord
+			key := models.MetricKey(r.ID, r.Labels)
+			if m := s.shards.shard(key).metrics[key]; m != nil && m.MType == r.MType {
+				history[key] = append(history[key], r.MetricPoint)
+			}
+		}
+	}
+}
+
+func (s *fileMetricsStorage) loadRollups() error {
+	s.logger.Info("starting load rollups...")
+	file, err := os.OpenFile(s.rollupsFile(), os.O_RDONLY|os.O_CREATE, 0777)
+	if err != nil {
+		s.logger.Errorf("error on load rollups: %v", err)
 		return err
-	} else {
-		defer file.Close()
-		decoder := json.NewDecoder(file)
-		metrics := make(map[string]*models.Metrics, 0)
-		for {
-			var m models.Metrics
-			if err := decoder.Decode(&m); err == io.EOF {
-				s.metrics = metrics
-				s.logger.Info("load metrics completed")
-				return nil
-			} else if err != nil {
-				s.logger.Errorf("error on read from file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var r rollupRecord
+		if err := decoder.Decode(&r); err == io.EOF {
+			for _, shard := range s.shards {
+				for _, tiers := range shard.rollups {
+					for _, rollups := range tiers {
+						sort.Slice(rollups, func(i, j int) bool { return rollups[i].Timestamp.Before(rollups[j].Timestamp) })
+					}
+				}
+			}
+			s.logger.Info("load rollups completed")
+			return nil
+		} else if err != nil {
+			s.logger.Errorf("error on read rollups from file: %v", err)
+			return err
+		}
+		key := models.MetricKey(r.ID, r.Labels)
+		shard := s.shards.shard(key)
+		if m := shard.metrics[key]; m == nil || m.MType != r.MType {
+			continue
+		}
+		if shard.rollups[key] == nil {
+			shard.rollups[key] = make(map[time.Duration][]models.Rollup)
+		}
+		shard.rollups[key][r.Step] = append(shard.rollups[key][r.Step], r.Rollup)
+	}
+}
+
+// compact - применение политик хранения: удаление давно не обновлявшихся метрик,
+// построение агрегатов и удаление устаревших точек.
+// сегменты обрабатываются по очереди, обновления остальных сегментов в это время не блокируются
+func (s *fileMetricsStorage) compact(now time.Time) error {
+	for _, shard := range s.shards {
+		if err := s.compactShard(shard, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileMetricsStorage) compactShard(shard *metricsShard, now time.Time) error {
+	shard.Lock()
+	defer shard.Unlock()
+
+	expired := make([]string, 0)
+	for key, m := range shard.metrics {
+		if s.cfg.Retention.Match(m.ID).Expired(shard.updated[key], now) {
+			expired = append(expired, key)
+		}
+	}
+	if len(expired) > 0 {
+		if err := s.removeMetrics(shard, expired, now); err != nil {
+			return err
+		}
+		s.logger.Infof("%d expired metrics deleted", len(expired))
+	}
+
+	for key, m := range shard.metrics {
+		policy := s.cfg.Retention.Match(m.ID)
+		if policy == nil {
+			continue
+		}
+		if retention.Rollupable(m.MType) {
+			if err := buildRollups(&fileRollupStore{shard, key}, m.MType, policy, now); err != nil {
 				return err
-			} else {
-				metrics[m.ID] = &m
 			}
 		}
+
+		if raw := policy.Raw.Duration; raw > 0 {
+			shard.history[key] = dropBefore(shard.history[key], now.Add(-raw), func(p models.MetricPoint) time.Time { return p.Timestamp })
+		}
+		tiers := make(map[time.Duration][]models.Rollup)
+		for _, t := range policy.Rollups {
+			rollups := shard.rollups[key][t.Step.Duration]
+			if ttl := t.TTL.Duration; ttl > 0 {
+				rollups = dropBefore(rollups, now.Add(-ttl), func(r models.Rollup) time.Time { return r.Timestamp })
+			}
+			if len(rollups) > 0 {
+				tiers[t.Step.Duration] = rollups
+			}
+		}
+		// агрегаты уровней, которых больше нет в политике, удаляются
+		if len(tiers) > 0 {
+			shard.rollups[key] = tiers
+		} else {
+			delete(shard.rollups, key)
+		}
 	}
+	return nil
+}
+
+// dropBefore - удаление из начала отсортированного по времени среза элементов старше ts
+func dropBefore[T any](items []T, ts time.Time, timestamp func(T) time.Time) []T {
+	i := sort.Search(len(items), func(i int) bool { return !timestamp(items[i]).Before(ts) })
+	if i == 0 {
+		return items
+	}
+	return append(make([]T, 0, len(items)-i), items[i:]...)
+}
+
+// fileRollupStore - доступ к истории метрики в памяти, вызывается под блокировкой сегмента
+type fileRollupStore struct {
+	shard *metricsShard
+	key   string
+}
+
+func (f *fileRollupStore) lastRollup(step time.Duration) (*models.Rollup, error) {
+	rollups := f.shard.rollups[f.key][step]
+	if len(rollups) == 0 {
+		return nil, nil
+	}
+	return &rollups[len(rollups)-1], nil
+}
+
+func (f *fileRollupStore) pointsFrom(from time.Time) ([]models.MetricPoint, *models.MetricPoint, error) {
+	points := f.shard.history[f.key]
+	i := sort.Search(len(points), func(i int) bool { return !points[i].Timestamp.Before(from) })
+	if i == 0 {
+		return points, nil, nil
+	}
+	return points[i:], &points[i-1], nil
+}
+
+func (f *fileRollupStore) rollupsFrom(step time.Duration, from time.Time) ([]models.Rollup, error) {
+	rollups := f.shard.rollups[f.key][step]
+	i := sort.Search(len(rollups), func(i int) bool { return !rollups[i].Timestamp.Before(from) })
+	return rollups[i:], nil
+}
+
+func (f *fileRollupStore) addRollups(step time.Duration, rollups []models.Rollup) error {
+	if f.shard.rollups[f.key] == nil {
+		f.shard.rollups[f.key] = make(map[time.Duration][]models.Rollup)
+	}
+	f.shard.rollups[f.key][step] = append(f.shard.rollups[f.key][step], rollups...)
+	return nil
 }
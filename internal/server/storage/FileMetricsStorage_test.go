@@ -0,0 +1,337 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"yametrics/internal/durationextension"
+	"yametrics/internal/histogram"
+	"yametrics/internal/server/config"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/retention"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestFileStorage(t *testing.T, file string) *fileMetricsStorage {
+	cfg := &config.ServerConfig{
+		StoreFile:     file,
+		Restore:       true,
+		StoreInterval: durationextension.Duration{Duration: time.Hour},
+	}
+	// контекст не отменяется: сохранение при отмене шло бы параллельно с удалением каталога теста
+	storage, err := NewFileMetricsStorage(cfg, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	return storage.(*fileMetricsStorage)
+}
+
+func getCounter(t *testing.T, storage MetricsStorage, id string) int64 {
+	m, err := storage.Get(id, models.COUNTER, nil)
+	require.NoError(t, err)
+	require.NotNil(t, m)
+	return *m.Delta
+}
+
+func TestFileMetricsStorageReplayWAL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	storage := newTestFileStorage(t, file)
+
+	d := int64(2)
+	v := 1.5
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	require.NoError(t, storage.Updates([]models.Metrics{
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d},
+		{ID: "Alloc", MType: models.GAUGE, Value: &v},
+	}))
+	// сбой: состояние не сохранено, есть только журнал
+	require.NoError(t, storage.wal.close())
+
+	storage = newTestFileStorage(t, file)
+	defer storage.Close()
+	assert.Equal(t, int64(4), getCounter(t, storage, "PollCount"))
+	gauge, err := storage.Get("Alloc", models.GAUGE, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *gauge.Value)
+
+	points, err := storage.History("PollCount", models.COUNTER, nil, time.Now().Add(-time.Minute), time.Now(), 0)
+	require.NoError(t, err)
+	assert.Len(t, points, 2)
+}
+
+func TestFileMetricsStorageHistoryLimit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	open := func(limit int) *fileMetricsStorage {
+		cfg := &config.ServerConfig{StoreFile: file, Restore: true, StoreInterval: durationextension.Duration{Duration: time.Hour}, HistoryLimit: limit}
+		storage, err := NewFileMetricsStorage(cfg, zap.NewNop().Sugar(), context.Background())
+		require.NoError(t, err)
+		return storage.(*fileMetricsStorage)
+	}
+	values := func(storage MetricsStorage) []float64 {
+		points, err := storage.History("Alloc", models.GAUGE, nil, time.Now().Add(-time.Minute), time.Now(), 0)
+		require.NoError(t, err)
+		result := make([]float64, len(points))
+		for i, p := range points {
+			result[i] = *p.Value
+		}
+		return result
+	}
+
+	// без политик хранения в памяти остаются только последние точки
+	storage := open(3)
+	for i := 1; i <= 5; i++ {
+		v := float64(i)
+		require.NoError(t, storage.Update(&models.Metrics{ID: "Alloc", MType: models.GAUGE, Value: &v}))
+	}
+	assert.Equal(t, []float64{3, 4, 5}, values(storage))
+	storage.saveMetrics()
+	require.NoError(t, storage.wal.close())
+
+	storage = open(2)
+	defer storage.Close()
+	assert.Equal(t, []float64{4, 5}, values(storage))
+	assert.Equal(t, retention.DefaultRawLimit, (&fileMetricsStorage{cfg: &config.ServerConfig{}}).historyLimit())
+}
+
+func TestFileMetricsStorageSnapshotCompactsWAL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	storage := newTestFileStorage(t, file)
+
+	d := int64(3)
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	storage.saveMetrics()
+	info, err := os.Stat(file + ".wal")
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	require.NoError(t, storage.wal.close())
+
+	// запись из снимка не должна примениться повторно
+	storage = newTestFileStorage(t, file)
+	assert.Equal(t, int64(6), getCounter(t, storage, "PollCount"))
+	points, err := storage.History("PollCount", models.COUNTER, nil, time.Now().Add(-time.Minute), time.Now(), 0)
+	require.NoError(t, err)
+	assert.Len(t, points, 2)
+
+	// номера записей продолжаются после снимка
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	require.NoError(t, storage.wal.close())
+	storage = newTestFileStorage(t, file)
+	defer storage.Close()
+	assert.Equal(t, int64(9), getCounter(t, storage, "PollCount"))
+}
+
+func TestFileMetricsStorageTornWAL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	storage := newTestFileStorage(t, file)
+
+	d := int64(1)
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	require.NoError(t, storage.wal.close())
+
+	// запись, оборванная на середине
+	wal, err := os.OpenFile(file+".wal", os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = wal.WriteString(`{"Seq":2,"Timestamp":"2022-`)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	storage = newTestFileStorage(t, file)
+	assert.Equal(t, int64(1), getCounter(t, storage, "PollCount"))
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	require.NoError(t, storage.wal.close())
+
+	storage = newTestFileStorage(t, file)
+	defer storage.Close()
+	assert.Equal(t, int64(2), getCounter(t, storage, "PollCount"))
+}
+
+func TestFileMetricsStorageIncompatibleBatch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	storage := newTestFileStorage(t, file)
+
+	// гистограммы пакета несовместимы друг с другом, сохраненного значения еще нет
+	a, b := histogram.New([]float64{1, 10}), histogram.New([]float64{5})
+	a.Observe(2)
+	b.Observe(3)
+	d := int64(1)
+	err := storage.Updates([]models.Metrics{
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d},
+		{ID: "Latency", MType: models.HISTOGRAM, Histogram: a},
+		{ID: "Latency", MType: models.HISTOGRAM, Histogram: b},
+	})
+	assert.ErrorIs(t, err, histogram.ErrIncompatibleBuckets)
+	seq, _ := storage.wal.position()
+	assert.Zero(t, seq, "rejected batch is not written to wal")
+	m, err := storage.Get("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Nil(t, m, "no metric of the batch is applied")
+
+	// смена типа в пакете начинает значение заново, такой пакет применяется
+	v := 1.5
+	require.NoError(t, storage.Updates([]models.Metrics{
+		{ID: "Latency", MType: models.HISTOGRAM, Histogram: a},
+		{ID: "Latency", MType: models.GAUGE, Value: &v},
+		{ID: "Latency", MType: models.HISTOGRAM, Histogram: b},
+	}))
+	require.NoError(t, storage.wal.close())
+
+	storage = newTestFileStorage(t, file)
+	defer storage.Close()
+	m, err = storage.Get("Latency", models.HISTOGRAM, nil)
+	require.NoError(t, err)
+	require.NotNil(t, m)
+	assert.Equal(t, b, m.Histogram)
+}
+
+// TestFileMetricsStorageConcurrent - одновременные обновления, чтения, сохранение и применение политик.
+// имеет смысл запускать с -race
+func TestFileMetricsStorageConcurrent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := &config.ServerConfig{
+		StoreFile:     file,
+		StoreInterval: durationextension.Duration{Duration: time.Hour},
+		Retention:     testRetentionConfig(),
+	}
+	s, err := NewFileMetricsStorage(cfg, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	storage := s.(*fileMetricsStorage)
+
+	const agents, updates = 32, 50
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < agents; i++ {
+		writers.Add(1)
+		go func(agent int) {
+			defer writers.Done()
+			labels := models.Labels{"host": fmt.Sprintf("agent-%d", agent)}
+			for j := 0; j < updates; j++ {
+				d, v := int64(1), float64(j)
+				assert.NoError(t, storage.Updates([]models.Metrics{
+					{ID: "PollCount", MType: models.COUNTER, Delta: &d},
+					{ID: "RandomValue", MType: models.GAUGE, Labels: labels, Value: &v},
+				}))
+			}
+		}(i)
+	}
+
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, err := storage.Get("PollCount", models.COUNTER, nil)
+			assert.NoError(t, err)
+			_, err = storage.GetAll()
+			assert.NoError(t, err)
+			_, err = storage.History("PollCount", models.COUNTER, nil, time.Now().Add(-time.Hour), time.Now(), 0)
+			assert.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			storage.saveMetrics()
+			assert.NoError(t, storage.compact(time.Now()))
+		}
+	}()
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	assert.Equal(t, int64(agents*updates), getCounter(t, storage, "PollCount"))
+	all, err := storage.GetAll()
+	require.NoError(t, err)
+	assert.Len(t, all, agents+1)
+
+	// состояние после восстановления совпадает, сколько бы снимков ни было сделано во время обновлений
+	require.NoError(t, storage.wal.close())
+	storage = newTestFileStorage(t, file)
+	defer storage.Close()
+	assert.Equal(t, int64(agents*updates), getCounter(t, storage, "PollCount"))
+	points, err := storage.History("PollCount", models.COUNTER, nil, time.Now().Add(-time.Hour), time.Now(), 0)
+	require.NoError(t, err)
+	assert.Len(t, points, agents*updates)
+}
+
+// benchmarkAgents - число одновременно работающих агентов в бенчмарках
+const benchmarkAgents = 2000
+
+func newBenchmarkFileStorage(b *testing.B) MetricsStorage {
+	storage, err := NewFileMetricsStorage(&config.ServerConfig{}, zap.NewNop().Sugar(), context.Background())
+	require.NoError(b, err)
+	return storage
+}
+
+// runAgents - запуск не менее benchmarkAgents горутин, у каждой свой набор меток
+func runAgents(b *testing.B, body func(labels models.Labels, pb *testing.PB)) {
+	var agent int64
+	b.SetParallelism(benchmarkAgents/runtime.GOMAXPROCS(0) + 1)
+	b.RunParallel(func(pb *testing.PB) {
+		labels := models.Labels{"host": fmt.Sprintf("agent-%d", atomic.AddInt64(&agent, 1))}
+		body(labels, pb)
+	})
+}
+
+func BenchmarkFileMetricsStorageUpdates(b *testing.B) {
+	storage := newBenchmarkFileStorage(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	runAgents(b, func(labels models.Labels, pb *testing.PB) {
+		d, v := int64(1), 1.5
+		batch := []models.Metrics{
+			{ID: "PollCount", MType: models.COUNTER, Labels: labels, Delta: &d},
+			{ID: "Alloc", MType: models.GAUGE, Labels: labels, Value: &v},
+			{ID: "HeapInuse", MType: models.GAUGE, Labels: labels, Value: &v},
+		}
+		for pb.Next() {
+			if err := storage.Updates(batch); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFileMetricsStorageGetDuringUpdates(b *testing.B) {
+	storage := newBenchmarkFileStorage(b)
+	d, v := int64(1), 1.5
+	require.NoError(b, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+
+	// половина агентов пишет, половина читает
+	var agent int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	runAgents(b, func(labels models.Labels, pb *testing.PB) {
+		writer := atomic.AddInt64(&agent, 1)%2 == 0
+		m := models.Metrics{ID: "Alloc", MType: models.GAUGE, Labels: labels, Value: &v}
+		for pb.Next() {
+			var err error
+			if writer {
+				err = storage.Update(&m)
+			} else {
+				_, err = storage.Get("PollCount", models.COUNTER, nil)
+			}
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
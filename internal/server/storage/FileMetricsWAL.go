@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"yametrics/internal/server/models"
+
+	"go.uber.org/zap"
+)
+
+var errWALClosed = errors.New("wal is closed")
+
+// walRecord - запись журнала: метрики одного вызова Updates или ключи удаленных метрик
+type walRecord struct {
+	Seq       uint64
+	Timestamp time.Time
+	Metrics   []models.Metrics `json:",omitempty"`
+	Deleted   []string         `json:",omitempty"`
+}
+
+// metricsWAL - журнал обновлений метрик (write-ahead log).
+// каждая запись - строка json с возрастающим номером, после записи файл синхронизируется с диском.
+// методы, кроме replay, безопасны для вызова из разных горутин
+type metricsWAL struct {
+	mutex  sync.Mutex
+	path   string
+	file   *os.File
+	seq    uint64
+	size   int64
+	logger *zap.SugaredLogger
+}
+
+// openMetricsWAL - открытие журнала на дозапись.
+// недописанная при сбое последняя запись отрезается
+func openMetricsWAL(path string, logger *zap.SugaredLogger) (*metricsWAL, error) {
+	w := &metricsWAL{path: path, logger: logger}
+	size, err := w.replay(func(r walRecord) { w.seq = r.Seq })
+	if err != nil {
+		return nil, err
+	}
+	if err := truncateFile(path, size); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	w.size = size
+	return w, nil
+}
+
+// append - запись в журнал, номер записи назначается журналом
+func (w *metricsWAL) append(r walRecord) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return errWALClosed
+	}
+	r.Seq = w.seq + 1
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err := w.file.Write(data); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.seq++
+	w.size += int64(len(data))
+	return nil
+}
+
+// position - номер последней записи и размер журнала
+func (w *metricsWAL) position() (uint64, int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.seq, w.size
+}
+
+// compact - удаление из журнала записей до смещения offset, уже сохраненных в файл состояния
+func (w *metricsWAL) compact(offset int64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return errWALClosed
+	}
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	tail := data[offset:]
+	if err := writeFileAtomic(w.path, tail); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.size = int64(len(tail))
+	return nil
+}
+
+// truncate - удаление всех записей журнала
+func (w *metricsWAL) truncate() error {
+	_, size := w.position()
+	return w.compact(size)
+}
+
+// skipTo - следующая запись получит номер после seq, если журнал отстает
+func (w *metricsWAL) skipTo(seq uint64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.seq < seq {
+		w.seq = seq
+	}
+}
+
+func (w *metricsWAL) close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// replay - чтение записей журнала по порядку.
+// чтение останавливается на первой поврежденной записи, возвращается размер корректной части
+func (w *metricsWAL) replay(apply func(r walRecord)) (int64, error) {
+	file, err := os.Open(w.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				w.logger.Warnf("wal %s: skip incomplete record at offset %d", w.path, size)
+			}
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+		var r walRecord
+		if err := json.Unmarshal(bytes.TrimSpace(line), &r); err != nil {
+			w.logger.Warnf("wal %s: skip corrupted records from offset %d: %v", w.path, size, err)
+			return size, nil
+		}
+		apply(r)
+		size += int64(len(line))
+	}
+}
+
+func truncateFile(path string, size int64) error {
+	if err := os.Truncate(path, size); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic - запись во временный файл с последующим переименованием,
+// поэтому при сбое на диске остается либо старая, либо новая версия файла
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
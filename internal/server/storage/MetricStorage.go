@@ -2,19 +2,54 @@ package storage
 
 import (
 	"fmt"
+	"path"
+	"strings"
+	"time"
 	"yametrics/internal/server/models"
 )
 
+// DefaultHistoryWindow - период истории, который отдается, если границы запроса не заданы
+const DefaultHistoryWindow = time.Hour
+
 // MetricsStorage - интерфейс для абстрагирования работ с хранилищем
 type MetricsStorage interface {
-	Get(id string, mtype string) (*models.Metrics, error)
+	// Get - метрика с заданным именем, типом и набором меток
+	Get(id string, mtype string, labels models.Labels) (*models.Metrics, error)
 	GetAll() ([]models.Metrics, error)
+	// Query - метрики, подходящие под условия q, в порядке сортировки q.
+	// ошибка в условиях оборачивает ErrBadQuery
+	Query(q Query) ([]models.Metrics, error)
+	// History - значения метрики в интервале [from, to].
+	// если step > 0, точки прореживаются: на каждый интервал step остается последнее значение
+	History(id string, mtype string, labels models.Labels, from time.Time, to time.Time, step time.Duration) ([]models.MetricPoint, error)
 	Update(*models.Metrics) error
 	Updates([]models.Metrics) error
+	// Delete - удаление метрики вместе с историей, false - метрики нет
+	Delete(id string, mtype string, labels models.Labels) (bool, error)
+	// DeleteByPattern - удаление метрик, имена которых подходят под шаблон в формате path.Match,
+	// а метки содержат все метки selector. пустой mtype - метрики любого типа.
+	// возвращает число удаленных метрик
+	DeleteByPattern(pattern string, mtype string, selector models.Labels) (int, error)
 	Close()
 	Check() error
 }
 
+// StateStore - хранение служебного состояния сервера рядом с метриками,
+// чтобы оно переживало перезапуск. состояние хранится как непрозрачные данные под именем name
+type StateStore interface {
+	// LoadState - сохраненное состояние, nil - состояние не сохранялось
+	LoadState(name string) ([]byte, error)
+	SaveState(name string, data []byte) error
+}
+
+// AppliedUpdater - хранилище, которое сообщает значения метрик после обновления.
+// значения получаются вместе с записью, поэтому отдельное чтение не нужно и не расходится с ней
+type AppliedUpdater interface {
+	// UpdatesApplied - Updates, возвращающий значение каждой метрики пакета сразу после ее обновления,
+	// в порядке пакета: у counter - накопленная сумма, у гистограммы - объединенная гистограмма
+	UpdatesApplied([]models.Metrics) ([]models.Metrics, error)
+}
+
 type storageInitError struct {
 	err error
 }
@@ -26,3 +61,36 @@ func (s *storageInitError) Error() string {
 func NewStorageInitError(err error) error {
 	return &storageInitError{err}
 }
+
+// IsPattern - содержит ли имя метасимволы шаблона path.Match
+func IsPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[\\")
+}
+
+// matchMetric - подходит ли метрика под условия DeleteByPattern, шаблон должен быть проверен заранее
+func matchMetric(m *models.Metrics, pattern string, mtype string, selector models.Labels) bool {
+	if mtype != "" && m.MType != mtype {
+		return false
+	}
+	ok, _ := path.Match(pattern, m.ID)
+	return ok && m.Labels.Match(selector)
+}
+
+// downsample - прореживание отсортированных по времени точек.
+// время точки выравнивается на начало интервала step, отсчитываемого от from
+func downsample(points []models.MetricPoint, from time.Time, step time.Duration) []models.MetricPoint {
+	if step <= 0 || len(points) == 0 {
+		return points
+	}
+	result := make([]models.MetricPoint, 0)
+	for _, p := range points {
+		bucket := from.Add(p.Timestamp.Sub(from) / step * step)
+		p.Timestamp = bucket
+		if n := len(result); n > 0 && result[n-1].Timestamp.Equal(bucket) {
+			result[n-1] = p
+		} else {
+			result = append(result, p)
+		}
+	}
+	return result
+}
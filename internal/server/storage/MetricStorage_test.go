@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"path"
+	"path/filepath"
+	"testing"
+	"yametrics/internal/histogram"
+	"yametrics/internal/server/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testDelete - удаление метрики и удаление по шаблону с фильтром по меткам
+func testDelete(t *testing.T, storage MetricsStorage) {
+	d := int64(1)
+	v := 1.5
+	web, db := models.Labels{"host": "web"}, models.Labels{"host": "db"}
+	require.NoError(t, storage.Updates([]models.Metrics{
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d},
+		{ID: "HeapAlloc", MType: models.GAUGE, Labels: web, Value: &v},
+		{ID: "HeapInuse", MType: models.GAUGE, Labels: web, Value: &v},
+		{ID: "HeapInuse", MType: models.GAUGE, Labels: db, Value: &v},
+	}))
+
+	deleted, err := storage.Delete("PollCount", models.GAUGE, nil)
+	require.NoError(t, err)
+	assert.False(t, deleted, "type mismatch")
+	deleted, err = storage.Delete("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	m, err := storage.Get("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Nil(t, m)
+
+	_, err = storage.DeleteByPattern("Heap[", "", nil)
+	assert.ErrorIs(t, err, path.ErrBadPattern)
+	n, err := storage.DeleteByPattern("Heap*", models.GAUGE, web)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	all, err := storage.GetAll()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Equal(t, db, all[0].Labels)
+
+	// метрика, созданная заново после удаления, начинается с нуля
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	assert.Equal(t, int64(1), getCounter(t, storage, "PollCount"))
+}
+
+func TestFileMetricsStorageDelete(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	storage := newTestFileStorage(t, file)
+	testDelete(t, storage)
+
+	// удаление воспроизводится из журнала
+	require.NoError(t, storage.wal.close())
+	storage = newTestFileStorage(t, file)
+	defer storage.Close()
+	all, err := storage.GetAll()
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+	assert.Equal(t, int64(1), getCounter(t, storage, "PollCount"))
+}
+
+func TestSQLiteMetricStorageDelete(t *testing.T) {
+	storage := newTestSQLiteStorage(t, filepath.Join(t.TempDir(), "metrics.db"))
+	defer storage.Close()
+	testDelete(t, storage)
+}
+
+func TestBufferedMetricsStorageDelete(t *testing.T) {
+	storage, _ := newTestBufferedStorage(t, 100)
+	testDelete(t, storage)
+
+	// часть метрик сброшена, часть только в буфере
+	d := int64(1)
+	require.NoError(t, storage.flush())
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollTotal", MType: models.COUNTER, Delta: &d}))
+	n, err := storage.DeleteByPattern("Poll*", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.NoError(t, storage.flush())
+	all, err := storage.GetAll()
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+}
+
+// testUpdatesApplied - значение каждого обновления пакета с учетом сохраненного и предыдущих в пакете
+func testUpdatesApplied(t *testing.T, storage MetricsStorage) {
+	d, c, v := int64(2), int64(10), 1.5
+	web := models.Labels{"host": "web"}
+	h := histogram.New([]float64{1, 10})
+	h.Observe(5)
+	require.NoError(t, storage.Updates([]models.Metrics{
+		{ID: "PollCount", MType: models.COUNTER, Labels: web, Delta: &d},
+		{ID: "GCPauseNs", MType: models.HISTOGRAM, Histogram: h},
+	}))
+
+	applied, err := storage.(AppliedUpdater).UpdatesApplied([]models.Metrics{
+		{ID: "PollCount", MType: models.COUNTER, Labels: web, Delta: &d},
+		{ID: "Alloc", MType: models.GAUGE, Value: &v},
+		{ID: "PollCount", MType: models.COUNTER, Labels: web, Delta: &c, Temporality: models.CUMULATIVE},
+		{ID: "GCPauseNs", MType: models.HISTOGRAM, Histogram: h},
+		{ID: "PollCount", MType: models.COUNTER, Labels: web, Delta: &d},
+	})
+	require.NoError(t, err)
+	require.Len(t, applied, 5)
+	assert.Equal(t, int64(4), *applied[0].Delta)
+	assert.Equal(t, web, applied[0].Labels)
+	assert.Equal(t, 1.5, *applied[1].Value)
+	assert.Equal(t, int64(14), *applied[2].Delta)
+	assert.Equal(t, int64(10), *applied[2].Cumulative)
+	assert.Equal(t, uint64(2), applied[3].Histogram.Count)
+	assert.Equal(t, int64(16), *applied[4].Delta)
+	assert.False(t, applied[4].UpdatedAt.IsZero())
+
+	m, err := storage.Get("PollCount", models.COUNTER, web)
+	require.NoError(t, err)
+	assert.Equal(t, *applied[4].Delta, *m.Delta)
+}
+
+func TestFileMetricsStorageUpdatesApplied(t *testing.T) {
+	storage := newTestFileStorage(t, filepath.Join(t.TempDir(), "metrics.json"))
+	defer storage.Close()
+	testUpdatesApplied(t, storage)
+}
+
+func TestSQLiteMetricStorageUpdatesApplied(t *testing.T) {
+	storage := newTestSQLiteStorage(t, filepath.Join(t.TempDir(), "metrics.db"))
+	defer storage.Close()
+	testUpdatesApplied(t, storage)
+}
+
+func TestBufferedMetricsStorageUpdatesApplied(t *testing.T) {
+	storage, _ := newTestBufferedStorage(t, 100)
+	testUpdatesApplied(t, storage)
+
+	// после сброса значения считаются от сохраненного состояния
+	require.NoError(t, storage.flush())
+	d := int64(1)
+	applied, err := storage.UpdatesApplied([]models.Metrics{{ID: "PollCount", MType: models.COUNTER, Labels: models.Labels{"host": "web"}, Delta: &d}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(17), *applied[0].Delta)
+}
+
+func TestUniqueParts(t *testing.T) {
+	d := int64(1)
+	counter := func(id string) models.Metrics {
+		return models.Metrics{ID: id, MType: models.COUNTER, Delta: &d}
+	}
+	metrics := []models.Metrics{counter("A"), counter("B"), counter("A"), counter("A"), counter("C"), counter("B")}
+	assert.Equal(t, [][]int{{0, 1, 4}, {2, 5}, {3}}, uniqueParts(metrics))
+}
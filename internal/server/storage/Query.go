@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"yametrics/internal/server/models"
+)
+
+// поля сортировки Query
+const (
+	SortByID      = "id"
+	SortByType    = "type"
+	SortByUpdated = "updated"
+)
+
+// ErrBadQuery - условия выборки заданы неверно
+var ErrBadQuery = errors.New("bad query")
+
+// Query - условия выборки метрик для MetricsStorage.Query.
+// условия на имя (Prefix, Pattern, Regexp) объединяются по И
+type Query struct {
+	// MType - тип метрик, пустой - любой
+	MType string
+	// Prefix - начало имени
+	Prefix string
+	// Pattern - шаблон имени в формате path.Match
+	Pattern string
+	// Regexp - регулярное выражение для имени. в postgres выражение проверяется самой бд,
+	// поэтому стоит ограничиваться синтаксисом, общим для RE2 и регулярных выражений postgres
+	Regexp string
+	// Selector - метки, которые должны быть у метрики
+	Selector models.Labels
+	// SortBy - поле сортировки: SortByID (по умолчанию), SortByType или SortByUpdated.
+	// при равенстве поля метрики упорядочиваются по имени, меткам и типу, поэтому порядок однозначный
+	SortBy string
+	Desc   bool
+	// After - выборка начинается после этой позиции, nil - с начала
+	After *Cursor
+	// Limit - максимальное число метрик, 0 - без ограничения
+	Limit int
+}
+
+// Cursor - позиция в выборке: ключ сортировки последней метрики предыдущей страницы
+type Cursor struct {
+	ID        string        `json:"id"`
+	MType     string        `json:"type"`
+	Labels    models.Labels `json:"labels,omitempty"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// CursorOf - позиция сразу после метрики m
+func CursorOf(m *models.Metrics) *Cursor {
+	return &Cursor{ID: m.ID, MType: m.MType, Labels: m.Labels, UpdatedAt: m.UpdatedAt}
+}
+
+// Validate - проверка условий, ошибка оборачивает ErrBadQuery
+func (q *Query) Validate() error {
+	switch q.SortBy {
+	case "", SortByID, SortByType, SortByUpdated:
+	default:
+		return fmt.Errorf("%w: unknown sort field %q", ErrBadQuery, q.SortBy)
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("%w: negative limit", ErrBadQuery)
+	}
+	if q.Pattern != "" {
+		if _, err := path.Match(q.Pattern, ""); err != nil {
+			return fmt.Errorf("%w: pattern %q: %v", ErrBadQuery, q.Pattern, err)
+		}
+	}
+	if q.Regexp != "" {
+		if _, err := regexp.Compile(q.Regexp); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadQuery, err)
+		}
+	}
+	return nil
+}
+
+// queryKey - ключ сортировки метрики, метки сравниваются в том виде, в котором они хранятся в бд
+type queryKey struct {
+	id        string
+	mtype     string
+	labels    string
+	updatedAt time.Time
+}
+
+func newQueryKey(id string, mtype string, labels models.Labels, updatedAt time.Time) (queryKey, error) {
+	l, err := labelsString(labels)
+	return queryKey{id: id, mtype: mtype, labels: l, updatedAt: updatedAt}, err
+}
+
+// compare - сравнение ключей в порядке сортировки sortBy
+func (a queryKey) compare(b queryKey, sortBy string) int {
+	byID := func() int {
+		if c := strings.Compare(a.id, b.id); c != 0 {
+			return c
+		}
+		return strings.Compare(a.labels, b.labels)
+	}
+	switch sortBy {
+	case SortByType:
+		if c := strings.Compare(a.mtype, b.mtype); c != 0 {
+			return c
+		}
+		return byID()
+	case SortByUpdated:
+		if a.updatedAt.Before(b.updatedAt) {
+			return -1
+		} else if a.updatedAt.After(b.updatedAt) {
+			return 1
+		}
+	}
+	if c := byID(); c != 0 {
+		return c
+	}
+	return strings.Compare(a.mtype, b.mtype)
+}
+
+// applyQuery - выборка из всех метрик на стороне сервиса, для хранилищ без собственной реализации фильтров
+func applyQuery(metrics []models.Metrics, q Query) ([]models.Metrics, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	var re *regexp.Regexp
+	if q.Regexp != "" {
+		re = regexp.MustCompile(q.Regexp)
+	}
+	var after queryKey
+	if q.After != nil {
+		var err error
+		if after, err = newQueryKey(q.After.ID, q.After.MType, q.After.Labels, q.After.UpdatedAt); err != nil {
+			return nil, err
+		}
+	}
+
+	type keyed struct {
+		key    queryKey
+		metric models.Metrics
+	}
+	selected := make([]keyed, 0)
+	for _, m := range metrics {
+		if q.MType != "" && m.MType != q.MType || !strings.HasPrefix(m.ID, q.Prefix) || !m.Labels.Match(q.Selector) {
+			continue
+		}
+		if q.Pattern != "" {
+			if ok, _ := path.Match(q.Pattern, m.ID); !ok {
+				continue
+			}
+		}
+		if re != nil && !re.MatchString(m.ID) {
+			continue
+		}
+		key, err := newQueryKey(m.ID, m.MType, m.Labels, m.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if q.After != nil {
+			if c := key.compare(after, q.SortBy); q.Desc && c >= 0 || !q.Desc && c <= 0 {
+				continue
+			}
+		}
+		selected = append(selected, keyed{key: key, metric: m})
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		c := selected[i].key.compare(selected[j].key, q.SortBy)
+		if q.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+	if q.Limit > 0 && len(selected) > q.Limit {
+		selected = selected[:q.Limit]
+	}
+	result := make([]models.Metrics, len(selected))
+	for i := range selected {
+		result[i] = selected[i].metric
+	}
+	return result, nil
+}
+
+// globRegexp - регулярное выражение, эквивалентное шаблону path.Match, шаблон должен быть проверен заранее.
+// выражение использует только синтаксис, общий для RE2 и postgres
+func globRegexp(pattern string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	inClass := false
+	for i := 0; i < len(pattern); {
+		r, n := utf8.DecodeRuneInString(pattern[i:])
+		i += n
+		switch {
+		case r == '\\' && i < len(pattern):
+			r, n = utf8.DecodeRuneInString(pattern[i:])
+			i += n
+			sb.WriteString(quoteRune(r))
+		case inClass && r == ']':
+			sb.WriteRune(r)
+			inClass = false
+		case inClass && r == '-':
+			sb.WriteRune(r)
+		case inClass:
+			sb.WriteString(quoteRune(r))
+		case r == '[':
+			sb.WriteRune(r)
+			if i < len(pattern) && pattern[i] == '^' {
+				sb.WriteByte('^')
+				i++
+			}
+			inClass = true
+		case r == '*':
+			sb.WriteString("[^/]*")
+		case r == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(quoteRune(r))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// quoteRune - экранирование символа для регулярного выражения. буквы и цифры не экранируются:
+// в postgres обратная косая черта перед ними означает класс символов
+func quoteRune(r rune) string {
+	if r < utf8.RuneSelf && !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_') {
+		return `\` + string(r)
+	}
+	return string(r)
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"path"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+	"yametrics/internal/server/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testQuery - фильтры, сортировка и постраничная выборка
+func testQuery(t *testing.T, storage MetricsStorage) {
+	d := int64(1)
+	v := 1.5
+	web, db := models.Labels{"host": "web"}, models.Labels{"host": "db"}
+	require.NoError(t, storage.Updates([]models.Metrics{
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d},
+		{ID: "HeapAlloc", MType: models.GAUGE, Labels: web, Value: &v},
+		{ID: "HeapInuse", MType: models.GAUGE, Labels: web, Value: &v},
+		{ID: "HeapInuse", MType: models.GAUGE, Labels: db, Value: &v},
+		{ID: "Heap_Sys", MType: models.GAUGE, Value: &v},
+	}))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, storage.Update(&models.Metrics{ID: "PollCount", MType: models.COUNTER, Delta: &d}))
+
+	keys := func(q Query) []string {
+		metrics, err := storage.Query(q)
+		require.NoError(t, err)
+		result := make([]string, len(metrics))
+		for i := range metrics {
+			result[i] = metrics[i].Key()
+		}
+		return result
+	}
+	all := []string{"HeapAlloc{host=web}", "HeapInuse{host=db}", "HeapInuse{host=web}", "Heap_Sys", "PollCount"}
+	assert.Equal(t, all, keys(Query{}))
+	assert.Equal(t, []string{"PollCount", "Heap_Sys", "HeapInuse{host=web}", "HeapInuse{host=db}", "HeapAlloc{host=web}"}, keys(Query{Desc: true}))
+	assert.Equal(t, []string{"PollCount"}, keys(Query{MType: models.COUNTER}))
+	assert.Equal(t, []string{"Heap_Sys"}, keys(Query{Prefix: "Heap_"}))
+	assert.Equal(t, []string{"HeapInuse{host=db}", "HeapInuse{host=web}"}, keys(Query{Pattern: "Heap[H-J]*"}))
+	assert.Equal(t, []string{"HeapAlloc{host=web}", "PollCount"}, keys(Query{Regexp: "(Alloc|Count)$"}))
+	assert.Equal(t, []string{"HeapAlloc{host=web}", "HeapInuse{host=web}"}, keys(Query{Selector: web}))
+	assert.Equal(t, "PollCount", keys(Query{SortBy: SortByType})[0])
+	assert.Equal(t, "PollCount", keys(Query{SortBy: SortByUpdated, Desc: true})[0])
+
+	// постраничная выборка проходит все метрики ровно один раз
+	for _, sortBy := range []string{SortByID, SortByType, SortByUpdated} {
+		for _, desc := range []bool{false, true} {
+			q := Query{SortBy: sortBy, Desc: desc, Limit: 2}
+			pages := make([]string, 0)
+			for {
+				page, err := storage.Query(q)
+				require.NoError(t, err)
+				for i := range page {
+					pages = append(pages, page[i].Key())
+				}
+				if len(page) < q.Limit {
+					break
+				}
+				q.After = CursorOf(&page[len(page)-1])
+			}
+			assert.ElementsMatch(t, all, pages, "sort by %s, desc %v", sortBy, desc)
+			assert.Len(t, pages, len(all))
+		}
+	}
+
+	_, err := storage.Query(Query{Pattern: "Heap["})
+	assert.ErrorIs(t, err, ErrBadQuery)
+	_, err = storage.Query(Query{Regexp: "("})
+	assert.ErrorIs(t, err, ErrBadQuery)
+	_, err = storage.Query(Query{SortBy: "value"})
+	assert.ErrorIs(t, err, ErrBadQuery)
+}
+
+func TestFileMetricsStorageQuery(t *testing.T) {
+	testQuery(t, newTestFileStorage(t, ""))
+}
+
+func TestSQLiteMetricStorageQuery(t *testing.T) {
+	storage := newTestSQLiteStorage(t, filepath.Join(t.TempDir(), "metrics.db"))
+	defer storage.Close()
+	testQuery(t, storage)
+}
+
+func TestGlobRegexp(t *testing.T) {
+	patterns := []string{"Heap*", "Heap?nuse", "*.cpu.*", "Heap[A-C]*", "Heap[^A]*", `a\*b`, "[a-c.]x", "(x|y)+"}
+	names := []string{"HeapAlloc", "HeapInuse", "Heap", "web.cpu.load", "web/cpu.load", "a*b", "ab", ".x", "bx", "(x|y)+", "xy"}
+	for _, pattern := range patterns {
+		re := regexp.MustCompile(globRegexp(pattern))
+		for _, name := range names {
+			want, err := path.Match(pattern, name)
+			require.NoError(t, err)
+			assert.Equal(t, want, re.MatchString(name), "pattern %q, name %q", pattern, name)
+		}
+	}
+}
+
+func TestQuerySQL(t *testing.T) {
+	query, args, err := querySQL(Query{
+		MType:    models.GAUGE,
+		Prefix:   "cpu_",
+		Selector: models.Labels{"host": "web"},
+		SortBy:   SortByType,
+		Desc:     true,
+		After:    &Cursor{ID: "cpu_load", MType: models.GAUGE},
+		Limit:    10,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, getAllSQL+` where mtype = $1 and id like $2 escape '\' and labels::jsonb @> $3::jsonb`+
+		` and (mtype collate "C", id collate "C", labels collate "C") < ($4, $5, $6)`+
+		` order by mtype collate "C" desc, id collate "C" desc, labels collate "C" desc limit $7`, query)
+	assert.Equal(t, []any{models.GAUGE, `cpu\_%`, `{"host":"web"}`, models.GAUGE, "cpu_load", "{}", 10}, args)
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"time"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/retention"
+
+	"go.uber.org/zap"
+)
+
+// rollupStore - доступ к истории одной метрики при построении агрегатов
+type rollupStore interface {
+	// lastRollup - последний агрегат уровня step, nil если агрегатов еще нет
+	lastRollup(step time.Duration) (*models.Rollup, error)
+	// pointsFrom - сырые точки начиная с from и последняя точка перед ними (nil, если ее нет)
+	pointsFrom(from time.Time) ([]models.MetricPoint, *models.MetricPoint, error)
+	// rollupsFrom - агрегаты уровня step начиная с from
+	rollupsFrom(step time.Duration, from time.Time) ([]models.Rollup, error)
+	addRollups(step time.Duration, rollups []models.Rollup) error
+}
+
+// buildRollups - построение агрегатов всех уровней политики для интервалов, завершенных к моменту now.
+// агрегируются только интервалы после последнего построенного, поэтому повторный запуск ничего не дублирует
+func buildRollups(store rollupStore, mtype string, policy *retention.Policy, now time.Time) error {
+	for i, t := range policy.Rollups {
+		step := t.Step.Duration
+		last, err := store.lastRollup(step)
+		if err != nil {
+			return err
+		}
+		// точек раньше начала unix-времени не бывает
+		from, prev := time.Unix(0, 0), 0.0
+		if last != nil {
+			from, prev = last.Timestamp.Add(step), last.Last
+		}
+
+		var rollups []models.Rollup
+		if i == 0 {
+			points, before, err := store.pointsFrom(from)
+			if err != nil {
+				return err
+			}
+			if before != nil && before.Delta != nil {
+				prev = float64(*before.Delta)
+			}
+			rollups = retention.Aggregate(mtype, points, prev, step, now)
+		} else {
+			source, err := store.rollupsFrom(policy.Rollups[i-1].Step.Duration, from)
+			if err != nil {
+				return err
+			}
+			rollups = retention.Merge(source, step, now)
+		}
+		if len(rollups) == 0 {
+			continue
+		}
+		if err := store.addRollups(step, rollups); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupHistory - агрегаты, объединенные в интервалы step, в виде точек истории
+func rollupHistory(mtype string, rollups []models.Rollup, from time.Time, step time.Duration) []models.MetricPoint {
+	rollups = retention.Resample(rollups, from, step)
+	points := make([]models.MetricPoint, len(rollups))
+	for i := range rollups {
+		points[i] = retention.ToPoint(mtype, rollups[i])
+	}
+	return points
+}
+
+// historySource - уровень агрегирования, из которого отдается история метрики, -1 - сырые точки
+func historySource(cfg *retention.Config, id string, mtype string, from time.Time, step time.Duration) (*retention.Policy, int) {
+	if !retention.Rollupable(mtype) {
+		return nil, -1
+	}
+	policy := cfg.Match(id)
+	return policy, policy.Source(from, time.Now(), step)
+}
+
+// runRetentionJob - периодическое применение политик хранения
+func runRetentionJob(ctx context.Context, cfg *retention.Config, logger *zap.SugaredLogger, compact func(now time.Time) error) {
+	interval := cfg.Interval.Duration
+	if interval <= 0 {
+		interval = retention.DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := compact(time.Now()); err != nil {
+				logger.Errorf("error on apply retention policies: %v", err)
+			}
+
+		case <-ctx.Done():
+			ticker.Stop()
+			logger.Info("stop runRetentionJob")
+			return
+		}
+	}
+}
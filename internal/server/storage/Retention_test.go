@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+	"yametrics/internal/durationextension"
+	"yametrics/internal/server/config"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/retention"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func testRetentionConfig() retention.Config {
+	return retention.Config{Policies: []retention.Policy{{
+		Pattern: "*",
+		Raw:     durationextension.Duration{Duration: 24 * time.Hour},
+		Rollups: []retention.Tier{
+			{Step: durationextension.Duration{Duration: time.Minute}, TTL: durationextension.Duration{Duration: 30 * 24 * time.Hour}},
+			{Step: durationextension.Duration{Duration: time.Hour}},
+		},
+	}}}
+}
+
+// testRetention - после применения политик сырые точки удаляются, а история отдается из агрегатов
+func testRetention(t *testing.T, storage MetricsStorage, compact func(now time.Time) error) {
+	d := int64(2)
+	values := []float64{3, 1, 2}
+	from := time.Now().Add(-time.Minute)
+	for i := range values {
+		require.NoError(t, storage.Updates([]models.Metrics{
+			{ID: "PollCount", MType: models.COUNTER, Delta: &d},
+			{ID: "Alloc", MType: models.GAUGE, Value: &values[i]},
+		}))
+	}
+
+	// повторное применение не должно дублировать агрегаты
+	now := time.Now().Add(25 * time.Hour)
+	require.NoError(t, compact(now))
+	require.NoError(t, compact(now))
+
+	points, err := storage.History("Alloc", models.GAUGE, nil, from, time.Now(), 0)
+	require.NoError(t, err)
+	assert.Empty(t, points)
+
+	points, err = storage.History("Alloc", models.GAUGE, nil, from, time.Now(), time.Hour)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 2.0, *points[0].Value)
+	assert.Equal(t, 1.0, *points[0].Min)
+	assert.Equal(t, 3.0, *points[0].Max)
+	assert.Equal(t, 2.0, *points[0].Avg)
+
+	points, err = storage.History("PollCount", models.COUNTER, nil, from, time.Now(), time.Hour)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, int64(6), *points[0].Delta)
+	assert.Equal(t, 6.0, *points[0].Sum)
+
+	// значения метрик не затрагиваются
+	counter, err := storage.Get("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), *counter.Delta)
+}
+
+func TestFileMetricsStorageRetention(t *testing.T) {
+	cfg := &config.ServerConfig{
+		StoreFile:     filepath.Join(t.TempDir(), "metrics.json"),
+		StoreInterval: durationextension.Duration{Duration: time.Hour},
+		Retention:     testRetentionConfig(),
+	}
+	storage, err := NewFileMetricsStorage(cfg, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	fileStorage := storage.(*fileMetricsStorage)
+	testRetention(t, storage, fileStorage.compact)
+
+	// агрегаты сохраняются вместе с состоянием
+	storage.Close()
+	cfg.Restore = true
+	storage, err = NewFileMetricsStorage(cfg, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	defer storage.Close()
+	points, err := storage.History("Alloc", models.GAUGE, nil, time.Now().Add(-time.Hour), time.Now(), time.Hour)
+	require.NoError(t, err)
+	assert.Len(t, points, 1)
+}
+
+func TestSQLiteMetricStorageRetention(t *testing.T) {
+	cfg := testRetentionConfig()
+	storage, err := NewSQLiteMetricStorage(filepath.Join(t.TempDir(), "metrics.db"), &cfg, context.Background(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer storage.Close()
+	testRetention(t, storage, storage.(*sqliteMetricStorage).compact)
+}
+
+// testExpire - метрики, которые не обновлялись дольше expire, удаляются вместе с историей
+func testExpire(t *testing.T, storage MetricsStorage, compact func(now time.Time) error) {
+	d := int64(1)
+	require.NoError(t, storage.Updates([]models.Metrics{
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d},
+		{ID: "agent.PollCount", MType: models.COUNTER, Delta: &d},
+	}))
+
+	require.NoError(t, compact(time.Now().Add(30*time.Minute)))
+	all, err := storage.GetAll()
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	require.NoError(t, compact(time.Now().Add(2*time.Hour)))
+	all, err = storage.GetAll()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Equal(t, "PollCount", all[0].ID)
+
+	// вернувшаяся метрика начинается с нуля и без старой истории
+	require.NoError(t, storage.Update(&models.Metrics{ID: "agent.PollCount", MType: models.COUNTER, Delta: &d}))
+	assert.Equal(t, int64(1), getCounter(t, storage, "agent.PollCount"))
+	points, err := storage.History("agent.PollCount", models.COUNTER, nil, time.Now().Add(-time.Hour), time.Now(), 0)
+	require.NoError(t, err)
+	assert.Len(t, points, 1)
+}
+
+func testExpireConfig() retention.Config {
+	return retention.Config{Policies: []retention.Policy{{
+		Pattern: "agent.*",
+		Expire:  durationextension.Duration{Duration: time.Hour},
+	}}}
+}
+
+func TestFileMetricsStorageExpire(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	cfg := &config.ServerConfig{
+		StoreFile:     file,
+		StoreInterval: durationextension.Duration{Duration: time.Hour},
+		Retention:     testExpireConfig(),
+	}
+	storage, err := NewFileMetricsStorage(cfg, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	fileStorage := storage.(*fileMetricsStorage)
+	testExpire(t, storage, fileStorage.compact)
+
+	// время обновления сохраняется вместе с состоянием
+	fileStorage.saveMetrics()
+	require.NoError(t, fileStorage.wal.close())
+	cfg.Restore = true
+	storage, err = NewFileMetricsStorage(cfg, zap.NewNop().Sugar(), context.Background())
+	require.NoError(t, err)
+	defer storage.Close()
+	require.NoError(t, storage.(*fileMetricsStorage).compact(time.Now().Add(2*time.Hour)))
+	all, err := storage.GetAll()
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+}
+
+func TestSQLiteMetricStorageExpire(t *testing.T) {
+	cfg := testExpireConfig()
+	storage, err := NewSQLiteMetricStorage(filepath.Join(t.TempDir(), "metrics.db"), &cfg, context.Background(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	defer storage.Close()
+	testExpire(t, storage, storage.(*sqliteMetricStorage).compact)
+}
@@ -0,0 +1,592 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"time"
+	"yametrics/internal/histogram"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/retention"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	sqliteDriverName = "sqlite"
+	// каждая запись сразу сбрасывается на диск: журнал WAL + synchronous=FULL
+	sqliteDSNParams = "?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=busy_timeout(5000)"
+
+	sqliteCreateTableIfNeedSQL = `create table if not exists metrics(
+		id text not null,
+		mtype text not null,
+		labels text not null default '{}',
+		delta integer,
+		value real,
+		histogram text,
+		updated_at integer not null default 0,
+		cumulative integer,
+		primary key (id, labels))`
+	sqliteCreateHistoryTableIfNeedSQL = `create table if not exists metrics_history(
+		id text not null,
+		mtype text not null,
+		labels text not null default '{}',
+		delta integer,
+		value real,
+		histogram text,
+		ts integer not null)`
+	sqliteCreateHistoryIndexIfNeedSQL = `create index if not exists metrics_history_id_labels_ts_idx on metrics_history(id, labels, mtype, ts)`
+	sqliteCreateRollupsTableIfNeedSQL = `create table if not exists metrics_rollups(
+		id text not null,
+		mtype text not null,
+		labels text not null default '{}',
+		step integer not null,
+		ts integer not null,
+		min real not null,
+		max real not null,
+		sum real not null,
+		count integer not null,
+		last real not null,
+		primary key (id, labels, mtype, step, ts))`
+	sqliteCreateStateTableIfNeedSQL = `create table if not exists server_state(
+		name text primary key,
+		data blob not null)`
+	// колонки metrics, добавленные позже: в бд, созданных раньше, их может не быть
+	sqliteHasColumnSQL    = `select count(*) from pragma_table_info('metrics') where name = ?`
+	sqliteAddColumnSQL    = `alter table metrics add column %s %s`
+	sqliteSetUpdatedAtSQL = `update metrics set updated_at = ?`
+
+	sqliteUpInsertSQL = `insert into metrics(id, mtype, labels, delta, value, histogram, updated_at, cumulative)
+		values(:id, :mtype, :labels, :delta, :value, :histogram, :updated_at, :cumulative)
+		on conflict(id, labels) do update set
+		mtype = excluded.mtype,
+		updated_at = excluded.updated_at,
+		delta = case when metrics.mtype = 'counter' then metrics.delta + excluded.delta end,
+		cumulative = case when metrics.mtype = 'counter' then coalesce(excluded.cumulative, metrics.cumulative) end,
+		value = case when metrics.mtype = 'gauge' then excluded.value end,
+		histogram = case when metrics.mtype = 'histogram' then excluded.histogram end
+		returning id, mtype, labels, delta, value, histogram, cumulative, updated_at`
+	sqliteGetSQL           = `select id, mtype, labels, delta, value, histogram, cumulative from metrics where id = ? and mtype = ? and labels = ?`
+	sqliteGetAllSQL        = `select id, mtype, labels, delta, value, histogram, cumulative, updated_at from metrics`
+	sqliteGetHistogramSQL  = `select mtype, histogram from metrics where id = ? and labels = ?`
+	sqliteGetCumulativeSQL = `select mtype, cumulative from metrics where id = ? and labels = ?`
+	sqliteInsertHistorySQL = `insert into metrics_history(id, mtype, labels, delta, value, histogram, ts)
+		select id, mtype, labels, delta, value, histogram, ? from metrics where id = ? and mtype = ? and labels = ?`
+	sqliteGetHistorySQL = `select ts, delta, value, histogram from metrics_history
+		where id = ? and mtype = ? and labels = ? and ts between ? and ?
+		order by ts`
+
+	sqliteGetRollupsSQL = `select ts, min, max, sum, count, last from metrics_rollups
+		where id = ? and mtype = ? and labels = ? and step = ? and ts > ? and ts <= ?
+		order by ts`
+	sqliteGetLastRollupSQL = `select ts, min, max, sum, count, last from metrics_rollups
+		where id = ? and mtype = ? and labels = ? and step = ?
+		order by ts desc limit 1`
+	sqliteGetRollupsFromSQL = `select ts, min, max, sum, count, last from metrics_rollups
+		where id = ? and mtype = ? and labels = ? and step = ? and ts >= ?
+		order by ts`
+	sqliteInsertRollupSQL = `insert into metrics_rollups(id, mtype, labels, step, ts, min, max, sum, count, last)
+		values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		on conflict do nothing`
+	sqliteGetHistoryFromSQL = `select ts, delta, value, histogram from metrics_history
+		where id = ? and mtype = ? and labels = ? and ts >= ?
+		order by ts`
+	sqliteGetHistoryBeforeSQL = `select ts, delta, value, histogram from metrics_history
+		where id = ? and mtype = ? and labels = ? and ts < ?
+		order by ts desc limit 1`
+	sqliteDeleteHistorySQL = `delete from metrics_history where id = ? and mtype = ? and labels = ? and ts < ?`
+	sqliteDeleteRollupsSQL = `delete from metrics_rollups where id = ? and mtype = ? and labels = ? and step = ? and ts < ?`
+	// агрегаты, оставшиеся от метрики с тем же именем, но другим типом
+	sqliteDeleteStaleRollupsSQL = `delete from metrics_rollups where id = ? and labels = ? and mtype <> ?`
+
+	sqliteDeleteSQL           = `delete from metrics where id = ? and mtype = ? and labels = ?`
+	sqliteDeleteExpiredSQL    = `delete from metrics where id = ? and mtype = ? and labels = ? and updated_at < ?`
+	sqliteDeleteAllHistorySQL = `delete from metrics_history where id = ? and labels = ?`
+	sqliteDeleteAllRollupsSQL = `delete from metrics_rollups where id = ? and labels = ?`
+
+	sqliteLoadStateSQL = `select data from server_state where name = ?`
+	sqliteSaveStateSQL = `insert into server_state(name, data) values (?, ?)
+		on conflict(name) do update set data = excluded.data`
+)
+
+func init() {
+	sqlx.BindDriver(sqliteDriverName, sqlx.QUESTION)
+}
+
+// sqliteMetricStorage - хранилище метрик во встроенной бд sqlite.
+// в отличие от fileMetricsStorage каждое обновление сразу сохраняется на диск
+type sqliteMetricStorage struct {
+	ctx       context.Context
+	xdb       *sqlx.DB
+	retention *retention.Config
+	logger    *zap.SugaredLogger
+}
+
+// sqliteMetric - метрика со временем последнего обновления в unix-наносекундах
+type sqliteMetric struct {
+	models.Metrics
+	UpdatedAt int64 `db:"updated_at"`
+}
+
+// sqliteMetricPoint - время точки истории хранится в unix-наносекундах
+type sqliteMetricPoint struct {
+	Timestamp int64 `db:"ts"`
+	models.MetricPoint
+}
+
+// sqliteRollup - время начала интервала агрегата хранится в unix-наносекундах
+type sqliteRollup struct {
+	Timestamp int64 `db:"ts"`
+	models.Rollup
+}
+
+func (r *sqliteRollup) toModel() models.Rollup {
+	rollup := r.Rollup
+	rollup.Timestamp = time.Unix(0, r.Timestamp)
+	return rollup
+}
+
+func (p *sqliteMetricPoint) toModel() models.MetricPoint {
+	point := p.MetricPoint
+	point.Timestamp = time.Unix(0, p.Timestamp)
+	return point
+}
+
+func NewSQLiteMetricStorage(path string, retentionCfg *retention.Config, ctx context.Context, logger *zap.SugaredLogger) (MetricsStorage, error) {
+	logger.Infow("start init sqlite storage ...")
+	xdb, err := sqlx.Connect(sqliteDriverName, path+sqliteDSNParams)
+	if err != nil {
+		logger.Errorf("error on open sqlite db: %v", err)
+		return nil, NewStorageInitError(err)
+	}
+	// sqlite допускает только одного писателя, поэтому все запросы идут через одно соединение
+	xdb.SetMaxOpenConns(1)
+
+	storage := &sqliteMetricStorage{ctx, xdb, retentionCfg, logger}
+	if err := storage.initDB(); err != nil {
+		logger.Errorf("error on init sqlite db: %v", err)
+		xdb.Close()
+		return nil, NewStorageInitError(err)
+	}
+	if retentionCfg.Enabled() {
+		go runRetentionJob(ctx, retentionCfg, logger, storage.compact)
+	}
+	logger.Info("sqlite storage initialized successfully")
+	return storage, nil
+}
+
+func (db *sqliteMetricStorage) initDB() error {
+	for _, query := range []string{sqliteCreateTableIfNeedSQL, sqliteCreateHistoryTableIfNeedSQL, sqliteCreateHistoryIndexIfNeedSQL, sqliteCreateRollupsTableIfNeedSQL, sqliteCreateStateTableIfNeedSQL} {
+		if _, err := db.xdb.ExecContext(db.ctx, query); err != nil {
+			return err
+		}
+	}
+	added, err := db.addColumnIfNeed("updated_at", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	if added {
+		// время обновления старых метрик неизвестно, срок хранения отсчитывается от момента добавления колонки
+		if _, err := db.xdb.ExecContext(db.ctx, sqliteSetUpdatedAtSQL, time.Now().UnixNano()); err != nil {
+			return err
+		}
+	}
+	_, err = db.addColumnIfNeed("cumulative", "integer")
+	return err
+}
+
+// addColumnIfNeed - добавление колонки в таблицу metrics, созданную до ее появления
+func (db *sqliteMetricStorage) addColumnIfNeed(column string, definition string) (bool, error) {
+	var exists int
+	if err := db.xdb.GetContext(db.ctx, &exists, sqliteHasColumnSQL, column); err != nil || exists > 0 {
+		return false, err
+	}
+	if _, err := db.xdb.ExecContext(db.ctx, fmt.Sprintf(sqliteAddColumnSQL, column, definition)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (db *sqliteMetricStorage) Get(id string, mtype string, labels models.Labels) (*models.Metrics, error) {
+	metric := models.Metrics{}
+	err := db.xdb.GetContext(db.ctx, &metric, sqliteGetSQL, id, mtype, labels)
+	if err == nil {
+		return &metric, nil
+	} else if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else {
+		return nil, err
+	}
+}
+
+func (db *sqliteMetricStorage) GetAll() ([]models.Metrics, error) {
+	stored := []sqliteMetric{}
+	if err := db.xdb.SelectContext(db.ctx, &stored, sqliteGetAllSQL); err != nil {
+		return nil, err
+	}
+	metrics := make([]models.Metrics, len(stored))
+	for i := range stored {
+		metrics[i] = stored[i].Metrics
+		if stored[i].UpdatedAt > 0 {
+			metrics[i].UpdatedAt = time.Unix(0, stored[i].UpdatedAt)
+		}
+	}
+	return metrics, nil
+}
+
+// Query - условия проверяются на стороне сервиса: в sqlite нет регулярных выражений и шаблонов path.Match
+func (db *sqliteMetricStorage) Query(q Query) ([]models.Metrics, error) {
+	metrics, err := db.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	return applyQuery(metrics, q)
+}
+
+func (db *sqliteMetricStorage) History(id string, mtype string, labels models.Labels, from time.Time, to time.Time, step time.Duration) ([]models.MetricPoint, error) {
+	if policy, source := historySource(db.retention, id, mtype, from, step); source >= 0 {
+		rows := []sqliteRollup{}
+		tierStep := policy.Rollups[source].Step.Duration
+		// агрегат попадает в историю, если его интервал пересекается с [from, to]
+		if err := db.xdb.SelectContext(db.ctx, &rows, sqliteGetRollupsSQL,
+			id, mtype, labels, int64(tierStep.Seconds()), from.Add(-tierStep).UnixNano(), to.UnixNano()); err != nil {
+			return nil, err
+		}
+		rollups := make([]models.Rollup, len(rows))
+		for i := range rows {
+			rollups[i] = rows[i].toModel()
+		}
+		return rollupHistory(mtype, rollups, from, step), nil
+	}
+
+	rows := []sqliteMetricPoint{}
+	if err := db.xdb.SelectContext(db.ctx, &rows, sqliteGetHistorySQL, id, mtype, labels, from.UnixNano(), to.UnixNano()); err != nil {
+		return nil, err
+	}
+	points := make([]models.MetricPoint, len(rows))
+	for i := range rows {
+		points[i] = rows[i].toModel()
+	}
+	return downsample(points, from, step), nil
+}
+
+func (db *sqliteMetricStorage) Update(m *models.Metrics) error {
+	return db.Updates([]models.Metrics{*m})
+}
+
+// Updates - все метрики сохраняются в одной транзакции
+func (db *sqliteMetricStorage) Updates(mtrcs []models.Metrics) error {
+	_, err := db.UpdatesApplied(mtrcs)
+	return err
+}
+
+// UpdatesApplied - значения возвращает сам upsert, метрики пакета обновляются по одной
+func (db *sqliteMetricStorage) UpdatesApplied(mtrcs []models.Metrics) ([]models.Metrics, error) {
+	tx, err := db.xdb.BeginTxx(db.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	rollback := func(err error) ([]models.Metrics, error) {
+		if txErr := tx.Rollback(); txErr != nil {
+			return nil, txErr
+		}
+		return nil, err
+	}
+
+	mtrcs, err = toIncrements(mtrcs, func(m *models.Metrics) (*int64, error) {
+		return db.lastCumulative(tx, m)
+	})
+	if err != nil {
+		return rollback(err)
+	}
+	ts := time.Now().UnixNano()
+	applied := make([]models.Metrics, len(mtrcs))
+	for i := 0; i < len(mtrcs); i++ {
+		m := mtrcs[i]
+		if m.MType == models.HISTOGRAM {
+			if m.Histogram, err = db.mergeHistogram(tx, &m); err != nil {
+				return rollback(err)
+			}
+		}
+		if applied[i], err = db.upInsert(tx, &sqliteMetric{m, ts}); err != nil {
+			return rollback(err)
+		}
+		if _, err := tx.ExecContext(db.ctx, sqliteInsertHistorySQL, ts, m.ID, m.MType, m.Labels); err != nil {
+			return rollback(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// upInsert - сохранение метрики, возвращает ее значение после обновления
+func (db *sqliteMetricStorage) upInsert(tx *sqlx.Tx, m *sqliteMetric) (models.Metrics, error) {
+	rows, err := sqlx.NamedQueryContext(db.ctx, tx, sqliteUpInsertSQL, m)
+	if err != nil {
+		return models.Metrics{}, err
+	}
+	defer rows.Close()
+
+	stored := sqliteMetric{}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return models.Metrics{}, err
+		}
+		return models.Metrics{}, sql.ErrNoRows
+	}
+	if err := rows.StructScan(&stored); err != nil {
+		return models.Metrics{}, err
+	}
+	stored.Metrics.UpdatedAt = time.Unix(0, stored.UpdatedAt)
+	return stored.Metrics, rows.Close()
+}
+
+func (db *sqliteMetricStorage) Delete(id string, mtype string, labels models.Labels) (bool, error) {
+	tx, err := db.xdb.BeginTxx(db.ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := db.removeMetric(tx, id, labels, sqliteDeleteSQL, id, mtype, labels)
+	if err != nil {
+		if txErr := tx.Rollback(); txErr != nil {
+			return false, txErr
+		}
+		return false, err
+	}
+	return deleted, tx.Commit()
+}
+
+// DeleteByPattern - шаблон проверяется на стороне сервера, все метрики удаляются в одной транзакции
+func (db *sqliteMetricStorage) DeleteByPattern(pattern string, mtype string, selector models.Labels) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, err
+	}
+	metrics, err := db.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.xdb.BeginTxx(db.ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	rollback := func(err error) error {
+		if txErr := tx.Rollback(); txErr != nil {
+			return txErr
+		}
+		return err
+	}
+
+	count := 0
+	for i := range metrics {
+		m := &metrics[i]
+		if !matchMetric(m, pattern, mtype, selector) {
+			continue
+		}
+		deleted, err := db.removeMetric(tx, m.ID, m.Labels, sqliteDeleteSQL, m.ID, m.MType, m.Labels)
+		if err != nil {
+			return 0, rollback(err)
+		}
+		if deleted {
+			count++
+		}
+	}
+	return count, tx.Commit()
+}
+
+// removeMetric - удаление метрики запросом query вместе с историей и агрегатами,
+// false - запрос не удалил ни одной метрики
+func (db *sqliteMetricStorage) removeMetric(tx *sqlx.Tx, id string, labels models.Labels, query string, args ...any) (bool, error) {
+	result, err := tx.ExecContext(db.ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	for _, q := range []string{sqliteDeleteAllHistorySQL, sqliteDeleteAllRollupsSQL} {
+		if _, err := tx.ExecContext(db.ctx, q, id, labels); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// lastCumulative - последнее накопленное значение counter, сохраненное в бд
+func (db *sqliteMetricStorage) lastCumulative(tx *sqlx.Tx, m *models.Metrics) (*int64, error) {
+	stored := models.Metrics{}
+	err := tx.GetContext(db.ctx, &stored, sqliteGetCumulativeSQL, m.ID, m.Labels)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return storedCumulative(&stored), nil
+}
+
+// mergeHistogram - объединение гистограммы с сохраненным в бд значением
+func (db *sqliteMetricStorage) mergeHistogram(tx *sqlx.Tx, m *models.Metrics) (*histogram.Histogram, error) {
+	stored := models.Metrics{}
+	err := tx.GetContext(db.ctx, &stored, sqliteGetHistogramSQL, m.ID, m.Labels)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (stored.MType != models.HISTOGRAM || stored.Histogram == nil)) {
+		return m.Histogram.Copy(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := stored.Histogram.Merge(m.Histogram); err != nil {
+		return nil, err
+	}
+	return stored.Histogram, nil
+}
+
+// compact - применение политик хранения, каждая метрика обрабатывается в отдельной транзакции
+func (db *sqliteMetricStorage) compact(now time.Time) error {
+	metrics, err := db.GetAll()
+	if err != nil {
+		return err
+	}
+	for i := range metrics {
+		if policy := db.retention.Match(metrics[i].ID); policy != nil {
+			if err := db.compactMetric(&metrics[i], policy, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *sqliteMetricStorage) compactMetric(m *models.Metrics, policy *retention.Policy, now time.Time) error {
+	tx, err := db.xdb.BeginTxx(db.ctx, nil)
+	if err != nil {
+		return err
+	}
+	rollback := func(err error) error {
+		if txErr := tx.Rollback(); txErr != nil {
+			return txErr
+		}
+		return err
+	}
+
+	if expire := policy.Expire.Duration; expire > 0 {
+		expired, err := db.removeMetric(tx, m.ID, m.Labels, sqliteDeleteExpiredSQL, m.ID, m.MType, m.Labels, now.Add(-expire).UnixNano())
+		if err != nil {
+			return rollback(err)
+		}
+		if expired {
+			db.logger.Infof("metric %s expired", m.Key())
+			return tx.Commit()
+		}
+	}
+	if _, err := tx.ExecContext(db.ctx, sqliteDeleteStaleRollupsSQL, m.ID, m.Labels, m.MType); err != nil {
+		return rollback(err)
+	}
+	if retention.Rollupable(m.MType) {
+		if err := buildRollups(&sqliteRollupStore{db.ctx, tx, m}, m.MType, policy, now); err != nil {
+			return rollback(err)
+		}
+	}
+	if raw := policy.Raw.Duration; raw > 0 {
+		if _, err := tx.ExecContext(db.ctx, sqliteDeleteHistorySQL, m.ID, m.MType, m.Labels, now.Add(-raw).UnixNano()); err != nil {
+			return rollback(err)
+		}
+	}
+	for _, t := range policy.Rollups {
+		if ttl := t.TTL.Duration; ttl > 0 {
+			if _, err := tx.ExecContext(db.ctx, sqliteDeleteRollupsSQL, m.ID, m.MType, m.Labels, int64(t.Step.Seconds()), now.Add(-ttl).UnixNano()); err != nil {
+				return rollback(err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// sqliteRollupStore - доступ к истории метрики внутри транзакции применения политик
+type sqliteRollupStore struct {
+	ctx context.Context
+	tx  *sqlx.Tx
+	m   *models.Metrics
+}
+
+func (s *sqliteRollupStore) lastRollup(step time.Duration) (*models.Rollup, error) {
+	row := sqliteRollup{}
+	err := s.tx.GetContext(s.ctx, &row, sqliteGetLastRollupSQL, s.m.ID, s.m.MType, s.m.Labels, int64(step.Seconds()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rollup := row.toModel()
+	return &rollup, nil
+}
+
+func (s *sqliteRollupStore) pointsFrom(from time.Time) ([]models.MetricPoint, *models.MetricPoint, error) {
+	rows := []sqliteMetricPoint{}
+	if err := s.tx.SelectContext(s.ctx, &rows, sqliteGetHistoryFromSQL, s.m.ID, s.m.MType, s.m.Labels, from.UnixNano()); err != nil {
+		return nil, nil, err
+	}
+	points := make([]models.MetricPoint, len(rows))
+	for i := range rows {
+		points[i] = rows[i].toModel()
+	}
+
+	row := sqliteMetricPoint{}
+	err := s.tx.GetContext(s.ctx, &row, sqliteGetHistoryBeforeSQL, s.m.ID, s.m.MType, s.m.Labels, from.UnixNano())
+	if errors.Is(err, sql.ErrNoRows) {
+		return points, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	before := row.toModel()
+	return points, &before, nil
+}
+
+func (s *sqliteRollupStore) rollupsFrom(step time.Duration, from time.Time) ([]models.Rollup, error) {
+	rows := []sqliteRollup{}
+	if err := s.tx.SelectContext(s.ctx, &rows, sqliteGetRollupsFromSQL, s.m.ID, s.m.MType, s.m.Labels, int64(step.Seconds()), from.UnixNano()); err != nil {
+		return nil, err
+	}
+	rollups := make([]models.Rollup, len(rows))
+	for i := range rows {
+		rollups[i] = rows[i].toModel()
+	}
+	return rollups, nil
+}
+
+func (s *sqliteRollupStore) addRollups(step time.Duration, rollups []models.Rollup) error {
+	for _, r := range rollups {
+		if _, err := s.tx.ExecContext(s.ctx, sqliteInsertRollupSQL,
+			s.m.ID, s.m.MType, s.m.Labels, int64(step.Seconds()), r.Timestamp.UnixNano(), r.Min, r.Max, r.Sum, r.Count, r.Last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *sqliteMetricStorage) LoadState(name string) ([]byte, error) {
+	var data []byte
+	err := db.xdb.GetContext(db.ctx, &data, sqliteLoadStateSQL, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (db *sqliteMetricStorage) SaveState(name string, data []byte) error {
+	_, err := db.xdb.ExecContext(db.ctx, sqliteSaveStateSQL, name, data)
+	return err
+}
+
+func (db *sqliteMetricStorage) Check() error {
+	return db.xdb.PingContext(db.ctx)
+}
+
+func (db *sqliteMetricStorage) Close() {
+	db.logger.Info("closing sqliteMetricStorage...")
+	db.xdb.Close()
+	db.logger.Info("sqliteMetricStorage closed")
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+	"yametrics/internal/histogram"
+	"yametrics/internal/server/models"
+	"yametrics/internal/server/retention"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestSQLiteStorage(t *testing.T, path string) MetricsStorage {
+	storage, err := NewSQLiteMetricStorage(path, &retention.Config{}, context.Background(), zap.NewNop().Sugar())
+	require.NoError(t, err)
+	return storage
+}
+
+func TestSQLiteMetricStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	storage := newTestSQLiteStorage(t, path)
+
+	d1, d2 := int64(2), int64(3)
+	v := 1.5
+	h1 := histogram.New([]float64{1, 10})
+	h1.Observe(0.5)
+	h2 := histogram.New([]float64{1, 10})
+	h2.Observe(5)
+	web := models.Labels{"host": "web"}
+
+	from := time.Now()
+	require.NoError(t, storage.Updates([]models.Metrics{
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d1},
+		{ID: "PollCount", MType: models.COUNTER, Delta: &d2},
+		{ID: "Alloc", MType: models.GAUGE, Labels: web, Value: &v},
+		{ID: "GCPauseNs", MType: models.HISTOGRAM, Histogram: h1},
+	}))
+	require.NoError(t, storage.Update(&models.Metrics{ID: "GCPauseNs", MType: models.HISTOGRAM, Histogram: h2}))
+	storage.Close()
+
+	// после переоткрытия данные должны сохраниться
+	storage = newTestSQLiteStorage(t, path)
+	defer storage.Close()
+
+	counter, err := storage.Get("PollCount", models.COUNTER, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *counter.Delta)
+
+	gauge, err := storage.Get("Alloc", models.GAUGE, web)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *gauge.Value)
+
+	gauge, err = storage.Get("Alloc", models.GAUGE, nil)
+	require.NoError(t, err)
+	assert.Nil(t, gauge)
+
+	hist, err := storage.Get("GCPauseNs", models.HISTOGRAM, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 1, 0}, hist.Histogram.Counts)
+
+	err = storage.Update(&models.Metrics{ID: "GCPauseNs", MType: models.HISTOGRAM, Histogram: histogram.New([]float64{2})})
+	assert.ErrorIs(t, err, histogram.ErrIncompatibleBuckets)
+
+	all, err := storage.GetAll()
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	points, err := storage.History("PollCount", models.COUNTER, nil, from, time.Now(), 0)
+	require.NoError(t, err)
+	if assert.Len(t, points, 2) {
+		assert.Equal(t, int64(2), *points[0].Delta)
+		assert.Equal(t, int64(5), *points[1].Delta)
+	}
+}
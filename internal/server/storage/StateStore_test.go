@@ -0,0 +1,39 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStateStore - состояние сохраняется и читается после переоткрытия хранилища
+func testStateStore(t *testing.T, open func() MetricsStorage) {
+	storage := open()
+	store := storage.(StateStore)
+
+	data, err := store.LoadState("idempotency")
+	require.NoError(t, err)
+	assert.Nil(t, data)
+
+	require.NoError(t, store.SaveState("idempotency", []byte(`{"a":1}`)))
+	require.NoError(t, store.SaveState("idempotency", []byte(`{"a":2}`)))
+	storage.Close()
+
+	storage = open()
+	defer storage.Close()
+	data, err = storage.(StateStore).LoadState("idempotency")
+	require.NoError(t, err)
+	assert.Equal(t, `{"a":2}`, string(data))
+}
+
+func TestFileMetricsStorageState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "metrics.json")
+	testStateStore(t, func() MetricsStorage { return newTestFileStorage(t, file) })
+}
+
+func TestSQLiteMetricStorageState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	testStateStore(t, func() MetricsStorage { return newTestSQLiteStorage(t, path) })
+}
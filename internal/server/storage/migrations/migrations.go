@@ -0,0 +1,245 @@
+// Package migrations - версионные миграции схемы postgres.
+// миграции хранятся в файлах sql/<номер>_<название>.up.sql и sql/<номер>_<название>.down.sql,
+// примененные версии записываются в таблицу schema_migrations
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+const (
+	createMigrationsTableIfNeedSQL = `create table if not exists schema_migrations(
+		version bigint not null primary key,
+		name varchar not null,
+		applied_at timestamp with time zone not null default now())`
+	getAppliedSQL    = `select version, applied_at from schema_migrations order by version`
+	isAppliedSQL     = `select exists(select 1 from schema_migrations where version = $1)`
+	insertAppliedSQL = `insert into schema_migrations(version, name) values($1, $2)`
+	deleteAppliedSQL = `delete from schema_migrations where version = $1`
+
+	// миграции выполняются одним экземпляром сервера, остальные ждут на блокировке
+	lockSQL = `select pg_advisory_xact_lock($1)`
+	lockKey = 7293520418
+)
+
+var fileNameRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration - одна миграция схемы
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status - состояние миграции в бд
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Applied - применена ли миграция
+func (s Status) Applied() bool {
+	return s.AppliedAt != nil
+}
+
+// Migrator - применение и откат миграций
+type Migrator struct {
+	db         *sqlx.DB
+	logger     *zap.SugaredLogger
+	migrations []Migration
+}
+
+func NewMigrator(db *sqlx.DB, logger *zap.SugaredLogger) (*Migrator, error) {
+	migrations, err := load(files)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, logger: logger, migrations: migrations}, nil
+}
+
+// load - чтение миграций, отсортированных по номеру версии
+func load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "sql/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, name := range names {
+		match := fileNameRegexp.FindStringSubmatch(path.Base(name))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", name)
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version %s: %w", name, err)
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s, %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Status - список всех миграций с отметкой о применении
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i] = Status{Migration: migration}
+		if ts, ok := applied[migration.Version]; ok {
+			statuses[i].AppliedAt = &ts
+		}
+	}
+	return statuses, nil
+}
+
+// Up - применение всех непримененных миграций, возвращает число примененных
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	count := 0
+	for _, migration := range m.migrations {
+		ok, err := m.run(ctx, migration, true)
+		if err != nil {
+			return count, fmt.Errorf("migration %d_%s up: %w", migration.Version, migration.Name, err)
+		}
+		if ok {
+			m.logger.Infof("migration %d_%s applied", migration.Version, migration.Name)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Down - откат steps последних примененных миграций, возвращает число откаченных
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		ok, err := m.run(ctx, migration, false)
+		if err != nil {
+			return count, fmt.Errorf("migration %d_%s down: %w", migration.Version, migration.Name, err)
+		}
+		if ok {
+			m.logger.Infof("migration %d_%s rolled back", migration.Version, migration.Name)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// applied - время применения миграций по номерам версий
+func (m *Migrator) applied(ctx context.Context) (map[int64]time.Time, error) {
+	if _, err := m.db.ExecContext(ctx, createMigrationsTableIfNeedSQL); err != nil {
+		return nil, err
+	}
+	rows := []struct {
+		Version   int64     `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}{}
+	if err := m.db.SelectContext(ctx, &rows, getAppliedSQL); err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]time.Time, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r.AppliedAt
+	}
+	return applied, nil
+}
+
+// run - применение (up = true) или откат миграции в отдельной транзакции.
+// возвращает false, если миграция уже в нужном состоянии
+func (m *Migrator) run(ctx context.Context, migration Migration, up bool) (bool, error) {
+	tx, err := m.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	rollback := func(err error) (bool, error) {
+		if txErr := tx.Rollback(); txErr != nil && !errors.Is(txErr, sql.ErrTxDone) {
+			return false, txErr
+		}
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, lockSQL, lockKey); err != nil {
+		return rollback(err)
+	}
+	if _, err := tx.ExecContext(ctx, createMigrationsTableIfNeedSQL); err != nil {
+		return rollback(err)
+	}
+	// пока ждали блокировку, миграцию мог выполнить другой экземпляр
+	var applied bool
+	if err := tx.GetContext(ctx, &applied, isAppliedSQL, migration.Version); err != nil {
+		return rollback(err)
+	}
+	if applied == up {
+		return rollback(nil)
+	}
+
+	if up {
+		if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+			return rollback(err)
+		}
+		if _, err := tx.ExecContext(ctx, insertAppliedSQL, migration.Version, migration.Name); err != nil {
+			return rollback(err)
+		}
+	} else {
+		if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+			return rollback(err)
+		}
+		if _, err := tx.ExecContext(ctx, deleteAppliedSQL, migration.Version); err != nil {
+			return rollback(err)
+		}
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,80 @@
+package migrations
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadEmbedded(t *testing.T) {
+	migrations, err := load(files)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		// номера версий идут подряд с единицы
+		assert.Equal(t, int64(i+1), m.Version)
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		fsys     fstest.MapFS
+		versions []int64
+		wantErr  bool
+	}{
+		{
+			name: "sorted by version",
+			fsys: fstest.MapFS{
+				"sql/0010_second.up.sql":   {Data: []byte("up 10")},
+				"sql/0010_second.down.sql": {Data: []byte("down 10")},
+				"sql/0002_first.up.sql":    {Data: []byte("up 2")},
+				"sql/0002_first.down.sql":  {Data: []byte("down 2")},
+			},
+			versions: []int64{2, 10},
+		},
+		{
+			name: "missing down",
+			fsys: fstest.MapFS{
+				"sql/0001_first.up.sql": {Data: []byte("up")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid name",
+			fsys: fstest.MapFS{
+				"sql/first.up.sql": {Data: []byte("up")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "different names",
+			fsys: fstest.MapFS{
+				"sql/0001_first.up.sql":    {Data: []byte("up")},
+				"sql/0001_second.down.sql": {Data: []byte("down")},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := load(tt.fsys)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			versions := make([]int64, len(migrations))
+			for i, m := range migrations {
+				versions[i] = m.Version
+			}
+			assert.Equal(t, tt.versions, versions)
+			assert.Equal(t, "up 2", migrations[0].Up)
+			assert.Equal(t, "down 2", migrations[0].Down)
+		})
+	}
+}
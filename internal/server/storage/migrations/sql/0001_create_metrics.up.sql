@@ -0,0 +1,6 @@
+-- базы, созданные до появления миграций, уже содержат таблицу
+create table if not exists metrics(
+	id varchar not null primary key,
+	mtype varchar not null,
+	delta bigint,
+	value double precision);
@@ -0,0 +1,8 @@
+create table if not exists metrics_history(
+	id varchar not null,
+	mtype varchar not null,
+	delta bigint,
+	value double precision,
+	ts timestamp with time zone not null default now());
+
+create index if not exists metrics_history_id_ts_idx on metrics_history(id, mtype, ts);
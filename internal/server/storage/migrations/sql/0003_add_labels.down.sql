@@ -0,0 +1,10 @@
+-- без меток метрики с одинаковым именем неразличимы, остаются только метрики без меток
+delete from metrics where labels <> '{}';
+alter table metrics drop constraint if exists metrics_pkey;
+alter table metrics drop column if exists labels;
+alter table metrics add primary key (id);
+
+delete from metrics_history where labels <> '{}';
+drop index if exists metrics_history_id_labels_ts_idx;
+alter table metrics_history drop column if exists labels;
+create index if not exists metrics_history_id_ts_idx on metrics_history(id, mtype, ts);
@@ -0,0 +1,17 @@
+alter table metrics add column if not exists labels varchar not null default '{}';
+
+-- метрика идентифицируется именем и набором меток
+do $$
+	begin
+		if not exists (
+			select 1 from information_schema.key_column_usage
+			where table_name = 'metrics' and constraint_name = 'metrics_pkey' and column_name = 'labels') then
+			alter table metrics drop constraint if exists metrics_pkey;
+			alter table metrics add primary key (id, labels);
+		end if;
+	end $$;
+
+alter table metrics_history add column if not exists labels varchar not null default '{}';
+
+drop index if exists metrics_history_id_ts_idx;
+create index if not exists metrics_history_id_labels_ts_idx on metrics_history(id, labels, mtype, ts);
@@ -0,0 +1,5 @@
+delete from metrics where mtype = 'histogram';
+alter table metrics drop column if exists histogram;
+
+delete from metrics_history where mtype = 'histogram';
+alter table metrics_history drop column if exists histogram;
@@ -0,0 +1,2 @@
+alter table metrics add column if not exists histogram varchar;
+alter table metrics_history add column if not exists histogram varchar;
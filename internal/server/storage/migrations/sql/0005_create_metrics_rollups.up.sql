@@ -0,0 +1,13 @@
+-- агрегаты истории по уровням политик хранения, step - длина интервала в секундах
+create table if not exists metrics_rollups(
+	id varchar not null,
+	mtype varchar not null,
+	labels varchar not null default '{}',
+	step bigint not null,
+	ts timestamp with time zone not null,
+	min double precision not null,
+	max double precision not null,
+	sum double precision not null,
+	count bigint not null,
+	last double precision not null,
+	primary key (id, labels, mtype, step, ts));
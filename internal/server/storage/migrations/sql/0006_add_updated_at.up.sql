@@ -0,0 +1,3 @@
+-- время последнего обновления, по нему удаляются давно не обновлявшиеся метрики.
+-- для уже существующих метрик отсчитывается от момента миграции
+alter table metrics add column if not exists updated_at timestamp with time zone not null default now();
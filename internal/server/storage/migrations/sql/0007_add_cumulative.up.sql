@@ -0,0 +1,2 @@
+-- последнее накопленное значение counter, присланное агентом, от него считается следующее приращение
+alter table metrics add column if not exists cumulative bigint;
@@ -0,0 +1,4 @@
+-- служебное состояние сервера, которое должно переживать перезапуск (например, окно ключей идемпотентности)
+create table if not exists server_state(
+	name varchar primary key,
+	data bytea not null);
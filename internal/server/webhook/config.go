@@ -0,0 +1,142 @@
+// Package webhook - уведомление внешних систем о записи метрик.
+// для каждого хука задаются адрес, фильтры по имени, типу и меткам и, при необходимости, порог.
+// тело уведомления подписывается секретом хука, недоставленные уведомления отправляются повторно
+// с растущей задержкой, результаты попыток доступны в журнале доставки
+package webhook
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+	"yametrics/internal/durationextension"
+	"yametrics/internal/metricscrypto"
+	"yametrics/internal/server/models"
+)
+
+const (
+	// DefaultTimeout - время ожидания ответа на уведомление
+	DefaultTimeout = 10 * time.Second
+	// DefaultMaxAttempts - число попыток доставки уведомления, включая первую
+	DefaultMaxAttempts = 5
+	// DefaultRetryDelay - задержка перед первой повторной попыткой, каждая следующая вдвое больше
+	DefaultRetryDelay = time.Second
+	// DefaultMaxRetryDelay - предел задержки между попытками
+	DefaultMaxRetryDelay = 5 * time.Minute
+	// DefaultQueueSize - число уведомлений, ожидающих отправки, сверх него уведомления отбрасываются
+	DefaultQueueSize = 1000
+	// DefaultWorkers - число одновременных отправок
+	DefaultWorkers = 4
+	// DefaultLogSize - число последних попыток доставки в журнале
+	DefaultLogSize = 1000
+)
+
+// Hook - получатель уведомлений
+type Hook struct {
+	// Name - уникальное имя хука, по нему фильтруется журнал доставки
+	Name string `json:"name"`
+	// URL - адрес, на который уведомления отправляются запросом POST
+	URL string `json:"url"`
+	// Secret - ключ подписи уведомлений, пустой - уведомления не подписываются
+	Secret string `json:"secret"`
+	// SignVersion - схема подписи метрики в уведомлении: 2 (по умолчанию) или 1 для получателей, не знающих v2
+	SignVersion int `json:"sign_version"`
+	// Names - имена или шаблоны имен метрик в формате path.Match, пустой список - любые метрики
+	Names []string `json:"names"`
+	// Types - типы метрик, пустой список - любые типы
+	Types []string `json:"types"`
+	// Labels - метки, которые должны быть у метрики
+	Labels models.Labels `json:"labels"`
+	// Threshold - порог для gauge и counter: уведомление отправляется, только когда значение
+	// пересекает порог в любую сторону. первое значение метрики после запуска сервера только запоминается
+	Threshold *float64 `json:"threshold"`
+}
+
+// Config - хуки и параметры доставки, задаются в файле конфигурации
+type Config struct {
+	Hooks         []Hook                     `json:"hooks"`
+	Timeout       durationextension.Duration `json:"timeout"`
+	MaxAttempts   int                        `json:"max_attempts"`
+	RetryDelay    durationextension.Duration `json:"retry_delay"`
+	MaxRetryDelay durationextension.Duration `json:"max_retry_delay"`
+	QueueSize     int                        `json:"queue_size"`
+	Workers       int                        `json:"workers"`
+	LogSize       int                        `json:"log_size"`
+}
+
+// Enabled - задан ли хотя бы один хук
+func (c *Config) Enabled() bool {
+	return len(c.Hooks) > 0
+}
+
+// Validate - проверка хуков: имена уникальны, адреса http или https, шаблоны и типы корректны
+func (c *Config) Validate() error {
+	names := make(map[string]bool, len(c.Hooks))
+	for _, h := range c.Hooks {
+		if h.Name == "" {
+			return fmt.Errorf("webhook %s: name must be nonempty", h.URL)
+		}
+		if names[h.Name] {
+			return fmt.Errorf("webhook %s: duplicate name", h.Name)
+		}
+		names[h.Name] = true
+		u, err := url.Parse(h.URL)
+		if err != nil {
+			return fmt.Errorf("webhook %s: %w", h.Name, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook %s: url must be absolute http or https url", h.Name)
+		}
+		if h.SignVersion != 0 && h.SignVersion != metricscrypto.SignV1 && h.SignVersion != metricscrypto.SignV2 {
+			return fmt.Errorf("webhook %s: wrong sign version %d", h.Name, h.SignVersion)
+		}
+		for _, pattern := range h.Names {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("webhook %s: wrong name pattern %q: %w", h.Name, pattern, err)
+			}
+		}
+		for _, t := range h.Types {
+			if t != models.GAUGE && t != models.COUNTER && t != models.HISTOGRAM {
+				return fmt.Errorf("webhook %s: wrong metric type %s", h.Name, t)
+			}
+		}
+	}
+	if c.MaxAttempts < 0 || c.QueueSize < 0 || c.Workers < 0 || c.LogSize < 0 {
+		return fmt.Errorf("webhook delivery settings must be non-negative")
+	}
+	return nil
+}
+
+// withDefaults - копия настроек, в которой незаданные значения заменены значениями по умолчанию
+func (c Config) withDefaults() Config {
+	setDuration := func(d *durationextension.Duration, def time.Duration) {
+		if d.Duration <= 0 {
+			d.Duration = def
+		}
+	}
+	setInt := func(v *int, def int) {
+		if *v <= 0 {
+			*v = def
+		}
+	}
+	setDuration(&c.Timeout, DefaultTimeout)
+	setDuration(&c.RetryDelay, DefaultRetryDelay)
+	setDuration(&c.MaxRetryDelay, DefaultMaxRetryDelay)
+	setInt(&c.MaxAttempts, DefaultMaxAttempts)
+	setInt(&c.QueueSize, DefaultQueueSize)
+	setInt(&c.Workers, DefaultWorkers)
+	setInt(&c.LogSize, DefaultLogSize)
+	return c
+}
+
+// retryDelay - задержка перед попыткой с номером attempt (начиная со второй)
+func (c *Config) retryDelay(attempt int) time.Duration {
+	d := c.RetryDelay.Duration
+	for i := 2; i < attempt && d < c.MaxRetryDelay.Duration; i++ {
+		d *= 2
+	}
+	if d > c.MaxRetryDelay.Duration {
+		d = c.MaxRetryDelay.Duration
+	}
+	return d
+}
@@ -0,0 +1,308 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"yametrics/internal/metricscrypto"
+	"yametrics/internal/protocol"
+	"yametrics/internal/server/models"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// SignatureHeader - заголовок с подписью тела уведомления: sha256=<hex HMAC-SHA256 секретом хука>
+	SignatureHeader = "X-Yametrics-Signature"
+	// HookHeader - заголовок с именем хука
+	HookHeader = "X-Yametrics-Webhook"
+	// DeliveryHeader - заголовок с номером уведомления, одинаковым во всех попытках доставки,
+	// по нему получатель может отсеять повторы
+	DeliveryHeader = "X-Yametrics-Delivery"
+)
+
+// Payload - тело уведомления
+type Payload struct {
+	ID   uint64    `json:"id"`   // номер уведомления
+	Hook string    `json:"hook"` // имя хука
+	Seq  uint64    `json:"seq"`  // номер обновления метрики
+	Time time.Time `json:"time"` // время обновления
+	// Metric - значение метрики после обновления, у counter - накопленная сумма.
+	// если у хука задан секрет, метрика подписана им так же, как метрики агента
+	Metric    protocol.Metrics `json:"metric"`
+	Threshold *float64         `json:"threshold,omitempty"` // порог хука
+	Previous  *float64         `json:"previous,omitempty"`  // значение до пересечения порога
+}
+
+// notification - уведомление в очереди отправки
+type notification struct {
+	id      uint64
+	hook    *Hook
+	metric  protocol.Metrics
+	body    []byte
+	attempt int
+}
+
+// Dispatcher - очередь и отправка уведомлений.
+// обновления передаются в Notify, отправка выполняется в фоне и не задерживает запись метрик
+type Dispatcher struct {
+	cfg    Config
+	hooks  map[string]*Hook
+	client *http.Client
+	logger *zap.SugaredLogger
+	log    *deliveryLog
+	queue  chan *notification
+	ids    uint64
+	// ctx - прерывает отправку, если при остановке получатели не успевают ответить
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// mutex - защищает last, retries и closed
+	mutex sync.Mutex
+	// last - последние значения метрик для хуков с порогом
+	last map[string]float64
+	// retries - уведомления, ожидающие повторной попытки
+	retries map[*notification]*time.Timer
+	closed  bool
+	once    sync.Once
+}
+
+// NewDispatcher - создание и запуск отправки уведомлений хукам из cfg
+func NewDispatcher(cfg *Config, logger *zap.SugaredLogger) (*Dispatcher, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	c := cfg.withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		cfg:     c,
+		hooks:   make(map[string]*Hook, len(c.Hooks)),
+		client:  &http.Client{Timeout: c.Timeout.Duration},
+		logger:  logger,
+		log:     newDeliveryLog(c.LogSize),
+		queue:   make(chan *notification, c.QueueSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		last:    make(map[string]float64),
+		retries: make(map[*notification]*time.Timer),
+	}
+	for i := range c.Hooks {
+		d.hooks[c.Hooks[i].Name] = &c.Hooks[i]
+	}
+	for i := 0; i < c.Workers; i++ {
+		d.wg.Add(1)
+		go d.runWorker()
+	}
+	return d, nil
+}
+
+// Hooks - хуки, обновления для которых нужно передавать в Notify
+func (d *Dispatcher) Hooks() []Hook {
+	return d.cfg.Hooks
+}
+
+// Notify - уведомление хука hook об обновлении метрики, которое подходит под его фильтры.
+// если у хука задан порог, уведомление ставится в очередь, только когда значение его пересекает
+func (d *Dispatcher) Notify(hook string, seq uint64, at time.Time, m models.Metrics) {
+	h, ok := d.hooks[hook]
+	if !ok {
+		return
+	}
+	payload := Payload{Hook: h.Name, Seq: seq, Time: at, Metric: toProtocol(m)}
+	if h.Threshold != nil {
+		previous, crossed := d.crossed(h, &m)
+		if !crossed {
+			return
+		}
+		payload.Threshold = h.Threshold
+		payload.Previous = &previous
+	}
+	if h.Secret != "" {
+		payload.Metric.Hash = metricscrypto.SignMetric(payload.Metric, h.Secret, signVersion(h), time.Now())
+	}
+	payload.ID = atomic.AddUint64(&d.ids, 1)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		d.logger.Errorf("error on marshal webhook %s payload: %v", h.Name, err)
+		return
+	}
+	d.enqueue(&notification{id: payload.ID, hook: h, metric: payload.Metric, body: body})
+}
+
+// signVersion - схема подписи метрики в уведомлениях хука, по умолчанию v2
+func signVersion(h *Hook) int {
+	if h.SignVersion == metricscrypto.SignV1 {
+		return metricscrypto.SignV1
+	}
+	return metricscrypto.SignV2
+}
+
+// crossed - пересекло ли новое значение метрики порог хука, и значение до обновления
+func (d *Dispatcher) crossed(h *Hook, m *models.Metrics) (float64, bool) {
+	var v float64
+	switch {
+	case m.MType == models.GAUGE && m.Value != nil:
+		v = *m.Value
+	case m.MType == models.COUNTER && m.Delta != nil:
+		v = float64(*m.Delta)
+	default:
+		return 0, false
+	}
+	key := h.Name + "\x00" + m.MType + "\x00" + m.Key()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	previous, ok := d.last[key]
+	d.last[key] = v
+	threshold := *h.Threshold
+	return previous, ok && (previous < threshold) != (v < threshold)
+}
+
+func toProtocol(m models.Metrics) protocol.Metrics {
+	return protocol.Metrics{ID: m.ID, MType: m.MType, Labels: m.Labels, Delta: m.Delta, Value: m.Value, Histogram: m.Histogram}
+}
+
+// enqueue - постановка в очередь отправки, при заполненной очереди или после остановки уведомление отбрасывается
+func (d *Dispatcher) enqueue(n *notification) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		d.record(n, Delivery{Attempt: n.attempt, Status: StatusDropped, Error: "dispatcher is stopped"})
+		return
+	}
+	select {
+	case d.queue <- n:
+	default:
+		d.logger.Warnf("webhook %s queue is full, notification %d dropped", n.hook.Name, n.id)
+		d.record(n, Delivery{Attempt: n.attempt, Status: StatusDropped, Error: "queue is full"})
+	}
+}
+
+func (d *Dispatcher) runWorker() {
+	defer d.wg.Done()
+	for n := range d.queue {
+		d.deliver(n)
+	}
+}
+
+// deliver - попытка доставки. при ошибке сети, таймауте, ответе 5xx, 408 или 429 попытка повторяется
+// с задержкой, которая растет вдвое с каждой попыткой. остальные ответы 4xx повторять бесполезно
+func (d *Dispatcher) deliver(n *notification) {
+	// после постановки на повтор уведомление может забрать другой обработчик, поэтому номер попытки копируется
+	n.attempt++
+	attempt := n.attempt
+	start := time.Now()
+	code, err := d.send(n)
+	entry := Delivery{Attempt: attempt, Time: start, Duration: time.Since(start).Seconds() * 1000, StatusCode: code}
+	if err == nil {
+		entry.Status = StatusDelivered
+		d.record(n, entry)
+		return
+	}
+	entry.Error = err.Error()
+	permanent := code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+	if !permanent && attempt < d.cfg.MaxAttempts {
+		if d.retry(n, d.cfg.retryDelay(attempt+1), entry) {
+			return
+		}
+	}
+	d.logger.Warnf("webhook %s notification %d failed after %d attempts: %v", n.hook.Name, n.id, attempt, err)
+	entry.Status = StatusFailed
+	d.record(n, entry)
+}
+
+func (d *Dispatcher) send(n *notification) (int, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, n.hook.URL, bytes.NewReader(n.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HookHeader, n.hook.Name)
+	req.Header.Set(DeliveryHeader, fmt.Sprint(n.id))
+	if n.hook.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+metricscrypto.GetSign(n.body, n.hook.Secret))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// тело читается, чтобы соединение можно было использовать повторно
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// retry - повторная постановка в очередь через delay, false - отправка остановлена.
+// попытка записывается в журнал до запуска таймера, чтобы записи следующих попыток шли после нее
+func (d *Dispatcher) retry(n *notification, delay time.Duration, entry Delivery) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return false
+	}
+	next := time.Now().Add(delay)
+	entry.Status, entry.NextAttempt = StatusRetrying, &next
+	d.record(n, entry)
+	d.retries[n] = time.AfterFunc(delay, func() {
+		d.mutex.Lock()
+		_, ok := d.retries[n]
+		delete(d.retries, n)
+		d.mutex.Unlock()
+		// уведомление уже отброшено при остановке
+		if ok {
+			d.enqueue(n)
+		}
+	})
+	return true
+}
+
+func (d *Dispatcher) record(n *notification, entry Delivery) {
+	entry.ID = n.id
+	entry.Hook = n.hook.Name
+	entry.Metric = n.metric.ID
+	entry.MType = n.metric.MType
+	entry.Labels = n.metric.Labels
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	d.log.add(entry)
+}
+
+// Close - остановка: новые уведомления и ожидающие повтора отбрасываются, уведомления из очереди
+// отправляются последний раз. если получатели не отвечают дольше таймаута, отправка прерывается
+func (d *Dispatcher) Close() {
+	d.once.Do(func() {
+		d.mutex.Lock()
+		d.closed = true
+		for n, timer := range d.retries {
+			timer.Stop()
+			d.record(n, Delivery{Attempt: n.attempt, Status: StatusDropped, Error: "dispatcher is stopped"})
+		}
+		d.retries = make(map[*notification]*time.Timer)
+		close(d.queue)
+		d.mutex.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			d.wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(d.cfg.Timeout.Duration):
+			d.cancel()
+			<-done
+		}
+		d.cancel()
+		d.logger.Info("webhook dispatcher stopped")
+	})
+}
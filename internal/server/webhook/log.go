@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// статусы попыток доставки
+const (
+	// StatusDelivered - получатель ответил 2xx
+	StatusDelivered = "delivered"
+	// StatusRetrying - попытка неудачна, запланирована следующая
+	StatusRetrying = "retrying"
+	// StatusFailed - попытка неудачна, и повторов больше не будет
+	StatusFailed = "failed"
+	// StatusDropped - уведомление отброшено без отправки: очередь заполнена или отправка остановлена
+	StatusDropped = "dropped"
+)
+
+// defaultLogLimit - число записей в ответе журнала, если limit не задан
+const defaultLogLimit = 100
+
+// Delivery - запись журнала доставки об одной попытке
+type Delivery struct {
+	ID          uint64            `json:"id"`   // номер уведомления
+	Hook        string            `json:"hook"` // имя хука
+	Metric      string            `json:"metric"`
+	MType       string            `json:"type"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Attempt     int               `json:"attempt"` // номер попытки, 0 - уведомление не отправлялось
+	Status      string            `json:"status"`
+	StatusCode  int               `json:"status_code,omitempty"` // код ответа получателя
+	Error       string            `json:"error,omitempty"`
+	Time        time.Time         `json:"time"`                   // начало попытки
+	Duration    float64           `json:"duration_ms,omitempty"`  // длительность попытки в миллисекундах
+	NextAttempt *time.Time        `json:"next_attempt,omitempty"` // время следующей попытки
+}
+
+// deliveryLog - последние попытки доставки в кольцевом буфере
+type deliveryLog struct {
+	mutex   sync.Mutex
+	entries []Delivery
+	next    int
+	full    bool
+}
+
+func newDeliveryLog(size int) *deliveryLog {
+	return &deliveryLog{entries: make([]Delivery, size)}
+}
+
+func (l *deliveryLog) add(d Delivery) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries[l.next] = d
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// list - не больше limit записей хука hook со статусом status от новых к старым, пустые условия не проверяются
+func (l *deliveryLog) list(hook string, status string, limit int) []Delivery {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+	result := make([]Delivery, 0)
+	for i := 1; i <= n && len(result) < limit; i++ {
+		d := l.entries[(l.next-i+len(l.entries))%len(l.entries)]
+		if (hook == "" || d.Hook == hook) && (status == "" || d.Status == status) {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+// Deliveries - записи журнала доставки от новых к старым
+func (d *Dispatcher) Deliveries(hook string, status string, limit int) []Delivery {
+	return d.log.list(hook, status, limit)
+}
+
+// hookInfo - описание хука без секрета. адрес сокращен до хоста, так как путь и параметры часто содержат токен
+type hookInfo struct {
+	Name      string            `json:"name"`
+	Host      string            `json:"host"`
+	Signed    bool              `json:"signed"`
+	Names     []string          `json:"names,omitempty"`
+	Types     []string          `json:"types,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Threshold *float64          `json:"threshold,omitempty"`
+}
+
+// Routes - регистрация обработчиков списка хуков и журнала доставки
+func (d *Dispatcher) Routes(r chi.Router) {
+	r.Route("/webhooks", func(r chi.Router) {
+		r.Get("/", d.List)
+		r.Get("/deliveries", d.DeliveryLog)
+	})
+}
+
+// List - список хуков: GET /webhooks
+func (d *Dispatcher) List(w http.ResponseWriter, r *http.Request) {
+	hooks := make([]hookInfo, 0, len(d.cfg.Hooks))
+	for _, h := range d.cfg.Hooks {
+		info := hookInfo{Name: h.Name, Signed: h.Secret != "", Names: h.Names, Types: h.Types, Labels: h.Labels, Threshold: h.Threshold}
+		if u, err := url.Parse(h.URL); err == nil {
+			info.Host = u.Host
+		}
+		hooks = append(hooks, info)
+	}
+	writeJSON(w, hooks)
+}
+
+// DeliveryLog - журнал доставки: GET /webhooks/deliveries?hook=&status=&limit=
+func (d *Dispatcher) DeliveryLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	hook, status := query.Get("hook"), query.Get("status")
+	if hook != "" {
+		if _, ok := d.hooks[hook]; !ok {
+			http.Error(w, fmt.Sprintf("unknown webhook %s", hook), http.StatusNotFound)
+			return
+		}
+	}
+	switch status {
+	case "", StatusDelivered, StatusRetrying, StatusFailed, StatusDropped:
+	default:
+		http.Error(w, fmt.Sprintf("wrong status %s", status), http.StatusBadRequest)
+		return
+	}
+	limit := defaultLogLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "param `limit` must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, d.Deliveries(hook, status, limit))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,258 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"yametrics/internal/durationextension"
+	"yametrics/internal/metricscrypto"
+	"yametrics/internal/server/models"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// receiver - получатель уведомлений, отвечающий кодами из statuses по очереди, затем 200
+type receiver struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	if len(rc.statuses) > 0 {
+		w.WriteHeader(rc.statuses[0])
+		rc.statuses = rc.statuses[1:]
+	}
+}
+
+func (rc *receiver) count() int {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return len(rc.requests)
+}
+
+func newDispatcher(t *testing.T, hooks ...Hook) *Dispatcher {
+	d, err := NewDispatcher(&Config{
+		Hooks:      hooks,
+		RetryDelay: durationextension.Duration{Duration: 10 * time.Millisecond},
+		Timeout:    durationextension.Duration{Duration: time.Second},
+	}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	t.Cleanup(d.Close)
+	return d
+}
+
+func gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: models.GAUGE, Value: &v}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		hook Hook
+		ok   bool
+	}{
+		{"ok", Hook{Name: "deploys", URL: "https://example.com/hook", Names: []string{"deploys"}, Types: []string{models.COUNTER}}, true},
+		{"no name", Hook{URL: "https://example.com/hook"}, false},
+		{"relative url", Hook{Name: "a", URL: "/hook"}, false},
+		{"wrong scheme", Hook{Name: "a", URL: "ftp://example.com/hook"}, false},
+		{"wrong pattern", Hook{Name: "a", URL: "http://example.com", Names: []string{"a["}}, false},
+		{"wrong type", Hook{Name: "a", URL: "http://example.com", Types: []string{"summary"}}, false},
+		{"legacy sign", Hook{Name: "a", URL: "http://example.com", SignVersion: 1}, true},
+		{"wrong sign version", Hook{Name: "a", URL: "http://example.com", SignVersion: 3}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Hooks: []Hook{tt.hook}}
+			assert.Equal(t, tt.ok, cfg.Validate() == nil)
+		})
+	}
+	hook := Hook{Name: "a", URL: "http://example.com"}
+	assert.Error(t, (&Config{Hooks: []Hook{hook, hook}}).Validate(), "duplicate name")
+}
+
+func TestRetryDelay(t *testing.T) {
+	cfg := Config{
+		RetryDelay:    durationextension.Duration{Duration: time.Second},
+		MaxRetryDelay: durationextension.Duration{Duration: 5 * time.Second},
+	}
+	delays := make([]time.Duration, 0)
+	for attempt := 2; attempt <= 6; attempt++ {
+		delays = append(delays, cfg.retryDelay(attempt))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+}
+
+func TestNotify(t *testing.T) {
+	rc := &receiver{}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	d := newDispatcher(t, Hook{Name: "alloc", URL: ts.URL + "/hook", Secret: "secret"})
+
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	d.Notify("alloc", 7, at, gauge("Alloc", 42))
+	d.Notify("unknown", 8, at, gauge("Alloc", 43))
+	require.Eventually(t, func() bool { return len(d.Deliveries("", StatusDelivered, 10)) == 1 }, time.Second, 10*time.Millisecond)
+
+	require.Equal(t, 1, rc.count())
+	r, body := rc.requests[0], rc.bodies[0]
+	assert.Equal(t, "/hook", r.URL.Path)
+	assert.Equal(t, "alloc", r.Header.Get(HookHeader))
+	assert.Equal(t, "1", r.Header.Get(DeliveryHeader))
+	assert.Equal(t, "sha256="+metricscrypto.GetSign(body, "secret"), r.Header.Get(SignatureHeader))
+
+	var p Payload
+	require.NoError(t, json.Unmarshal(body, &p))
+	assert.Equal(t, uint64(1), p.ID)
+	assert.Equal(t, uint64(7), p.Seq)
+	assert.True(t, at.Equal(p.Time))
+	assert.Equal(t, 42.0, *p.Metric.Value)
+	assert.True(t, strings.HasPrefix(p.Metric.Hash, "v2:"))
+	assert.NoError(t, metricscrypto.NewVerifier("secret", 0, false).VerifyMetric(p.Metric, time.Now()))
+	assert.Nil(t, p.Threshold)
+
+	entry := d.Deliveries("alloc", "", 10)[0]
+	assert.Equal(t, "Alloc", entry.Metric)
+	assert.Equal(t, 1, entry.Attempt)
+	assert.Equal(t, http.StatusOK, entry.StatusCode)
+}
+
+func TestRetry(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadRequest}}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	d := newDispatcher(t, Hook{Name: "alloc", URL: ts.URL})
+
+	// 503 и 429 повторяются, 400 - нет
+	d.Notify("alloc", 1, time.Now(), gauge("Alloc", 1))
+	require.Eventually(t, func() bool { return len(d.Deliveries("", StatusFailed, 10)) == 1 }, time.Second, 10*time.Millisecond)
+	log := d.Deliveries("", "", 10)
+	require.Len(t, log, 3)
+	assert.Equal(t, []string{StatusFailed, StatusRetrying, StatusRetrying}, []string{log[0].Status, log[1].Status, log[2].Status})
+	assert.Equal(t, []int{3, 2, 1}, []int{log[0].Attempt, log[1].Attempt, log[2].Attempt})
+	assert.Equal(t, http.StatusBadRequest, log[0].StatusCode)
+	assert.NotNil(t, log[1].NextAttempt)
+
+	// недоступный получатель: попытки заканчиваются
+	ts.Close()
+	d.Notify("alloc", 2, time.Now(), gauge("Alloc", 2))
+	require.Eventually(t, func() bool { return len(d.Deliveries("", StatusFailed, 10)) == 2 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, DefaultMaxAttempts, d.Deliveries("", StatusFailed, 1)[0].Attempt)
+	assert.NotEmpty(t, d.Deliveries("", StatusFailed, 1)[0].Error)
+}
+
+func TestThreshold(t *testing.T) {
+	rc := &receiver{}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	threshold := 10.0
+	d := newDispatcher(t, Hook{Name: "high", URL: ts.URL, Threshold: &threshold})
+
+	for i, v := range []float64{5, 8, 12, 15, 9, 10} {
+		d.Notify("high", uint64(i), time.Now(), gauge("Load", v))
+	}
+	d.Notify("high", 10, time.Now(), gauge("Other", 20))
+	require.Eventually(t, func() bool { return len(d.Deliveries("", StatusDelivered, 10)) == 3 }, time.Second, 10*time.Millisecond)
+
+	// пересечения: 8 -> 12, 15 -> 9, 9 -> 10. первое значение метрики Other только запоминается
+	previous := make(map[float64]float64)
+	for _, body := range rc.bodies {
+		var p Payload
+		require.NoError(t, json.Unmarshal(body, &p))
+		assert.Equal(t, threshold, *p.Threshold)
+		previous[*p.Metric.Value] = *p.Previous
+	}
+	assert.Equal(t, map[float64]float64{12: 8, 9: 15, 10: 9}, previous)
+}
+
+func TestClose(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusServiceUnavailable}}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	d, err := NewDispatcher(&Config{
+		Hooks:      []Hook{{Name: "alloc", URL: ts.URL}},
+		RetryDelay: durationextension.Duration{Duration: time.Hour},
+	}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	d.Notify("alloc", 1, time.Now(), gauge("Alloc", 1))
+	require.Eventually(t, func() bool { return len(d.Deliveries("", StatusRetrying, 10)) == 1 }, time.Second, 10*time.Millisecond)
+	d.Close()
+	d.Close()
+	d.Notify("alloc", 2, time.Now(), gauge("Alloc", 2))
+	assert.Len(t, d.Deliveries("", StatusDropped, 10), 2)
+	assert.Equal(t, 1, rc.count())
+}
+
+func TestHandlers(t *testing.T) {
+	rc := &receiver{}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	d := newDispatcher(t,
+		Hook{Name: "alloc", URL: ts.URL + "/hook?token=xyz", Secret: "secret", Names: []string{"Alloc"}},
+		Hook{Name: "other", URL: ts.URL})
+	d.Notify("alloc", 1, time.Now(), gauge("Alloc", 1))
+	d.Notify("other", 2, time.Now(), gauge("Alloc", 1))
+	require.Eventually(t, func() bool { return len(d.Deliveries("", StatusDelivered, 10)) == 2 }, time.Second, 10*time.Millisecond)
+
+	r := chi.NewRouter()
+	d.Routes(r)
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	w := get("/webhooks")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "secret")
+	assert.NotContains(t, w.Body.String(), "token")
+	var hooks []hookInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &hooks))
+	require.Len(t, hooks, 2)
+	assert.True(t, hooks[0].Signed)
+	assert.Equal(t, []string{"Alloc"}, hooks[0].Names)
+
+	w = get("/webhooks/deliveries?hook=alloc")
+	require.Equal(t, http.StatusOK, w.Code)
+	var log []Delivery
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &log))
+	require.Len(t, log, 1)
+	assert.Equal(t, "alloc", log[0].Hook)
+	assert.Equal(t, StatusDelivered, log[0].Status)
+
+	w = get("/webhooks/deliveries?limit=1")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &log))
+	assert.Len(t, log, 1)
+
+	assert.Equal(t, http.StatusNotFound, get("/webhooks/deliveries?hook=missing").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/webhooks/deliveries?status=lost").Code)
+	assert.Equal(t, http.StatusBadRequest, get("/webhooks/deliveries?limit=0").Code)
+}
+
+func TestDeliveryLog(t *testing.T) {
+	l := newDeliveryLog(3)
+	for i := 1; i <= 5; i++ {
+		l.add(Delivery{ID: uint64(i), Hook: "a"})
+	}
+	ids := make([]uint64, 0)
+	for _, d := range l.list("a", "", 10) {
+		ids = append(ids, d.ID)
+	}
+	assert.Equal(t, []uint64{5, 4, 3}, ids)
+	assert.Empty(t, l.list("b", "", 10))
+}